@@ -49,18 +49,30 @@ import (
 	"k8s.io/utils/strings/slices"
 
 	"github.com/edgelesssys/constellation/v2/csi/cryptmapper"
-	cryptKms "github.com/edgelesssys/constellation/v2/csi/kms"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	driver "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-pd-csi-driver"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/headerbackup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
 
 var (
-	constellationAddr    = flag.String("kms-addr", "kms.kube-system:9000", "Address of the Constellation Coordinator's VPN API. Used to request keys (default: kms.kube-system:9000")
+	kmsBackend           = flag.String("kms-backend", kms.BackendConstellation, "Key management backend used to request keys. One of constellation, file (static master secret, for testing only) or http (default: constellation)")
+	kmsAddr              = flag.String("kms-addr", "kms.kube-system:9000", "Address of the key management backend. Used to request keys. Host and port of the Constellation key service, path of the master secret file, or URL of the HTTP key server, depending on --kms-backend (default: kms.kube-system:9000")
+	attestationCmd       = flag.String("attestation-cmd", "", "If set, key requests carry an attestation report of the node, which the key server verifies before releasing keys. The command, with space separated arguments, reads the 32 byte report data to bind, derived from a key server nonce and the key ID, from stdin and writes the report to stdout. Requires --kms-backend=http")
+	kmsKeyCacheTTL       = flag.Duration("kms-key-cache-ttl", 10*time.Minute, "How long the node plugin keeps volume keys in memory, so volumes can be staged while the key management backend is briefly unavailable. Keys are never written to disk. Set to 0 to disable the cache. The cache is disabled with --attestation-cmd, and never holds keys of crypto-shredded volumes")
+	kmsKeyCacheSize      = flag.Int("kms-key-cache-size", 256, "Maximum number of volume keys the node plugin keeps in memory")
+	cryptStateDir        = flag.String("crypt-state-dir", "/var/lib/kubelet/plugins/gcp.csi.confidential.cloud/crypt-state", "Directory on the node used to persist the progress of long running crypt operations, such as online re-keying")
+	headerBackupDir      = flag.String("luks-header-backup-dir", "", "If set, the node plugin backs up the LUKS2 header of every staged volume to this directory. Restore a header with gce-pd-csi-restore-header")
+	auditLog             = flag.String("audit-log", "", "If set, the node plugin appends a JSON line for every key request and every open, close and resize of a crypt device and every publish of a volume to a pod to this file. Set to - to write to stdout")
+	cryptGCInterval      = flag.Duration("crypt-gc-interval", 10*time.Minute, "How often the node plugin closes orphaned crypt mappings left behind by interrupted stage and unstage operations. The collector always runs once at startup, set to 0 to only run it then")
+	cryptGCDryRun        = flag.Bool("crypt-gc-dry-run", false, "If set, orphaned crypt mappings are only logged instead of closed")
 	cloudConfigFilePath  = flag.String("cloud-config", "", "Path to GCE cloud provider config")
 	endpoint             = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
 	runControllerService = flag.Bool("run-controller-service", true, "If set to false then the CSI driver does not activate its controller service (default: true)")
@@ -161,15 +173,23 @@ func handle() {
 		}()
 	}
 
-	if *runControllerService && *httpEndpoint != "" {
-		mm := metrics.NewMetricsManager()
+	// [Edgeless] the node plugin exposes the metrics of its key requests
+	var mm *metrics.MetricsManager
+	if (*runControllerService || *runNodeService) && *httpEndpoint != "" {
+		manager := metrics.NewMetricsManager()
+		mm = &manager
 		mm.InitializeHttpHandler(*httpEndpoint, *metricsPath)
+	}
+	if *runControllerService && mm != nil {
 		mm.RegisterPDCSIMetric()
 
 		if metrics.IsGKEComponentVersionAvailable() {
 			mm.EmitGKEComponentVersion()
 		}
 	}
+	if *runNodeService && mm != nil {
+		mm.RegisterKMSMetrics()
+	}
 
 	if len(*extraVolumeLabelsStr) > 0 && !*runControllerService {
 		klog.Fatalf("Extra volume labels provided but not running controller")
@@ -231,6 +251,14 @@ func handle() {
 		initialBackoffDuration := time.Duration(*errorBackoffInitialDurationMs) * time.Millisecond
 		maxBackoffDuration := time.Duration(*errorBackoffMaxDurationMs) * time.Millisecond
 		controllerServer = driver.NewControllerServer(gceDriver, cloudProvider, initialBackoffDuration, maxBackoffDuration, fallbackRequisiteZones, *enableStoragePoolsFlag, multiZoneVolumeHandleConfig, listVolumesConfig)
+		// [Edgeless] crypto-shredding volumes requires a key server that can destroy keys
+		if *kmsBackend == kms.BackendHTTP {
+			destroyer, err := kms.NewKeyDestroyer(*kmsBackend, *kmsAddr)
+			if err != nil {
+				klog.Fatalf("Failed to set up key destruction: %v", err.Error())
+			}
+			controllerServer = controllerServer.WithKeyDestroyer(destroyer)
+		}
 	} else if *cloudConfigFilePath != "" {
 		klog.Warningf("controller service is disabled but cloud config given - it has no effect")
 	}
@@ -249,13 +277,60 @@ func handle() {
 			klog.Fatalf("Failed to set up metadata service: %v", err.Error())
 		}
 
-		// [Edgeless] set up Constellation key management
-		mapper := cryptmapper.New(cryptKms.NewConstellationKMS(*constellationAddr))
+		// [Edgeless] set up key management
+		var attester kms.Attester
+		if cmd := strings.Fields(*attestationCmd); len(cmd) > 0 {
+			attester = kms.NewCommandAttester(cmd[0], cmd[1:]...)
+		}
+		backend, err := kms.NewWithAttester(*kmsBackend, *kmsAddr, attester)
+		if err != nil {
+			klog.Fatalf("Failed to set up key management: %v", err.Error())
+		}
+		cacheTTL := *kmsKeyCacheTTL
+		if attester != nil && cacheTTL > 0 {
+			// Cached keys would be handed out without attesting the node again
+			klog.Infof("Disabling the key cache, every key request is attested")
+			cacheTTL = 0
+		}
+		keyManager := kms.NewCachingKMS(backend, cacheTTL, *kmsKeyCacheSize)
+		if mm != nil {
+			keyManager = keyManager.WithMetrics(mm)
+		}
+		var auditor audit.Emitter
+		var mapperKMS kms.KMS = keyManager
+		if *auditLog != "" {
+			emitter := audit.NewJSONEmitter(os.Stdout)
+			if *auditLog != "-" {
+				emitter, err = audit.NewFileEmitter(*auditLog)
+				if err != nil {
+					klog.Fatalf("Failed to set up audit log: %v", err.Error())
+				}
+			}
+			auditor = emitter
+			mapperKMS = audit.NewKMS(keyManager, auditor)
+		}
+		mapper := cryptmapper.New(mapperKMS)
+		cryptState, err := cryptsetup.NewStateStore(*cryptStateDir)
+		if err != nil {
+			klog.Fatalf("Failed to set up crypt state store: %v", err.Error())
+		}
 
-		nodeServer = driver.NewNodeServer(gceDriver, mounter, deviceUtils, meta, statter, mapper)
+		nodeServer = driver.NewNodeServer(gceDriver, mounter, deviceUtils, meta, statter, mapper, keyManager, cryptsetup.NewCryptSetup(mounter.Exec), auditor)
+		nodeServer = nodeServer.WithCryptStateStore(cryptState).WithKeyCache(keyManager)
+		if *headerBackupDir != "" {
+			sink, err := headerbackup.NewDirSink(*headerBackupDir)
+			if err != nil {
+				klog.Fatalf("Failed to set up LUKS2 header backups: %v", err.Error())
+			}
+			nodeServer = nodeServer.WithHeaderBackup(sink)
+		}
 		if *maxConcurrentFormatAndMount > 0 {
 			nodeServer = nodeServer.WithSerializedFormatAndMount(*formatAndMountTimeout, *maxConcurrentFormatAndMount)
 		}
+		if err := nodeServer.ResumeReencryptions(); err != nil {
+			klog.Errorf("Failed to resume reencryptions: %v", err.Error())
+		}
+		go nodeServer.RunCryptMappingCollector(context.Background(), *cryptGCInterval, *cryptGCDryRun)
 	}
 
 	err = gceDriver.SetupGCEDriver(driverName, version, extraVolumeLabels, extraTags, identityServer, controllerServer, nodeServer)
@@ -0,0 +1,283 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package main implements a debugging tool which lists the crypt mappings
+// the GCE PD CSI driver opened on a node and correlates them with their
+// volumes, disks and mount points.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
+)
+
+const (
+	mapperDir        = "/dev/mapper/"
+	diskByIDDir      = "/dev/disk/by-id/"
+	diskGooglePrefix = "google-"
+
+	// regionalDeviceNameSuffix is appended to the device name of regional PDs.
+	regionalDeviceNameSuffix = "_regional"
+)
+
+var (
+	cryptStateDir = flag.String("crypt-state-dir", "/var/lib/kubelet/plugins/gcp.csi.confidential.cloud/crypt-state", "Crypt state directory of the driver on the node, used to map crypt mappings back to their volume ID")
+	output        = flag.String("output", "text", "Output format, one of text or json")
+)
+
+// volumeInfo is everything known about a crypt mapping opened by the driver.
+type volumeInfo struct {
+	Name       string `json:"name"`
+	MappedPath string `json:"mappedPath"`
+	VolumeID   string `json:"volumeID,omitempty"`
+	KeyScope   string `json:"keyScope,omitempty"`
+	// DeviceName is the name the PD is attached to the instance with.
+	DeviceName string `json:"deviceName,omitempty"`
+	// DiskPaths are the /dev/disk/by-id paths of the PD, DiskPresent is set if one of them exists.
+	DiskPaths   []string `json:"diskPaths,omitempty"`
+	DiskPresent bool     `json:"diskPresent"`
+
+	UUID                   string                   `json:"uuid,omitempty"`
+	Header                 *cryptsetup.Mapping      `json:"header,omitempty"`
+	ReencryptionInProgress bool                     `json:"reencryptionInProgress"`
+	Health                 *cryptsetup.DeviceStatus `json:"health,omitempty"`
+	MountPoints            []string                 `json:"mountPoints"`
+	// Errors holds the inspection steps which failed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func main() {
+	flag.Parse()
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unsupported output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	volumes, err := inspect(cryptsetup.NewCryptSetup(exec.New()), mount.New(""))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspecting crypt mappings: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(volumes); err != nil {
+			fmt.Fprintf(os.Stderr, "encoding output: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	printTable(volumes)
+}
+
+// inspect collects the volumeInfo of all crypt mappings opened by the driver.
+func inspect(cs cryptsetup.CryptSetup, mounter mount.Interface) ([]*volumeInfo, error) {
+	names, err := cs.Mappings()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing mount points: %w", err)
+	}
+	// The state directory only exists if the driver ran a long running crypt operation
+	var store *cryptsetup.StateStore
+	if _, err := os.Stat(*cryptStateDir); err == nil {
+		if store, err = cryptsetup.NewStateStore(*cryptStateDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var volumes []*volumeInfo
+	for _, name := range names {
+		info := inspectMapping(cs, store, name)
+		if info == nil {
+			continue
+		}
+		for _, mp := range mountPoints {
+			if mp.Device == info.MappedPath {
+				info.MountPoints = append(info.MountPoints, mp.Path)
+			}
+		}
+		volumes = append(volumes, info)
+	}
+	return volumes, nil
+}
+
+// inspectMapping returns the volumeInfo of the crypt mapping name, or nil if
+// the mapping was not opened by the driver. The driver names mappings after
+// the PD they were opened on.
+func inspectMapping(cs cryptsetup.CryptSetup, store *cryptsetup.StateStore, name string) *volumeInfo {
+	info := &volumeInfo{Name: name, MappedPath: mapperDir + name, MountPoints: []string{}}
+	failed := func(step string, err error) {
+		info.Errors = append(info.Errors, fmt.Sprintf("%s: %v", step, err))
+	}
+
+	header, err := cs.Mapping(name)
+	if err != nil {
+		failed("reading crypt mapping", err)
+		return info
+	}
+	if header.Type != "LUKS2" {
+		return nil
+	}
+	info.Header = header
+
+	if store != nil {
+		state, err := store.Get(name)
+		if err != nil {
+			failed("reading crypt state", err)
+		} else if state != nil {
+			info.VolumeID = state.VolumeID
+			info.KeyScope = state.KeyScope
+		}
+	}
+
+	if info.VolumeID != "" {
+		_, volKey, err := common.VolumeIDToKey(info.VolumeID)
+		if err != nil {
+			failed("parsing volume ID", err)
+		} else if info.DeviceName, err = common.GetDeviceName(volKey); err != nil {
+			failed("determining device name", err)
+		}
+	} else {
+		// Without recorded state, find the PD by its by-id link pointing to the mapped device
+		info.DeviceName = deviceNameOf(header.Device)
+	}
+	if info.DeviceName == "" {
+		// Mappings of other crypt devices on the node, e.g. the state disk, are not
+		// named after the PD they were opened on.
+		return nil
+	}
+	if info.DeviceName != name && strings.TrimSuffix(info.DeviceName, regionalDeviceNameSuffix) != name {
+		return nil
+	}
+
+	info.DiskPaths = deviceutils.NewDeviceUtils().GetDiskByIdPaths(info.DeviceName, "")
+	for _, path := range info.DiskPaths {
+		if _, err := os.Stat(path); err == nil {
+			info.DiskPresent = true
+		}
+	}
+
+	if info.UUID, err = cs.UUID(header.Device); err != nil {
+		failed("reading LUKS2 UUID", err)
+	}
+	if info.ReencryptionInProgress, err = cs.ReencryptionInProgress(header.Device); err != nil {
+		failed("reading reencryption state", err)
+	}
+	if info.Health, err = cs.Status(name); err != nil {
+		failed("reading mapping health", err)
+	}
+	return info
+}
+
+// deviceNameOf returns the device name of the PD attached as device, or an
+// empty string if device is not a PD.
+func deviceNameOf(device string) string {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	links, err := filepath.Glob(diskByIDDir + diskGooglePrefix + "*")
+	if err != nil {
+		return ""
+	}
+	for _, link := range links {
+		if strings.Contains(link, "-part") {
+			continue
+		}
+		if target, err := filepath.EvalSymlinks(link); err == nil && target == device {
+			return strings.TrimPrefix(filepath.Base(link), diskGooglePrefix)
+		}
+	}
+	return ""
+}
+
+func printTable(volumes []*volumeInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MAPPING\tVOLUME ID\tDEVICE\tDISK PRESENT\tCIPHER\tINTEGRITY\tHEALTH\tMOUNT POINTS")
+	for _, v := range volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\n",
+			v.Name, orNone(v.VolumeID), orNone(v.device()), v.DiskPresent, orNone(v.cipher()),
+			orNone(v.integrity()), v.health(), orNone(strings.Join(v.MountPoints, ",")))
+	}
+	w.Flush()
+
+	for _, v := range volumes {
+		for _, e := range v.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", v.Name, e)
+		}
+	}
+}
+
+// device returns the block device the mapping was opened on.
+func (v *volumeInfo) device() string {
+	if v.Header == nil {
+		return ""
+	}
+	return v.Header.Device
+}
+
+func (v *volumeInfo) cipher() string {
+	if v.Header == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", v.Header.Cipher, v.Header.KeySize)
+}
+
+func (v *volumeInfo) integrity() string {
+	if v.Header == nil {
+		return ""
+	}
+	return v.Header.Integrity
+}
+
+func (v *volumeInfo) health() string {
+	switch {
+	case v.Health == nil:
+		return "unknown"
+	case !v.Health.Active:
+		return "inactive"
+	case v.Health.IntegrityMismatches > 0:
+		return fmt.Sprintf("%d integrity mismatches", v.Health.IntegrityMismatches)
+	case v.Health.IOErrors > 0:
+		return fmt.Sprintf("%d I/O errors", v.Health.IOErrors)
+	case v.ReencryptionInProgress:
+		return "reencrypting"
+	default:
+		return "ok"
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
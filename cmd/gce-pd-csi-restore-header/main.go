@@ -0,0 +1,98 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package main implements a recovery tool which restores the LUKS2 header of
+// a volume from a backup taken by the GCE PD CSI driver.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"k8s.io/utils/exec"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/headerbackup"
+)
+
+const diskByIDGooglePrefix = "/dev/disk/by-id/google-"
+
+var (
+	backupDir = flag.String("backup-dir", "", "Directory holding the header backups, as configured with --luks-header-backup-dir of the driver")
+	volumeID  = flag.String("volume-id", "", "ID of the volume to restore the header of, e.g. projects/<project>/zones/<zone>/disks/<name>")
+	uuid      = flag.String("uuid", "", "LUKS2 UUID of the header backup to restore. Defaults to the most recent backup of the volume")
+	device    = flag.String("device", "", "Device to restore the header onto. Defaults to the device the PD of the volume is attached as")
+	force     = flag.Bool("force", false, "Overwrite the header of a device which still holds a readable LUKS2 header")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(cryptsetup.NewCryptSetup(exec.New())); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cs cryptsetup.CryptSetup) error {
+	if *backupDir == "" || *volumeID == "" {
+		return errors.New("--backup-dir and --volume-id are required")
+	}
+	_, volKey, err := common.VolumeIDToKey(*volumeID)
+	if err != nil {
+		return fmt.Errorf("invalid volume ID: %w", err)
+	}
+	devicePath := *device
+	if devicePath == "" {
+		deviceName, err := common.GetDeviceName(volKey)
+		if err != nil {
+			return err
+		}
+		devicePath = diskByIDGooglePrefix + deviceName
+	}
+
+	// The header must not change underneath an active mapping
+	if _, err := cs.Mapping(volKey.Name); err == nil {
+		return fmt.Errorf("volume %s is mapped as /dev/mapper/%s, unstage it before restoring its header", *volumeID, volKey.Name)
+	}
+	isLUKS, err := cs.IsLUKS(devicePath)
+	if err != nil {
+		return err
+	}
+	if isLUKS && !*force {
+		return fmt.Errorf("%s still holds a readable LUKS2 header, use --force to replace it", devicePath)
+	}
+
+	sink, err := headerbackup.NewDirSink(*backupDir)
+	if err != nil {
+		return err
+	}
+	header, err := sink.Load(context.Background(), *volumeID, *uuid)
+	if err != nil {
+		return fmt.Errorf("loading header backup of volume %s: %w", *volumeID, err)
+	}
+	if err := cs.RestoreHeader(devicePath, header); err != nil {
+		return err
+	}
+	restoredUUID, err := cs.UUID(devicePath)
+	if err != nil {
+		return fmt.Errorf("verifying restored header: %w", err)
+	}
+	fmt.Printf("Restored LUKS2 header %s of volume %s onto %s\n", restoredUUID, *volumeID, devicePath)
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package audit emits a structured, append-only log of the key requests and
+// crypt operations of the node plugin, for auditors.
+package audit
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+// Operations recorded in the audit log.
+const (
+	OperationKeyRequest = "key-request"
+	OperationOpen       = "crypt-open"
+	OperationClose      = "crypt-close"
+	OperationResize     = "crypt-resize"
+	// OperationPublish records a volume being published to a pod.
+	OperationPublish = "publish"
+)
+
+// Results of audited operations.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Keys of the pod info the kubelet adds to the volume context of
+// NodePublishVolume requests if the CSI driver object sets podInfoOnMount.
+const (
+	podNameKey           = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey      = "csi.storage.k8s.io/pod.namespace"
+	podUIDKey            = "csi.storage.k8s.io/pod.uid"
+	podServiceAccountKey = "csi.storage.k8s.io/serviceAccount.name"
+)
+
+// Emitter records audit events.
+type Emitter interface {
+	// Emit appends event to the audit log.
+	Emit(ctx context.Context, event Event) error
+}
+
+// Event is a single entry of the audit log.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	VolumeID  string    `json:"volumeID,omitempty"`
+	NodeID    string    `json:"nodeID,omitempty"`
+	Pod       *Pod      `json:"pod,omitempty"`
+	KeyScope  string    `json:"keyScope,omitempty"`
+	// KeyID is the ID of the requested key, for key requests.
+	KeyID  string `json:"keyID,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Pod identifies the pod an operation was requested for.
+type Pod struct {
+	Name           string `json:"name,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	UID            string `json:"uid,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// Volume identifies the volume, node and pod of the operations of a request.
+type Volume struct {
+	ID     string
+	NodeID string
+	Pod    *Pod
+}
+
+type volumeKey struct{}
+
+// WithVolume returns a copy of ctx carrying v, which is recorded in the events
+// of operations using ctx.
+func WithVolume(ctx context.Context, v Volume) context.Context {
+	return context.WithValue(ctx, volumeKey{}, v)
+}
+
+// VolumeFromContext returns the volume carried by ctx, if any.
+func VolumeFromContext(ctx context.Context) Volume {
+	v, _ := ctx.Value(volumeKey{}).(Volume)
+	return v
+}
+
+// PodFromVolumeContext returns the pod info in a volume context, or nil if
+// the volume context holds none.
+func PodFromVolumeContext(volumeContext map[string]string) *Pod {
+	pod := &Pod{
+		Name:           volumeContext[podNameKey],
+		Namespace:      volumeContext[podNamespaceKey],
+		UID:            volumeContext[podUIDKey],
+		ServiceAccount: volumeContext[podServiceAccountKey],
+	}
+	if *pod == (Pod{}) {
+		return nil
+	}
+	return pod
+}
+
+// NewEvent returns the event of operation on the volume and in the key scope
+// carried by ctx, failed if err is set.
+func NewEvent(ctx context.Context, operation string, err error) Event {
+	v := VolumeFromContext(ctx)
+	event := Event{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		VolumeID:  v.ID,
+		NodeID:    v.NodeID,
+		Pod:       v.Pod,
+		KeyScope:  kms.KeyScopeFromContext(ctx),
+		Result:    ResultSuccess,
+	}
+	if err != nil {
+		event.Result = ResultFailure
+		event.Error = err.Error()
+	}
+	return event
+}
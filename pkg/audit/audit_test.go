@@ -0,0 +1,119 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+func TestFileEmitter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("{}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emitter, err := NewFileEmitter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithVolume(context.Background(), Volume{
+		ID:     "projects/test-project/zones/zone/disks/disk",
+		NodeID: "projects/test-project/zones/zone/instances/node",
+		Pod:    PodFromVolumeContext(map[string]string{podNameKey: "app", podNamespaceKey: "default"}),
+	})
+	ctx = kms.WithKeyScope(ctx, "tenant-a")
+	if err := emitter.Emit(ctx, NewEvent(ctx, OperationOpen, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := emitter.Emit(ctx, NewEvent(ctx, OperationResize, errors.New("no space left"))); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit log line %q is not JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected events to be appended to the existing line, got %d lines", len(events))
+	}
+	open, resize := events[1], events[2]
+	if open.Operation != OperationOpen || open.Result != ResultSuccess || open.Error != "" {
+		t.Errorf("unexpected open event %+v", open)
+	}
+	if open.VolumeID != "projects/test-project/zones/zone/disks/disk" || open.NodeID != "projects/test-project/zones/zone/instances/node" || open.KeyScope != "tenant-a" {
+		t.Errorf("unexpected volume of open event %+v", open)
+	}
+	if open.Pod == nil || open.Pod.Name != "app" || open.Pod.Namespace != "default" {
+		t.Errorf("unexpected pod of open event %+v", open.Pod)
+	}
+	if resize.Result != ResultFailure || resize.Error != "no space left" {
+		t.Errorf("unexpected resize event %+v", resize)
+	}
+}
+
+func TestPodFromVolumeContext(t *testing.T) {
+	if pod := PodFromVolumeContext(map[string]string{"type": "pd-standard"}); pod != nil {
+		t.Errorf("expected no pod, got %+v", pod)
+	}
+}
+
+type failingKMS struct{}
+
+func (failingKMS) GetDEK(context.Context, string, int) ([]byte, error) {
+	return nil, errors.New("key server unavailable")
+}
+
+func TestKMS(t *testing.T) {
+	emitter := NewFakeEmitter()
+	ctx := WithVolume(context.Background(), Volume{ID: "volume"})
+
+	audited := NewKMS(kms.NewStaticKMS(make([]byte, 32)), emitter)
+	if _, err := audited.GetDEK(ctx, "uuid", 32); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKMS(failingKMS{}, emitter).GetDEK(ctx, "other-uuid", 32); err == nil {
+		t.Fatal("expected key request to fail")
+	}
+
+	events := emitter.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Operation != OperationKeyRequest || events[0].KeyID != "uuid" || events[0].VolumeID != "volume" || events[0].Result != ResultSuccess {
+		t.Errorf("unexpected event %+v", events[0])
+	}
+	if events[1].KeyID != "other-uuid" || events[1].Result != ResultFailure {
+		t.Errorf("unexpected event %+v", events[1])
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeEmitter keeps audit events in memory, for tests.
+type FakeEmitter struct {
+	mux    sync.Mutex
+	events []Event
+}
+
+var _ Emitter = &FakeEmitter{}
+
+func NewFakeEmitter() *FakeEmitter {
+	return &FakeEmitter{}
+}
+
+func (e *FakeEmitter) Emit(_ context.Context, event Event) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.events = append(e.events, event)
+	return nil
+}
+
+// Events returns the events emitted so far.
+func (e *FakeEmitter) Events() []Event {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return append([]Event{}, e.events...)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONEmitter writes audit events as JSON lines.
+type JSONEmitter struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+var _ Emitter = &JSONEmitter{}
+
+// NewJSONEmitter returns an emitter writing one JSON object per line to w.
+func NewJSONEmitter(w io.Writer) *JSONEmitter {
+	return &JSONEmitter{w: w}
+}
+
+// NewFileEmitter returns an emitter appending JSON lines to the file at path.
+// The file is created if it does not exist.
+func NewFileEmitter(path string) (*JSONEmitter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log %s: %w", path, err)
+	}
+	return NewJSONEmitter(f), nil
+}
+
+func (e *JSONEmitter) Emit(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	// A single write per event, so concurrent events never interleave
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if _, err := e.w.Write(line); err != nil {
+		return fmt.Errorf("writing audit event: %w", err)
+	}
+	return nil
+}
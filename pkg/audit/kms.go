@@ -0,0 +1,50 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package audit
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+// KMS records every key request to a KMS in the audit log.
+type KMS struct {
+	kms     kms.KMS
+	emitter Emitter
+}
+
+var _ kms.KMS = &KMS{}
+
+// NewKMS returns a KMS recording the key requests to k with emitter.
+func NewKMS(k kms.KMS, emitter Emitter) *KMS {
+	return &KMS{kms: k, emitter: emitter}
+}
+
+// GetDEK requests the key from the underlying KMS and records the request.
+// The key is never recorded. Failing to record the request is logged, but
+// does not fail it.
+func (k *KMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	dek, err := k.kms.GetDEK(ctx, dekID, dekSize)
+	event := NewEvent(ctx, OperationKeyRequest, err)
+	event.KeyID = dekID
+	if emitErr := k.emitter.Emit(ctx, event); emitErr != nil {
+		klog.Errorf("Failed to record key request for %s in the audit log: %v", dekID, emitErr)
+	}
+	return dek, err
+}
@@ -23,6 +23,42 @@ const (
 	// VolumeAttributes for Partition
 	VolumeAttributePartition = "partition"
 
+	// [Edgeless] VolumeAttributes for online re-keying of the LUKS2 volume key.
+	// Whenever the value differs from the generation the volume was last
+	// re-keyed with, the node plugin starts an online reencryption.
+	VolumeAttributeRekeyGeneration = "rekey-generation"
+
+	// [Edgeless] VolumeAttributes for the key derivation scope of the volume's
+	// encryption key, set from the StorageClass parameter key-scope.
+	VolumeAttributeKeyScope = "key-scope"
+
+	// [Edgeless] VolumeAttributes for volumes created from a content source
+	// whose keyslot is rewrapped from the key of the source to their own key.
+	VolumeAttributeRewrapKey      = "rewrap-key"
+	VolumeAttributeSourceKeyScope = "source-key-scope"
+
+	// [Edgeless] VolumeAttributes for the LUKS2 format of new encrypted volumes.
+	VolumeAttributeCipher             = "cipher"
+	VolumeAttributeCryptKeySize       = "key-size"
+	VolumeAttributeSectorSize         = "sector-size"
+	VolumeAttributeIntegrityAlgorithm = "integrity-algorithm"
+	VolumeAttributePBKDF              = "pbkdf"
+	VolumeAttributeIntegrityInit      = "integrity-init"
+
+	// [Edgeless] VolumeAttributes for volumes which are staged as plain disks,
+	// without a crypt mapping. Set to EncryptionNone, unset for LUKS2 volumes.
+	VolumeAttributeEncryption = "encryption"
+
+	// [Edgeless] VolumeAttributes of statically provisioned volumes whose
+	// unencrypted disk is encrypted in place when it is first staged. The
+	// controller passes the same key in the publish context to allow the
+	// encryption, as long as the disk does not carry the ImportedLabel.
+	VolumeAttributeImportPlaintext = "import-plaintext"
+
+	// [Edgeless] VolumeAttributes of volumes whose key scope is destroyed when
+	// they are deleted. The node plugin never caches their keys.
+	VolumeAttributeCryptoShred = "crypto-shred"
+
 	UnspecifiedValue = "UNSPECIFIED"
 
 	// Keyword indicating a 'multi-zone' volumeHandle. Replaces "zones" in the volumeHandle:
@@ -32,4 +68,37 @@ const (
 
 	// Label that is set on a disk when it is used by a 'multi-zone' VolumeHandle
 	MultiZoneLabel = "goog-gke-multi-zone"
+
+	// [Edgeless] Label recording the key derivation scope a disk, snapshot or
+	// image is encrypted in. Disks created from a content source inherit it.
+	KeyScopeLabel = "constellation-key-scope"
+
+	// [Edgeless] Label set to EncryptionNone on disks, snapshots and images
+	// which are not LUKS2 encrypted. Disks created from a content source
+	// inherit it.
+	EncryptionLabel = "constellation-encryption"
+
+	// [Edgeless] Label set on imported disks when they are handed to a node for
+	// in-place encryption, so their data is never encrypted twice.
+	ImportedLabel = "constellation-imported"
+
+	// [Edgeless] Label recording the crypto-shred mode of a disk. The key scope
+	// of such disks is their own, and is destroyed when they are deleted.
+	CryptoShredLabel = "constellation-crypto-shred"
+
+	// [Edgeless] Label set on a zonal disk while it is converted to a regional
+	// disk. Such disks are not attached to nodes anymore.
+	ConvertingLabel = "constellation-converting"
+
+	// [Edgeless] Label recording the zone of the zonal disk a regional disk was
+	// converted from. The volume ID of the zonal disk refers to the regional disk.
+	ConvertedFromLabel = "constellation-converted-from"
+
+	// [Edgeless] Label recording the re-key generation requested through
+	// ControllerModifyVolume. It is passed to the node in the publish context.
+	RekeyGenerationLabel = "constellation-rekey-generation"
+
+	// [Edgeless] Label set on integrity protected disks. They can't be re-keyed
+	// online, so ControllerModifyVolume refuses a re-key generation for them.
+	IntegrityLabel = "constellation-integrity"
 )
@@ -18,6 +18,8 @@ package common
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -35,6 +37,42 @@ const (
 	ParameterKeyResourceTags                  = "resource-tags"
 	ParameterKeyEnableMultiZoneProvisioning   = "enable-multi-zone-provisioning"
 
+	// [Edgeless] Key derivation scope of the volume's encryption key
+	ParameterKeyKeyScope = "key-scope"
+	// [Edgeless] Rewrap the keyslot of restored and cloned volumes under their own key
+	ParameterKeyRewrapKey = "rewrap-key"
+	// [Edgeless] LUKS2 format of new encrypted volumes
+	ParameterKeyCipher             = "cipher"
+	ParameterKeyCryptKeySize       = "key-size"
+	ParameterKeySectorSize         = "sector-size"
+	ParameterKeyIntegrityAlgorithm = "integrity-algorithm"
+	ParameterKeyPBKDF              = "pbkdf"
+	// [Edgeless] How the integrity tags of new integrity protected volumes are initialized
+	ParameterKeyIntegrityInit = "integrity-init"
+	// [Edgeless] Whether volumes are encrypted with LUKS2 or passed through as plain disks
+	ParameterKeyEncryption = "encryption"
+	// [Edgeless] Over-provision disks for the LUKS2 header and integrity metadata
+	ParameterKeyProvisionCryptOverhead = "provision-crypt-overhead"
+	// [Edgeless] Destroy the key material of volumes when they are deleted
+	ParameterKeyCryptoShred = "crypto-shred"
+	// [Edgeless] Image or snapshot, possibly of another project, new disks are created from
+	ParameterKeyDiskSource = "disk-source"
+
+	// [Edgeless] Values for ParameterKeyIntegrityInit
+	IntegrityInitWipe       = "wipe"
+	IntegrityInitNoWipe     = "no-wipe"
+	IntegrityInitBackground = "background"
+
+	// [Edgeless] Values for ParameterKeyEncryption
+	EncryptionLUKS2 = "luks2"
+	EncryptionNone  = "none"
+
+	// [Edgeless] Values for ParameterKeyCryptoShred. Deleting a volume whose
+	// key is still needed by snapshots, images or clones is refused, or the
+	// key is destroyed anyway.
+	CryptoShredRefuse = "true"
+	CryptoShredForce  = "force"
+
 	// Parameters for VolumeSnapshotClass
 	ParameterKeyStorageLocations = "storage-locations"
 	ParameterKeySnapshotType     = "snapshot-type"
@@ -106,6 +144,70 @@ type DiskParameters struct {
 	// Values: {bool}
 	// Default: false
 	MultiZoneProvisioning bool
+	// [Edgeless] Namespace the volume's encryption key is derived in. Volumes
+	// with different scopes never share key material.
+	// Values: {string}, lowercase letters, digits and dashes, at most 63 characters
+	// Default: ""
+	KeyScope string
+	// [Edgeless] Whether a volume created from a content source gets its own
+	// key, instead of sharing the key of its source.
+	// Values: {bool}
+	// Default: false
+	RewrapKey bool
+	// [Edgeless] Key scope of the volume content source the keyslot is rewrapped
+	// from. Not a StorageClass parameter, it is looked up from the source.
+	SourceKeyScope string
+	// [Edgeless] Cipher specification of new LUKS2 devices, in cryptsetup syntax.
+	// Values: {string}, e.g. aes-xts-plain64, aes-gcm-random, chacha20-random
+	// Default: "", aes-xts-plain64
+	Cipher string
+	// [Edgeless] Size of the LUKS2 volume key in bits.
+	// Values: {128, 256, 512}
+	// Default: 0, 512
+	CryptKeySize int
+	// [Edgeless] Encryption sector size of new LUKS2 devices in bytes.
+	// Values: {512, 1024, 2048, 4096}
+	// Default: 0, 4096
+	SectorSize int
+	// [Edgeless] Integrity algorithm of new LUKS2 devices. Setting it enables
+	// integrity protection.
+	// Values: {hmac-sha256, hmac-sha512, aead, poly1305}
+	// Default: "", hmac-sha256 if integrity is requested with the fstype
+	IntegrityAlgorithm string
+	// [Edgeless] Key derivation function of the keyslot of new LUKS2 devices.
+	// Values: {argon2id, argon2i, pbkdf2}
+	// Default: "", argon2id
+	PBKDF string
+	// [Edgeless] How the integrity tags of new integrity protected volumes are
+	// initialized: by wiping the disk before first use, not at all, or by
+	// wiping it in the background before the volume can be used.
+	// Values: {wipe, no-wipe, background}
+	// Default: "", wipe
+	IntegrityInit string
+	// [Edgeless] Whether the volume is encrypted with LUKS2, or staged as a
+	// plain disk without a crypt mapping.
+	// Values: {luks2, none}
+	// Default: "", luks2
+	Encryption string
+	// [Edgeless] Whether disks are made larger than the requested capacity by
+	// the size of the LUKS2 header and the integrity metadata, so the
+	// requested capacity is usable.
+	// Values: {bool}
+	// Default: false
+	ProvisionCryptOverhead bool
+	// [Edgeless] Whether the volume gets its own key scope, whose key material
+	// is destroyed when the volume is deleted. Deleting volumes whose key is
+	// still used by snapshots, images or clones is refused, unless forced.
+	// Values: {true, force, false}
+	// Default: ""
+	CryptoShred string
+	// [Edgeless] Image, image family or snapshot new disks are created from,
+	// which may belong to another project. The plaintext data of the source is
+	// encrypted in place when the volume is first published.
+	// Values: {projects/{project}/global/{images|snapshots}/{name},
+	// projects/{project}/global/images/family/{family}}
+	// Default: ""
+	DiskSource string
 }
 
 // SnapshotParameters contains normalized and defaulted parameters for snapshots
@@ -181,6 +283,18 @@ func (pp *ParameterProcessor) ExtractAndDefaultParameters(parameters map[string]
 			if err != nil {
 				return p, fmt.Errorf("parameters contain invalid labels parameter: %w", err)
 			}
+			// [Edgeless] The key scope label must match the key the disk is encrypted with
+			if _, ok := paramLabels[KeyScopeLabel]; ok {
+				return p, fmt.Errorf("parameters contain invalid labels parameter: label %q is reserved, use the %s parameter", KeyScopeLabel, ParameterKeyKeyScope)
+			}
+			if _, ok := paramLabels[EncryptionLabel]; ok {
+				return p, fmt.Errorf("parameters contain invalid labels parameter: label %q is reserved, use the %s parameter", EncryptionLabel, ParameterKeyEncryption)
+			}
+			for _, label := range []string{ImportedLabel, CryptoShredLabel, ConvertingLabel, ConvertedFromLabel, RekeyGenerationLabel, IntegrityLabel} {
+				if _, ok := paramLabels[label]; ok {
+					return p, fmt.Errorf("parameters contain invalid labels parameter: label %q is reserved", label)
+				}
+			}
 			// Override any existing labels with those from this parameter.
 			for labelKey, labelValue := range paramLabels {
 				p.Labels[labelKey] = labelValue
@@ -245,6 +359,74 @@ func (pp *ParameterProcessor) ExtractAndDefaultParameters(parameters map[string]
 			if paramEnableMultiZoneProvisioning {
 				p.Labels[MultiZoneLabel] = "true"
 			}
+		case ParameterKeyKeyScope:
+			if v != "" && !regexKeyScope.MatchString(v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q (lowercase letters, digits and - are allowed / 1-63 characters)", ParameterKeyKeyScope, v)
+			}
+			p.KeyScope = v
+		case ParameterKeyRewrapKey:
+			paramRewrapKey, err := ConvertStringToBool(v)
+			if err != nil {
+				return p, fmt.Errorf("parameters contain invalid value for %s parameter: %w", ParameterKeyRewrapKey, err)
+			}
+			p.RewrapKey = paramRewrapKey
+		case ParameterKeyCipher:
+			if v != "" && !regexCipher.MatchString(v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, expected a cipher specification such as aes-xts-plain64", ParameterKeyCipher, v)
+			}
+			p.Cipher = v
+		case ParameterKeyCryptKeySize:
+			keySize, err := strconv.Atoi(v)
+			if err != nil || !slices.Contains(supportedCryptKeySizes, keySize) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeyCryptKeySize, v, supportedCryptKeySizes)
+			}
+			p.CryptKeySize = keySize
+		case ParameterKeySectorSize:
+			sectorSize, err := strconv.Atoi(v)
+			if err != nil || !slices.Contains(supportedSectorSizes, sectorSize) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeySectorSize, v, supportedSectorSizes)
+			}
+			p.SectorSize = sectorSize
+		case ParameterKeyIntegrityAlgorithm:
+			if !slices.Contains(supportedIntegrityAlgorithms, v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeyIntegrityAlgorithm, v, supportedIntegrityAlgorithms)
+			}
+			p.IntegrityAlgorithm = v
+		case ParameterKeyPBKDF:
+			if !slices.Contains(supportedPBKDFs, v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeyPBKDF, v, supportedPBKDFs)
+			}
+			p.PBKDF = v
+		case ParameterKeyIntegrityInit:
+			if !slices.Contains(supportedIntegrityInits, v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeyIntegrityInit, v, supportedIntegrityInits)
+			}
+			p.IntegrityInit = v
+		case ParameterKeyEncryption:
+			if !slices.Contains(supportedEncryptions, v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v", ParameterKeyEncryption, v, supportedEncryptions)
+			}
+			p.Encryption = v
+		case ParameterKeyProvisionCryptOverhead:
+			paramProvisionCryptOverhead, err := ConvertStringToBool(v)
+			if err != nil {
+				return p, fmt.Errorf("parameters contain invalid value for %s parameter: %w", ParameterKeyProvisionCryptOverhead, err)
+			}
+			p.ProvisionCryptOverhead = paramProvisionCryptOverhead
+		case ParameterKeyCryptoShred:
+			if v == "false" {
+				p.CryptoShred = ""
+				continue
+			}
+			if !slices.Contains(supportedCryptoShredModes, v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, supported values are %v and false", ParameterKeyCryptoShred, v, supportedCryptoShredModes)
+			}
+			p.CryptoShred = v
+		case ParameterKeyDiskSource:
+			if _, _, _, err := DiskSourceToProjectKey(v); err != nil {
+				return p, fmt.Errorf("parameters contain invalid %s parameter: %w", ParameterKeyDiskSource, err)
+			}
+			p.DiskSource = v
 		default:
 			return p, fmt.Errorf("parameters contains invalid option %q", k)
 		}
@@ -252,9 +434,85 @@ func (pp *ParameterProcessor) ExtractAndDefaultParameters(parameters map[string]
 	if len(p.Tags) > 0 {
 		p.Tags[tagKeyCreatedBy] = pp.DriverName
 	}
+	// [Edgeless] Authenticated encryption needs a matching cipher mode
+	if cipher, ok := aeadCiphers[p.IntegrityAlgorithm]; ok && p.Cipher != cipher {
+		return p, fmt.Errorf("parameters contain invalid %s parameter %q, integrity algorithm %s requires cipher %s", ParameterKeyCipher, p.Cipher, p.IntegrityAlgorithm, cipher)
+	}
+	// [Edgeless] The key size must fit the cipher, it is defaulted per cipher on the node
+	if sizes := cipherKeySizes(p.Cipher); p.CryptKeySize != 0 && !slices.Contains(sizes, p.CryptKeySize) {
+		return p, fmt.Errorf("parameters contain invalid %s parameter %d, supported values for cipher %q are %v", ParameterKeyCryptKeySize, p.CryptKeySize, p.Cipher, sizes)
+	}
+	// [Edgeless] Plain volumes have no key and no LUKS2 header to configure
+	if p.Encryption == EncryptionNone {
+		if param := p.cryptParameter(); param != "" {
+			return p, fmt.Errorf("parameters contain invalid %s parameter, it cannot be set for volumes with %s %q", param, ParameterKeyEncryption, EncryptionNone)
+		}
+		p.Labels[EncryptionLabel] = EncryptionNone
+	}
+	// [Edgeless] The plaintext data of disk sources is encrypted in place, which
+	// leaves no room for integrity tags
+	if p.DiskSource != "" && p.IntegrityAlgorithm != "" {
+		return p, fmt.Errorf("parameters contain invalid %s parameter, it cannot be combined with %s", ParameterKeyIntegrityAlgorithm, ParameterKeyDiskSource)
+	}
+	// [Edgeless] Crypto-shredded volumes are encrypted in a key scope of their own
+	if p.CryptoShred != "" {
+		if p.KeyScope != "" {
+			return p, fmt.Errorf("parameters contain invalid %s parameter, it cannot be combined with %s", ParameterKeyKeyScope, ParameterKeyCryptoShred)
+		}
+		if p.MultiZoneProvisioning {
+			return p, fmt.Errorf("parameters contain invalid %s parameter, it cannot be combined with %s", ParameterKeyEnableMultiZoneProvisioning, ParameterKeyCryptoShred)
+		}
+		p.Labels[CryptoShredLabel] = p.CryptoShred
+	}
+	// [Edgeless] Record the key scope on the disk, so it is known for snapshots and clones
+	if p.KeyScope != "" {
+		p.Labels[KeyScopeLabel] = p.KeyScope
+	}
 	return p, nil
 }
 
+// [Edgeless] cryptParameter returns the name of a set parameter which only
+// applies to LUKS2 encrypted volumes, or "" if none is set.
+func (p DiskParameters) cryptParameter() string {
+	switch {
+	case p.KeyScope != "":
+		return ParameterKeyKeyScope
+	case p.RewrapKey:
+		return ParameterKeyRewrapKey
+	case p.Cipher != "":
+		return ParameterKeyCipher
+	case p.CryptKeySize != 0:
+		return ParameterKeyCryptKeySize
+	case p.SectorSize != 0:
+		return ParameterKeySectorSize
+	case p.IntegrityAlgorithm != "":
+		return ParameterKeyIntegrityAlgorithm
+	case p.PBKDF != "":
+		return ParameterKeyPBKDF
+	case p.IntegrityInit != "":
+		return ParameterKeyIntegrityInit
+	case p.ProvisionCryptOverhead:
+		return ParameterKeyProvisionCryptOverhead
+	case p.CryptoShred != "":
+		return ParameterKeyCryptoShred
+	}
+	return ""
+}
+
+// [Edgeless] cipherKeySizes returns the volume key sizes in bits supported by
+// cipher. The key of XTS modes, including the default aes-xts-plain64, holds
+// two keys, chacha20 only takes 256 bit keys.
+func cipherKeySizes(cipher string) []int {
+	switch {
+	case cipher == "" || strings.Contains(cipher, "-xts-"):
+		return []int{256, 512}
+	case strings.HasPrefix(cipher, "chacha20-"):
+		return []int{256}
+	default:
+		return []int{128, 256}
+	}
+}
+
 func ExtractAndDefaultSnapshotParameters(parameters map[string]string, driverName string, extraTags map[string]string) (SnapshotParameters, error) {
 	p := SnapshotParameters{
 		StorageLocations: []string{},
@@ -295,6 +553,12 @@ func ExtractAndDefaultSnapshotParameters(parameters map[string]string, driverNam
 			if err != nil {
 				return p, fmt.Errorf("parameters contain invalid labels parameter: %w", err)
 			}
+			// [Edgeless] The key scope and encryption labels are copied from the source disk
+			for _, label := range []string{KeyScopeLabel, EncryptionLabel} {
+				if _, ok := paramLabels[label]; ok {
+					return p, fmt.Errorf("parameters contain invalid labels parameter: label %q is reserved", label)
+				}
+			}
 			// Override any existing labels with those from this parameter.
 			for labelKey, labelValue := range paramLabels {
 				p.Labels[labelKey] = labelValue
@@ -313,6 +577,63 @@ func ExtractAndDefaultSnapshotParameters(parameters map[string]string, driverNam
 	return p, nil
 }
 
+// [Edgeless] ModifyVolumeParameters are the mutable parameters of a volume,
+// set by its VolumeAttributesClass. Parameters that are not set are nil or
+// empty and left unchanged.
+type ModifyVolumeParameters struct {
+	// Values: pd-standard, pd-balanced, pd-ssd, pd-extreme, hyperdisk-*
+	DiskType string
+	// IOPS to provision for the disk.
+	IOPS *int64
+	// Throughput in MiB/s to provision for the disk.
+	Throughput *int64
+	// Values: "none", regional-pd
+	ReplicationType string
+	// Re-key generation of the volume, applied the next time it is published.
+	RekeyGeneration string
+}
+
+// [Edgeless] ExtractModifyVolumeParameters parses the mutable parameters of a
+// ControllerModifyVolume request. It accepts the same keys as the storage
+// class parameters they change.
+func ExtractModifyVolumeParameters(parameters map[string]string) (ModifyVolumeParameters, error) {
+	p := ModifyVolumeParameters{}
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case ParameterKeyType:
+			if v == "" {
+				return p, fmt.Errorf("parameters contain empty %s parameter", ParameterKeyType)
+			}
+			p.DiskType = strings.ToLower(v)
+		case ParameterKeyReplicationType:
+			if v == "" {
+				return p, fmt.Errorf("parameters contain empty %s parameter", ParameterKeyReplicationType)
+			}
+			p.ReplicationType = strings.ToLower(v)
+		case ParameterKeyProvisionedIOPSOnCreate:
+			iops, err := ConvertStringToInt64(v)
+			if err != nil {
+				return p, fmt.Errorf("parameters contain invalid provisionedIOPSOnCreate parameter: %w", err)
+			}
+			p.IOPS = &iops
+		case ParameterKeyProvisionedThroughputOnCreate:
+			throughput, err := ConvertMiStringToInt64(v)
+			if err != nil {
+				return p, fmt.Errorf("parameters contain invalid provisionedThroughputOnCreate parameter: %w", err)
+			}
+			p.Throughput = &throughput
+		case VolumeAttributeRekeyGeneration:
+			if !regexRekeyGeneration.MatchString(v) {
+				return p, fmt.Errorf("parameters contain invalid %s parameter %q, it must be a valid GCE label value", VolumeAttributeRekeyGeneration, v)
+			}
+			p.RekeyGeneration = v
+		default:
+			return p, fmt.Errorf("parameters contains invalid mutable option %q", k)
+		}
+	}
+	return p, nil
+}
+
 func extractResourceTagsParameter(tagsString string, resourceTags map[string]string) error {
 	paramResourceTags, err := ConvertTagsStringToMap(tagsString)
 	if err != nil {
@@ -377,6 +377,266 @@ func TestExtractAndDefaultParameters(t *testing.T) {
 				Labels:          map[string]string{},
 			},
 		},
+		{
+			name:       "key scope",
+			parameters: map[string]string{ParameterKeyKeyScope: "tenant-a"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{KeyScopeLabel: "tenant-a"},
+				ResourceTags:         map[string]string{},
+				KeyScope:             "tenant-a",
+			},
+		},
+		{
+			name:       "key scope label is reserved",
+			parameters: map[string]string{ParameterKeyLabels: KeyScopeLabel + "=tenant-b"},
+			expectErr:  true,
+		},
+		{
+			name:       "rewrap key",
+			parameters: map[string]string{ParameterKeyRewrapKey: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+				ResourceTags:         map[string]string{},
+				RewrapKey:            true,
+			},
+		},
+		{
+			name:       "invalid rewrap key",
+			parameters: map[string]string{ParameterKeyRewrapKey: "maybe"},
+			expectErr:  true,
+		},
+		{
+			name: "LUKS2 format options",
+			parameters: map[string]string{
+				ParameterKeyCipher:             "chacha20-random",
+				ParameterKeyCryptKeySize:       "256",
+				ParameterKeySectorSize:         "512",
+				ParameterKeyIntegrityAlgorithm: "poly1305",
+				ParameterKeyPBKDF:              "argon2i",
+			},
+			labels: map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+				ResourceTags:         map[string]string{},
+				Cipher:               "chacha20-random",
+				CryptKeySize:         256,
+				SectorSize:           512,
+				IntegrityAlgorithm:   "poly1305",
+				PBKDF:                "argon2i",
+			},
+		},
+		{
+			name:       "invalid cipher",
+			parameters: map[string]string{ParameterKeyCipher: "aes xts"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid key size",
+			parameters: map[string]string{ParameterKeyCryptKeySize: "384"},
+			expectErr:  true,
+		},
+		{
+			name:       "key size too large for authenticated cipher",
+			parameters: map[string]string{ParameterKeyCipher: "aes-gcm-random", ParameterKeyIntegrityAlgorithm: "aead", ParameterKeyCryptKeySize: "512"},
+			expectErr:  true,
+		},
+		{
+			name:       "key size too small for default cipher",
+			parameters: map[string]string{ParameterKeyCryptKeySize: "128"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid sector size",
+			parameters: map[string]string{ParameterKeySectorSize: "4k"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid integrity algorithm",
+			parameters: map[string]string{ParameterKeyIntegrityAlgorithm: "crc32"},
+			expectErr:  true,
+		},
+		{
+			name:       "aead integrity without matching cipher",
+			parameters: map[string]string{ParameterKeyIntegrityAlgorithm: "aead"},
+			expectErr:  true,
+		},
+		{
+			name:       "integrity init",
+			parameters: map[string]string{ParameterKeyIntegrityInit: "background"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+				ResourceTags:         map[string]string{},
+				IntegrityInit:        IntegrityInitBackground,
+			},
+		},
+		{
+			name:       "invalid integrity init",
+			parameters: map[string]string{ParameterKeyIntegrityInit: "lazy"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid pbkdf",
+			parameters: map[string]string{ParameterKeyPBKDF: "scrypt"},
+			expectErr:  true,
+		},
+		{
+			name:       "invalid key scope",
+			parameters: map[string]string{ParameterKeyKeyScope: "Tenant/A"},
+			expectErr:  true,
+		},
+		{
+			name:       "unencrypted",
+			parameters: map[string]string{ParameterKeyEncryption: "none"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{EncryptionLabel: EncryptionNone},
+				ResourceTags:         map[string]string{},
+				Encryption:           EncryptionNone,
+			},
+		},
+		{
+			name:       "invalid encryption",
+			parameters: map[string]string{ParameterKeyEncryption: "aes"},
+			expectErr:  true,
+		},
+		{
+			name:       "unencrypted with key scope",
+			parameters: map[string]string{ParameterKeyEncryption: "none", ParameterKeyKeyScope: "tenant-a"},
+			expectErr:  true,
+		},
+		{
+			name:       "unencrypted with cipher",
+			parameters: map[string]string{ParameterKeyEncryption: "none", ParameterKeyCipher: "aes-xts-plain64"},
+			expectErr:  true,
+		},
+		{
+			name:       "provision crypt overhead",
+			parameters: map[string]string{ParameterKeyProvisionCryptOverhead: "true"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:               "pd-standard",
+				ReplicationType:        "none",
+				DiskEncryptionKMSKey:   "",
+				Tags:                   map[string]string{},
+				Labels:                 map[string]string{},
+				ResourceTags:           map[string]string{},
+				ProvisionCryptOverhead: true,
+			},
+		},
+		{
+			name:       "invalid provision crypt overhead",
+			parameters: map[string]string{ParameterKeyProvisionCryptOverhead: "yes please"},
+			expectErr:  true,
+		},
+		{
+			name:       "unencrypted with provision crypt overhead",
+			parameters: map[string]string{ParameterKeyEncryption: "none", ParameterKeyProvisionCryptOverhead: "true"},
+			expectErr:  true,
+		},
+		{
+			name:       "reserved encryption label",
+			parameters: map[string]string{ParameterKeyLabels: EncryptionLabel + "=none"},
+			expectErr:  true,
+		},
+		{
+			name:       "reserved imported label",
+			parameters: map[string]string{ParameterKeyLabels: ImportedLabel + "=true"},
+			expectErr:  true,
+		},
+		{
+			name:       "crypto-shred",
+			parameters: map[string]string{ParameterKeyCryptoShred: "force"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{CryptoShredLabel: "force"},
+				ResourceTags:         map[string]string{},
+				CryptoShred:          CryptoShredForce,
+			},
+		},
+		{
+			name:       "crypto-shred disabled",
+			parameters: map[string]string{ParameterKeyCryptoShred: "false"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+				ResourceTags:         map[string]string{},
+			},
+		},
+		{
+			name:       "invalid crypto-shred",
+			parameters: map[string]string{ParameterKeyCryptoShred: "always"},
+			expectErr:  true,
+		},
+		{
+			name:       "crypto-shred with key scope",
+			parameters: map[string]string{ParameterKeyCryptoShred: "true", ParameterKeyKeyScope: "tenant-a"},
+			expectErr:  true,
+		},
+		{
+			name:       "unencrypted with crypto-shred",
+			parameters: map[string]string{ParameterKeyEncryption: "none", ParameterKeyCryptoShred: "true"},
+			expectErr:  true,
+		},
+		{
+			name:       "reserved crypto-shred label",
+			parameters: map[string]string{ParameterKeyLabels: CryptoShredLabel + "=force"},
+			expectErr:  true,
+		},
+		{
+			name:       "disk-source image family",
+			parameters: map[string]string{ParameterKeyDiskSource: "projects/images-project/global/images/family/base"},
+			labels:     map[string]string{},
+			expectParams: DiskParameters{
+				DiskType:             "pd-standard",
+				ReplicationType:      "none",
+				DiskEncryptionKMSKey: "",
+				Tags:                 map[string]string{},
+				Labels:               map[string]string{},
+				ResourceTags:         map[string]string{},
+				DiskSource:           "projects/images-project/global/images/family/base",
+			},
+		},
+		{
+			name:       "invalid disk-source",
+			parameters: map[string]string{ParameterKeyDiskSource: "projects/images-project/global/machineImages/base"},
+			expectErr:  true,
+		},
+		{
+			name:       "disk-source with integrity",
+			parameters: map[string]string{ParameterKeyDiskSource: "projects/images-project/global/snapshots/base", ParameterKeyIntegrityAlgorithm: "hmac(sha256)"},
+			expectErr:  true,
+		},
 		{
 			name:            "multi-zone-enable parameters, invalid value, multi-zone feature enabled",
 			parameters:      map[string]string{ParameterKeyType: "hyperdisk-ml", ParameterKeyEnableMultiZoneProvisioning: "unknown"},
@@ -461,6 +721,16 @@ func TestSnapshotParameters(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			desc:        "reserved key scope label",
+			parameters:  map[string]string{ParameterKeyLabels: KeyScopeLabel + "=tenant-a"},
+			expectError: true,
+		},
+		{
+			desc:        "reserved encryption label",
+			parameters:  map[string]string{ParameterKeyLabels: EncryptionLabel + "=none"},
+			expectError: true,
+		},
 		{
 			desc:        "invalid snapshot type",
 			parameters:  map[string]string{ParameterKeySnapshotType: "invalid-type"},
@@ -482,3 +752,74 @@ func TestSnapshotParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractModifyVolumeParameters(t *testing.T) {
+	iops := int64(20000)
+	throughput := int64(500)
+	tests := []struct {
+		desc        string
+		parameters  map[string]string
+		expectParam ModifyVolumeParameters
+		expectError bool
+	}{
+		{
+			desc:        "no parameters",
+			parameters:  map[string]string{},
+			expectParam: ModifyVolumeParameters{},
+		},
+		{
+			desc:        "iops and throughput",
+			parameters:  map[string]string{ParameterKeyProvisionedIOPSOnCreate: "20k", ParameterKeyProvisionedThroughputOnCreate: "500Mi"},
+			expectParam: ModifyVolumeParameters{IOPS: &iops, Throughput: &throughput},
+		},
+		{
+			desc:        "case insensitive keys and disk type",
+			parameters:  map[string]string{"Type": "Hyperdisk-Balanced"},
+			expectParam: ModifyVolumeParameters{DiskType: "hyperdisk-balanced"},
+		},
+		{
+			desc:        "replication type",
+			parameters:  map[string]string{ParameterKeyReplicationType: "Regional-PD"},
+			expectParam: ModifyVolumeParameters{ReplicationType: "regional-pd"},
+		},
+		{
+			desc:        "rekey generation",
+			parameters:  map[string]string{VolumeAttributeRekeyGeneration: "2026-10-18"},
+			expectParam: ModifyVolumeParameters{RekeyGeneration: "2026-10-18"},
+		},
+		{
+			desc:        "invalid rekey generation",
+			parameters:  map[string]string{VolumeAttributeRekeyGeneration: "Generation 2"},
+			expectError: true,
+		},
+		{
+			desc:        "empty disk type",
+			parameters:  map[string]string{ParameterKeyType: ""},
+			expectError: true,
+		},
+		{
+			desc:        "invalid iops",
+			parameters:  map[string]string{ParameterKeyProvisionedIOPSOnCreate: "many"},
+			expectError: true,
+		},
+		{
+			desc:        "immutable parameter",
+			parameters:  map[string]string{ParameterKeyEncryption: EncryptionNone},
+			expectError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := ExtractModifyVolumeParameters(tc.parameters)
+			if err != nil && !tc.expectError {
+				t.Errorf("Got error %v; expect no error", err)
+			}
+			if err == nil && tc.expectError {
+				t.Error("Got no error; expect an error")
+			}
+			if err == nil && !reflect.DeepEqual(p, tc.expectParam) {
+				t.Errorf("Got ExtractModifyVolumeParameters(%+v) = %+v; expect %+v", tc.parameters, p, tc.expectParam)
+			}
+		})
+	}
+}
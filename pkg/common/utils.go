@@ -105,6 +105,24 @@ var (
 	regexKey    = regexp.MustCompile(`^[a-zA-Z0-9]([0-9A-Za-z_.-]{0,61}[a-zA-Z0-9])?$`)
 	regexValue  = regexp.MustCompile(`^[a-zA-Z0-9]([0-9A-Za-z_.@%=+:,*#&()\[\]{}\-\s]{0,61}[a-zA-Z0-9])?$`)
 
+	// [Edgeless] Regular expression for validating key derivation scopes.
+	regexKeyScope = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	// [Edgeless] Regular expression for validating re-key generations, which are stored as disk labels.
+	regexRekeyGeneration = regexp.MustCompile(`^[a-z0-9]([-_a-z0-9]{0,61}[a-z0-9])?$`)
+	// [Edgeless] Regular expression for validating cryptsetup cipher specifications.
+	regexCipher = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+){1,2}(:[a-z0-9]+)?$`)
+
+	// [Edgeless] Supported LUKS2 format options.
+	supportedCryptKeySizes       = []int{128, 256, 512}
+	supportedSectorSizes         = []int{512, 1024, 2048, 4096}
+	supportedIntegrityAlgorithms = []string{"hmac-sha256", "hmac-sha512", "aead", "poly1305"}
+	supportedPBKDFs              = []string{"argon2id", "argon2i", "pbkdf2"}
+	supportedIntegrityInits      = []string{IntegrityInitWipe, IntegrityInitNoWipe, IntegrityInitBackground}
+	supportedEncryptions         = []string{EncryptionLUKS2, EncryptionNone}
+	supportedCryptoShredModes    = []string{CryptoShredRefuse, CryptoShredForce}
+	// aeadCiphers maps authenticated encryption integrity modes to the cipher they require.
+	aeadCiphers = map[string]string{"aead": "aes-gcm-random", "poly1305": "chacha20-random"}
+
 	csiRetryableErrorCodes = []codes.Code{codes.Canceled, codes.DeadlineExceeded, codes.Unavailable, codes.Aborted, codes.ResourceExhausted}
 )
 
@@ -170,6 +188,29 @@ func SnapshotIDToProjectKey(id string) (string, string, string, error) {
 	}
 }
 
+// [Edgeless] DiskSourceToProjectKey returns the project, type and name of the
+// image or snapshot of a disk-source parameter, which is either
+// projects/{project}/global/{snapshots|images}/{name} or the image family
+// projects/{project}/global/images/family/{family}. Image families are
+// returned with the name family/{family}.
+func DiskSourceToProjectKey(source string) (string, string, string, error) {
+	splitSource := strings.Split(source, "/")
+	if len(splitSource) == snapshotTotalElements+1 && splitSource[snapshotTotalElements-2] == DiskImageType && splitSource[snapshotTotalElements-1] == "family" {
+		splitSource = append(splitSource[:snapshotTotalElements-1], "family/"+splitSource[snapshotTotalElements])
+	}
+	if len(splitSource) != snapshotTotalElements || splitSource[0] != "projects" || splitSource[snapshotTopologyKey] != "global" {
+		return "", "", "", fmt.Errorf("expected projects/{project}/global/{snapshots|images}/{name} or projects/{project}/global/images/family/{family}, got: %s", source)
+	}
+	project, sourceType, name := splitSource[snapshotProjectKey], splitSource[snapshotTotalElements-2], splitSource[snapshotTotalElements-1]
+	if sourceType != DiskSnapshotType && sourceType != DiskImageType {
+		return "", "", "", fmt.Errorf("expected a source of type %s or %s, got: %s", DiskSnapshotType, DiskImageType, sourceType)
+	}
+	if project == "" || name == "" || name == "family/" {
+		return "", "", "", fmt.Errorf("source %s has an empty project or name", source)
+	}
+	return project, sourceType, name, nil
+}
+
 func NodeIDToZoneAndName(id string) (string, string, error) {
 	splitId := strings.Split(id, "/")
 	if len(splitId) != nodeIDTotalElements {
@@ -816,6 +816,73 @@ func TestSnapshotStorageLocations(t *testing.T) {
 	}
 }
 
+func TestDiskSourceToProjectKey(t *testing.T) {
+	tests := []struct {
+		desc        string
+		source      string
+		expProject  string
+		expType     string
+		expName     string
+		expectError bool
+	}{
+		{
+			desc:       "image",
+			source:     "projects/images-project/global/images/base",
+			expProject: "images-project",
+			expType:    DiskImageType,
+			expName:    "base",
+		},
+		{
+			desc:       "image family",
+			source:     "projects/images-project/global/images/family/base",
+			expProject: "images-project",
+			expType:    DiskImageType,
+			expName:    "family/base",
+		},
+		{
+			desc:       "snapshot",
+			source:     "projects/snapshots-project/global/snapshots/base",
+			expProject: "snapshots-project",
+			expType:    DiskSnapshotType,
+			expName:    "base",
+		},
+		{
+			desc:        "zonal disk",
+			source:      "projects/disks-project/zones/us-central1-a/disks/base",
+			expectError: true,
+		},
+		{
+			desc:        "machine image",
+			source:      "projects/images-project/global/machineImages/base",
+			expectError: true,
+		},
+		{
+			desc:        "empty image family",
+			source:      "projects/images-project/global/images/family/",
+			expectError: true,
+		},
+		{
+			desc:        "name only",
+			source:      "base",
+			expectError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			project, sourceType, name, err := DiskSourceToProjectKey(tc.source)
+			if err != nil && !tc.expectError {
+				t.Errorf("Got error %v parsing disk source %q; expect no error", err, tc.source)
+			}
+			if err == nil && tc.expectError {
+				t.Errorf("Got no error parsing disk source %q; expect an error", tc.source)
+			}
+			if err == nil && (project != tc.expProject || sourceType != tc.expType || name != tc.expName) {
+				t.Errorf("Got %s, %s, %s for disk source %q; expect %s, %s, %s", project, sourceType, name, tc.source, tc.expProject, tc.expType, tc.expName)
+			}
+		})
+	}
+}
+
 func TestConvertStringToInt64(t *testing.T) {
 	tests := []struct {
 		desc        string
@@ -0,0 +1,353 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package cryptsetup implements LUKS2 operations which are not covered by the
+// Constellation cryptmapper by shelling out to the cryptsetup binary.
+package cryptsetup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// KeySize is the length of the passphrase requested from the KMS for every
+	// LUKS2 keyslot. It matches the key length used by the Constellation cryptmapper.
+	KeySize = 32
+
+	cryptsetupCmd = "cryptsetup"
+
+	// cryptsetup exits with 1 if an action was not permitted, e.g. because a token slot is empty.
+	exitCodeNotPermitted = 1
+	// cryptsetup exits with 2 if no keyslot can be unlocked with the given passphrase.
+	exitCodeBadPassphrase = 2
+)
+
+// keyFileDir is a memory backed directory new passphrases are passed to
+// cryptsetup through, since stdin is already taken by the existing passphrase.
+var keyFileDir = "/dev/shm"
+
+// ProgressFunc is called with the number of processed bytes and the total
+// number of bytes of a long running operation.
+type ProgressFunc func(done, total uint64)
+
+// CryptSetup is a collection of LUKS2 operations on devices attached to the node.
+type CryptSetup interface {
+	// UUID returns the LUKS2 UUID of the device at devicePath.
+	UUID(devicePath string) (string, error)
+
+	// Reencrypt runs an online reencryption of the LUKS2 device at devicePath,
+	// replacing its volume key. The passphrase must unlock an existing keyslot
+	// and is used to protect the new volume key. If resume is set, an interrupted
+	// reencryption is continued instead of starting a new one.
+	Reencrypt(ctx context.Context, devicePath string, passphrase []byte, resume bool, progress ProgressFunc) error
+
+	// ReencryptionInProgress returns whether the LUKS2 header of devicePath
+	// records an unfinished reencryption.
+	ReencryptionInProgress(devicePath string) (bool, error)
+
+	// Token returns the JSON of the LUKS2 token stored at tokenID, or nil if
+	// the token slot is empty.
+	Token(devicePath string, tokenID int) ([]byte, error)
+
+	// SetToken stores the JSON token at tokenID, replacing any existing token.
+	SetToken(devicePath string, tokenID int, token []byte) error
+
+	// IsLUKS returns whether devicePath holds a LUKS2 header.
+	IsLUKS(devicePath string) (bool, error)
+
+	// SetUUID replaces the LUKS2 UUID of the device at devicePath.
+	SetUUID(devicePath, uuid string) error
+
+	// TestKey returns whether passphrase unlocks a keyslot of devicePath.
+	TestKey(devicePath string, passphrase []byte) (bool, error)
+
+	// AddKey adds a keyslot protected by newPassphrase, using passphrase to
+	// unlock the volume key.
+	AddKey(devicePath string, passphrase, newPassphrase []byte) error
+
+	// RemoveKey removes the keyslot unlocked by passphrase.
+	RemoveKey(devicePath string, passphrase []byte) error
+
+	// Format creates a new LUKS2 header with the given UUID on devicePath and
+	// protects its volume key with passphrase in keyslot 0.
+	Format(devicePath, uuid string, passphrase []byte, opts FormatOptions) error
+
+	// InitEncryption creates a LUKS2 header with the given UUID for the in-place
+	// encryption of the unencrypted data on devicePath and protects its volume
+	// key with passphrase in keyslot 0. The last EncryptReduceSize bytes of the
+	// device must be unused. The data is encrypted by resuming the reencryption
+	// with Reencrypt.
+	InitEncryption(devicePath, uuid string, passphrase []byte, opts FormatOptions) error
+
+	// Wipe overwrites the mapped crypt device at devicePath with zeros, starting
+	// at offset, which initializes the integrity tags of the sectors written.
+	// Progress is only reported for data synced to the device.
+	Wipe(ctx context.Context, devicePath string, offset uint64, progress ProgressFunc) error
+
+	// Resize extends the active crypt mapping name, including a dm-integrity
+	// mapping backing it, to the size of the underlying device.
+	Resize(ctx context.Context, name string, passphrase []byte) error
+
+	// OpenReadOnly maps the LUKS2 device at devicePath read-only as the crypt
+	// mapping name, including a dm-integrity mapping backing it. Nothing is
+	// written to the device.
+	OpenReadOnly(devicePath, name string, passphrase []byte) error
+
+	// Status inspects the active crypt mapping name, the dm-integrity mapping
+	// backing it and the disk underneath.
+	Status(name string) (*DeviceStatus, error)
+
+	// Mappings returns the names of all active dm-crypt mappings on the node.
+	Mappings() ([]string, error)
+
+	// Mapping returns the configuration of the active crypt mapping name.
+	Mapping(name string) (*Mapping, error)
+
+	// BackupHeader returns a binary backup of the LUKS2 header of devicePath,
+	// including its keyslots and tokens.
+	BackupHeader(devicePath string) ([]byte, error)
+
+	// RestoreHeader replaces the LUKS2 header of devicePath with a backup
+	// created by BackupHeader.
+	RestoreHeader(devicePath string, header []byte) error
+}
+
+type cryptSetup struct {
+	exec utilexec.Interface
+}
+
+var _ CryptSetup = &cryptSetup{}
+
+func NewCryptSetup(exec utilexec.Interface) *cryptSetup {
+	return &cryptSetup{
+		exec: exec,
+	}
+}
+
+func (c *cryptSetup) UUID(devicePath string) (string, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "luksUUID", devicePath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("reading LUKS2 UUID of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	uuid := strings.TrimSpace(string(output))
+	if uuid == "" {
+		return "", fmt.Errorf("device %s has an empty LUKS2 UUID", devicePath)
+	}
+	return uuid, nil
+}
+
+func (c *cryptSetup) Reencrypt(ctx context.Context, devicePath string, passphrase []byte, resume bool, progress ProgressFunc) error {
+	args := []string{"reencrypt", "--batch-mode", "--key-file", "-", "--progress-json", "--progress-frequency", "10"}
+	if resume {
+		args = append(args, "--resume-only")
+	}
+	args = append(args, devicePath)
+
+	var stderr bytes.Buffer
+	progressWriter := newProgressWriter(progress)
+	cmd := c.exec.CommandContext(ctx, cryptsetupCmd, args...)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	cmd.SetStdout(progressWriter)
+	cmd.SetStderr(&stderr)
+	err := cmd.Run()
+	progressWriter.Close()
+	if err != nil {
+		return fmt.Errorf("reencrypting %s: output: %s, err: %w", devicePath, stderr.String(), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) ReencryptionInProgress(devicePath string) (bool, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "luksDump", devicePath).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("dumping LUKS2 header of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(key) != "Requirements" {
+			continue
+		}
+		return strings.Contains(value, "online-reencrypt"), nil
+	}
+	return false, nil
+}
+
+func (c *cryptSetup) Token(devicePath string, tokenID int) ([]byte, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "token", "export", "--token-id", strconv.Itoa(tokenID), devicePath).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == exitCodeNotPermitted {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("exporting LUKS2 token %d of %s: output: %s, err: %w", tokenID, devicePath, string(output), err)
+	}
+	return bytes.TrimSpace(output), nil
+}
+
+func (c *cryptSetup) SetToken(devicePath string, tokenID int, token []byte) error {
+	cmd := c.exec.Command(cryptsetupCmd, "token", "import", "--json-file", "-", "--token-id", strconv.Itoa(tokenID), "--token-replace", devicePath)
+	cmd.SetStdin(bytes.NewReader(token))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("importing LUKS2 token %d to %s: output: %s, err: %w", tokenID, devicePath, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) IsLUKS(devicePath string) (bool, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "isLuks", "--type", "luks2", devicePath).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == exitCodeNotPermitted {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking for LUKS2 header on %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return true, nil
+}
+
+func (c *cryptSetup) SetUUID(devicePath, uuid string) error {
+	output, err := c.exec.Command(cryptsetupCmd, "luksUUID", "--batch-mode", "--uuid", uuid, devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("setting LUKS2 UUID of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) TestKey(devicePath string, passphrase []byte) (bool, error) {
+	cmd := c.exec.Command(cryptsetupCmd, "open", "--test-passphrase", "--key-file", "-", devicePath)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == exitCodeBadPassphrase {
+			return false, nil
+		}
+		return false, fmt.Errorf("testing passphrase of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return true, nil
+}
+
+func (c *cryptSetup) AddKey(devicePath string, passphrase, newPassphrase []byte) error {
+	keyFile, err := os.CreateTemp(keyFileDir, "cryptsetup-key-")
+	if err != nil {
+		return fmt.Errorf("creating key file: %w", err)
+	}
+	defer os.Remove(keyFile.Name())
+	_, err = keyFile.Write(newPassphrase)
+	if closeErr := keyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing key file: %w", err)
+	}
+
+	cmd := c.exec.Command(cryptsetupCmd, "luksAddKey", "--batch-mode", "--key-file", "-", devicePath, keyFile.Name())
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("adding keyslot to %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) RemoveKey(devicePath string, passphrase []byte) error {
+	cmd := c.exec.Command(cryptsetupCmd, "luksRemoveKey", "--batch-mode", "--key-file", "-", devicePath)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("removing keyslot of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) Resize(ctx context.Context, name string, passphrase []byte) error {
+	cmd := c.exec.CommandContext(ctx, cryptsetupCmd, "resize", "--batch-mode", "--key-file", "-", name)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resizing crypt device %s: output: %s, err: %w", name, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) OpenReadOnly(devicePath, name string, passphrase []byte) error {
+	cmd := c.exec.Command(cryptsetupCmd, "open", "--type", "luks2", "--readonly", "--key-file", "-", devicePath, name)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("opening %s read-only as crypt device %s: output: %s, err: %w", devicePath, name, string(output), err)
+	}
+	return nil
+}
+
+// progressWriter parses the JSON progress lines written by cryptsetup's
+// --progress-json option and forwards them to a ProgressFunc.
+type progressWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+type progressLine struct {
+	DeviceBytes string `json:"device_bytes"`
+	DeviceSize  string `json:"device_size"`
+}
+
+func newProgressWriter(progress ProgressFunc) *progressWriter {
+	r, w := io.Pipe()
+	pw := &progressWriter{PipeWriter: w, done: make(chan struct{})}
+	go func() {
+		defer close(pw.done)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var line progressLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				klog.V(6).Infof("Ignoring cryptsetup output line %q", scanner.Text())
+				continue
+			}
+			done, errDone := strconv.ParseUint(line.DeviceBytes, 10, 64)
+			total, errTotal := strconv.ParseUint(line.DeviceSize, 10, 64)
+			if errDone != nil || errTotal != nil {
+				continue
+			}
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+		// Drain the pipe so cryptsetup never blocks on a full buffer
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	return pw
+}
+
+// Close closes the writer and waits for all buffered progress to be reported.
+func (pw *progressWriter) Close() error {
+	err := pw.PipeWriter.Close()
+	<-pw.done
+	return err
+}
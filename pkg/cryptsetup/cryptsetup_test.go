@@ -0,0 +1,789 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func fakeExec(t *testing.T, wantArgs []string, stdout string, err error) (*testingexec.FakeExec, *testingexec.FakeCmd) {
+	t.Helper()
+	fakeCmd := &testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return []byte(stdout), nil, err },
+		},
+		RunScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return []byte(stdout), nil, err },
+		},
+	}
+	action := func(cmd string, args ...string) exec.Cmd {
+		if got := append([]string{cmd}, args...); !cmp.Equal(got, wantArgs) {
+			t.Errorf("unexpected command: %s", cmp.Diff(wantArgs, got))
+		}
+		return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+	}
+	return &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{action}}, fakeCmd
+}
+
+func TestUUID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		output   string
+		err      error
+		wantUUID string
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			output:   "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e\n",
+			wantUUID: "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e",
+		},
+		{
+			name:    "empty output",
+			output:  "\n",
+			wantErr: true,
+		},
+		{
+			name:    "not a LUKS device",
+			output:  "Device /dev/sdb is not a valid LUKS device.",
+			err:     testingexec.FakeExitError{Status: 1},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"cryptsetup", "luksUUID", "/dev/sdb"}, tc.output, tc.err)
+			uuid, err := NewCryptSetup(e).UUID("/dev/sdb")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("UUID() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if uuid != tc.wantUUID {
+				t.Errorf("UUID() = %q, want %q", uuid, tc.wantUUID)
+			}
+		})
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	testCases := []struct {
+		name         string
+		resume       bool
+		output       string
+		err          error
+		wantArgs     []string
+		wantProgress [][2]uint64
+		wantErr      bool
+	}{
+		{
+			name:   "start reencryption",
+			output: "{\"device\":\"/dev/sdb\",\"device_bytes\":\"1024\",\"device_size\":\"4096\",\"speed\":\"0\",\"eta_ms\":\"0\",\"time_ms\":\"1\"}\nnot json\n{\"device\":\"/dev/sdb\",\"device_bytes\":\"4096\",\"device_size\":\"4096\",\"speed\":\"0\",\"eta_ms\":\"0\",\"time_ms\":\"2\"}\n",
+			wantArgs: []string{
+				"cryptsetup", "reencrypt", "--batch-mode", "--key-file", "-", "--progress-json", "--progress-frequency", "10", "/dev/sdb",
+			},
+			wantProgress: [][2]uint64{{1024, 4096}, {4096, 4096}},
+		},
+		{
+			name:   "resume reencryption",
+			resume: true,
+			wantArgs: []string{
+				"cryptsetup", "reencrypt", "--batch-mode", "--key-file", "-", "--progress-json", "--progress-frequency", "10", "--resume-only", "/dev/sdb",
+			},
+		},
+		{
+			name: "reencryption fails",
+			err:  testingexec.FakeExitError{Status: 1},
+			wantArgs: []string{
+				"cryptsetup", "reencrypt", "--batch-mode", "--key-file", "-", "--progress-json", "--progress-frequency", "10", "/dev/sdb",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cmd := fakeExec(t, tc.wantArgs, tc.output, tc.err)
+			var progress [][2]uint64
+			err := NewCryptSetup(e).Reencrypt(context.Background(), "/dev/sdb", []byte("passphrase"), tc.resume, func(done, total uint64) {
+				progress = append(progress, [2]uint64{done, total})
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Reencrypt() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantProgress, progress); diff != "" {
+				t.Errorf("unexpected progress: %s", diff)
+			}
+			stdin, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				t.Fatalf("reading stdin: %v", err)
+			}
+			if string(stdin) != "passphrase" {
+				t.Errorf("expected passphrase on stdin, got %q", stdin)
+			}
+		})
+	}
+}
+
+func TestReencryptionInProgress(t *testing.T) {
+	dump := `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+%s
+Data segments:
+`
+	testCases := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{
+			name:   "no reencryption",
+			output: strings.Replace(dump, "%s", "", 1),
+		},
+		{
+			name:   "reencryption in progress",
+			output: strings.Replace(dump, "%s", "Requirements:\tonline-reencrypt-v2", 1),
+			want:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"cryptsetup", "luksDump", "/dev/sdb"}, tc.output, nil)
+			got, err := NewCryptSetup(e).ReencryptionInProgress("/dev/sdb")
+			if err != nil {
+				t.Fatalf("ReencryptionInProgress() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("ReencryptionInProgress() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	testCases := []struct {
+		name      string
+		output    string
+		err       error
+		wantToken []byte
+		wantErr   bool
+	}{
+		{
+			name:      "token exists",
+			output:    "{\"type\":\"test\",\"keyslots\":[]}\n",
+			wantToken: []byte(`{"type":"test","keyslots":[]}`),
+		},
+		{
+			name: "empty token slot",
+			err:  testingexec.FakeExitError{Status: 1},
+		},
+		{
+			name:    "not a LUKS device",
+			err:     testingexec.FakeExitError{Status: 4},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"cryptsetup", "token", "export", "--token-id", "3", "/dev/sdb"}, tc.output, tc.err)
+			token, err := NewCryptSetup(e).Token("/dev/sdb", 3)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Token() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.wantToken, token); diff != "" {
+				t.Errorf("unexpected token: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSetToken(t *testing.T) {
+	token := []byte(`{"type":"test","keyslots":[]}`)
+	e, cmd := fakeExec(t, []string{"cryptsetup", "token", "import", "--json-file", "-", "--token-id", "3", "--token-replace", "/dev/sdb"}, "", nil)
+	if err := NewCryptSetup(e).SetToken("/dev/sdb", 3, token); err != nil {
+		t.Fatalf("SetToken() error = %v", err)
+	}
+	stdin, err := io.ReadAll(cmd.Stdin)
+	if err != nil {
+		t.Fatalf("reading stdin: %v", err)
+	}
+	if diff := cmp.Diff(token, stdin); diff != "" {
+		t.Errorf("unexpected token on stdin: %s", diff)
+	}
+}
+
+func TestIsLUKS(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "LUKS2 device",
+			want: true,
+		},
+		{
+			name: "no LUKS2 header",
+			err:  testingexec.FakeExitError{Status: 1},
+		},
+		{
+			name:    "device missing",
+			err:     testingexec.FakeExitError{Status: 4},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"cryptsetup", "isLuks", "--type", "luks2", "/dev/sdb"}, "", tc.err)
+			got, err := NewCryptSetup(e).IsLUKS("/dev/sdb")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("IsLUKS() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("IsLUKS() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTestKey(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "key unlocks a keyslot",
+			want: true,
+		},
+		{
+			name: "wrong key",
+			err:  testingexec.FakeExitError{Status: 2},
+		},
+		{
+			name:    "not a LUKS device",
+			err:     testingexec.FakeExitError{Status: 1},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cmd := fakeExec(t, []string{"cryptsetup", "open", "--test-passphrase", "--key-file", "-", "/dev/sdb"}, "", tc.err)
+			got, err := NewCryptSetup(e).TestKey("/dev/sdb", []byte("passphrase"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("TestKey() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("TestKey() = %v, want %v", got, tc.want)
+			}
+			stdin, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				t.Fatalf("reading stdin: %v", err)
+			}
+			if string(stdin) != "passphrase" {
+				t.Errorf("expected passphrase on stdin, got %q", stdin)
+			}
+		})
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	keyFileDir = t.TempDir()
+	var newKey []byte
+	fakeCmd := &testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return nil, nil, nil },
+		},
+	}
+	action := func(cmd string, args ...string) exec.Cmd {
+		wantArgs := []string{"cryptsetup", "luksAddKey", "--batch-mode", "--key-file", "-", "/dev/sdb"}
+		got := append([]string{cmd}, args...)
+		if len(got) != len(wantArgs)+1 || !cmp.Equal(got[:len(wantArgs)], wantArgs) {
+			t.Fatalf("unexpected command: %v", got)
+		}
+		// The new key is passed in a file, which is removed once cryptsetup returns
+		keyFile := got[len(wantArgs)]
+		if !strings.HasPrefix(keyFile, keyFileDir) {
+			t.Errorf("expected key file in %s, got %s", keyFileDir, keyFile)
+		}
+		var err error
+		if newKey, err = os.ReadFile(keyFile); err != nil {
+			t.Fatalf("reading key file: %v", err)
+		}
+		return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+	}
+	e := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{action}}
+
+	if err := NewCryptSetup(e).AddKey("/dev/sdb", []byte("old"), []byte("new")); err != nil {
+		t.Fatalf("AddKey() error = %v", err)
+	}
+	if string(newKey) != "new" {
+		t.Errorf("expected new key in key file, got %q", newKey)
+	}
+	stdin, err := io.ReadAll(fakeCmd.Stdin)
+	if err != nil {
+		t.Fatalf("reading stdin: %v", err)
+	}
+	if string(stdin) != "old" {
+		t.Errorf("expected old key on stdin, got %q", stdin)
+	}
+	if entries, err := os.ReadDir(keyFileDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected key file to be removed, got %v, %v", entries, err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     FormatOptions
+		wantArgs []string
+	}{
+		{
+			name: "defaults",
+			wantArgs: []string{
+				"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--uuid", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", "--key-file", "-", "--key-slot", "0",
+				"--cipher", "aes-xts-plain64", "--key-size", "512", "--sector-size", "4096", "--pbkdf", "argon2id", "--iter-time", "2000", "--pbkdf-memory", "65536", "--pbkdf-parallel", "4",
+				"/dev/sdb",
+			},
+		},
+		{
+			name: "custom options",
+			opts: FormatOptions{Cipher: "aes-gcm-random", KeySize: 256, SectorSize: 512, Integrity: "aead", PBKDF: "pbkdf2"},
+			wantArgs: []string{
+				"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--uuid", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", "--key-file", "-", "--key-slot", "0",
+				"--cipher", "aes-gcm-random", "--key-size", "256", "--sector-size", "512", "--pbkdf", "pbkdf2", "--iter-time", "2000", "--integrity", "aead",
+				"/dev/sdb",
+			},
+		},
+		{
+			name: "default key size of authenticated cipher",
+			opts: FormatOptions{Cipher: "chacha20-random", Integrity: "poly1305"},
+			wantArgs: []string{
+				"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--uuid", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", "--key-file", "-", "--key-slot", "0",
+				"--cipher", "chacha20-random", "--key-size", "256", "--sector-size", "4096", "--pbkdf", "argon2id", "--iter-time", "2000", "--pbkdf-memory", "65536", "--pbkdf-parallel", "4",
+				"--integrity", "poly1305",
+				"/dev/sdb",
+			},
+		},
+		{
+			name: "integrity without wipe",
+			opts: FormatOptions{Integrity: "hmac-sha256", NoWipe: true},
+			wantArgs: []string{
+				"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--uuid", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", "--key-file", "-", "--key-slot", "0",
+				"--cipher", "aes-xts-plain64", "--key-size", "512", "--sector-size", "4096", "--pbkdf", "argon2id", "--iter-time", "2000", "--pbkdf-memory", "65536", "--pbkdf-parallel", "4",
+				"--integrity", "hmac-sha256", "--integrity-no-wipe",
+				"/dev/sdb",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cmd := fakeExec(t, tc.wantArgs, "", nil)
+			if err := NewCryptSetup(e).Format("/dev/sdb", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", []byte("passphrase"), tc.opts); err != nil {
+				t.Fatalf("Format() error = %v", err)
+			}
+			stdin, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				t.Fatalf("reading stdin: %v", err)
+			}
+			if string(stdin) != "passphrase" {
+				t.Errorf("expected passphrase on stdin, got %q", stdin)
+			}
+		})
+	}
+}
+
+func TestInitEncryption(t *testing.T) {
+	wantArgs := []string{
+		"cryptsetup", "reencrypt", "--encrypt", "--init-only", "--batch-mode", "--type", "luks2", "--reduce-device-size", "32M",
+		"--uuid", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", "--key-file", "-", "--key-slot", "0",
+		"--cipher", "aes-xts-plain64", "--key-size", "256", "--sector-size", "4096", "--pbkdf", "argon2id", "--iter-time", "2000", "--pbkdf-memory", "65536", "--pbkdf-parallel", "4",
+		"/dev/sdb",
+	}
+	e, cmd := fakeExec(t, wantArgs, "", nil)
+	if err := NewCryptSetup(e).InitEncryption("/dev/sdb", "2fd3b5a4-6a2e-4a4c-8b3e-1f6a5b5c1d2e", []byte("passphrase"), FormatOptions{KeySize: 256}); err != nil {
+		t.Fatalf("InitEncryption() error = %v", err)
+	}
+	stdin, err := io.ReadAll(cmd.Stdin)
+	if err != nil {
+		t.Fatalf("reading stdin: %v", err)
+	}
+	if string(stdin) != "passphrase" {
+		t.Errorf("expected passphrase on stdin, got %q", stdin)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	const size = 2*wipeChunkSize + wipeChunkSize/2
+	device := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(device, bytes.Repeat([]byte{0xff}, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress [][2]uint64
+	// Resuming in the middle of the second chunk rewrites the whole chunk
+	err := NewCryptSetup(nil).Wipe(context.Background(), device, wipeChunkSize+10, func(done, total uint64) {
+		progress = append(progress, [2]uint64{done, total})
+	})
+	if err != nil {
+		t.Fatalf("Wipe() error = %v", err)
+	}
+	if diff := cmp.Diff([][2]uint64{{size, size}}, progress); diff != "" {
+		t.Errorf("unexpected progress: %s", diff)
+	}
+
+	data, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:wipeChunkSize], bytes.Repeat([]byte{0xff}, wipeChunkSize)) {
+		t.Errorf("expected data before the offset to be unchanged")
+	}
+	if !bytes.Equal(data[wipeChunkSize:], make([]byte, size-wipeChunkSize)) {
+		t.Errorf("expected data after the offset to be wiped")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewCryptSetup(nil).Wipe(ctx, device, 0, nil); err == nil {
+		t.Errorf("expected cancelled Wipe() to fail")
+	}
+}
+
+func TestResize(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:    "resize fails",
+			err:     testingexec.FakeExitError{Status: 1},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cmd := fakeExec(t, []string{"cryptsetup", "resize", "--batch-mode", "--key-file", "-", "testDisk"}, "", tc.err)
+			err := NewCryptSetup(e).Resize(context.Background(), "testDisk", []byte("passphrase"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Resize() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			stdin, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				t.Fatalf("reading stdin: %v", err)
+			}
+			if string(stdin) != "passphrase" {
+				t.Errorf("expected passphrase on stdin, got %q", stdin)
+			}
+		})
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:    "wrong passphrase",
+			err:     testingexec.FakeExitError{Status: exitCodeBadPassphrase},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, cmd := fakeExec(t, []string{"cryptsetup", "open", "--type", "luks2", "--readonly", "--key-file", "-", "/dev/sdb", "testDisk"}, "", tc.err)
+			err := NewCryptSetup(e).OpenReadOnly("/dev/sdb", "testDisk", []byte("passphrase"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("OpenReadOnly() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			stdin, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				t.Fatalf("reading stdin: %v", err)
+			}
+			if string(stdin) != "passphrase" {
+				t.Errorf("expected passphrase on stdin, got %q", stdin)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sysBlockDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sysBlockDir, "sdb", "device"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sysBlockDir, "sdb", "device", "ioerr_cnt"), []byte("0x2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	type dmCmd struct {
+		args   []string
+		output string
+		err    error
+	}
+	notFound := testingexec.FakeExitError{Status: 1}
+	testCases := []struct {
+		name    string
+		cmds    []dmCmd
+		want    *DeviceStatus
+		wantErr bool
+	}{
+		{
+			name: "crypt mapping",
+			cmds: []dmCmd{
+				{args: []string{"dmsetup", "status", "testDisk"}, output: "0 2097152 crypt \n"},
+				{args: []string{"dmsetup", "status", "testDisk_dif"}, output: "Device does not exist.\nCommand failed.\n", err: notFound},
+				{args: []string{"dmsetup", "deps", "-o", "devname", "testDisk"}, output: " 1 dependencies\t: (sdb)\n"},
+			},
+			want: &DeviceStatus{Active: true, Target: "crypt", Disk: "sdb", IOErrors: 2},
+		},
+		{
+			name: "integrity mapping",
+			cmds: []dmCmd{
+				{args: []string{"dmsetup", "status", "testDisk"}, output: "0 2097152 crypt \n"},
+				{args: []string{"dmsetup", "status", "testDisk_dif"}, output: "0 2097152 integrity 5 2097152 -\n"},
+				{args: []string{"dmsetup", "deps", "-o", "devname", "testDisk_dif"}, output: " 1 dependencies\t: (nvme0n2)\n"},
+			},
+			want: &DeviceStatus{Active: true, Target: "crypt", Integrity: true, IntegrityMismatches: 5, Disk: "nvme0n2"},
+		},
+		{
+			name: "mapping not active",
+			cmds: []dmCmd{
+				{args: []string{"dmsetup", "status", "testDisk"}, output: "Device does not exist.\nCommand failed.\n", err: notFound},
+			},
+			want: &DeviceStatus{},
+		},
+		{
+			name: "dmsetup fails",
+			cmds: []dmCmd{
+				{args: []string{"dmsetup", "status", "testDisk"}, output: "permission denied", err: notFound},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &testingexec.FakeExec{}
+			for _, c := range tc.cmds {
+				fakeCmd := &testingexec.FakeCmd{
+					CombinedOutputScript: []testingexec.FakeAction{
+						func() ([]byte, []byte, error) { return []byte(c.output), nil, c.err },
+					},
+				}
+				e.CommandScript = append(e.CommandScript, func(cmd string, args ...string) exec.Cmd {
+					if got := append([]string{cmd}, args...); !cmp.Equal(got, c.args) {
+						t.Errorf("unexpected command: %s", cmp.Diff(c.args, got))
+					}
+					return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+				})
+			}
+
+			got, err := NewCryptSetup(e).Status("testDisk")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Status() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Status() mismatch (-want +got):\n%s", diff)
+			}
+			if e.CommandCalls != len(tc.cmds) {
+				t.Errorf("expected %d commands, got %d", len(tc.cmds), e.CommandCalls)
+			}
+		})
+	}
+}
+
+func TestMappings(t *testing.T) {
+	testCases := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name:   "mappings",
+			output: "testDisk\t(253:1)\nstate\t(253:0)\n",
+			want:   []string{"testDisk", "state"},
+		},
+		{
+			name:   "no mappings",
+			output: "No devices found\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"dmsetup", "ls", "--target", "crypt"}, tc.output, nil)
+			got, err := NewCryptSetup(e).Mappings()
+			if err != nil {
+				t.Fatalf("Mappings() error = %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Mappings() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMapping(t *testing.T) {
+	testCases := []struct {
+		name    string
+		output  string
+		err     error
+		want    *Mapping
+		wantErr bool
+	}{
+		{
+			name: "integrity protected mapping",
+			output: `/dev/mapper/testDisk is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  integrity: hmac(sha256)
+  integrity keysize: 256 bits
+  device:  /dev/sdb
+  sector size:  4096
+  offset:  0 sectors
+  size:    2064384 sectors
+  mode:    read/write
+`,
+			want: &Mapping{Name: "testDisk", Type: "LUKS2", Cipher: "aes-xts-plain64", KeySize: 512, SectorSize: 4096, Integrity: "hmac(sha256)", Device: "/dev/sdb", InUse: true},
+		},
+		{
+			name: "read-only mapping",
+			output: `/dev/mapper/testDisk is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 256 bits
+  device:  /dev/sdc
+  sector size:  512
+  mode:    readonly
+`,
+			want: &Mapping{Name: "testDisk", Type: "LUKS2", Cipher: "aes-xts-plain64", KeySize: 256, SectorSize: 512, Device: "/dev/sdc", ReadOnly: true},
+		},
+		{
+			name:    "mapping not active",
+			output:  "/dev/mapper/testDisk is inactive.\n",
+			err:     testingexec.FakeExitError{Status: 4},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := fakeExec(t, []string{"cryptsetup", "status", "testDisk"}, tc.output, tc.err)
+			got, err := NewCryptSetup(e).Mapping("testDisk")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Mapping() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Mapping() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBackupHeader(t *testing.T) {
+	keyFileDir = t.TempDir()
+	fakeCmd := &testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return nil, nil, nil },
+		},
+	}
+	action := func(cmd string, args ...string) exec.Cmd {
+		wantArgs := []string{"cryptsetup", "luksHeaderBackup", "--batch-mode", "/dev/sdb", "--header-backup-file"}
+		got := append([]string{cmd}, args...)
+		if len(got) != len(wantArgs)+1 || !cmp.Equal(got[:len(wantArgs)], wantArgs) {
+			t.Fatalf("unexpected command: %v", got)
+		}
+		backupFile := got[len(wantArgs)]
+		if _, err := os.Stat(backupFile); !os.IsNotExist(err) {
+			t.Errorf("expected backup file %s to not exist yet, got %v", backupFile, err)
+		}
+		if err := os.WriteFile(backupFile, []byte("header"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+	}
+	e := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{action}}
+
+	header, err := NewCryptSetup(e).BackupHeader("/dev/sdb")
+	if err != nil {
+		t.Fatalf("BackupHeader() error = %v", err)
+	}
+	if string(header) != "header" {
+		t.Errorf("expected header backup %q, got %q", "header", header)
+	}
+	if entries, err := os.ReadDir(keyFileDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected header backup to be removed, got %v entries, err %v", entries, err)
+	}
+}
+
+func TestRestoreHeader(t *testing.T) {
+	keyFileDir = t.TempDir()
+	var restored []byte
+	fakeCmd := &testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return nil, nil, nil },
+		},
+	}
+	action := func(cmd string, args ...string) exec.Cmd {
+		wantArgs := []string{"cryptsetup", "luksHeaderRestore", "--batch-mode", "/dev/sdb", "--header-backup-file"}
+		got := append([]string{cmd}, args...)
+		if len(got) != len(wantArgs)+1 || !cmp.Equal(got[:len(wantArgs)], wantArgs) {
+			t.Fatalf("unexpected command: %v", got)
+		}
+		var err error
+		if restored, err = os.ReadFile(got[len(wantArgs)]); err != nil {
+			t.Fatalf("reading header backup file: %v", err)
+		}
+		return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+	}
+	e := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{action}}
+
+	if err := NewCryptSetup(e).RestoreHeader("/dev/sdb", []byte("header")); err != nil {
+		t.Fatalf("RestoreHeader() error = %v", err)
+	}
+	if string(restored) != "header" {
+		t.Errorf("expected header %q to be restored, got %q", "header", restored)
+	}
+	if entries, err := os.ReadDir(keyFileDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected header backup file to be removed, got %v entries, err %v", entries, err)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// FakeCryptSetup keeps LUKS2 header state in memory and records the
+// operations run against it.
+type FakeCryptSetup struct {
+	mux sync.Mutex
+
+	// UUIDs maps device paths to their LUKS2 UUID. Devices without an entry
+	// have the UUID "fake-uuid-<device path>".
+	UUIDs map[string]string
+	// Keys maps device paths to the passphrases of their keyslots. Devices
+	// without an entry accept any passphrase.
+	Keys map[string][]string
+	// NotLUKS holds devices without a LUKS2 header.
+	NotLUKS map[string]bool
+	// Formats maps devices formatted with Format to the options they were formatted with.
+	Formats map[string]FormatOptions
+	// Encryptions maps devices passed to InitEncryption to the options they
+	// are encrypted with.
+	Encryptions map[string]FormatOptions
+	// Tokens maps device paths to their LUKS2 tokens.
+	Tokens map[string]map[int][]byte
+	// Reencrypting holds devices with an unfinished reencryption.
+	Reencrypting map[string]bool
+	// Reencryptions records the devices passed to Reencrypt, in order.
+	Reencryptions []string
+	// ReencryptErr is returned by Reencrypt if set.
+	ReencryptErr error
+	// ReencryptBlock, if set, blocks Reencrypt until it is closed or the
+	// context is cancelled.
+	ReencryptBlock chan struct{}
+	// Wipes records the devices and offsets passed to Wipe, in order.
+	Wipes []FakeWipe
+	// WipeErr is returned by Wipe if set.
+	WipeErr error
+	// WipeBlock, if set, blocks Wipe until it is closed or the context is cancelled.
+	WipeBlock chan struct{}
+	// Resizes records the mappings passed to Resize, in order.
+	Resizes []string
+	// Statuses maps mapping names to their status. Mappings without an entry
+	// are reported as active and intact.
+	Statuses map[string]*DeviceStatus
+	// Mapped maps the names of active crypt mappings to their configuration.
+	Mapped map[string]*Mapping
+	// HeaderBackups records the number of header backups taken of each device.
+	HeaderBackups map[string]int
+	// RestoredHeaders maps devices to the header restored onto them.
+	RestoredHeaders map[string][]byte
+}
+
+// FakeWipe is a call to FakeCryptSetup.Wipe.
+type FakeWipe struct {
+	DevicePath string
+	Offset     uint64
+}
+
+var _ CryptSetup = &FakeCryptSetup{}
+
+func NewFakeCryptSetup() *FakeCryptSetup {
+	return &FakeCryptSetup{
+		UUIDs:           map[string]string{},
+		Keys:            map[string][]string{},
+		NotLUKS:         map[string]bool{},
+		Formats:         map[string]FormatOptions{},
+		Encryptions:     map[string]FormatOptions{},
+		Tokens:          map[string]map[int][]byte{},
+		Reencrypting:    map[string]bool{},
+		Statuses:        map[string]*DeviceStatus{},
+		Mapped:          map[string]*Mapping{},
+		HeaderBackups:   map[string]int{},
+		RestoredHeaders: map[string][]byte{},
+	}
+}
+
+func (f *FakeCryptSetup) UUID(devicePath string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.uuid(devicePath), nil
+}
+
+func (f *FakeCryptSetup) uuid(devicePath string) string {
+	if uuid, ok := f.UUIDs[devicePath]; ok {
+		return uuid
+	}
+	return "fake-uuid-" + devicePath
+}
+
+func (f *FakeCryptSetup) Reencrypt(ctx context.Context, devicePath string, passphrase []byte, resume bool, progress ProgressFunc) error {
+	f.mux.Lock()
+	f.Reencryptions = append(f.Reencryptions, devicePath)
+	f.Reencrypting[devicePath] = true
+	block := f.ReencryptBlock
+	f.mux.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.ReencryptErr != nil {
+		return f.ReencryptErr
+	}
+	if progress != nil {
+		progress(1, 1)
+	}
+	delete(f.Reencrypting, devicePath)
+	return nil
+}
+
+func (f *FakeCryptSetup) ReencryptionInProgress(devicePath string) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.Reencrypting[devicePath], nil
+}
+
+func (f *FakeCryptSetup) Token(devicePath string, tokenID int) ([]byte, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.Tokens[devicePath][tokenID], nil
+}
+
+func (f *FakeCryptSetup) SetToken(devicePath string, tokenID int, token []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.Tokens[devicePath] == nil {
+		f.Tokens[devicePath] = map[int][]byte{}
+	}
+	f.Tokens[devicePath][tokenID] = token
+	return nil
+}
+
+func (f *FakeCryptSetup) IsLUKS(devicePath string) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return !f.NotLUKS[devicePath], nil
+}
+
+func (f *FakeCryptSetup) SetUUID(devicePath, uuid string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.UUIDs[devicePath] = uuid
+	return nil
+}
+
+func (f *FakeCryptSetup) TestKey(devicePath string, passphrase []byte) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.unlocks(devicePath, passphrase), nil
+}
+
+func (f *FakeCryptSetup) AddKey(devicePath string, passphrase, newPassphrase []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !f.unlocks(devicePath, passphrase) {
+		return errors.New("no key available with this passphrase")
+	}
+	f.Keys[devicePath] = append(f.Keys[devicePath], string(newPassphrase))
+	return nil
+}
+
+func (f *FakeCryptSetup) RemoveKey(devicePath string, passphrase []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	keys, ok := f.Keys[devicePath]
+	if !ok {
+		return nil
+	}
+	idx := slices.Index(keys, string(passphrase))
+	if idx < 0 {
+		return errors.New("no key available with this passphrase")
+	}
+	f.Keys[devicePath] = slices.Delete(keys, idx, idx+1)
+	return nil
+}
+
+func (f *FakeCryptSetup) Format(devicePath, uuid string, passphrase []byte, opts FormatOptions) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.NotLUKS, devicePath)
+	delete(f.Tokens, devicePath)
+	f.UUIDs[devicePath] = uuid
+	f.Keys[devicePath] = []string{string(passphrase)}
+	f.Formats[devicePath] = opts
+	return nil
+}
+
+func (f *FakeCryptSetup) InitEncryption(devicePath, uuid string, passphrase []byte, opts FormatOptions) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.NotLUKS, devicePath)
+	delete(f.Tokens, devicePath)
+	f.UUIDs[devicePath] = uuid
+	f.Keys[devicePath] = []string{string(passphrase)}
+	f.Encryptions[devicePath] = opts
+	f.Reencrypting[devicePath] = true
+	return nil
+}
+
+func (f *FakeCryptSetup) Wipe(ctx context.Context, devicePath string, offset uint64, progress ProgressFunc) error {
+	f.mux.Lock()
+	f.Wipes = append(f.Wipes, FakeWipe{DevicePath: devicePath, Offset: offset})
+	block := f.WipeBlock
+	f.mux.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.WipeErr != nil {
+		return f.WipeErr
+	}
+	if progress != nil {
+		progress(1, 1)
+	}
+	return nil
+}
+
+func (f *FakeCryptSetup) Resize(ctx context.Context, name string, passphrase []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.Resizes = append(f.Resizes, name)
+	return nil
+}
+
+// OpenReadOnly adds a read-only mapping of devicePath to Mapped.
+func (f *FakeCryptSetup) OpenReadOnly(devicePath, name string, passphrase []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.NotLUKS[devicePath] {
+		return errors.New("device is not a LUKS2 device")
+	}
+	if !f.unlocks(devicePath, passphrase) {
+		return errors.New("no key available with this passphrase")
+	}
+	f.Mapped[name] = &Mapping{Name: name, Type: "LUKS2", Device: devicePath, ReadOnly: true}
+	return nil
+}
+
+func (f *FakeCryptSetup) Status(name string) (*DeviceStatus, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if status, ok := f.Statuses[name]; ok {
+		return status, nil
+	}
+	return &DeviceStatus{Active: true, Target: "crypt", Disk: "sdb"}, nil
+}
+
+func (f *FakeCryptSetup) Mappings() ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	names := make([]string, 0, len(f.Mapped))
+	for name := range f.Mapped {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (f *FakeCryptSetup) Mapping(name string) (*Mapping, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	mapping, ok := f.Mapped[name]
+	if !ok {
+		return nil, errors.New("crypt mapping not found")
+	}
+	return mapping, nil
+}
+
+// BackupHeader returns "header of <device path> with UUID <uuid>" as header backup.
+func (f *FakeCryptSetup) BackupHeader(devicePath string) ([]byte, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.NotLUKS[devicePath] {
+		return nil, errors.New("device is not a LUKS2 device")
+	}
+	f.HeaderBackups[devicePath]++
+	return []byte("header of " + devicePath + " with UUID " + f.uuid(devicePath)), nil
+}
+
+func (f *FakeCryptSetup) RestoreHeader(devicePath string, header []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.RestoredHeaders[devicePath] = header
+	delete(f.NotLUKS, devicePath)
+	return nil
+}
+
+func (f *FakeCryptSetup) unlocks(devicePath string, passphrase []byte) bool {
+	keys, ok := f.Keys[devicePath]
+	return !ok || slices.Contains(keys, string(passphrase))
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the LUKS2 format, matching the format of the Constellation cryptmapper.
+const (
+	DefaultCipher     = "aes-xts-plain64"
+	DefaultSectorSize = 4096
+	DefaultIntegrity  = "hmac-sha256"
+	DefaultPBKDF      = "argon2id"
+
+	// Argon2 cost parameters of the Constellation cryptmapper, following the
+	// low memory recommendation of RFC 9106.
+	argon2MemoryKB = 65536
+	argon2Threads  = 4
+	argon2TimeMs   = 2000
+
+	// EncryptReduceSize is the space at the end of a device in-place encryption
+	// needs to move the data by the size of the LUKS2 header. The data offset
+	// of the encrypted device is half of it.
+	EncryptReduceSize = 32 << 20
+)
+
+// FormatOptions configure a new LUKS2 header. Zero values select the defaults.
+type FormatOptions struct {
+	// Cipher is the cipher specification in cryptsetup syntax.
+	Cipher string
+	// KeySize is the size of the volume key in bits. Zero selects the default
+	// of the cipher.
+	KeySize int
+	// SectorSize is the encryption sector size in bytes.
+	SectorSize int
+	// Integrity is the dm-integrity algorithm. Empty disables integrity protection.
+	Integrity string
+	// PBKDF is the key derivation function protecting the keyslot.
+	PBKDF string
+	// NoWipe skips initializing the integrity tags of the device. Sectors read
+	// before they were first written fail the integrity check.
+	NoWipe bool
+}
+
+// IsZero returns whether no option is set.
+func (o FormatOptions) IsZero() bool {
+	return o == FormatOptions{}
+}
+
+func (o FormatOptions) args() []string {
+	cipher, keySize, sectorSize, pbkdf := o.Cipher, o.KeySize, o.SectorSize, o.PBKDF
+	if cipher == "" {
+		cipher = DefaultCipher
+	}
+	if keySize == 0 {
+		keySize = defaultKeySize(cipher)
+	}
+	if sectorSize == 0 {
+		sectorSize = DefaultSectorSize
+	}
+	if pbkdf == "" {
+		pbkdf = DefaultPBKDF
+	}
+	args := []string{
+		"--cipher", cipher,
+		"--key-size", strconv.Itoa(keySize),
+		"--sector-size", strconv.Itoa(sectorSize),
+		"--pbkdf", pbkdf,
+		"--iter-time", strconv.Itoa(argon2TimeMs),
+	}
+	if pbkdf != "pbkdf2" {
+		args = append(args, "--pbkdf-memory", strconv.Itoa(argon2MemoryKB), "--pbkdf-parallel", strconv.Itoa(argon2Threads))
+	}
+	if o.Integrity != "" {
+		args = append(args, "--integrity", o.Integrity)
+		if o.NoWipe {
+			args = append(args, "--integrity-no-wipe")
+		}
+	}
+	return args
+}
+
+// defaultKeySize returns the default volume key size in bits of cipher. The
+// key of XTS modes holds two 256 bit keys, other modes, such as the
+// authenticated aes-gcm-random and chacha20-random, take a single one.
+func defaultKeySize(cipher string) int {
+	if strings.Contains(cipher, "-xts-") {
+		return 512
+	}
+	return 256
+}
+
+func (c *cryptSetup) Format(devicePath, uuid string, passphrase []byte, opts FormatOptions) error {
+	args := []string{"luksFormat", "--batch-mode", "--type", "luks2", "--uuid", uuid, "--key-file", "-", "--key-slot", "0"}
+	args = append(args, opts.args()...)
+	args = append(args, devicePath)
+	cmd := c.exec.Command(cryptsetupCmd, args...)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("formatting %s as LUKS2 device: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
+
+func (c *cryptSetup) InitEncryption(devicePath, uuid string, passphrase []byte, opts FormatOptions) error {
+	args := []string{
+		"reencrypt", "--encrypt", "--init-only", "--batch-mode", "--type", "luks2",
+		"--reduce-device-size", strconv.Itoa(EncryptReduceSize>>20) + "M",
+		"--uuid", uuid, "--key-file", "-", "--key-slot", "0",
+	}
+	args = append(args, opts.args()...)
+	args = append(args, devicePath)
+	cmd := c.exec.Command(cryptsetupCmd, args...)
+	cmd.SetStdin(bytes.NewReader(passphrase))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("initializing encryption of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
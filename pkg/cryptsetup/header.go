@@ -0,0 +1,66 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cryptsetup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Header backups are passed through keyFileDir as well, since they hold the
+// keyslots of the volume key.
+
+func (c *cryptSetup) BackupHeader(devicePath string) ([]byte, error) {
+	// cryptsetup refuses to overwrite an existing backup file
+	dir, err := os.MkdirTemp(keyFileDir, "cryptsetup-header-")
+	if err != nil {
+		return nil, fmt.Errorf("creating header backup directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	backupFile := filepath.Join(dir, "header")
+
+	output, err := c.exec.Command(cryptsetupCmd, "luksHeaderBackup", "--batch-mode", devicePath, "--header-backup-file", backupFile).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("backing up LUKS2 header of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	header, err := os.ReadFile(backupFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading LUKS2 header backup of %s: %w", devicePath, err)
+	}
+	return header, nil
+}
+
+func (c *cryptSetup) RestoreHeader(devicePath string, header []byte) error {
+	backupFile, err := os.CreateTemp(keyFileDir, "cryptsetup-header-")
+	if err != nil {
+		return fmt.Errorf("creating header backup file: %w", err)
+	}
+	defer os.Remove(backupFile.Name())
+	_, err = backupFile.Write(header)
+	if closeErr := backupFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing header backup file: %w", err)
+	}
+
+	output, err := c.exec.Command(cryptsetupCmd, "luksHeaderRestore", "--batch-mode", devicePath, "--header-backup-file", backupFile.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("restoring LUKS2 header of %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cryptsetup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mapping describes an active dm-crypt mapping, as reported by cryptsetup status.
+type Mapping struct {
+	// Name is the name of the mapping below /dev/mapper.
+	Name string `json:"name"`
+	// Type is the type of the crypt header, e.g. "LUKS2".
+	Type string `json:"type"`
+	// Cipher is the cipher specification, e.g. "aes-xts-plain64".
+	Cipher string `json:"cipher"`
+	// KeySize is the size of the volume key in bits.
+	KeySize int `json:"keySize"`
+	// SectorSize is the encryption sector size in bytes.
+	SectorSize int `json:"sectorSize"`
+	// Integrity is the integrity algorithm, e.g. "hmac(sha256)", or empty
+	// if the mapping is not integrity protected.
+	Integrity string `json:"integrity,omitempty"`
+	// Device is the block device the mapping was opened on.
+	Device string `json:"device"`
+	// ReadOnly is set if the mapping was opened read-only.
+	ReadOnly bool `json:"readOnly"`
+	// InUse is set if the mapped device is held open, e.g. by a mounted file
+	// system or a loop device.
+	InUse bool `json:"inUse"`
+}
+
+func (c *cryptSetup) Mappings() ([]string, error) {
+	output, err := c.exec.Command(dmsetupCmd, "ls", "--target", "crypt").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("listing crypt mappings: output: %s, err: %w", string(output), err)
+	}
+	// Every mapping is listed as "<name>\t(<major>:<minor>)"
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "(") {
+			// Skips empty lines and the "No devices found" message
+			continue
+		}
+		names = append(names, fields[0])
+	}
+	return names, nil
+}
+
+func (c *cryptSetup) Mapping(name string) (*Mapping, error) {
+	output, err := c.exec.Command(cryptsetupCmd, "status", name).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("reading status of crypt mapping %s: output: %s, err: %w", name, string(output), err)
+	}
+
+	mapping := &Mapping{Name: name}
+	for i, line := range strings.Split(string(output), "\n") {
+		if i == 0 {
+			// The first line reports the state of the mapping, e.g. "/dev/mapper/<name> is active and is in use."
+			mapping.InUse = strings.Contains(line, "is in use")
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "type":
+			mapping.Type = value
+		case "cipher":
+			mapping.Cipher = value
+		case "keysize":
+			// The key size is reported as "512 bits"
+			size, _, _ := strings.Cut(value, " ")
+			if mapping.KeySize, err = strconv.Atoi(size); err != nil {
+				return nil, fmt.Errorf("parsing key size of crypt mapping %s: %w", name, err)
+			}
+		case "sector size":
+			if mapping.SectorSize, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("parsing sector size of crypt mapping %s: %w", name, err)
+			}
+		case "integrity":
+			mapping.Integrity = value
+		case "device":
+			mapping.Device = value
+		case "mode":
+			mapping.ReadOnly = value == "readonly"
+		}
+	}
+	if mapping.Device == "" {
+		return nil, fmt.Errorf("crypt mapping %s has no device: %q", name, string(output))
+	}
+	return mapping, nil
+}
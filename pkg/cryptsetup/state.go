@@ -0,0 +1,205 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stateFileSuffix = ".json"
+
+// Phase is the phase of a long running crypt operation.
+type Phase string
+
+const (
+	PhaseRunning  Phase = "Running"
+	PhaseComplete Phase = "Complete"
+	PhaseFailed   Phase = "Failed"
+)
+
+// VolumeState is the persisted state of long running crypt operations of a
+// single volume on the node. It never contains key material.
+type VolumeState struct {
+	// Name of the crypt mapping, which is also the name of the state file.
+	Name string `json:"name"`
+	// CSI volume ID the mapping belongs to.
+	VolumeID string `json:"volumeID"`
+	// Path of the LUKS2 formatted device backing the mapping.
+	DevicePath string `json:"devicePath"`
+	// Key derivation scope the volume key is requested in.
+	KeyScope string `json:"keyScope,omitempty"`
+	// Whether KeyScope is destroyed when the volume is deleted, so its keys
+	// must not be cached.
+	CryptoShred bool `json:"cryptoShred,omitempty"`
+	// Whether the mapping is backed by a dm-integrity device.
+	Integrity bool `json:"integrity,omitempty"`
+	// Integrity algorithm and encryption sector size requested for an
+	// integrity protected mapping, empty if the defaults were used. They give
+	// the usable size of the mapping after a resize.
+	IntegrityAlgorithm string `json:"integrityAlgorithm,omitempty"`
+	SectorSize         int    `json:"sectorSize,omitempty"`
+	// Whether the volume is a plain disk staged without a crypt mapping.
+	// DevicePath is then the path of the disk itself.
+	Unencrypted bool `json:"unencrypted,omitempty"`
+	// Staging target path of the volume, set once NodeStageVolume succeeded
+	// and cleared when NodeUnstageVolume starts. The mappings of staged
+	// volumes are in use even if nothing holds them open, e.g. raw block
+	// volumes between their stage and publish.
+	StagingTargetPath string `json:"stagingTargetPath,omitempty"`
+
+	Reencryption *OperationState `json:"reencryption,omitempty"`
+	// Wipe initializes the integrity tags of an integrity protected device,
+	// after formatting or of the region added by a resize.
+	Wipe *OperationState `json:"wipe,omitempty"`
+	// Import encrypts the data of an imported unencrypted disk in place.
+	Import *OperationState `json:"import,omitempty"`
+}
+
+// OperationState tracks the progress of a long running crypt operation.
+type OperationState struct {
+	Phase Phase `json:"phase"`
+	// Generation identifies the request which started the operation.
+	Generation string    `json:"generation,omitempty"`
+	BytesDone  uint64    `json:"bytesDone"`
+	BytesTotal uint64    `json:"bytesTotal"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// StateStore persists VolumeStates as JSON files in a directory on the node,
+// so operations can be resumed after a restart of the driver.
+type StateStore struct {
+	dir string
+	mux sync.Mutex
+}
+
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating crypt state directory %s: %w", dir, err)
+	}
+	return &StateStore{dir: dir}, nil
+}
+
+// Get returns the state stored for the mapping name, or nil if there is none.
+func (s *StateStore) Get(name string) (*VolumeState, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.read(name)
+}
+
+// Update atomically applies fn to the state stored for the mapping name. If no
+// state exists yet, fn is called with an empty state for name.
+func (s *StateStore) Update(name string, fn func(state *VolumeState)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	state, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &VolumeState{Name: name}
+	}
+	fn(state)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshalling crypt state of %s: %w", name, err)
+	}
+	tmp, err := os.CreateTemp(s.dir, name+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating crypt state file for %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing crypt state file for %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing crypt state file for %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing crypt state file for %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return fmt.Errorf("replacing crypt state file for %s: %w", name, err)
+	}
+	return nil
+}
+
+// Delete removes the state stored for the mapping name.
+func (s *StateStore) Delete(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing crypt state file for %s: %w", name, err)
+	}
+	return nil
+}
+
+// List returns all stored states.
+func (s *StateStore) List() ([]*VolumeState, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading crypt state directory %s: %w", s.dir, err)
+	}
+	var states []*VolumeState
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), stateFileSuffix) {
+			continue
+		}
+		state, err := s.read(strings.TrimSuffix(entry.Name(), stateFileSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+func (s *StateStore) read(name string) (*VolumeState, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading crypt state file for %s: %w", name, err)
+	}
+	state := &VolumeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing crypt state file for %s: %w", name, err)
+	}
+	return state, nil
+}
+
+func (s *StateStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name)+stateFileSuffix)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	store, err := NewStateStore(dir)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+
+	state, err := store.Get("disk-1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if state != nil {
+		t.Fatalf("expected no state for unknown volume, got %+v", state)
+	}
+
+	if err := store.Update("disk-1", func(state *VolumeState) {
+		state.VolumeID = "projects/p/zones/z/disks/disk-1"
+		state.Reencryption = &OperationState{Phase: PhaseRunning, Generation: "1"}
+	}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := store.Update("disk-1", func(state *VolumeState) {
+		state.Reencryption.BytesDone = 512
+	}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := store.Update("disk-2", func(state *VolumeState) {}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	// Stray files in the state directory are ignored
+	if err := os.WriteFile(filepath.Join(dir, "unrelated"), []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = store.Get("disk-1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if state.Name != "disk-1" || state.Reencryption.Generation != "1" || state.Reencryption.BytesDone != 512 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	states, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(states) != 2 {
+		t.Errorf("expected 2 states, got %d", len(states))
+	}
+
+	if err := store.Delete("disk-1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Delete("disk-1"); err != nil {
+		t.Fatalf("Delete() of missing state error = %v", err)
+	}
+	if state, _ := store.Get("disk-1"); state != nil {
+		t.Errorf("expected state to be deleted, got %+v", state)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cryptsetup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	dmsetupCmd = "dmsetup"
+
+	// integritySuffix is appended to the name of a crypt mapping by cryptsetup
+	// to name the dm-integrity mapping backing it.
+	integritySuffix = "_dif"
+)
+
+// sysBlockDir is where the kernel exposes block device attributes.
+var sysBlockDir = "/sys/block"
+
+// DeviceStatus is the health of a crypt mapping as reported by the kernel.
+type DeviceStatus struct {
+	// Active is set if the mapping exists.
+	Active bool
+	// Target is the device-mapper target of the mapping, "crypt" for intact mappings.
+	Target string
+	// Integrity is set if the mapping is backed by a dm-integrity mapping.
+	Integrity bool
+	// IntegrityMismatches is the number of sectors dm-integrity failed to verify
+	// since the mapping was activated.
+	IntegrityMismatches uint64
+	// Disk is the kernel name of the disk backing the mapping, e.g. "sdb".
+	Disk string
+	// IOErrors is the number of failed I/O requests of Disk, if the disk reports them.
+	IOErrors uint64
+}
+
+func (c *cryptSetup) Status(name string) (*DeviceStatus, error) {
+	target, _, active, err := c.dmStatus(name)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return &DeviceStatus{}, nil
+	}
+	status := &DeviceStatus{Active: true, Target: target}
+
+	lowest := name
+	target, fields, active, err := c.dmStatus(name + integritySuffix)
+	if err != nil {
+		return nil, err
+	}
+	if active && target == "integrity" {
+		// The status of an integrity target starts with the number of mismatches,
+		// see https://docs.kernel.org/admin-guide/device-mapper/dm-integrity.html
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("integrity mapping %s has no status", name+integritySuffix)
+		}
+		mismatches, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing integrity mismatches of %s: %w", name+integritySuffix, err)
+		}
+		status.Integrity = true
+		status.IntegrityMismatches = mismatches
+		lowest = name + integritySuffix
+	}
+
+	if status.Disk, err = c.dmDisk(lowest); err != nil {
+		return nil, err
+	}
+	if status.IOErrors, err = ioErrors(status.Disk); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// dmStatus returns the target and the target specific status fields of the
+// device-mapper mapping name, and whether the mapping exists.
+func (c *cryptSetup) dmStatus(name string) (string, []string, bool, error) {
+	output, err := c.exec.Command(dmsetupCmd, "status", name).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "does not exist") {
+			return "", nil, false, nil
+		}
+		return "", nil, false, fmt.Errorf("reading status of mapping %s: output: %s, err: %w", name, string(output), err)
+	}
+	// The status line is "<start> <length> <target> [<target status>...]"
+	fields := strings.Fields(strings.TrimSpace(string(output)))
+	if len(fields) < 3 {
+		return "", nil, false, fmt.Errorf("unexpected status of mapping %s: %q", name, string(output))
+	}
+	return fields[2], fields[3:], true, nil
+}
+
+// dmDisk returns the kernel name of the block device the mapping name is built on.
+func (c *cryptSetup) dmDisk(name string) (string, error) {
+	output, err := c.exec.Command(dmsetupCmd, "deps", "-o", "devname", name).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("reading dependencies of mapping %s: output: %s, err: %w", name, string(output), err)
+	}
+	// The dependencies are listed as " 1 dependencies  : (sdb)"
+	_, deps, ok := strings.Cut(string(output), "(")
+	disk, _, closed := strings.Cut(deps, ")")
+	if !ok || !closed || disk == "" {
+		return "", fmt.Errorf("unexpected dependencies of mapping %s: %q", name, string(output))
+	}
+	return disk, nil
+}
+
+// ioErrors returns the number of failed I/O requests of a SCSI disk. Disks
+// which do not count I/O errors, e.g. NVMe disks, report none.
+func ioErrors(disk string) (uint64, error) {
+	count, err := os.ReadFile(filepath.Join(sysBlockDir, disk, "device", "ioerr_cnt"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading I/O error count of %s: %w", disk, err)
+	}
+	// The count is formatted as a hexadecimal number, e.g. "0x2"
+	n, err := strconv.ParseUint(strings.TrimSpace(string(count)), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing I/O error count of %s: %w", disk, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cryptsetup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// wipeChunkSize is the size of a single write when wiping a device.
+	wipeChunkSize = 1 << 20
+	// wipeProgressInterval is how often a wipe syncs and reports its progress.
+	wipeProgressInterval = 10 * time.Second
+)
+
+func (c *cryptSetup) Wipe(ctx context.Context, devicePath string, offset uint64, progress ProgressFunc) error {
+	f, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", devicePath, err)
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("determining size of %s: %w", devicePath, err)
+	}
+	total := uint64(size)
+
+	// Restart at the beginning of the chunk which was interrupted
+	offset -= offset % wipeChunkSize
+	zeros := make([]byte, wipeChunkSize)
+	lastReport := time.Now()
+	for offset < total {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := min(uint64(wipeChunkSize), total-offset)
+		if _, err := f.WriteAt(zeros[:n], int64(offset)); err != nil {
+			return fmt.Errorf("wiping %s at offset %d: %w", devicePath, offset, err)
+		}
+		offset += n
+		if offset < total && time.Since(lastReport) < wipeProgressInterval {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("syncing %s: %w", devicePath, err)
+		}
+		lastReport = time.Now()
+		if progress != nil {
+			progress(offset, total)
+		}
+	}
+	return nil
+}
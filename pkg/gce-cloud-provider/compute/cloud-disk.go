@@ -267,3 +267,27 @@ func (d *CloudDisk) GetAccessMode() string {
 		return ""
 	}
 }
+
+// [Edgeless]
+func (d *CloudDisk) GetProvisionedIops() int64 {
+	switch {
+	case d.disk != nil:
+		return d.disk.ProvisionedIops
+	case d.betaDisk != nil:
+		return d.betaDisk.ProvisionedIops
+	default:
+		return 0
+	}
+}
+
+// [Edgeless]
+func (d *CloudDisk) GetProvisionedThroughput() int64 {
+	switch {
+	case d.disk != nil:
+		return d.disk.ProvisionedThroughput
+	case d.betaDisk != nil:
+		return d.betaDisk.ProvisionedThroughput
+	default:
+		return 0
+	}
+}
@@ -57,6 +57,8 @@ const (
 	BasePath                  = "https://www.googleapis.com/compute/v1/"
 	snapshotURITemplateGlobal = "projects/%s/global/snapshots/%s" //{gce.projectID}/global/snapshots/{snapshot.Name}"
 	imageURITemplateGlobal    = "projects/%s/global/images/%s"    //{gce.projectID}/global/images/{image.Name}"
+	// [Edgeless] highest IOPS of any disk type
+	maxProvisionedIOPS = 350000
 )
 
 var (
@@ -77,6 +79,9 @@ type FakeCloudProvider struct {
 	instances  map[string]*computev1.Instance
 	snapshots  map[string]*computev1.Snapshot
 	images     map[string]*computev1.Image
+	// [Edgeless] quotas are keyed by region, storagePools by zone and name
+	quotas       map[string][]*computev1.Quota
+	storagePools map[string]*computev1.StoragePool
 
 	// marker to set disk status during InsertDisk operation.
 	mockDiskStatus string
@@ -93,9 +98,19 @@ func CreateFakeCloudProvider(project, zone string, cloudDisks []*CloudDisk) (*Fa
 		snapshots:  map[string]*computev1.Snapshot{},
 		images:     map[string]*computev1.Image{},
 		pageTokens: map[string]sets.String{},
+		// [Edgeless]
+		quotas:       map[string][]*computev1.Quota{},
+		storagePools: map[string]*computev1.StoragePool{},
 		// A newly created disk is marked READY by default.
 		mockDiskStatus: "READY",
 	}
+	// [Edgeless] give the default region some disk quota
+	if region, err := common.GetRegionFromZones([]string{zone}); err == nil {
+		fcp.quotas[region] = []*computev1.Quota{
+			{Metric: "DISKS_TOTAL_GB", Limit: 4096},
+			{Metric: "SSD_TOTAL_GB", Limit: 2048},
+		}
+	}
 	for _, d := range cloudDisks {
 		diskZone := d.GetZone()
 		if diskZone == "" {
@@ -149,6 +164,20 @@ func (cloud *FakeCloudProvider) ListZones(ctx context.Context, region string) ([
 	return []string{cloud.zone, "country-region-fakesecondzone"}, nil
 }
 
+// [Edgeless]
+func (cloud *FakeCloudProvider) GetRegionQuotas(ctx context.Context, project, region string) ([]*computev1.Quota, error) {
+	return cloud.quotas[region], nil
+}
+
+// [Edgeless]
+func (cloud *FakeCloudProvider) GetStoragePool(ctx context.Context, project, zone, name string) (*computev1.StoragePool, error) {
+	sp, ok := cloud.storagePools[zone+"/"+name]
+	if !ok {
+		return nil, notFoundError()
+	}
+	return sp, nil
+}
+
 func (cloud *FakeCloudProvider) ListCompatibleDiskTypeZones(ctx context.Context, project string, zones []string, diskType string) ([]string, error) {
 	// Assume all zones are compatible
 	return zones, nil
@@ -177,12 +206,20 @@ func (cloud *FakeCloudProvider) ListInstances(ctx context.Context, fields []goog
 func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string) ([]*computev1.Snapshot, string, error) {
 	var sourceDisk string
 	snapshots := []*computev1.Snapshot{}
+	var labelKey, labelValue string
 	if len(filter) > 0 {
 		filterSplits := strings.Fields(filter)
-		if len(filterSplits) != 3 || filterSplits[0] != "sourceDisk" {
+		if len(filterSplits) != 3 {
+			return nil, "", invalidError()
+		}
+		switch {
+		case filterSplits[0] == "sourceDisk":
+			sourceDisk = filterSplits[2]
+		case strings.HasPrefix(filterSplits[0], "labels."):
+			labelKey, labelValue = strings.TrimPrefix(filterSplits[0], "labels."), filterSplits[2]
+		default:
 			return nil, "", invalidError()
 		}
-		sourceDisk = filterSplits[2]
 	}
 	for _, snapshot := range cloud.snapshots {
 		if len(sourceDisk) > 0 {
@@ -190,6 +227,9 @@ func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string
 				continue
 			}
 		}
+		if labelKey != "" && snapshot.Labels[labelKey] != labelValue {
+			continue
+		}
 		snapshots = append(snapshots, snapshot)
 	}
 
@@ -269,6 +309,17 @@ func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, project string,
 		default:
 			return fmt.Errorf("invalid snapshot type in snapshot ID: %s", snapshotType)
 		}
+	} else if params.DiskSource != "" {
+		// [Edgeless] create the disk from the image or snapshot of the disk-source parameter
+		_, sourceType, _, err := common.DiskSourceToProjectKey(params.DiskSource)
+		if err != nil {
+			return err
+		}
+		if sourceType == common.DiskSnapshotType {
+			computeDisk.SourceSnapshotId = params.DiskSource
+		} else {
+			computeDisk.SourceImageId = params.DiskSource
+		}
 	}
 
 	if params.DiskEncryptionKMSKey != "" {
@@ -302,11 +353,11 @@ func (cloud *FakeCloudProvider) DeleteDisk(ctx context.Context, project string,
 	return nil
 }
 
-func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
+func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, deviceName, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
 	source := cloud.GetDiskSourceURI(project, volKey)
 
 	attachedDiskV1 := &computev1.AttachedDisk{
-		DeviceName:  volKey.Name,
+		DeviceName:  deviceName,
 		Kind:        diskKind,
 		Mode:        readWrite,
 		Source:      source,
@@ -354,6 +405,52 @@ func (cloud *FakeCloudProvider) SetDiskAccessMode(ctx context.Context, project s
 	return nil
 }
 
+func (cloud *FakeCloudProvider) UpdateDisk(ctx context.Context, project string, volKey *meta.Key, existingDisk *CloudDisk, params common.ModifyVolumeParameters) error {
+	disk, ok := cloud.disks[volKey.String()]
+	if !ok {
+		return notFoundError()
+	}
+	// [Edgeless] GCE rejects IOPS out of the range of the disk type
+	if params.IOPS != nil && *params.IOPS > maxProvisionedIOPS {
+		return invalidError()
+	}
+
+	if params.IOPS != nil {
+		if disk.disk != nil {
+			disk.disk.ProvisionedIops = *params.IOPS
+		}
+		if disk.betaDisk != nil {
+			disk.betaDisk.ProvisionedIops = *params.IOPS
+		}
+	}
+	if params.Throughput != nil {
+		if disk.disk != nil {
+			disk.disk.ProvisionedThroughput = *params.Throughput
+		}
+		if disk.betaDisk != nil {
+			disk.betaDisk.ProvisionedThroughput = *params.Throughput
+		}
+	}
+
+	return nil
+}
+
+func (cloud *FakeCloudProvider) SetDiskLabels(ctx context.Context, project string, volKey *meta.Key, labels map[string]string) error {
+	disk, ok := cloud.disks[volKey.String()]
+	if !ok {
+		return notFoundError()
+	}
+
+	if disk.disk != nil {
+		disk.disk.Labels = mergeLabels(disk.disk.Labels, labels)
+	}
+	if disk.betaDisk != nil {
+		disk.betaDisk.Labels = mergeLabels(disk.betaDisk.Labels, labels)
+	}
+
+	return nil
+}
+
 func (cloud *FakeCloudProvider) GetDiskTypeURI(project string, volKey *meta.Key, diskType string) string {
 	switch volKey.Type() {
 	case meta.Zonal:
@@ -373,7 +470,7 @@ func (cloud *FakeCloudProvider) getRegionalDiskTypeURI(project, region, diskType
 	return fmt.Sprintf(diskTypeURITemplateRegional, project, region, diskType)
 }
 
-func (cloud *FakeCloudProvider) WaitForAttach(ctx context.Context, project string, volKey *meta.Key, diskType, instanceZone, instanceName string) error {
+func (cloud *FakeCloudProvider) WaitForAttach(ctx context.Context, project string, volKey *meta.Key, deviceName, diskType, instanceZone, instanceName string) error {
 	return nil
 }
 
@@ -459,12 +556,20 @@ func (cloud *FakeCloudProvider) DeleteSnapshot(ctx context.Context, project, sna
 func (cloud *FakeCloudProvider) ListImages(ctx context.Context, filter string) ([]*computev1.Image, string, error) {
 	var sourceDisk string
 	images := []*computev1.Image{}
+	var labelKey, labelValue string
 	if len(filter) > 0 {
 		filterSplits := strings.Fields(filter)
-		if len(filterSplits) != 3 || filterSplits[0] != "sourceDisk" {
+		if len(filterSplits) != 3 {
+			return nil, "", invalidError()
+		}
+		switch {
+		case filterSplits[0] == "sourceDisk":
+			sourceDisk = filterSplits[2]
+		case strings.HasPrefix(filterSplits[0], "labels."):
+			labelKey, labelValue = strings.TrimPrefix(filterSplits[0], "labels."), filterSplits[2]
+		default:
 			return nil, "", invalidError()
 		}
-		sourceDisk = filterSplits[2]
 	}
 	for _, image := range cloud.images {
 		if len(sourceDisk) > 0 {
@@ -472,6 +577,9 @@ func (cloud *FakeCloudProvider) ListImages(ctx context.Context, filter string) (
 				continue
 			}
 		}
+		if labelKey != "" && image.Labels[labelKey] != labelValue {
+			continue
+		}
 		images = append(images, image)
 	}
 
@@ -490,6 +598,24 @@ func (cloud *FakeCloudProvider) GetImage(ctx context.Context, project, imageName
 	return image, nil
 }
 
+// [Edgeless] GetImageFromFamily returns the newest non-deprecated image of the family.
+func (cloud *FakeCloudProvider) GetImageFromFamily(ctx context.Context, project, family string) (*computev1.Image, error) {
+	var latest *computev1.Image
+	for _, image := range cloud.images {
+		if image.Family != family || image.Deprecated != nil {
+			continue
+		}
+		if latest == nil || image.CreationTimestamp > latest.CreationTimestamp {
+			latest = image
+		}
+	}
+	if latest == nil {
+		return nil, notFoundError()
+	}
+	latest.Status = "READY"
+	return latest, nil
+}
+
 func (cloud *FakeCloudProvider) CreateImage(ctx context.Context, project string, volKey *meta.Key, imageName string, snapshotParams common.SnapshotParameters) (*computev1.Image, error) {
 	if image, ok := cloud.images[imageName]; ok {
 		return image, nil
@@ -584,6 +710,16 @@ func (cloud *FakeCloudProvider) UpdateDiskStatus(s string) {
 	cloud.mockDiskStatus = s
 }
 
+// [Edgeless] SetRegionQuotas replaces the quotas of region.
+func (cloud *FakeCloudProvider) SetRegionQuotas(region string, quotas []*computev1.Quota) {
+	cloud.quotas[region] = quotas
+}
+
+// [Edgeless] SetStoragePool adds or replaces a storage pool in zone.
+func (cloud *FakeCloudProvider) SetStoragePool(zone string, sp *computev1.StoragePool) {
+	cloud.storagePools[zone+"/"+sp.Name] = sp
+}
+
 type FakeBlockingCloudProvider struct {
 	*FakeCloudProvider
 	ReadyToExecute chan chan Signal
@@ -617,14 +753,14 @@ func (cloud *FakeBlockingCloudProvider) DetachDisk(ctx context.Context, project,
 	return cloud.FakeCloudProvider.DetachDisk(ctx, project, deviceName, instanceZone, instanceName)
 }
 
-func (cloud *FakeBlockingCloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
+func (cloud *FakeBlockingCloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, deviceName, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
 	execute := make(chan Signal)
 	cloud.ReadyToExecute <- execute
 	val := <-execute
 	if val.ReportError {
 		return fmt.Errorf("force mock error for AttachDisk: volkey %s", volKey)
 	}
-	return cloud.FakeCloudProvider.AttachDisk(ctx, project, volKey, readWrite, diskType, instanceZone, instanceName, forceAttach)
+	return cloud.FakeCloudProvider.AttachDisk(ctx, project, volKey, deviceName, readWrite, diskType, instanceZone, instanceName, forceAttach)
 }
 
 func notFoundError() *googleapi.Error {
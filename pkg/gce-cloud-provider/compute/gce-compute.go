@@ -104,13 +104,17 @@ type GCECompute interface {
 	ValidateExistingDisk(ctx context.Context, disk *CloudDisk, params common.DiskParameters, reqBytes, limBytes int64, multiWriter bool) error
 	InsertDisk(ctx context.Context, project string, volKey *meta.Key, params common.DiskParameters, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID string, volumeContentSourceVolumeID string, multiWriter bool, accessMode string) error
 	DeleteDisk(ctx context.Context, project string, volumeKey *meta.Key) error
-	AttachDisk(ctx context.Context, project string, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error
+	AttachDisk(ctx context.Context, project string, volKey *meta.Key, deviceName, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error
 	DetachDisk(ctx context.Context, project, deviceName, instanceZone, instanceName string) error
 	SetDiskAccessMode(ctx context.Context, project string, volKey *meta.Key, accessMode string) error
+	// [Edgeless] UpdateDisk changes the provisioned performance of a disk
+	UpdateDisk(ctx context.Context, project string, volKey *meta.Key, existingDisk *CloudDisk, params common.ModifyVolumeParameters) error
+	// [Edgeless] SetDiskLabels adds labels to a disk, keeping its other labels
+	SetDiskLabels(ctx context.Context, project string, volKey *meta.Key, labels map[string]string) error
 	ListCompatibleDiskTypeZones(ctx context.Context, project string, zones []string, diskType string) ([]string, error)
 	GetDiskSourceURI(project string, volKey *meta.Key) string
 	GetDiskTypeURI(project string, volKey *meta.Key, diskType string) string
-	WaitForAttach(ctx context.Context, project string, volKey *meta.Key, diskType, instanceZone, instanceName string) error
+	WaitForAttach(ctx context.Context, project string, volKey *meta.Key, deviceName, diskType, instanceZone, instanceName string) error
 	ResizeDisk(ctx context.Context, project string, volKey *meta.Key, requestBytes int64) (int64, error)
 	ListDisks(ctx context.Context, fields []googleapi.Field) ([]*computev1.Disk, string, error)
 	ListDisksWithFilter(ctx context.Context, fields []googleapi.Field, filter string) ([]*computev1.Disk, string, error)
@@ -121,12 +125,17 @@ type GCECompute interface {
 	GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*computev1.Instance, error)
 	// Zone Methods
 	ListZones(ctx context.Context, region string) ([]string, error)
+	// [Edgeless] Capacity Methods
+	GetRegionQuotas(ctx context.Context, project, region string) ([]*computev1.Quota, error)
+	GetStoragePool(ctx context.Context, project, zone, name string) (*computev1.StoragePool, error)
 	ListSnapshots(ctx context.Context, filter string) ([]*computev1.Snapshot, string, error)
 	GetSnapshot(ctx context.Context, project, snapshotName string) (*computev1.Snapshot, error)
 	CreateSnapshot(ctx context.Context, project string, volKey *meta.Key, snapshotName string, snapshotParams common.SnapshotParameters) (*computev1.Snapshot, error)
 	DeleteSnapshot(ctx context.Context, project, snapshotName string) error
 	ListImages(ctx context.Context, filter string) ([]*computev1.Image, string, error)
 	GetImage(ctx context.Context, project, imageName string) (*computev1.Image, error)
+	// [Edgeless] GetImageFromFamily returns the latest image of an image family
+	GetImageFromFamily(ctx context.Context, project, family string) (*computev1.Image, error)
 	CreateImage(ctx context.Context, project string, volKey *meta.Key, imageName string, snapshotParams common.SnapshotParameters) (*computev1.Image, error)
 	DeleteImage(ctx context.Context, project, imageName string) error
 }
@@ -305,6 +314,22 @@ func (cloud *CloudProvider) ListZones(ctx context.Context, region string) ([]str
 
 }
 
+// [Edgeless] GetRegionQuotas returns the quotas of the project in region.
+func (cloud *CloudProvider) GetRegionQuotas(ctx context.Context, project, region string) ([]*computev1.Quota, error) {
+	klog.V(5).Infof("Getting quotas of region %v", region)
+	r, err := cloud.service.Regions.Get(project, region).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get region %s: %w", region, err)
+	}
+	return r.Quotas, nil
+}
+
+// [Edgeless] GetStoragePool returns the storage pool name in zone.
+func (cloud *CloudProvider) GetStoragePool(ctx context.Context, project, zone, name string) (*computev1.StoragePool, error) {
+	klog.V(5).Infof("Getting storage pool %v in zone %v", name, zone)
+	return cloud.service.StoragePools.Get(project, zone, name).Context(ctx).Do()
+}
+
 func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string) ([]*computev1.Snapshot, string, error) {
 	klog.V(5).Infof("Listing snapshots with filter: %s", filter)
 	items := []*computev1.Snapshot{}
@@ -316,6 +341,8 @@ func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string) ([
 			return nil, "", err
 		}
 		items = append(items, snapshotList.Items...)
+		nextPageToken = snapshotList.NextPageToken
+		lCall.PageToken(nextPageToken)
 	}
 	return items, "", nil
 }
@@ -555,19 +582,9 @@ func (cloud *CloudProvider) insertRegionalDisk(
 		Type:        cloud.GetDiskTypeURI(cloud.project, volKey, params.DiskType),
 		Labels:      params.Labels,
 	}
-	if snapshotID != "" {
-		_, snapshotType, _, err := common.SnapshotIDToProjectKey(snapshotID)
-		if err != nil {
-			return err
-		}
-		switch snapshotType {
-		case common.DiskSnapshotType:
-			diskToCreate.SourceSnapshot = snapshotID
-		case common.DiskImageType:
-			diskToCreate.SourceImage = snapshotID
-		default:
-			return fmt.Errorf("invalid snapshot type in snapshot ID: %s", snapshotType)
-		}
+	// [Edgeless] set the source snapshot or image, including the disk-source parameter
+	if err := setDiskSource(diskToCreate, snapshotID, params.DiskSource); err != nil {
+		return err
 	}
 	if volumeContentSourceVolumeID != "" {
 		diskToCreate.SourceDisk = volumeContentSourceVolumeID
@@ -654,6 +671,37 @@ func (cloud *CloudProvider) insertRegionalDisk(
 	return nil
 }
 
+// [Edgeless] setDiskSource sets the source snapshot or image of a new disk,
+// either from the snapshot ID of a volume content source or from the
+// disk-source parameter.
+func setDiskSource(diskToCreate *computev1.Disk, snapshotID, diskSource string) error {
+	if snapshotID != "" {
+		_, snapshotType, _, err := common.SnapshotIDToProjectKey(snapshotID)
+		if err != nil {
+			return err
+		}
+		switch snapshotType {
+		case common.DiskSnapshotType:
+			diskToCreate.SourceSnapshot = snapshotID
+		case common.DiskImageType:
+			diskToCreate.SourceImage = snapshotID
+		default:
+			return fmt.Errorf("invalid snapshot type in snapshot ID: %s", snapshotType)
+		}
+	} else if diskSource != "" {
+		_, sourceType, _, err := common.DiskSourceToProjectKey(diskSource)
+		if err != nil {
+			return err
+		}
+		if sourceType == common.DiskSnapshotType {
+			diskToCreate.SourceSnapshot = diskSource
+		} else {
+			diskToCreate.SourceImage = diskSource
+		}
+	}
+	return nil
+}
+
 func (cloud *CloudProvider) insertZonalDisk(
 	ctx context.Context,
 	project string,
@@ -698,19 +746,9 @@ func (cloud *CloudProvider) insertZonalDisk(
 		diskToCreate.StoragePool = sp.ResourceName
 	}
 
-	if snapshotID != "" {
-		_, snapshotType, _, err := common.SnapshotIDToProjectKey(snapshotID)
-		if err != nil {
-			return err
-		}
-		switch snapshotType {
-		case common.DiskSnapshotType:
-			diskToCreate.SourceSnapshot = snapshotID
-		case common.DiskImageType:
-			diskToCreate.SourceImage = snapshotID
-		default:
-			return fmt.Errorf("invalid snapshot type in snapshot ID: %s", snapshotType)
-		}
+	// [Edgeless] set the source snapshot or image, including the disk-source parameter
+	if err := setDiskSource(diskToCreate, snapshotID, params.DiskSource); err != nil {
+		return err
 	}
 	if volumeContentSourceVolumeID != "" {
 		diskToCreate.SourceDisk = volumeContentSourceVolumeID
@@ -847,14 +885,12 @@ func (cloud *CloudProvider) deleteRegionalDisk(ctx context.Context, project, reg
 	return nil
 }
 
-func (cloud *CloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
+// [Edgeless] AttachDisk attaches the disk volKey as deviceName, which is
+// usually common.GetDeviceName(volKey).
+func (cloud *CloudProvider) AttachDisk(ctx context.Context, project string, volKey *meta.Key, deviceName, readWrite, diskType, instanceZone, instanceName string, forceAttach bool) error {
 	klog.V(5).Infof("Attaching disk %v to %s", volKey, instanceName)
 	source := cloud.GetDiskSourceURI(project, volKey)
 
-	deviceName, err := common.GetDeviceName(volKey)
-	if err != nil {
-		return fmt.Errorf("failed to get device name: %w", err)
-	}
 	attachedDiskV1 := &computev1.AttachedDisk{
 		DeviceName: deviceName,
 		Kind:       diskKind,
@@ -930,6 +966,113 @@ func (cloud *CloudProvider) SetDiskAccessMode(ctx context.Context, project strin
 	return nil
 }
 
+// [Edgeless] UpdateDisk sets the provisioned IOPS and throughput of params on
+// the disk volKey. Parameters that are not set or already have the values of
+// existingDisk are left unchanged.
+func (cloud *CloudProvider) UpdateDisk(ctx context.Context, project string, volKey *meta.Key, existingDisk *CloudDisk, params common.ModifyVolumeParameters) error {
+	diskMask := &computev1.Disk{Name: volKey.Name}
+	var paths []string
+	if params.IOPS != nil && *params.IOPS != existingDisk.GetProvisionedIops() {
+		diskMask.ProvisionedIops = *params.IOPS
+		paths = append(paths, "provisionedIops")
+	}
+	if params.Throughput != nil && *params.Throughput != existingDisk.GetProvisionedThroughput() {
+		diskMask.ProvisionedThroughput = *params.Throughput
+		paths = append(paths, "provisionedThroughput")
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	switch volKey.Type() {
+	case meta.Zonal:
+		op, err := cloud.service.Disks.Update(project, volKey.Zone, volKey.Name, diskMask).Context(ctx).Paths(paths...).Do()
+		if err != nil {
+			return fmt.Errorf("failed to update zonal volume %v: %w", volKey, err)
+		}
+		klog.V(5).Infof("UpdateDisk operation %s for disk %s", op.Name, volKey.Name)
+
+		err = cloud.waitForZonalOp(ctx, project, op.Name, volKey.Zone)
+		if err != nil {
+			return fmt.Errorf("failed waiting for op for zonal disk update for %v: %w", volKey, err)
+		}
+	case meta.Regional:
+		op, err := cloud.service.RegionDisks.Update(project, volKey.Region, volKey.Name, diskMask).Context(ctx).Paths(paths...).Do()
+		if err != nil {
+			return fmt.Errorf("failed to update regional volume %v: %w", volKey, err)
+		}
+		klog.V(5).Infof("UpdateDisk operation %s for disk %s", op.Name, volKey.Name)
+
+		err = cloud.waitForRegionalOp(ctx, project, op.Name, volKey.Region)
+		if err != nil {
+			return fmt.Errorf("failed waiting for op for regional disk update for %v: %w", volKey, err)
+		}
+	default:
+		return fmt.Errorf("volume key %v not zonal nor regional", volKey.Name)
+	}
+
+	return nil
+}
+
+// [Edgeless] SetDiskLabels adds labels to the disk volKey, replacing the values of
+// existing labels with the same keys and keeping all other labels.
+func (cloud *CloudProvider) SetDiskLabels(ctx context.Context, project string, volKey *meta.Key, labels map[string]string) error {
+	switch volKey.Type() {
+	case meta.Zonal:
+		disk, err := cloud.getZonalDiskOrError(ctx, project, volKey.Zone, volKey.Name)
+		if err != nil {
+			return err
+		}
+		req := &computev1.ZoneSetLabelsRequest{
+			Labels:           mergeLabels(disk.Labels, labels),
+			LabelFingerprint: disk.LabelFingerprint,
+		}
+		op, err := cloud.service.Disks.SetLabels(project, volKey.Zone, volKey.Name, req).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to set labels for zonal volume %v: %w", volKey, err)
+		}
+		klog.V(5).Infof("SetDiskLabels operation %s for disk %s", op.Name, volKey.Name)
+
+		err = cloud.waitForZonalOp(ctx, project, op.Name, volKey.Zone)
+		if err != nil {
+			return fmt.Errorf("failed waiting for op for zonal disk set labels for %v: %w", volKey, err)
+		}
+	case meta.Regional:
+		disk, err := cloud.getRegionalDiskOrError(ctx, project, volKey.Region, volKey.Name)
+		if err != nil {
+			return err
+		}
+		req := &computev1.RegionSetLabelsRequest{
+			Labels:           mergeLabels(disk.Labels, labels),
+			LabelFingerprint: disk.LabelFingerprint,
+		}
+		op, err := cloud.service.RegionDisks.SetLabels(project, volKey.Region, volKey.Name, req).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to set labels for regional volume %v: %w", volKey, err)
+		}
+		klog.V(5).Infof("SetDiskLabels operation %s for disk %s", op.Name, volKey.Name)
+
+		err = cloud.waitForRegionalOp(ctx, project, op.Name, volKey.Region)
+		if err != nil {
+			return fmt.Errorf("failed waiting for op for regional disk set labels for %v: %w", volKey, err)
+		}
+	default:
+		return fmt.Errorf("volume key %v not zonal nor regional", volKey.Name)
+	}
+
+	return nil
+}
+
+func mergeLabels(existing, labels map[string]string) map[string]string {
+	merged := make(map[string]string, len(existing)+len(labels))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
 func (cloud *CloudProvider) ListCompatibleDiskTypeZones(ctx context.Context, project string, zones []string, diskType string) ([]string, error) {
 	diskTypeFilter := fmt.Sprintf("name=%s", diskType)
 	filters := []string{diskTypeFilter}
@@ -1046,7 +1189,7 @@ func (cloud *CloudProvider) waitForGlobalOp(ctx context.Context, project, opName
 	})
 }
 
-func (cloud *CloudProvider) waitForAttachOnInstance(ctx context.Context, project string, volKey *meta.Key, instanceZone, instanceName string) error {
+func (cloud *CloudProvider) waitForAttachOnInstance(ctx context.Context, project string, volKey *meta.Key, deviceName, instanceZone, instanceName string) error {
 	klog.V(5).Infof("Waiting for attach of disk %v to instance %v to complete...", volKey.Name, instanceName)
 	start := time.Now()
 	return wait.ExponentialBackoff(AttachDiskBackoff, func() (bool, error) {
@@ -1061,11 +1204,6 @@ func (cloud *CloudProvider) waitForAttachOnInstance(ctx context.Context, project
 		}
 
 		for _, disk := range instance.Disks {
-			deviceName, err := common.GetDeviceName(volKey)
-			if err != nil {
-				return false, fmt.Errorf("failed to get disk device name for %s: %w", volKey, err)
-			}
-
 			if deviceName == disk.DeviceName {
 				return true, nil
 			}
@@ -1097,9 +1235,9 @@ func (cloud *CloudProvider) waitForAttachOnDisk(ctx context.Context, project str
 	})
 }
 
-func (cloud *CloudProvider) WaitForAttach(ctx context.Context, project string, volKey *meta.Key, diskType, instanceZone, instanceName string) error {
+func (cloud *CloudProvider) WaitForAttach(ctx context.Context, project string, volKey *meta.Key, deviceName, diskType, instanceZone, instanceName string) error {
 	if cloud.waitForAttachConfig.ShouldUseGetInstanceAPI(diskType) {
-		return cloud.waitForAttachOnInstance(ctx, project, volKey, instanceZone, instanceName)
+		return cloud.waitForAttachOnInstance(ctx, project, volKey, deviceName, instanceZone, instanceName)
 	} else {
 		return cloud.waitForAttachOnDisk(ctx, project, volKey, instanceZone, instanceName)
 	}
@@ -1291,6 +1429,16 @@ func (cloud *CloudProvider) GetImage(ctx context.Context, project, imageName str
 	return image, nil
 }
 
+// [Edgeless] GetImageFromFamily returns the latest non-deprecated image of an image family.
+func (cloud *CloudProvider) GetImageFromFamily(ctx context.Context, project, family string) (*computev1.Image, error) {
+	klog.V(5).Infof("Getting image from family %v", family)
+	image, err := cloud.service.Images.GetFromFamily(project, family).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
 func (cloud *CloudProvider) ListImages(ctx context.Context, filter string) ([]*computev1.Image, string, error) {
 	klog.V(5).Infof("Listing images with filter: %s", filter)
 	var items []*computev1.Image
@@ -1302,6 +1450,8 @@ func (cloud *CloudProvider) ListImages(ctx context.Context, filter string) ([]*c
 			return nil, "", err
 		}
 		items = append(items, imageList.Items...)
+		nextPageToken = imageList.NextPageToken
+		lCall.PageToken(nextPageToken)
 	}
 	return items, "", nil
 }
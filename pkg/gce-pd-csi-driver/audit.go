@@ -0,0 +1,50 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+// auditContext returns a copy of ctx carrying the volume, this node and the pod
+// info of volumeContext, which are recorded in the audit events of operations
+// using ctx. Only the volume context of NodePublishVolume requests holds pod
+// info.
+func (ns *GCENodeServer) auditContext(ctx context.Context, volumeID string, volumeContext map[string]string) context.Context {
+	if ns.auditor == nil {
+		return ctx
+	}
+	return audit.WithVolume(ctx, audit.Volume{
+		ID:     volumeID,
+		NodeID: common.CreateNodeID(ns.MetadataService.GetProject(), ns.MetadataService.GetZone(), ns.MetadataService.GetName()),
+		Pod:    audit.PodFromVolumeContext(volumeContext),
+	})
+}
+
+// emitAudit records the result of a crypt operation in the audit log.
+func (ns *GCENodeServer) emitAudit(ctx context.Context, operation string, err error) {
+	if ns.auditor == nil {
+		return
+	}
+	if emitErr := ns.auditor.Emit(ctx, audit.NewEvent(ctx, operation, err)); emitErr != nil {
+		klog.Errorf("Failed to record %s in the audit log: %v", operation, emitErr)
+	}
+}
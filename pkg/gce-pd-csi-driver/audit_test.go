@@ -0,0 +1,108 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
+	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+func TestNodeStageVolumeAudit(t *testing.T) {
+	emitter := audit.NewFakeEmitter()
+	gceDriver := GetGCEDriver()
+	mounter := mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec(""))
+	meta := metadataservice.NewFakeService()
+	cryptSetup := cryptsetup.NewFakeCryptSetup()
+	cryptSetup.NotLUKS[defaultLUKSDevicePath] = true
+	store, err := cryptsetup.NewStateStore(filepath.Join(t.TempDir(), "crypt-state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := NewNodeServer(gceDriver, mounter, deviceutils.NewFakeDeviceUtils(false), meta, mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{}, kms.NewStaticKMS(make([]byte, 32)), cryptSetup, emitter).WithCryptStateStore(store)
+	if err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nil, ns); err != nil {
+		t.Fatalf("Failed to setup GCE Driver: %v", err)
+	}
+
+	req := rekeyStageRequest(t, "")
+	req.VolumeContext = map[string]string{
+		common.VolumeAttributeKeyScope:   "tenant-a",
+		common.VolumeAttributeSectorSize: "512",
+	}
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	// The kubelet only adds the pod info to the volume context of NodePublishVolume
+	publishContext := map[string]string{
+		"csi.storage.k8s.io/pod.name":            "app",
+		"csi.storage.k8s.io/pod.namespace":       "default",
+		"csi.storage.k8s.io/serviceAccount.name": "app-sa",
+	}
+	for k, v := range req.GetVolumeContext() {
+		publishContext[k] = v
+	}
+	targetPath := filepath.Join(t.TempDir(), "target")
+	if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: req.GetStagingTargetPath(),
+		TargetPath:        targetPath,
+		VolumeCapability:  req.GetVolumeCapability(),
+		VolumeContext:     publishContext,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: defaultVolumeID, TargetPath: targetPath}); err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %v", err)
+	}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: defaultVolumeID, StagingTargetPath: req.GetStagingTargetPath()}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+
+	nodeID := common.CreateNodeID(meta.GetProject(), meta.GetZone(), meta.GetName())
+	events := emitter.Events()
+	wantOperations := []string{audit.OperationKeyRequest, audit.OperationOpen, audit.OperationPublish, audit.OperationClose}
+	if len(events) != len(wantOperations) {
+		t.Fatalf("expected %d audit events, got %+v", len(wantOperations), events)
+	}
+	for i, event := range events {
+		if event.Operation != wantOperations[i] || event.Result != audit.ResultSuccess {
+			t.Errorf("expected successful %s event, got %+v", wantOperations[i], event)
+		}
+		if event.VolumeID != defaultVolumeID || event.NodeID != nodeID {
+			t.Errorf("expected event for volume %s on node %s, got %+v", defaultVolumeID, nodeID, event)
+		}
+	}
+	keyRequest := events[0]
+	if keyRequest.KeyScope != "tenant-a" || keyRequest.KeyID == "" {
+		t.Errorf("expected key request in scope tenant-a, got %+v", keyRequest)
+	}
+	if keyRequest.Pod != nil {
+		t.Errorf("expected no pod info in events of NodeStageVolume, got %+v", keyRequest.Pod)
+	}
+	if pod := events[2].Pod; pod == nil || pod.Name != "app" || pod.Namespace != "default" || pod.ServiceAccount != "app-sa" {
+		t.Errorf("expected pod info of the publish volume context, got %+v", pod)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/edgelesssys/constellation/v2/csi/cryptmapper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+// integrityMetadataReserve is the space reserved for the dm-integrity
+// superblock and journal. The kernel sizes the journal at 1/128 of the device,
+// but at most 64 MiB, the rest is left for the superblock and alignment.
+const integrityMetadataReserve = 65 << 20
+
+// integrityTagSizes are the bytes of metadata dm-integrity stores per sector
+// for each integrity algorithm. The authenticated encryption modes store a
+// 16 byte tag and a 12 byte random IV.
+var integrityTagSizes = map[string]int64{
+	"hmac-sha256": 32,
+	"hmac-sha512": 64,
+	"aead":        28,
+	"poly1305":    28,
+}
+
+// cryptOverhead describes how much of a disk is not usable by the crypt
+// mapping of a volume.
+type cryptOverhead struct {
+	// fixed is the overhead independent of the disk size in bytes.
+	fixed int64
+	// sectorSize and tagSize give the per sector overhead of integrity
+	// protection, tagSize is 0 without it.
+	sectorSize int64
+	tagSize    int64
+}
+
+// newCryptOverhead returns the overhead of the crypt mapping of a volume
+// created with params and capabilities caps, or nil if the disk is not to be
+// over-provisioned for it.
+func newCryptOverhead(params common.DiskParameters, caps []*csi.VolumeCapability) *cryptOverhead {
+	if !params.ProvisionCryptOverhead || params.Encryption == common.EncryptionNone {
+		return nil
+	}
+	o := &cryptOverhead{fixed: cryptmapper.LUKSHeaderSize}
+	if algorithm := integrityAlgorithm(params, caps); algorithm != "" {
+		o.fixed += integrityMetadataReserve
+		o.sectorSize = int64(params.SectorSize)
+		if o.sectorSize == 0 {
+			o.sectorSize = cryptsetup.DefaultSectorSize
+		}
+		o.tagSize = integrityTagSizes[algorithm]
+	}
+	return o
+}
+
+// integrityAlgorithm returns the integrity algorithm of a volume created with
+// params and capabilities caps, or "" if it is not integrity protected.
+func integrityAlgorithm(params common.DiskParameters, caps []*csi.VolumeCapability) string {
+	if params.Encryption == common.EncryptionNone {
+		return ""
+	}
+	if params.IntegrityAlgorithm != "" {
+		return params.IntegrityAlgorithm
+	}
+	for _, cap := range caps {
+		if _, integrity := cryptmapper.IsIntegrityFS(cap.GetMount().GetFsType()); integrity {
+			return cryptsetup.DefaultIntegrity
+		}
+	}
+	return ""
+}
+
+// diskBytes returns the size of a disk with usable bytes of usable capacity.
+func (o *cryptOverhead) diskBytes(usable int64) int64 {
+	if o.tagSize != 0 {
+		sectors := (usable + o.sectorSize - 1) / o.sectorSize
+		usable = sectors * (o.sectorSize + o.tagSize)
+	}
+	return usable + o.fixed
+}
+
+// usableBytes returns the usable capacity of a disk of diskBytes.
+func (o *cryptOverhead) usableBytes(diskBytes int64) int64 {
+	usable := diskBytes - o.fixed
+	if o.tagSize != 0 {
+		usable = usable / (o.sectorSize + o.tagSize) * o.sectorSize
+	}
+	return max(usable, 0)
+}
+
+// diskRange returns the capacity range of the disk backing a volume with
+// capacity range capRange. Disks are sized in whole GB, so the limit is
+// rounded up, otherwise a disk with the required capacity could exceed it.
+func (o *cryptOverhead) diskRange(capRange *csi.CapacityRange) *csi.CapacityRange {
+	if capRange == nil {
+		return nil
+	}
+	diskRange := &csi.CapacityRange{}
+	if capRange.GetRequiredBytes() > 0 {
+		diskRange.RequiredBytes = o.diskBytes(capRange.GetRequiredBytes())
+	}
+	if capRange.GetLimitBytes() > 0 {
+		diskRange.LimitBytes = common.GbToBytes(common.BytesToGbRoundUp(o.diskBytes(capRange.GetLimitBytes())))
+	}
+	return diskRange
+}
+
+// diskQuotaMetrics are the regional quota metrics the disk types count
+// against. Hyperdisks are only tracked in storage pools.
+var diskQuotaMetrics = map[string]string{
+	"pd-standard": "DISKS_TOTAL_GB",
+	"pd-balanced": "SSD_TOTAL_GB",
+	"pd-ssd":      "SSD_TOTAL_GB",
+	"pd-extreme":  "SSD_TOTAL_GB",
+}
+
+// quotaCapacity returns the bytes of disks with params that can still be
+// created in zone before exceeding the quota of its region. The capacity of
+// disk types which are only tracked in storage pools is unknown outside of
+// them, no capacity is reported for them, so the external-provisioner
+// publishes no CSIStorageCapacity object instead of one with no capacity.
+func (gceCS *GCEControllerServer) quotaCapacity(ctx context.Context, params common.DiskParameters, zone string) (int64, error) {
+	metric, ok := diskQuotaMetrics[params.DiskType]
+	if !ok {
+		klog.V(4).Infof("Capacity of disk type %q is only tracked in storage pools, reporting no capacity in zone %s", params.DiskType, zone)
+		return 0, status.Error(codes.Unimplemented, fmt.Sprintf("capacity of disk type %q is only tracked in storage pools", params.DiskType))
+	}
+	region, err := common.GetRegionFromZones([]string{zone})
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get region of zone %q: %v", zone, err.Error()))
+	}
+	quotas, err := gceCS.CloudProvider.GetRegionQuotas(ctx, gceCS.CloudProvider.GetDefaultProject(), region)
+	if err != nil {
+		return 0, common.LoggedError("Failed to get region quotas: ", err)
+	}
+	for _, quota := range quotas {
+		if quota.Metric != metric {
+			continue
+		}
+		availableGb := int64(quota.Limit - quota.Usage)
+		// regional disks are charged for both replicas
+		if params.ReplicationType == replicationTypeRegionalPD {
+			availableGb /= 2
+		}
+		return common.GbToBytes(max(availableGb, 0)), nil
+	}
+	return 0, status.Error(codes.Unavailable, fmt.Sprintf("region %s reports no %s quota", region, metric))
+}
+
+// storagePoolCapacity returns the unprovisioned bytes of the storage pool in
+// zone, or 0 if none of storagePools is in zone.
+func (gceCS *GCEControllerServer) storagePoolCapacity(ctx context.Context, storagePools []common.StoragePool, zone string) (int64, error) {
+	sp := common.StoragePoolInZone(storagePools, zone)
+	if sp == nil {
+		return 0, nil
+	}
+	pool, err := gceCS.CloudProvider.GetStoragePool(ctx, sp.Project, sp.Zone, sp.Name)
+	if err != nil {
+		return 0, common.LoggedError("Failed to get storage pool: ", err)
+	}
+	availableGb := pool.PoolProvisionedCapacityGb
+	if pool.ResourceStatus != nil {
+		availableGb -= pool.ResourceStatus.TotalProvisionedDiskCapacityGb
+	}
+	return common.GbToBytes(max(availableGb, 0)), nil
+}
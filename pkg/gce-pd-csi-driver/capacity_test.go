@@ -0,0 +1,265 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	computev1 "google.golang.org/api/compute/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+func TestCreateVolumeCryptOverhead(t *testing.T) {
+	integrityCaps := createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	integrityCaps[0].GetMount().FsType = "ext4-integrity"
+
+	testCases := []struct {
+		name       string
+		params     map[string]string
+		caps       []*csi.VolumeCapability
+		capRange   *csi.CapacityRange
+		expDiskGb  int64
+		expCapSame bool
+	}{
+		{
+			name:       "not over-provisioned by default",
+			params:     map[string]string{},
+			capRange:   &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			expDiskGb:  10,
+			expCapSame: true,
+		},
+		{
+			name:      "LUKS2 header",
+			params:    map[string]string{common.ParameterKeyProvisionCryptOverhead: "true"},
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			expDiskGb: 11,
+		},
+		{
+			name:      "integrity requested with the fstype",
+			params:    map[string]string{common.ParameterKeyProvisionCryptOverhead: "true"},
+			caps:      integrityCaps,
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(100)},
+			expDiskGb: 101,
+		},
+		{
+			name: "integrity algorithm with large tags",
+			params: map[string]string{
+				common.ParameterKeyProvisionCryptOverhead: "true",
+				common.ParameterKeyIntegrityAlgorithm:     "hmac-sha512",
+				common.ParameterKeySectorSize:             "512",
+			},
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(100)},
+			expDiskGb: 113,
+		},
+		{
+			name:      "limit is applied to the usable capacity",
+			params:    map[string]string{common.ParameterKeyProvisionCryptOverhead: "true"},
+			capRange:  &csi.CapacityRange{RequiredBytes: common.GbToBytes(10), LimitBytes: common.GbToBytes(10)},
+			expDiskGb: 11,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver := initGCEDriver(t, nil)
+			caps := tc.caps
+			if caps == nil {
+				caps = stdVolCaps
+			}
+			tc.params[common.ParameterKeyType] = "test-type"
+			resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      tc.capRange,
+				VolumeCapabilities: caps,
+				Parameters:         tc.params,
+			})
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			_, volKey, err := common.VolumeIDToKey(resp.GetVolume().GetVolumeId())
+			if err != nil {
+				t.Fatal(err)
+			}
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, volKey, gce.GCEAPIVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disk.GetSizeGb() != tc.expDiskGb {
+				t.Errorf("expected a disk of %d GB, got %d GB", tc.expDiskGb, disk.GetSizeGb())
+			}
+			gotCap := resp.GetVolume().GetCapacityBytes()
+			if gotCap < tc.capRange.GetRequiredBytes() {
+				t.Errorf("expected at least the required %d bytes to be usable, got %d", tc.capRange.GetRequiredBytes(), gotCap)
+			}
+			if tc.expCapSame != (gotCap == common.GbToBytes(disk.GetSizeGb())) {
+				t.Errorf("unexpected capacity %d of disk with %d GB", gotCap, disk.GetSizeGb())
+			}
+
+			// Creating the volume again succeeds with the existing disk
+			if _, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      tc.capRange,
+				VolumeCapabilities: caps,
+				Parameters:         tc.params,
+			}); err != nil {
+				t.Errorf("CreateVolume of existing volume failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestCryptOverheadUsableBytes(t *testing.T) {
+	overheads := map[string]*cryptOverhead{
+		"header":    {fixed: 16 << 20},
+		"integrity": {fixed: 16<<20 + integrityMetadataReserve, sectorSize: 4096, tagSize: 32},
+		"aead":      {fixed: 16<<20 + integrityMetadataReserve, sectorSize: 512, tagSize: 28},
+	}
+	for name, o := range overheads {
+		t.Run(name, func(t *testing.T) {
+			for _, usable := range []int64{1, 4096, common.GbToBytes(1) + 1, common.GbToBytes(64 << 10)} {
+				if got := o.usableBytes(o.diskBytes(usable)); got < usable {
+					t.Errorf("expected disk of %d usable bytes to have at least %d, got %d", usable, usable, got)
+				}
+			}
+			if got := o.usableBytes(o.fixed - 1); got != 0 {
+				t.Errorf("expected a disk smaller than the overhead to have no usable bytes, got %d", got)
+			}
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	const pool = "projects/test-project/zones/country-region-zone/storagePools/pool-1"
+	zoneTopology := func(zone string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{common.TopologyKeyZone: zone}}
+	}
+
+	testCases := []struct {
+		name       string
+		params     map[string]string
+		caps       []*csi.VolumeCapability
+		topology   *csi.Topology
+		expBytes   int64
+		expErrCode codes.Code
+	}{
+		{
+			name:     "standard disk quota",
+			params:   map[string]string{},
+			expBytes: common.GbToBytes(1000),
+		},
+		{
+			name:     "ssd quota in requested zone",
+			params:   map[string]string{common.ParameterKeyType: "pd-balanced"},
+			topology: zoneTopology(zone),
+			expBytes: common.GbToBytes(200),
+		},
+		{
+			name:     "regional disks are charged twice",
+			params:   map[string]string{common.ParameterKeyType: "pd-ssd", common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+			expBytes: common.GbToBytes(100),
+		},
+		{
+			name:     "exhausted quota",
+			params:   map[string]string{common.ParameterKeyType: "pd-standard"},
+			topology: zoneTopology("country-otherregion-zone"),
+			expBytes: 0,
+		},
+		{
+			name:     "crypt overhead is not usable",
+			params:   map[string]string{common.ParameterKeyProvisionCryptOverhead: "true"},
+			expBytes: (&cryptOverhead{fixed: 16 << 20}).usableBytes(common.GbToBytes(1000)),
+		},
+		{
+			name:     "storage pool",
+			params:   map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyStoragePools: pool},
+			topology: zoneTopology(zone),
+			expBytes: common.GbToBytes(3000),
+		},
+		{
+			name:     "no storage pool in zone",
+			params:   map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyStoragePools: pool},
+			topology: zoneTopology("country-region-otherzone"),
+			expBytes: 0,
+		},
+		{
+			name:       "hyperdisk without storage pool",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-balanced"},
+			expErrCode: codes.Unimplemented,
+		},
+		{
+			name:       "hyperdisk throughput without storage pool",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-throughput"},
+			topology:   zoneTopology(zone),
+			expErrCode: codes.Unimplemented,
+		},
+		{
+			name:       "topology without zone",
+			params:     map[string]string{},
+			topology:   &csi.Topology{Segments: map[string]string{"other": "segment"}},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "invalid parameters",
+			params:     map[string]string{"unknown": "parameter"},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver := initGCEDriver(t, nil)
+			gceDriver.cs.enableStoragePools = true
+			fcp := gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider)
+			fcp.SetRegionQuotas("country-region", []*computev1.Quota{
+				{Metric: "DISKS_TOTAL_GB", Limit: 4096, Usage: 3096},
+				{Metric: "SSD_TOTAL_GB", Limit: 500, Usage: 300},
+			})
+			fcp.SetRegionQuotas("country-otherregion", []*computev1.Quota{
+				{Metric: "DISKS_TOTAL_GB", Limit: 100, Usage: 120},
+			})
+			fcp.SetStoragePool(zone, &computev1.StoragePool{
+				Name:                      "pool-1",
+				PoolProvisionedCapacityGb: 10240,
+				ResourceStatus:            &computev1.StoragePoolResourceStatus{TotalProvisionedDiskCapacityGb: 7240},
+			})
+
+			resp, err := gceDriver.cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+				VolumeCapabilities: tc.caps,
+				Parameters:         tc.params,
+				AccessibleTopology: tc.topology,
+			})
+			if tc.expErrCode != codes.OK {
+				if status.Code(err) != tc.expErrCode {
+					t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+				}
+				if resp != nil {
+					t.Errorf("expected no capacity, got %v", resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetCapacity failed: %v", err)
+			}
+			if resp.GetAvailableCapacity() != tc.expBytes {
+				t.Errorf("expected %d available bytes, got %d", tc.expBytes, resp.GetAvailableCapacity())
+			}
+		})
+	}
+}
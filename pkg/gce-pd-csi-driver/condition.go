@@ -0,0 +1,96 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// ioErrorCounts records the I/O error count of the disk of each crypt mapping
+// at its last health check. The kernel counts the errors of a disk since it
+// was attached, only errors reported after the last check make a volume abnormal.
+type ioErrorCounts struct {
+	mux    sync.Mutex
+	counts map[string]ioErrorCount
+}
+
+type ioErrorCount struct {
+	disk  string
+	count uint64
+}
+
+// since records count as the I/O error count of disk backing the mapping name
+// and returns the number of errors since the last call.
+func (c *ioErrorCounts) since(name, disk string, count uint64) uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]ioErrorCount{}
+	}
+	last, ok := c.counts[name]
+	c.counts[name] = ioErrorCount{disk: disk, count: count}
+	if !ok || last.disk != disk || count < last.count {
+		return count
+	}
+	return count - last.count
+}
+
+// forget drops the count of the mapping name when its volume is unstaged.
+func (c *ioErrorCounts) forget(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.counts, name)
+}
+
+// volumeCondition inspects the crypt mapping name of a staged volume. The
+// volume is reported as abnormal if the mapping is gone or was replaced, if
+// dm-integrity failed to verify data read from the disk, which indicates
+// tampering or corruption, or if the disk reported I/O errors since the last
+// check. Plain volumes have no crypt mapping, no condition is reported for them.
+func (ns *GCENodeServer) volumeCondition(name string) *csi.VolumeCondition {
+	if plainDevicePath, err := ns.plainDevicePath(name); err != nil || plainDevicePath != "" {
+		return nil
+	}
+	status, err := ns.CryptSetup.Status(name)
+	if err != nil {
+		// Failing to inspect the mapping says nothing about the health of the volume
+		klog.Warningf("Failed to inspect crypt mapping %s: %v", name, err)
+		return nil
+	}
+
+	var problems []string
+	if !status.Active {
+		problems = append(problems, fmt.Sprintf("crypt mapping %s is not active", name))
+	} else if status.Target != "crypt" {
+		problems = append(problems, fmt.Sprintf("crypt mapping %s was replaced by a %s mapping", name, status.Target))
+	}
+	if status.IntegrityMismatches > 0 {
+		problems = append(problems, fmt.Sprintf("dm-integrity detected %d integrity mismatches, data on the disk may have been tampered with or corrupted", status.IntegrityMismatches))
+	}
+	if ioErrors := ns.ioErrors.since(name, status.Disk, status.IOErrors); ioErrors > 0 {
+		problems = append(problems, fmt.Sprintf("disk %s reported %d I/O errors since the last check", status.Disk, ioErrors))
+	}
+
+	if len(problems) == 0 {
+		return &csi.VolumeCondition{Message: "crypt mapping is healthy"}
+	}
+	return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+}
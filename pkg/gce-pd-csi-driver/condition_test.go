@@ -0,0 +1,98 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+func TestVolumeCondition(t *testing.T) {
+	testCases := []struct {
+		name        string
+		status      *cryptsetup.DeviceStatus
+		expAbnormal bool
+		expMessage  string
+	}{
+		{
+			name:       "healthy mapping",
+			status:     &cryptsetup.DeviceStatus{Active: true, Target: "crypt", Integrity: true, Disk: "sdb"},
+			expMessage: "crypt mapping is healthy",
+		},
+		{
+			name:        "mapping not active",
+			status:      &cryptsetup.DeviceStatus{},
+			expAbnormal: true,
+			expMessage:  "crypt mapping testDisk is not active",
+		},
+		{
+			name:        "mapping replaced",
+			status:      &cryptsetup.DeviceStatus{Active: true, Target: "error", Disk: "sdb"},
+			expAbnormal: true,
+			expMessage:  "crypt mapping testDisk was replaced by a error mapping",
+		},
+		{
+			name:        "integrity mismatches",
+			status:      &cryptsetup.DeviceStatus{Active: true, Target: "crypt", Integrity: true, IntegrityMismatches: 3, Disk: "sdb"},
+			expAbnormal: true,
+			expMessage:  "dm-integrity detected 3 integrity mismatches, data on the disk may have been tampered with or corrupted",
+		},
+		{
+			name:        "integrity mismatches and I/O errors",
+			status:      &cryptsetup.DeviceStatus{Active: true, Target: "crypt", Integrity: true, IntegrityMismatches: 1, Disk: "sdb", IOErrors: 2},
+			expAbnormal: true,
+			expMessage:  "dm-integrity detected 1 integrity mismatches, data on the disk may have been tampered with or corrupted; disk sdb reported 2 I/O errors since the last check",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+			cryptSetup.Statuses["testDisk"] = tc.status
+
+			condition := gceDriver.ns.volumeCondition("testDisk")
+			if condition.GetAbnormal() != tc.expAbnormal {
+				t.Errorf("expected abnormal %v, got %v", tc.expAbnormal, condition.GetAbnormal())
+			}
+			if condition.GetMessage() != tc.expMessage {
+				t.Errorf("expected message %q, got %q", tc.expMessage, condition.GetMessage())
+			}
+		})
+	}
+}
+
+func TestVolumeConditionIOErrorsSinceLastCheck(t *testing.T) {
+	gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	checks := []struct {
+		disk        string
+		ioErrors    uint64
+		expAbnormal bool
+	}{
+		{disk: "sdb", ioErrors: 2, expAbnormal: true},
+		{disk: "sdb", ioErrors: 2},
+		{disk: "sdb", ioErrors: 3, expAbnormal: true},
+		{disk: "sdb", ioErrors: 3},
+		// The volume was moved to another disk
+		{disk: "sdc", ioErrors: 1, expAbnormal: true},
+	}
+	for i, check := range checks {
+		cryptSetup.Statuses["testDisk"] = &cryptsetup.DeviceStatus{Active: true, Target: "crypt", Disk: check.disk, IOErrors: check.ioErrors}
+		if abnormal := ns.volumeCondition("testDisk").GetAbnormal(); abnormal != check.expAbnormal {
+			t.Errorf("check %d: expected abnormal %v, got %v", i, check.expAbnormal, abnormal)
+		}
+	}
+}
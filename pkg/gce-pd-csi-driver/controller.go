@@ -40,10 +40,13 @@ import (
 
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/metrics"
 )
 
 type GCEControllerServer struct {
+	csi.UnimplementedControllerServer // [Edgeless]
+
 	Driver        *GCEDriver
 	CloudProvider gce.GCECompute
 	Metrics       metrics.MetricsManager
@@ -108,6 +111,17 @@ type GCEControllerServer struct {
 	multiZoneVolumeHandleConfig MultiZoneVolumeHandleConfig
 
 	listVolumesConfig ListVolumesConfig
+
+	// [Edgeless] keyDestroyer destroys the key scope of crypto-shredded
+	// volumes when they are deleted.
+	keyDestroyer kms.KeyDestroyer
+}
+
+// [Edgeless] WithKeyDestroyer sets the key destroyer used to crypto-shred
+// deleted volumes.
+func (gceCS *GCEControllerServer) WithKeyDestroyer(destroyer kms.KeyDestroyer) *GCEControllerServer {
+	gceCS.keyDestroyer = destroyer
+	return gceCS
 }
 
 type MultiZoneVolumeHandleConfig struct {
@@ -328,6 +342,10 @@ func (gceCS *GCEControllerServer) createVolumeInternal(ctx context.Context, req
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "failed to extract parameters: %v", err.Error())
 	}
+	// [Edgeless] The parameters of a VolumeAttributesClass are only applied by ControllerModifyVolume
+	if len(req.GetMutableParameters()) > 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume does not support mutable parameters, apply them with ControllerModifyVolume")
+	}
 	// Validate multiwriter
 	if _, err := getMultiWriterFromCapabilities(volumeCapabilities); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapabilities is invalid: %v", err.Error())
@@ -342,7 +360,7 @@ func (gceCS *GCEControllerServer) createVolumeInternal(ctx context.Context, req
 
 	// Validate VolumeContentSource is set when access mode is read only
 	readonly, _ := getReadOnlyFromCapabilities(volumeCapabilities)
-	if readonly && req.GetVolumeContentSource() == nil {
+	if readonly && req.GetVolumeContentSource() == nil && params.DiskSource == "" { // [Edgeless] or a disk source
 		return nil, status.Error(codes.InvalidArgument, "VolumeContentSource must be provided when AccessMode is set to read only")
 	}
 
@@ -357,6 +375,29 @@ func (gceCS *GCEControllerServer) createVolumeInternal(ctx context.Context, req
 		return nil, status.Errorf(codes.InvalidArgument, "invalid availabilty class for zonal disk")
 	}
 
+	// [Edgeless] Crypto-shredded disks are encrypted in a key scope of their own
+	params, err = gceCS.applyCryptoShred(req, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// [Edgeless] Integrity protected disks can't be re-keyed online
+	if integrityAlgorithm(params, volumeCapabilities) != "" {
+		params.Labels[common.IntegrityLabel] = "true"
+	}
+
+	// [Edgeless] Disks created from a content source are encrypted with the key of their source
+	params, err = gceCS.applySourceKeyScope(ctx, req, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// [Edgeless] Disks created from a disk source hold the plaintext data of the source
+	params, err = gceCS.validateDiskSource(ctx, req, params, readonly)
+	if err != nil {
+		return nil, err
+	}
+
 	if gceCS.multiZoneVolumeHandleConfig.Enable && params.MultiZoneProvisioning {
 		// Create multi-zone disk, that may have up to N disks.
 		return gceCS.createMultiZoneDisk(ctx, req, params)
@@ -366,6 +407,185 @@ func (gceCS *GCEControllerServer) createVolumeInternal(ctx context.Context, req
 	return gceCS.createSingleDeviceDisk(ctx, req, params)
 }
 
+// [Edgeless] applyCryptoShred puts volumes that are crypto-shredded on
+// deletion into a key scope named after their disk, so destroying the scope
+// affects no other volume. Volumes created from a content source are
+// rewrapped into that scope.
+func (gceCS *GCEControllerServer) applyCryptoShred(req *csi.CreateVolumeRequest, params common.DiskParameters) (common.DiskParameters, error) {
+	if params.CryptoShred == "" {
+		return params, nil
+	}
+	if gceCS.keyDestroyer == nil {
+		return params, status.Error(codes.FailedPrecondition, fmt.Sprintf("CreateVolume failed: the %s parameter requires a key management backend that can destroy keys", common.ParameterKeyCryptoShred))
+	}
+	params.KeyScope = req.GetName()
+	params.RewrapKey = req.GetVolumeContentSource() != nil
+	labels := make(map[string]string, len(params.Labels)+1)
+	for k, v := range params.Labels {
+		labels[k] = v
+	}
+	labels[common.KeyScopeLabel] = params.KeyScope
+	params.Labels = labels
+	return params, nil
+}
+
+// [Edgeless] validateDiskSource checks the image or snapshot of the
+// disk-source parameter. Its data is plaintext, which the node plugin encrypts
+// in place when the volume is first published, so it must not be combined with
+// a volume content source or encrypted by this driver already. Image families
+// are resolved to their latest image, so the disk is created from the image
+// that was checked.
+func (gceCS *GCEControllerServer) validateDiskSource(ctx context.Context, req *csi.CreateVolumeRequest, params common.DiskParameters, readonly bool) (common.DiskParameters, error) {
+	if params.DiskSource == "" {
+		return params, nil
+	}
+	if req.GetVolumeContentSource() != nil {
+		return params, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed: the %s parameter cannot be combined with a volume content source", common.ParameterKeyDiskSource))
+	}
+	if readonly && params.Encryption != common.EncryptionNone {
+		return params, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed: read only volumes from the %s parameter must set %s %q, the data of encrypted volumes is encrypted in place", common.ParameterKeyDiskSource, common.ParameterKeyEncryption, common.EncryptionNone))
+	}
+	project, sourceType, key, err := common.DiskSourceToProjectKey(params.DiskSource)
+	if err != nil {
+		return params, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed: invalid %s parameter: %v", common.ParameterKeyDiskSource, err))
+	}
+	var sourceLabels map[string]string
+	if sourceType == common.DiskSnapshotType {
+		snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, project, key)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				return params, status.Error(codes.NotFound, fmt.Sprintf("CreateVolume failed: disk source snapshot %s not found", params.DiskSource))
+			}
+			return params, common.LoggedError("CreateVolume failed to get disk source snapshot "+params.DiskSource+": ", err)
+		}
+		sourceLabels = snapshot.Labels
+	} else {
+		var image *compute.Image
+		if family, ok := strings.CutPrefix(key, "family/"); ok {
+			image, err = gceCS.CloudProvider.GetImageFromFamily(ctx, project, family)
+		} else {
+			image, err = gceCS.CloudProvider.GetImage(ctx, project, key)
+		}
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				return params, status.Error(codes.NotFound, fmt.Sprintf("CreateVolume failed: disk source image %s not found", params.DiskSource))
+			}
+			return params, common.LoggedError("CreateVolume failed to get disk source image "+params.DiskSource+": ", err)
+		}
+		sourceLabels = image.Labels
+		params.DiskSource = fmt.Sprintf("projects/%s/global/%s/%s", project, common.DiskImageType, image.Name)
+	}
+	if _, ok := sourceLabels[common.KeyScopeLabel]; ok {
+		return params, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed: disk source %s is encrypted by this driver, restore it from a VolumeSnapshot instead", params.DiskSource))
+	}
+	return params, nil
+}
+
+// [Edgeless] applySourceKeyScope sets the key scope of a volume created from a
+// content source to the scope recorded on the source snapshot, image or disk,
+// so the node plugin requests the key the data was encrypted with. If the key
+// is rewrapped, the volume keeps its own scope and the source scope is
+// recorded to unlock the volume before rewrapping. Volumes restored or cloned
+// from an encrypted source are encrypted as well, plain sources are refused
+// unless the volume is plain.
+// Missing sources are reported when creating the disk.
+func (gceCS *GCEControllerServer) applySourceKeyScope(ctx context.Context, req *csi.CreateVolumeRequest, params common.DiskParameters) (common.DiskParameters, error) {
+	content := req.GetVolumeContentSource()
+	if content == nil {
+		// Fresh volumes are always encrypted with their own key
+		params.RewrapKey = false
+		return params, nil
+	}
+
+	var sourceLabels map[string]string
+	if content.GetSnapshot() != nil {
+		snapshotID := content.GetSnapshot().GetSnapshotId()
+		project, snapshotType, key, err := common.SnapshotIDToProjectKey(snapshotID)
+		if err != nil {
+			return params, nil
+		}
+		switch snapshotType {
+		case common.DiskSnapshotType:
+			snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, project, key)
+			if err != nil {
+				if gce.IsGCEError(err, "notFound") {
+					return params, nil
+				}
+				return params, common.LoggedError("CreateVolume failed to get snapshot "+snapshotID+": ", err)
+			}
+			sourceLabels = snapshot.Labels
+		case common.DiskImageType:
+			image, err := gceCS.CloudProvider.GetImage(ctx, project, key)
+			if err != nil {
+				if gce.IsGCEError(err, "notFound") {
+					return params, nil
+				}
+				return params, common.LoggedError("CreateVolume failed to get image "+snapshotID+": ", err)
+			}
+			sourceLabels = image.Labels
+		}
+	}
+	if content.GetVolume() != nil {
+		project, sourceVolKey, err := common.VolumeIDToKey(content.GetVolume().GetVolumeId())
+		if err != nil {
+			return params, nil
+		}
+		disk, err := gceCS.CloudProvider.GetDisk(ctx, project, sourceVolKey, gce.GCEAPIVersionV1)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				return params, nil
+			}
+			return params, common.LoggedError("CreateVolume, getDisk error when validating: ", err)
+		}
+		sourceLabels = disk.GetLabels()
+	}
+
+	plainSource := sourceLabels[common.EncryptionLabel] == common.EncryptionNone
+	if plainSource && params.Encryption != common.EncryptionNone {
+		// The data would be exposed on a volume its users expect to be encrypted
+		return params, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed: volume content source is not encrypted, restore it with %s %q or import it with the %s parameter", common.ParameterKeyEncryption, common.EncryptionNone, common.ParameterKeyDiskSource))
+	}
+	if !plainSource && params.Encryption == common.EncryptionNone {
+		klog.V(4).Infof("CreateVolume using encryption of the volume content source")
+		params = withEncryption(params)
+	}
+
+	sourceScope := sourceLabels[common.KeyScopeLabel]
+	if params.RewrapKey {
+		// The node plugin moves the volume to its own key in its own scope
+		params.SourceKeyScope = sourceScope
+		return params, nil
+	}
+	if sourceScope == params.KeyScope {
+		return params, nil
+	}
+	klog.V(4).Infof("CreateVolume using key scope %q of the volume content source instead of %q", sourceScope, params.KeyScope)
+	params.KeyScope = sourceScope
+	labels := make(map[string]string, len(params.Labels))
+	for k, v := range params.Labels {
+		labels[k] = v
+	}
+	delete(labels, common.KeyScopeLabel)
+	if sourceScope != "" {
+		labels[common.KeyScopeLabel] = sourceScope
+	}
+	params.Labels = labels
+	return params, nil
+}
+
+// [Edgeless] withEncryption returns a copy of params for a LUKS2 encrypted
+// volume, dropping the encryption label of plain volumes.
+func withEncryption(params common.DiskParameters) common.DiskParameters {
+	labels := make(map[string]string, len(params.Labels))
+	for k, v := range params.Labels {
+		labels[k] = v
+	}
+	delete(labels, common.EncryptionLabel)
+	params.Encryption = ""
+	params.Labels = labels
+	return params
+}
+
 func (gceCS *GCEControllerServer) getSupportedZonesForPDType(ctx context.Context, zones []string, diskType string) ([]string, error) {
 	project := gceCS.CloudProvider.GetDefaultProject()
 	zones, err := gceCS.CloudProvider.ListCompatibleDiskTypeZones(ctx, project, zones, diskType)
@@ -464,7 +684,7 @@ func (gceCS *GCEControllerServer) createMultiZoneDisk(ctx context.Context, req *
 	// Use the first response as a template
 	volumeId := fmt.Sprintf("projects/%s/zones/%s/disks/%s", gceCS.CloudProvider.GetDefaultProject(), common.MultiZoneValue, req.GetName())
 	klog.V(4).Infof("CreateVolume succeeded for multi-zone disks in zones %s: %v", zones, multiZoneVolKey)
-	return generateCreateVolumeResponseWithVolumeId(createdDisks[0], zones, params, volumeId), nil
+	return generateCreateVolumeResponseWithVolumeId(createdDisks[0], zones, params, req.GetVolumeCapabilities(), volumeId), nil
 }
 
 func (gceCS *GCEControllerServer) getZonesWithDiskNameAndType(ctx context.Context, name string, diskType string) ([]string, error) {
@@ -560,12 +780,17 @@ func (gceCS *GCEControllerServer) createSingleDeviceDisk(ctx context.Context, re
 		return nil, common.LoggedError("CreateVolume failed: %v", err)
 	}
 
-	return generateCreateVolumeResponseWithVolumeId(disk, zones, params, volumeID), err
+	return generateCreateVolumeResponseWithVolumeId(disk, zones, params, req.GetVolumeCapabilities(), volumeID), err
 }
 
 func (gceCS *GCEControllerServer) createSingleDisk(ctx context.Context, req *csi.CreateVolumeRequest, params common.DiskParameters, volKey *meta.Key, zones []string) (*gce.CloudDisk, error) {
 	capacityRange := req.GetCapacityRange()
 	capBytes, _ := getRequestCapacity(capacityRange)
+	// [Edgeless] make the requested capacity usable by the crypt mapping
+	if overhead := newCryptOverhead(params, req.GetVolumeCapabilities()); overhead != nil {
+		capacityRange = overhead.diskRange(capacityRange)
+		capBytes = overhead.diskBytes(capBytes)
+	}
 	multiWriter, _ := getMultiWriterFromCapabilities(req.GetVolumeCapabilities())
 	readonly, _ := getReadOnlyFromCapabilities(req.GetVolumeCapabilities())
 	accessMode := ""
@@ -804,7 +1029,7 @@ func (gceCS *GCEControllerServer) deleteSingleDeviceDisk(ctx context.Context, re
 		gceCS.Metrics.RecordOperationErrorMetrics("DeleteVolume", err, diskTypeForMetric, enableConfidentialCompute, enableStoragePools)
 	}()
 	volumeID := req.GetVolumeId()
-	project, volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			klog.Warningf("DeleteVolume treating volume as deleted because cannot find volume %v: %v", volumeID, err.Error())
@@ -817,8 +1042,19 @@ func (gceCS *GCEControllerServer) deleteSingleDeviceDisk(ctx context.Context, re
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer gceCS.volumeLocks.Release(volumeID)
-	disk, _ := gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
+	disk, getErr := gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
 	diskTypeForMetric, enableConfidentialCompute, enableStoragePools = metrics.GetMetricParameters(disk)
+	// [Edgeless] Destroy the key of crypto-shredded disks before the disk, so
+	// a failed deletion is retried with the key already gone
+	if getErr != nil && !gce.IsGCENotFoundError(getErr) {
+		err = getErr
+		return nil, common.LoggedError("DeleteVolume failed to get disk: ", err)
+	}
+	if getErr == nil {
+		if err = gceCS.cryptoShred(ctx, project, volKey, disk); err != nil {
+			return nil, err
+		}
+	}
 	err = gceCS.CloudProvider.DeleteDisk(ctx, project, volKey)
 	if err != nil {
 		return nil, common.LoggedError("Failed to delete disk: ", err)
@@ -828,6 +1064,77 @@ func (gceCS *GCEControllerServer) deleteSingleDeviceDisk(ctx context.Context, re
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// [Edgeless] cryptoShred destroys the key scope of a disk created with the
+// crypto-shred parameter. Snapshots, images and other disks still encrypted
+// in the scope become unreadable, so the deletion is refused while they exist
+// unless the crypto-shred mode is force.
+func (gceCS *GCEControllerServer) cryptoShred(ctx context.Context, project string, volKey *meta.Key, disk *gce.CloudDisk) error {
+	labels := disk.GetLabels()
+	mode := labels[common.CryptoShredLabel]
+	if mode == "" {
+		return nil
+	}
+	scope := labels[common.KeyScopeLabel]
+	if scope == "" {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume failed: disk %s is labeled for crypto-shredding but has no key scope", volKey.Name))
+	}
+	if gceCS.keyDestroyer == nil {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume failed: disk %s is labeled for crypto-shredding but no key management backend can destroy keys", volKey.Name))
+	}
+
+	dependents, err := gceCS.keyScopeDependents(ctx, scope, disk)
+	if err != nil {
+		return common.LoggedError("DeleteVolume failed to list resources encrypted in key scope "+scope+": ", err)
+	}
+	if len(dependents) > 0 {
+		if mode != common.CryptoShredForce {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume failed: key scope %q of disk %s is still used by %s", scope, volKey.Name, strings.Join(dependents, ", ")))
+		}
+		klog.Warningf("DeleteVolume destroying key scope %q of disk %s, which is still used by %s", scope, volKey.Name, strings.Join(dependents, ", "))
+	}
+
+	if err := gceCS.keyDestroyer.DestroyKeyScope(ctx, scope); err != nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("DeleteVolume failed to destroy key scope %q of disk %s: %v", scope, volKey.Name, err))
+	}
+	klog.V(4).Infof("DeleteVolume destroyed key scope %q of disk %s", scope, volKey.Name)
+	return nil
+}
+
+// [Edgeless] keyScopeDependents returns the snapshots, images and disks other
+// than disk that are encrypted in the given key scope.
+func (gceCS *GCEControllerServer) keyScopeDependents(ctx context.Context, scope string, disk *gce.CloudDisk) ([]string, error) {
+	filter := fmt.Sprintf("labels.%s = %s", common.KeyScopeLabel, scope)
+	var dependents []string
+	snapshots, _, err := gceCS.CloudProvider.ListSnapshots(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Labels[common.KeyScopeLabel] == scope {
+			dependents = append(dependents, "snapshot "+snapshot.Name)
+		}
+	}
+	images, _, err := gceCS.CloudProvider.ListImages(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		if image.Labels[common.KeyScopeLabel] == scope {
+			dependents = append(dependents, "image "+image.Name)
+		}
+	}
+	disks, _, err := gceCS.CloudProvider.ListDisksWithFilter(ctx, []googleapi.Field{"items/name", "items/selfLink", "items/labels", "nextPageToken"}, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range disks {
+		if d.Labels[common.KeyScopeLabel] == scope && d.SelfLink != disk.GetSelfLink() {
+			dependents = append(dependents, "disk "+d.Name)
+		}
+	}
+	return dependents, nil
+}
+
 func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	var err error
 	diskTypeForMetric := metrics.DefaultDiskTypeForMetric
@@ -977,7 +1284,10 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 		volKey = convertMultiZoneVolKeyToZoned(volKey, instanceZone)
 	}
 
-	project, volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	// [Edgeless] The node derives the device path from the volume ID, so a
+	// converted disk is attached as the device of the zonal disk
+	deviceKey := volKey
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			return nil, status.Errorf(codes.NotFound, "ControllerPublishVolume could not find volume with ID %v: %v", volumeID, err.Error()), nil
@@ -999,6 +1309,10 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 		}
 		return nil, common.LoggedError("Failed to getDisk: ", err), disk
 	}
+	// [Edgeless] The data of a disk converted to a regional disk is copied from a snapshot
+	if disk.GetLabels()[common.ConvertingLabel] != "" {
+		return nil, status.Errorf(codes.Unavailable, "Disk %v is being converted to a regional disk", volKey.String()), disk
+	}
 	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
@@ -1018,7 +1332,7 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 		readWrite = "READ_ONLY"
 	}
 
-	deviceName, err := common.GetDeviceName(volKey)
+	deviceName, err := common.GetDeviceName(deviceKey)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error getting device name: %v", err.Error()), disk
 	}
@@ -1029,6 +1343,9 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 	}
 	if attached {
 		// Volume is attached to node. Success!
+		if pubVolResp.PublishContext, err = gceCS.publishContext(ctx, project, volKey, disk, req.GetVolumeContext()); err != nil {
+			return nil, common.LoggedError("Failed to build publish context: ", err), disk
+		}
 		klog.V(4).Infof("ControllerPublishVolume succeeded for disk %v to instance %v, already attached.", volKey, nodeID)
 		return pubVolResp, nil, disk
 	}
@@ -1039,7 +1356,7 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not split nodeID: %v", err.Error()), disk
 	}
-	err = gceCS.CloudProvider.AttachDisk(ctx, project, volKey, readWrite, attachableDiskTypePersistent, instanceZone, instanceName, pdcsiContext.ForceAttach)
+	err = gceCS.CloudProvider.AttachDisk(ctx, project, volKey, deviceName, readWrite, attachableDiskTypePersistent, instanceZone, instanceName, pdcsiContext.ForceAttach)
 	if err != nil {
 		var udErr *gce.UnsupportedDiskError
 		if errors.As(err, &udErr) {
@@ -1051,15 +1368,54 @@ func (gceCS *GCEControllerServer) executeControllerPublishVolume(ctx context.Con
 		return nil, common.LoggedError("Failed to Attach: ", err), disk
 	}
 
-	err = gceCS.CloudProvider.WaitForAttach(ctx, project, volKey, disk.GetPDType(), instanceZone, instanceName)
+	err = gceCS.CloudProvider.WaitForAttach(ctx, project, volKey, deviceName, disk.GetPDType(), instanceZone, instanceName)
 	if err != nil {
 		return nil, common.LoggedError("Errored during WaitForAttach: ", err), disk
 	}
+	if pubVolResp.PublishContext, err = gceCS.publishContext(ctx, project, volKey, disk, req.GetVolumeContext()); err != nil {
+		return nil, common.LoggedError("Failed to build publish context: ", err), disk
+	}
 
 	klog.V(4).Infof("ControllerPublishVolume succeeded for disk %v to instance %v", volKey, nodeID)
 	return pubVolResp, nil, disk
 }
 
+// [Edgeless] publishContext returns the publish context of a disk, passing the
+// in-place encryption of imported disks and the re-key generation requested
+// through ControllerModifyVolume to the node plugin.
+func (gceCS *GCEControllerServer) publishContext(ctx context.Context, project string, volKey *meta.Key, disk *gce.CloudDisk, volumeContext map[string]string) (map[string]string, error) {
+	publishContext, err := gceCS.importPublishContext(ctx, project, volKey, disk, volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	if generation := disk.GetLabels()[common.RekeyGenerationLabel]; generation != "" {
+		if publishContext == nil {
+			publishContext = map[string]string{}
+		}
+		publishContext[common.VolumeAttributeRekeyGeneration] = generation
+	}
+	return publishContext, nil
+}
+
+// [Edgeless] importPublishContext returns the publish context allowing the node
+// plugin to encrypt the unencrypted disk of a volume imported with the
+// import-plaintext volume attribute in place. The disk is labeled when it is
+// first handed out for the import, so the import is never started twice: the
+// node plugin only encrypts labeled disks which still hold plaintext data.
+func (gceCS *GCEControllerServer) importPublishContext(ctx context.Context, project string, volKey *meta.Key, disk *gce.CloudDisk, volumeContext map[string]string) (map[string]string, error) {
+	if importPlaintext, _ := common.ConvertStringToBool(volumeContext[common.VolumeAttributeImportPlaintext]); !importPlaintext {
+		return nil, nil
+	}
+	if _, ok := disk.GetLabels()[common.ImportedLabel]; ok {
+		return nil, nil
+	}
+	if err := gceCS.CloudProvider.SetDiskLabels(ctx, project, volKey, map[string]string{common.ImportedLabel: "true"}); err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Handing out disk %v for in-place encryption", volKey)
+	return map[string]string{common.VolumeAttributeImportPlaintext: "true"}, nil
+}
+
 func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	var err error
 	diskTypeForMetric := metrics.DefaultDiskTypeForMetric
@@ -1128,7 +1484,9 @@ func (gceCS *GCEControllerServer) executeControllerUnpublishVolume(ctx context.C
 		volKey = convertMultiZoneVolKeyToZoned(volKey, instanceZone)
 	}
 
-	project, volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	// [Edgeless] Converted disks are attached as the device of the zonal disk
+	deviceKey := volKey
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			klog.Warningf("Treating volume %v as unpublished because it could not be found", volumeID)
@@ -1155,7 +1513,7 @@ func (gceCS *GCEControllerServer) executeControllerUnpublishVolume(ctx context.C
 		return nil, common.LoggedError("error getting instance: ", err), diskToUnpublish
 	}
 
-	deviceName, err := common.GetDeviceName(volKey)
+	deviceName, err := common.GetDeviceName(deviceKey)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error getting device name: %v", err.Error()), diskToUnpublish
 	}
@@ -1204,7 +1562,7 @@ func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context
 		return nil, status.Errorf(codes.InvalidArgument, "Volume ID is invalid: %v", err.Error())
 	}
 
-	project, volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
 			return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities could not find volume with ID %v: %v", volumeID, err.Error())
@@ -1255,9 +1613,66 @@ func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context
 	}, nil
 }
 
-// TODO(#809): Implement logic and advertise related capabilities.
+// [Edgeless] ControllerGetVolume reports the capacity, the nodes a volume is
+// published to and its condition. Disks that were deleted out from under a
+// volume or have failed are reported as abnormal, so the external health
+// monitor can raise an event for them.
 func (gceCS *GCEControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not implemented")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+	project, volKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerGetVolume Volume ID is invalid: %v", err.Error())
+	}
+	if gceCS.multiZoneVolumeHandleConfig.Enable && isMultiZoneVolKey(volKey) {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerGetVolume is not supported with the multi-zone PV volumeHandle feature, volume %v", volumeID)
+	}
+
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
+	if err == nil {
+		var disk *gce.CloudDisk
+		disk, err = gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
+		if err == nil {
+			return generateControllerGetVolumeResponse(volumeID, disk), nil
+		}
+	}
+	if gce.IsGCENotFoundError(err) {
+		return nil, status.Errorf(codes.NotFound, "ControllerGetVolume could not find disk %v: %v", volKey.Name, err.Error())
+	}
+	return nil, common.LoggedError("ControllerGetVolume failed to get disk: ", err)
+}
+
+// [Edgeless] generateControllerGetVolumeResponse reports the disk of a volume
+// as abnormal unless it is READY, CREATING or RESTORING.
+func generateControllerGetVolumeResponse(volumeID string, disk *gce.CloudDisk) *csi.ControllerGetVolumeResponse {
+	publishedNodeIDs := []string{}
+	for _, u := range disk.GetUsers() {
+		instanceID, err := getResourceId(u)
+		if err != nil {
+			klog.Warningf("Bad ControllerGetVolume user %s, skipped: %v", u, err)
+			continue
+		}
+		publishedNodeIDs = append(publishedNodeIDs, instanceID)
+	}
+
+	condition := &csi.VolumeCondition{Message: fmt.Sprintf("disk %s is %s", disk.GetName(), disk.GetStatus())}
+	switch disk.GetStatus() {
+	case "READY", "CREATING", "RESTORING":
+	default:
+		condition.Abnormal = true
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: common.GbToBytes(disk.GetSizeGb()),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs,
+			VolumeCondition:  condition,
+		},
+	}
 }
 
 func generateFailedValidationMessage(format string, a ...interface{}) *csi.ValidateVolumeCapabilitiesResponse {
@@ -1365,7 +1780,7 @@ func (gceCS *GCEControllerServer) disksAndInstancesToVolumeEntries(disks []*comp
 			continue
 		}
 
-		instanceIds := make([]string, len(d.Users))
+		instanceIds := make([]string, 0, len(d.Users))
 		for _, u := range d.Users {
 			instanceId, err := getResourceId(u)
 			if err != nil {
@@ -1420,9 +1835,35 @@ func (gceCS *GCEControllerServer) disksAndInstancesToVolumeEntries(disks []*comp
 }
 
 func (gceCS *GCEControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	// https://cloud.google.com/compute/quotas
-	// DISKS_TOTAL_GB.
-	return nil, status.Error(codes.Unimplemented, "")
+	// [Edgeless] report the remaining disk quota of the region, or the
+	// remaining capacity of the storage pool, of the requested zone
+	params, err := gceCS.parameterProcessor().ExtractAndDefaultParameters(req.GetParameters(), gceCS.Driver.extraVolumeLabels, gceCS.Driver.extraTags)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to extract parameters: %v", err.Error())
+	}
+	zone := gceCS.CloudProvider.GetDefaultZone()
+	if top := req.GetAccessibleTopology(); top != nil {
+		var ok bool
+		if zone, ok = top.GetSegments()[common.TopologyKeyZone]; !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetCapacity accessible topology has no %s segment", common.TopologyKeyZone))
+		}
+	}
+
+	var diskBytes int64
+	if len(params.StoragePools) > 0 {
+		diskBytes, err = gceCS.storagePoolCapacity(ctx, params.StoragePools, zone)
+	} else {
+		diskBytes, err = gceCS.quotaCapacity(ctx, params, zone)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &csi.GetCapacityResponse{AvailableCapacity: diskBytes}
+	if overhead := newCryptOverhead(params, req.GetVolumeCapabilities()); overhead != nil {
+		resp.AvailableCapacity = overhead.usableBytes(diskBytes)
+	}
+	return resp, nil
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
@@ -1457,6 +1898,11 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if gceCS.multiZoneVolumeHandleConfig.Enable && volumeIsMultiZone {
 		return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot for volume %v failed. Snapshots are not supported with the multi-zone PV volumeHandle feature", volumeID)
 	}
+	// [Edgeless] follow converted disks
+	volKey, err = gceCS.convertedVolumeKey(ctx, project, volKey)
+	if err != nil {
+		return nil, common.LoggedError("CreateSnapshot failed to look up converted disk: ", err)
+	}
 
 	if acquired := gceCS.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
@@ -1477,6 +1923,14 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid snapshot parameters: %v", err.Error())
 	}
+	// [Edgeless] Record the key scope of the disk, so restored volumes request the same key
+	if keyScope := disk.GetLabels()[common.KeyScopeLabel]; keyScope != "" {
+		snapshotParams.Labels[common.KeyScopeLabel] = keyScope
+	}
+	// [Edgeless] Volumes restored from a snapshot of a plain disk are plain as well
+	if encryption := disk.GetLabels()[common.EncryptionLabel]; encryption != "" {
+		snapshotParams.Labels[common.EncryptionLabel] = encryption
+	}
 
 	var snapshot *csi.Snapshot
 	switch snapshotParams.SnapshotType {
@@ -1805,7 +2259,7 @@ func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, re
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "ControllerExpandVolume Volume ID is invalid: %v", err.Error())
 	}
-	project, volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
 
 	if err != nil {
 		if gce.IsGCENotFoundError(err) {
@@ -1834,6 +2288,113 @@ func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, re
 	}, nil
 }
 
+// [Edgeless] ControllerModifyVolume changes the mutable parameters of a volume
+// set by its VolumeAttributesClass.
+func (gceCS *GCEControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	var err error
+	diskTypeForMetric := metrics.DefaultDiskTypeForMetric
+	enableConfidentialCompute := metrics.DefaultEnableConfidentialCompute
+	enableStoragePools := metrics.DefaultEnableStoragePools
+	defer func() {
+		gceCS.Metrics.RecordOperationErrorMetrics("ControllerModifyVolume", err, diskTypeForMetric, enableConfidentialCompute, enableStoragePools)
+	}()
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume volume ID must be provided")
+	}
+	params, err := common.ExtractModifyVolumeParameters(req.GetMutableParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume failed to extract mutable parameters: %v", err.Error())
+	}
+
+	project, volKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		// No volume can exist with an ID that is not in the correct format
+		return nil, status.Errorf(codes.NotFound, "ControllerModifyVolume Volume ID is invalid: %v", err.Error())
+	}
+	if isMultiZoneVolKey(volKey) {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume is not supported with the multi-zone PVC volumeHandle feature, volume %v", volumeID)
+	}
+	project, volKey, err = gceCS.repairVolumeKey(ctx, project, volKey) // [Edgeless] follow converted disks
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "ControllerModifyVolume could not find volume with ID %v: %v", volumeID, err.Error())
+		}
+		return nil, common.LoggedError("ControllerModifyVolume error repairing underspecified volume key: ", err)
+	}
+
+	if acquired := gceCS.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer gceCS.volumeLocks.Release(volumeID)
+
+	existingDisk, err := gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return nil, status.Errorf(codes.NotFound, "ControllerModifyVolume could not find volume with ID %v: %v", volumeID, err.Error())
+		}
+		return nil, common.LoggedError("ControllerModifyVolume failed to get disk: ", err)
+	}
+	diskTypeForMetric, enableConfidentialCompute, enableStoragePools = metrics.GetMetricParameters(existingDisk)
+
+	// The type of a PD can't be changed in place, only by recreating it from a snapshot
+	if params.DiskType != "" && params.DiskType != existingDisk.GetPDType() {
+		err = status.Errorf(codes.InvalidArgument, "ControllerModifyVolume can't change the type of disk %v from %s to %s in place, re-create the volume from a snapshot instead", volKey, existingDisk.GetPDType(), params.DiskType)
+		return nil, err
+	}
+	if err = validateModifyVolumeParameters(existingDisk.GetPDType(), params); err != nil {
+		err = status.Errorf(codes.InvalidArgument, "ControllerModifyVolume failed to validate mutable parameters: %v", err.Error())
+		return nil, err
+	}
+	// [Edgeless] the node could never apply the generation, the label would be passed on every publish
+	if _, ok := existingDisk.GetLabels()[common.IntegrityLabel]; ok && params.RekeyGeneration != "" {
+		err = status.Errorf(codes.InvalidArgument, "ControllerModifyVolume can't re-key integrity protected disk %v online", volKey)
+		return nil, err
+	}
+
+	switch {
+	case params.ReplicationType == "":
+		// [Edgeless] the replication type is left as is, a started conversion continues
+	case params.ReplicationType == replicationTypeNone && volKey.Type() == meta.Zonal:
+		// [Edgeless] the volume is to stay zonal, abort a started conversion
+		if existingDisk.GetLabels()[common.ConvertingLabel] != "" {
+			if err = gceCS.abortRegionalConversion(ctx, project, volKey); err != nil {
+				return nil, err
+			}
+		}
+	case params.ReplicationType == replicationTypeRegionalPD && volKey.Type() == meta.Regional:
+	case params.ReplicationType == replicationTypeRegionalPD:
+		// The volume ID and topology of the volume stay those of the zonal
+		// disk, they are resolved to the regional disk
+		if volKey, err = gceCS.convertToRegionalDisk(ctx, project, volKey, existingDisk); err != nil {
+			return nil, err
+		}
+		if existingDisk, err = gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1); err != nil {
+			return nil, common.LoggedError("ControllerModifyVolume failed to get regional disk: ", err)
+		}
+	default:
+		err = status.Errorf(codes.InvalidArgument, "ControllerModifyVolume can't change the replication type of disk %v to %q", volKey, params.ReplicationType)
+		return nil, err
+	}
+
+	if err = gceCS.CloudProvider.UpdateDisk(ctx, project, volKey, existingDisk, params); err != nil {
+		// GCE rejects IOPS and throughput out of the range of the disk type
+		if gce.IsGCEInvalidError(err) || gce.IsGCEError(err, "badRequest") {
+			return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume failed to update disk: %v", err.Error())
+		}
+		return nil, common.LoggedError("ControllerModifyVolume failed to update disk: ", err)
+	}
+	// [Edgeless] the node re-keys the volume when it is next published with the new generation
+	if params.RekeyGeneration != "" && params.RekeyGeneration != existingDisk.GetLabels()[common.RekeyGenerationLabel] {
+		if err = gceCS.CloudProvider.SetDiskLabels(ctx, project, volKey, map[string]string{common.RekeyGenerationLabel: params.RekeyGeneration}); err != nil {
+			return nil, common.LoggedError("ControllerModifyVolume failed to label disk with re-key generation: ", err)
+		}
+	}
+
+	klog.V(4).Infof("ControllerModifyVolume succeeded for disk %v", volKey)
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 func (gceCS *GCEControllerServer) getSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) ([]*csi.ListSnapshotsResponse_Entry, error) {
 	var snapshots []*compute.Snapshot
 	var images []*compute.Image
@@ -2247,6 +2808,46 @@ func paramsToVolumeContext(params common.DiskParameters) map[string]string {
 	if params.ForceAttach {
 		context[contextForceAttach] = "true"
 	}
+	// [Edgeless] the node plugin stages plain volumes without a crypt mapping
+	if params.Encryption == common.EncryptionNone {
+		context[common.VolumeAttributeEncryption] = common.EncryptionNone
+	}
+	// [Edgeless] the node plugin derives the volume's key within this scope
+	if params.KeyScope != "" {
+		context[common.VolumeAttributeKeyScope] = params.KeyScope
+	}
+	if params.CryptoShred != "" {
+		context[common.VolumeAttributeCryptoShred] = "true"
+	}
+	if params.RewrapKey {
+		context[common.VolumeAttributeRewrapKey] = "true"
+		if params.SourceKeyScope != "" {
+			context[common.VolumeAttributeSourceKeyScope] = params.SourceKeyScope
+		}
+	}
+	// [Edgeless] the node plugin formats new volumes with these LUKS2 options
+	if params.Cipher != "" {
+		context[common.VolumeAttributeCipher] = params.Cipher
+	}
+	if params.CryptKeySize != 0 {
+		context[common.VolumeAttributeCryptKeySize] = strconv.Itoa(params.CryptKeySize)
+	}
+	if params.SectorSize != 0 {
+		context[common.VolumeAttributeSectorSize] = strconv.Itoa(params.SectorSize)
+	}
+	if params.IntegrityAlgorithm != "" {
+		context[common.VolumeAttributeIntegrityAlgorithm] = params.IntegrityAlgorithm
+	}
+	if params.PBKDF != "" {
+		context[common.VolumeAttributePBKDF] = params.PBKDF
+	}
+	if params.IntegrityInit != "" {
+		context[common.VolumeAttributeIntegrityInit] = params.IntegrityInit
+	}
+	// [Edgeless] the node plugin encrypts the plaintext data of disk sources in place
+	if params.DiskSource != "" && params.Encryption != common.EncryptionNone {
+		context[common.VolumeAttributeImportPlaintext] = "true"
+	}
 	if len(context) > 0 {
 		return context
 	}
@@ -2270,7 +2871,7 @@ func extractVolumeContext(context map[string]string) (*PDCSIContext, error) {
 	return info, nil
 }
 
-func generateCreateVolumeResponseWithVolumeId(disk *gce.CloudDisk, zones []string, params common.DiskParameters, volumeId string) *csi.CreateVolumeResponse {
+func generateCreateVolumeResponseWithVolumeId(disk *gce.CloudDisk, zones []string, params common.DiskParameters, caps []*csi.VolumeCapability, volumeId string) *csi.CreateVolumeResponse {
 	tops := []*csi.Topology{}
 	for _, zone := range zones {
 		tops = append(tops, &csi.Topology{
@@ -2278,6 +2879,10 @@ func generateCreateVolumeResponseWithVolumeId(disk *gce.CloudDisk, zones []strin
 		})
 	}
 	realDiskSizeBytes := common.GbToBytes(disk.GetSizeGb())
+	// [Edgeless] report the capacity usable by the crypt mapping of over-provisioned disks
+	if overhead := newCryptOverhead(params, caps); overhead != nil {
+		realDiskSizeBytes = overhead.usableBytes(realDiskSizeBytes)
+	}
 	createResp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			CapacityBytes:      realDiskSizeBytes,
@@ -2289,7 +2894,8 @@ func generateCreateVolumeResponseWithVolumeId(disk *gce.CloudDisk, zones []strin
 	snapshotID := disk.GetSnapshotId()
 	imageID := disk.GetImageId()
 	diskID := disk.GetSourceDiskId()
-	if diskID != "" || snapshotID != "" || imageID != "" {
+	// [Edgeless] disk sources are a parameter, not a volume content source
+	if params.DiskSource == "" && (diskID != "" || snapshotID != "" || imageID != "") {
 		contentSource := &csi.VolumeContentSource{}
 		if snapshotID != "" {
 			contentSource = &csi.VolumeContentSource{
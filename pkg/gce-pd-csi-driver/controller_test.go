@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"strconv"
@@ -28,6 +29,7 @@ import (
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	compute "google.golang.org/api/compute/v1"
@@ -43,6 +45,7 @@ import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
 )
 
 const (
@@ -572,6 +575,78 @@ func TestCreateVolumeArguments(t *testing.T) {
 				AccessibleTopology: stdTopology,
 			},
 		},
+		{
+			name: "success with key scope",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:     "test-type",
+					common.ParameterKeyKeyScope: "tenant-a",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeKeyScope: "tenant-a"},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail with invalid key scope",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:     "test-type",
+					common.ParameterKeyKeyScope: "Tenant/A",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success with LUKS2 format options",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:               "test-type",
+					common.ParameterKeyCipher:             "aes-gcm-random",
+					common.ParameterKeyCryptKeySize:       "256",
+					common.ParameterKeySectorSize:         "4096",
+					common.ParameterKeyIntegrityAlgorithm: "aead",
+					common.ParameterKeyPBKDF:              "pbkdf2",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testVolumeID,
+				VolumeContext: map[string]string{
+					common.VolumeAttributeCipher:             "aes-gcm-random",
+					common.VolumeAttributeCryptKeySize:       "256",
+					common.VolumeAttributeSectorSize:         "4096",
+					common.VolumeAttributeIntegrityAlgorithm: "aead",
+					common.VolumeAttributePBKDF:              "pbkdf2",
+				},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail with invalid sector size",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-name",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:       "test-type",
+					common.ParameterKeySectorSize: "8192",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "fail with MULTI_NODE_READER_ONLY",
 			req: &csi.CreateVolumeRequest{
@@ -961,6 +1036,17 @@ func TestCreateVolumeArguments(t *testing.T) {
 			},
 			expErrCode: codes.InvalidArgument,
 		},
+		{
+			name: "fail with mutable parameters",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyType: "hyperdisk-balanced"},
+				MutableParameters:  map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "5000"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "success with provisionedThroughput parameter",
 			req: &csi.CreateVolumeRequest{
@@ -1518,7 +1604,7 @@ func TestMultiZoneVolumeCreation(t *testing.T) {
 		sortTopologies := func(t1, t2 *csi.Topology) bool {
 			return t1.Segments[common.TopologyKeyZone] < t2.Segments[common.TopologyKeyZone]
 		}
-		if diff := cmp.Diff(expVol, vol, cmpopts.SortSlices(sortTopologies)); diff != "" {
+		if diff := cmp.Diff(expVol, vol, protocmp.Transform(), protocmp.SortRepeated(sortTopologies)); diff != "" {
 			t.Errorf("Accessible topologies mismatch (-want +got):\n%s", diff)
 		}
 
@@ -4824,6 +4910,43 @@ func TestCreateConfidentialVolume(t *testing.T) {
 	}
 }
 
+func TestControllerPublishImportPlaintext(t *testing.T) {
+	driver := backoffDriver(t, &backoffDriverConfig{clock: clock.NewFakeClock(time.Now())})
+	pubreq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: testVolumeID,
+		NodeId:   testNodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{common.VolumeAttributeImportPlaintext: "true"},
+	}
+
+	resp, err := driver.cs.ControllerPublishVolume(context.Background(), pubreq)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if got := resp.GetPublishContext()[common.VolumeAttributeImportPlaintext]; got != "true" {
+		t.Errorf("expected the import to be allowed on the first publish, got publish context %v", resp.GetPublishContext())
+	}
+	disk, err := driver.cs.CloudProvider.GetDisk(context.Background(), project, meta.ZonalKey(name, zone), gce.GCEAPIVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := disk.GetLabels()[common.ImportedLabel]; !ok {
+		t.Errorf("expected disk to be labeled as imported, got labels %v", disk.GetLabels())
+	}
+
+	// The import is only allowed once, even if the disk is published again
+	resp, err = driver.cs.ControllerPublishVolume(context.Background(), pubreq)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if _, ok := resp.GetPublishContext()[common.VolumeAttributeImportPlaintext]; ok {
+		t.Errorf("expected the import not to be allowed again, got publish context %v", resp.GetPublishContext())
+	}
+}
+
 func backoffDriver(t *testing.T, config *backoffDriverConfig) *GCEDriver {
 	var cloudDisks []*gce.CloudDisk
 	if !config.mockMissingDisk {
@@ -4884,3 +5007,543 @@ func isInternalError(err error) bool {
 
 	return st.Code().String() == "Internal"
 }
+
+func TestCreateVolumeKeyScopeFromContentSource(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	cs := gceDriver.cs
+	scopedParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyKeyScope: "tenant-a"}
+	otherParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyKeyScope: "tenant-b"}
+
+	createVolume := func(name string, params map[string]string, source *csi.VolumeContentSource) *csi.Volume {
+		t.Helper()
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          params,
+			VolumeContentSource: source,
+		})
+		if err != nil {
+			t.Fatalf("CreateVolume(%s) failed: %v", name, err)
+		}
+		return resp.GetVolume()
+	}
+	expectKeyScope := func(vol *csi.Volume, scope string) {
+		t.Helper()
+		if got := vol.GetVolumeContext()[common.VolumeAttributeKeyScope]; got != scope {
+			t.Errorf("expected volume context key scope %q, got %q", scope, got)
+		}
+		_, volKey, err := common.VolumeIDToKey(vol.GetVolumeId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk, err := cs.CloudProvider.GetDisk(context.Background(), project, volKey, gce.GCEAPIVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := disk.GetLabels()[common.KeyScopeLabel]; got != scope {
+			t.Errorf("expected disk key scope label %q, got %q", scope, got)
+		}
+	}
+
+	source := createVolume("source", scopedParams, nil)
+	expectKeyScope(source, "tenant-a")
+
+	for _, snapshotType := range []string{common.DiskSnapshotType, common.DiskImageType} {
+		snapshotName := "snapshot-" + snapshotType
+		resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+			Name:           snapshotName,
+			SourceVolumeId: source.GetVolumeId(),
+			Parameters:     map[string]string{common.ParameterKeySnapshotType: snapshotType},
+		})
+		if err != nil {
+			t.Fatalf("CreateSnapshot failed: %v", err)
+		}
+		var labels map[string]string
+		if snapshotType == common.DiskSnapshotType {
+			snapshot, err := cs.CloudProvider.GetSnapshot(context.Background(), project, snapshotName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			labels = snapshot.Labels
+		} else {
+			image, err := cs.CloudProvider.GetImage(context.Background(), project, snapshotName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			labels = image.Labels
+		}
+		if labels[common.KeyScopeLabel] != "tenant-a" {
+			t.Errorf("expected %s to record key scope %q, got labels %v", snapshotType, "tenant-a", labels)
+		}
+
+		restored := createVolume("restored-"+snapshotType, otherParams, &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: resp.GetSnapshot().GetSnapshotId()},
+			},
+		})
+		expectKeyScope(restored, "tenant-a")
+	}
+
+	clone := createVolume("clone", otherParams, &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source.GetVolumeId()},
+		},
+	})
+	expectKeyScope(clone, "tenant-a")
+
+	// Volumes restored from unscoped sources are unscoped as well
+	unscoped := createVolume("unscoped", stdParams, nil)
+	unscopedClone := createVolume("unscoped-clone", otherParams, &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: unscoped.GetVolumeId()},
+		},
+	})
+	expectKeyScope(unscopedClone, "")
+}
+
+func TestCreateVolumeEncryptionFromContentSource(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	cs := gceDriver.cs
+	plainParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyEncryption: common.EncryptionNone}
+	scopedParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyKeyScope: "tenant-a", common.ParameterKeyRewrapKey: "true"}
+
+	createVolume := func(name string, params map[string]string, source *csi.VolumeContentSource) *csi.Volume {
+		t.Helper()
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          params,
+			VolumeContentSource: source,
+		})
+		if err != nil {
+			t.Fatalf("CreateVolume(%s) failed: %v", name, err)
+		}
+		return resp.GetVolume()
+	}
+	expectEncryption := func(vol *csi.Volume, plain bool) {
+		t.Helper()
+		want := ""
+		if plain {
+			want = common.EncryptionNone
+			// None of the LUKS2 parameters of the storage class apply to plain volumes
+			if wantContext := map[string]string{common.VolumeAttributeEncryption: want}; !reflect.DeepEqual(vol.GetVolumeContext(), wantContext) {
+				t.Errorf("expected volume context %v, got %v", wantContext, vol.GetVolumeContext())
+			}
+		} else if got := vol.GetVolumeContext()[common.VolumeAttributeEncryption]; got != "" {
+			t.Errorf("expected no volume context encryption, got %q", got)
+		}
+		_, volKey, err := common.VolumeIDToKey(vol.GetVolumeId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk, err := cs.CloudProvider.GetDisk(context.Background(), project, volKey, gce.GCEAPIVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := disk.GetLabels()[common.EncryptionLabel]; got != want {
+			t.Errorf("expected disk encryption label %q, got %q", want, got)
+		}
+		if plain && disk.GetLabels()[common.KeyScopeLabel] != "" {
+			t.Errorf("expected no key scope label on an unencrypted disk, got labels %v", disk.GetLabels())
+		}
+	}
+
+	plain := createVolume("plain", plainParams, nil)
+	expectEncryption(plain, true)
+
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "plain-snapshot",
+		SourceVolumeId: plain.GetVolumeId(),
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	snapshot, err := cs.CloudProvider.GetSnapshot(context.Background(), project, "plain-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Labels[common.EncryptionLabel] != common.EncryptionNone {
+		t.Errorf("expected snapshot to record encryption %q, got labels %v", common.EncryptionNone, snapshot.Labels)
+	}
+
+	// Restoring a plain snapshot with an encrypted storage class is refused
+	plainSources := map[string]*csi.VolumeContentSource{
+		"restored": {
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: resp.GetSnapshot().GetSnapshotId()},
+			},
+		},
+		"plain-clone": {
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: plain.GetVolumeId()},
+			},
+		},
+	}
+	for name, source := range plainSources {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          scopedParams,
+			VolumeContentSource: source,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateVolume(%s) from a plain source with an encrypted storage class: expected InvalidArgument, got %v", name, err)
+		}
+		if _, err := cs.CloudProvider.GetDisk(context.Background(), project, meta.ZonalKey(name, zone), gce.GCEAPIVersionV1); err == nil {
+			t.Errorf("expected no disk to be created for %s", name)
+		}
+	}
+
+	// Restoring a plain snapshot with a plain storage class keeps the volume plain
+	restored := createVolume("restored", plainParams, plainSources["restored"])
+	expectEncryption(restored, true)
+
+	// Cloning an encrypted volume with a plain storage class keeps the volume encrypted
+	encrypted := createVolume("encrypted", stdParams, nil)
+	clone := createVolume("clone", plainParams, &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: encrypted.GetVolumeId()},
+		},
+	})
+	expectEncryption(clone, false)
+}
+
+func TestCreateVolumeRewrapKey(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	cs := gceDriver.cs
+	sourceParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyKeyScope: "tenant-a"}
+	rewrapParams := map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyKeyScope: "tenant-b", common.ParameterKeyRewrapKey: "true"}
+
+	createVolume := func(name string, params map[string]string, source *csi.VolumeContentSource) *csi.Volume {
+		t.Helper()
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       stdCapRange,
+			VolumeCapabilities:  stdVolCaps,
+			Parameters:          params,
+			VolumeContentSource: source,
+		})
+		if err != nil {
+			t.Fatalf("CreateVolume(%s) failed: %v", name, err)
+		}
+		return resp.GetVolume()
+	}
+
+	// Fresh volumes get their own key anyway
+	fresh := createVolume("fresh", rewrapParams, nil)
+	if _, ok := fresh.GetVolumeContext()[common.VolumeAttributeRewrapKey]; ok {
+		t.Errorf("expected no rewrap for a volume without content source, got context %v", fresh.GetVolumeContext())
+	}
+
+	source := createVolume("source", sourceParams, nil)
+	clone := createVolume("clone", rewrapParams, &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source.GetVolumeId()},
+		},
+	})
+	wantContext := map[string]string{
+		common.VolumeAttributeKeyScope:       "tenant-b",
+		common.VolumeAttributeRewrapKey:      "true",
+		common.VolumeAttributeSourceKeyScope: "tenant-a",
+	}
+	for k, v := range wantContext {
+		if got := clone.GetVolumeContext()[k]; got != v {
+			t.Errorf("expected volume context %s=%q, got %q", k, v, got)
+		}
+	}
+	_, volKey, err := common.VolumeIDToKey(clone.GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := cs.CloudProvider.GetDisk(context.Background(), project, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := disk.GetLabels()[common.KeyScopeLabel]; got != "tenant-b" {
+		t.Errorf("expected disk key scope label %q, got %q", "tenant-b", got)
+	}
+}
+
+func TestDeleteVolumeCryptoShred(t *testing.T) {
+	testCases := []struct {
+		name          string
+		mode          string
+		noDestroyer   bool
+		snapshot      bool
+		expCreateCode codes.Code
+		expDeleteCode codes.Code
+		expDestroyed  bool
+	}{
+		{
+			name:         "destroy key scope",
+			mode:         common.CryptoShredRefuse,
+			expDestroyed: true,
+		},
+		{
+			name:          "refuse while snapshot exists",
+			mode:          common.CryptoShredRefuse,
+			snapshot:      true,
+			expDeleteCode: codes.FailedPrecondition,
+		},
+		{
+			name:         "force while snapshot exists",
+			mode:         common.CryptoShredForce,
+			snapshot:     true,
+			expDestroyed: true,
+		},
+		{
+			name:          "no key destroyer",
+			mode:          common.CryptoShredRefuse,
+			noDestroyer:   true,
+			expCreateCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := kms.NewFakeKeyServer([]byte("master-secret-of-32-bytes-length"))
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+			gceDriver := initGCEDriver(t, nil)
+			cs := gceDriver.cs
+			if !tc.noDestroyer {
+				destroyer, err := kms.NewKeyDestroyer(kms.BackendHTTP, httpServer.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cs = cs.WithKeyDestroyer(destroyer)
+			}
+
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-shred",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         map[string]string{common.ParameterKeyType: "test-type", common.ParameterKeyCryptoShred: tc.mode},
+			})
+			if tc.expCreateCode != codes.OK {
+				if status.Code(err) != tc.expCreateCode {
+					t.Fatalf("expected CreateVolume error code %v, got %v", tc.expCreateCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			if got := resp.GetVolume().GetVolumeContext()[common.VolumeAttributeKeyScope]; got != "pvc-shred" {
+				t.Errorf("expected key scope %q, got %q", "pvc-shred", got)
+			}
+			if got := resp.GetVolume().GetVolumeContext()[common.VolumeAttributeCryptoShred]; got != "true" {
+				t.Errorf("expected the volume context to mark the volume as crypto-shredded, got %v", resp.GetVolume().GetVolumeContext())
+			}
+			if tc.snapshot {
+				if _, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot", SourceVolumeId: volumeID}); err != nil {
+					t.Fatalf("CreateSnapshot failed: %v", err)
+				}
+			}
+
+			_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			if status.Code(err) != tc.expDeleteCode {
+				t.Fatalf("expected DeleteVolume error code %v, got %v", tc.expDeleteCode, err)
+			}
+			if got := server.Destroyed("pvc-shred"); got != tc.expDestroyed {
+				t.Errorf("expected key scope destroyed to be %v, got %v", tc.expDestroyed, got)
+			}
+			_, volKey, err := common.VolumeIDToKey(volumeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cs.CloudProvider.GetDisk(context.Background(), project, volKey, gce.GCEAPIVersionV1)
+			if deleted := gce.IsGCENotFoundError(err); deleted != tc.expDestroyed {
+				t.Errorf("expected disk deleted to be %v, got error %v", tc.expDestroyed, err)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name)
+	nodeID := fmt.Sprintf("projects/%s/zones/%s/instances/node-1", project, zone)
+	testCases := []struct {
+		name           string
+		diskStatus     string
+		noDisk         bool
+		volumeID       string
+		expErrCode     codes.Code
+		expAbnormal    bool
+		expPublishedTo []string
+	}{
+		{
+			name:           "ready disk",
+			diskStatus:     "READY",
+			expPublishedTo: []string{nodeID},
+		},
+		{
+			name:           "failed disk",
+			diskStatus:     "FAILED",
+			expAbnormal:    true,
+			expPublishedTo: []string{nodeID},
+		},
+		{
+			name:       "disk deleted out from under the volume",
+			noDisk:     true,
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:       "invalid volume ID",
+			volumeID:   "invalid",
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var seedDisks []*gce.CloudDisk
+			if !tc.noDisk {
+				seedDisks = append(seedDisks, gce.CloudDiskFromV1(&compute.Disk{
+					Name:   name,
+					SizeGb: 10,
+					Status: tc.diskStatus,
+					Users:  []string{fmt.Sprintf("https://www.googleapis.com/compute/v1/%s", nodeID)},
+				}))
+			}
+			gceDriver := initGCEDriver(t, seedDisks)
+			reqVolumeID := volumeID
+			if tc.volumeID != "" {
+				reqVolumeID = tc.volumeID
+			}
+
+			resp, err := gceDriver.cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: reqVolumeID})
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.GetVolume().GetVolumeId(); got != volumeID {
+				t.Errorf("expected volume ID %q, got %q", volumeID, got)
+			}
+			condition := resp.GetStatus().GetVolumeCondition()
+			if condition == nil || condition.GetAbnormal() != tc.expAbnormal {
+				t.Errorf("expected abnormal condition %v, got %v", tc.expAbnormal, condition)
+			}
+			if diff := cmp.Diff(tc.expPublishedTo, resp.GetStatus().GetPublishedNodeIds(), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("unexpected published node IDs: %s", diff)
+			}
+			if !tc.noDisk && resp.GetVolume().GetCapacityBytes() != common.GbToBytes(10) {
+				t.Errorf("expected capacity of 10 GiB, got %d", resp.GetVolume().GetCapacityBytes())
+			}
+		})
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name)
+	testCases := []struct {
+		name          string
+		params        map[string]string
+		noDisk        bool
+		volumeID      string
+		diskType      string
+		expErrCode    codes.Code
+		expIops       int64
+		expThroughput int64
+	}{
+		{
+			name:          "iops and throughput",
+			params:        map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "20000", common.ParameterKeyProvisionedThroughputOnCreate: "500Mi"},
+			expIops:       20000,
+			expThroughput: 500,
+		},
+		{
+			name:          "unchanged disk type",
+			params:        map[string]string{common.ParameterKeyType: "hyperdisk-balanced", common.ParameterKeyProvisionedIOPSOnCreate: "5000"},
+			expIops:       5000,
+			expThroughput: 140,
+		},
+		{
+			name:       "changed disk type",
+			params:     map[string]string{common.ParameterKeyType: "hyperdisk-extreme"},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "immutable parameter",
+			params:     map[string]string{common.ParameterKeyEncryption: common.EncryptionNone},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "missing disk",
+			params:     map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "20000"},
+			noDisk:     true,
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:       "invalid volume ID",
+			params:     map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "20000"},
+			volumeID:   "invalid",
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:       "iops of disk type without provisioned iops",
+			params:     map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "5000"},
+			diskType:   "pd-balanced",
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "throughput of disk type without provisioned throughput",
+			params:     map[string]string{common.ParameterKeyProvisionedThroughputOnCreate: "500Mi"},
+			diskType:   "hyperdisk-extreme",
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "iops rejected by GCE",
+			params:     map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "1000000"},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var seedDisks []*gce.CloudDisk
+			diskType := "hyperdisk-balanced"
+			if tc.diskType != "" {
+				diskType = tc.diskType
+			}
+			if !tc.noDisk {
+				seedDisks = append(seedDisks, gce.CloudDiskFromV1(&compute.Disk{
+					Name:                  name,
+					SizeGb:                10,
+					Type:                  fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", project, zone, diskType),
+					ProvisionedIops:       3000,
+					ProvisionedThroughput: 140,
+				}))
+			}
+			gceDriver := initGCEDriver(t, seedDisks)
+			reqVolumeID := volumeID
+			if tc.volumeID != "" {
+				reqVolumeID = tc.volumeID
+			}
+
+			_, err := gceDriver.cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+				VolumeId:          reqVolumeID,
+				MutableParameters: tc.params,
+			})
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if err != nil {
+				return
+			}
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, meta.ZonalKey(name, zone), gce.GCEAPIVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disk.GetProvisionedIops() != tc.expIops {
+				t.Errorf("expected %d provisioned IOPS, got %d", tc.expIops, disk.GetProvisionedIops())
+			}
+			if disk.GetProvisionedThroughput() != tc.expThroughput {
+				t.Errorf("expected %d MiB/s provisioned throughput, got %d", tc.expThroughput, disk.GetProvisionedThroughput())
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+// conversionSnapshotPrefix prefixes the name of the snapshot a zonal disk is
+// converted to a regional disk through.
+const conversionSnapshotPrefix = "regional-"
+
+// repairVolumeKey repairs an underspecified volume key like
+// RepairUnderspecifiedVolumeKey, and resolves the key of a zonal disk which
+// was converted to a regional disk to the key of the regional disk.
+func (gceCS *GCEControllerServer) repairVolumeKey(ctx context.Context, project string, volKey *meta.Key) (string, *meta.Key, error) {
+	project, volKey, err := gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, project, volKey)
+	if err != nil {
+		return "", nil, err
+	}
+	volKey, err = gceCS.convertedVolumeKey(ctx, project, volKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return project, volKey, nil
+}
+
+// convertedVolumeKey returns the key of the regional disk the zonal disk
+// volKey was converted to, or volKey if it was not converted.
+func (gceCS *GCEControllerServer) convertedVolumeKey(ctx context.Context, project string, volKey *meta.Key) (*meta.Key, error) {
+	if volKey.Type() != meta.Zonal || isMultiZoneVolKey(volKey) {
+		return volKey, nil
+	}
+	_, err := gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
+	if err == nil || !gce.IsGCENotFoundError(err) {
+		return volKey, nil
+	}
+	region, err := common.GetRegionFromZones([]string{volKey.Zone})
+	if err != nil {
+		return volKey, nil
+	}
+	regionalKey := meta.RegionalKey(volKey.Name, region)
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, project, regionalKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		if gce.IsGCENotFoundError(err) {
+			return volKey, nil
+		}
+		return nil, err
+	}
+	if disk.GetLabels()[common.ConvertedFromLabel] != volKey.Zone {
+		return volKey, nil
+	}
+	klog.V(4).Infof("Zonal disk %v was converted to regional disk %v", volKey, regionalKey)
+	return regionalKey, nil
+}
+
+// convertToRegionalDisk converts the zonal disk volKey to a regional disk with
+// the same name: it snapshots the zonal disk, creates the regional disk from
+// the snapshot in the zone of the zonal disk and another zone of its region,
+// and deletes the snapshot and the zonal disk. Retries continue an interrupted
+// conversion. The disk must not be attached, and is not attached while it is
+// converted.
+func (gceCS *GCEControllerServer) convertToRegionalDisk(ctx context.Context, project string, volKey *meta.Key, disk *gce.CloudDisk) (*meta.Key, error) {
+	region, err := common.GetRegionFromZones([]string{volKey.Zone})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get region of zone %q: %v", volKey.Zone, err.Error()))
+	}
+	regionalKey := meta.RegionalKey(volKey.Name, region)
+	snapshotName := conversionSnapshotPrefix + volKey.Name
+
+	if len(disk.GetUsers()) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("disk %v is attached to %v, it can only be converted to a regional disk when it is not in use", volKey, disk.GetUsers()))
+	}
+	if err := gceCS.CloudProvider.SetDiskLabels(ctx, project, volKey, map[string]string{common.ConvertingLabel: "true"}); err != nil {
+		return nil, common.LoggedError("Failed to mark disk as converting: ", err)
+	}
+	// The disk may have been attached before it was marked
+	disk, err = gceCS.CloudProvider.GetDisk(ctx, project, volKey, gce.GCEAPIVersionV1)
+	if err != nil {
+		return nil, common.LoggedError("Failed to get disk: ", err)
+	}
+	if len(disk.GetUsers()) > 0 {
+		if err := gceCS.abortRegionalConversion(ctx, project, volKey); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("disk %v is attached to %v, it can only be converted to a regional disk when it is not in use", volKey, disk.GetUsers()))
+	}
+
+	regionalDisk, err := gceCS.CloudProvider.GetDisk(ctx, project, regionalKey, gce.GCEAPIVersionV1)
+	switch {
+	case err == nil:
+		if regionalDisk.GetLabels()[common.ConvertedFromLabel] != volKey.Zone {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("regional disk %v already exists and was not converted from disk %v", regionalKey, volKey))
+		}
+	case gce.IsGCENotFoundError(err):
+		if err := gceCS.createConvertedRegionalDisk(ctx, project, volKey, disk, snapshotName); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, common.LoggedError("Failed to get regional disk: ", err)
+	}
+
+	if err := gceCS.CloudProvider.DeleteSnapshot(ctx, project, snapshotName); err != nil && !gce.IsGCENotFoundError(err) {
+		return nil, common.LoggedError("Failed to delete conversion snapshot: ", err)
+	}
+	if err := gceCS.CloudProvider.DeleteDisk(ctx, project, volKey); err != nil && !gce.IsGCENotFoundError(err) {
+		return nil, common.LoggedError("Failed to delete converted zonal disk: ", err)
+	}
+	klog.V(4).Infof("Converted zonal disk %v to regional disk %v", volKey, regionalKey)
+	return regionalKey, nil
+}
+
+// abortRegionalConversion deletes the regional disk and the snapshot of an
+// interrupted conversion of the zonal disk volKey, so it can be attached again.
+func (gceCS *GCEControllerServer) abortRegionalConversion(ctx context.Context, project string, volKey *meta.Key) error {
+	region, err := common.GetRegionFromZones([]string{volKey.Zone})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get region of zone %q: %v", volKey.Zone, err.Error()))
+	}
+	regionalKey := meta.RegionalKey(volKey.Name, region)
+	regionalDisk, err := gceCS.CloudProvider.GetDisk(ctx, project, regionalKey, gce.GCEAPIVersionV1)
+	switch {
+	case err == nil:
+		if regionalDisk.GetLabels()[common.ConvertedFromLabel] == volKey.Zone {
+			if err := gceCS.CloudProvider.DeleteDisk(ctx, project, regionalKey); err != nil && !gce.IsGCENotFoundError(err) {
+				return common.LoggedError("Failed to delete regional disk of aborted conversion: ", err)
+			}
+		}
+	case !gce.IsGCENotFoundError(err):
+		return common.LoggedError("Failed to get regional disk: ", err)
+	}
+	if err := gceCS.CloudProvider.DeleteSnapshot(ctx, project, conversionSnapshotPrefix+volKey.Name); err != nil && !gce.IsGCENotFoundError(err) {
+		return common.LoggedError("Failed to delete conversion snapshot: ", err)
+	}
+	if err := gceCS.CloudProvider.SetDiskLabels(ctx, project, volKey, map[string]string{common.ConvertingLabel: ""}); err != nil {
+		return common.LoggedError("Failed to unmark disk as converting: ", err)
+	}
+	klog.V(4).Infof("Aborted conversion of zonal disk %v to a regional disk", volKey)
+	return nil
+}
+
+// createConvertedRegionalDisk creates the regional disk the zonal disk volKey
+// is converted to from the snapshot snapshotName of it.
+func (gceCS *GCEControllerServer) createConvertedRegionalDisk(ctx context.Context, project string, volKey *meta.Key, disk *gce.CloudDisk, snapshotName string) error {
+	snapshotParams, err := common.ExtractAndDefaultSnapshotParameters(nil, gceCS.Driver.name, gceCS.Driver.extraTags)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to get default snapshot parameters: %v", err.Error()))
+	}
+	snapshot, err := gceCS.createPDSnapshot(ctx, project, volKey, snapshotName, snapshotParams)
+	if err != nil {
+		return err
+	}
+	if !snapshot.GetReadyToUse() {
+		return status.Error(codes.Unavailable, fmt.Sprintf("snapshot %s of disk %v is not ready yet", snapshotName, volKey))
+	}
+
+	region, err := common.GetRegionFromZones([]string{volKey.Zone})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("failed to get region of zone %q: %v", volKey.Zone, err.Error()))
+	}
+	regionZones, err := gceCS.CloudProvider.ListZones(ctx, region)
+	if err != nil {
+		return common.LoggedError("Failed to list zones: ", err)
+	}
+	top := &csi.TopologyRequirement{}
+	for _, zone := range regionZones {
+		top.Requisite = append(top.Requisite, &csi.Topology{Segments: map[string]string{common.TopologyKeyZone: zone}})
+	}
+	zones, err := pickZonesFromTopology(top, 2, &locationRequirements{
+		srcVolRegion:         region,
+		srcVolZone:           volKey.Zone,
+		srcReplicationType:   replicationTypeNone,
+		cloneReplicationType: replicationTypeRegionalPD,
+	}, gceCS.fallbackRequisiteZones)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("failed to pick replica zones for disk %v: %v", volKey, err.Error()))
+	}
+	// The persistent volume keeps its node affinity to the zone of the zonal
+	// disk, it must stay a replica zone of the regional disk
+	if !slices.Contains(zones, volKey.Zone) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("replica zones %v of the regional disk don't include zone %s of disk %v, its persistent volume could not be scheduled anymore", zones, volKey.Zone, volKey))
+	}
+
+	labels := make(map[string]string, len(disk.GetLabels()))
+	for k, v := range disk.GetLabels() {
+		labels[k] = v
+	}
+	delete(labels, common.ConvertingLabel)
+	labels[common.ConvertedFromLabel] = volKey.Zone
+	params := common.DiskParameters{
+		DiskType:                      disk.GetPDType(),
+		ReplicationType:               replicationTypeRegionalPD,
+		DiskEncryptionKMSKey:          kmsKeyWithoutVersion(disk.GetKMSKeyName()),
+		Tags:                          map[string]string{},
+		Labels:                        labels,
+		ProvisionedIOPSOnCreate:       disk.GetProvisionedIops(),
+		ProvisionedThroughputOnCreate: disk.GetProvisionedThroughput(),
+		EnableConfidentialCompute:     disk.GetEnableConfidentialCompute(),
+	}
+	capBytes := common.GbToBytes(disk.GetSizeGb())
+	if _, err := createRegionalDisk(ctx, gceCS.CloudProvider, volKey.Name, zones, params, nil, capBytes, snapshot.GetSnapshotId(), "", disk.GetMultiWriter(), disk.GetAccessMode()); err != nil {
+		return common.LoggedError("Failed to create regional disk: ", err)
+	}
+	return nil
+}
+
+// kmsKeyWithoutVersion strips the key version from the KMS key name of a disk.
+func kmsKeyWithoutVersion(kmsKeyName string) string {
+	key, _, _ := strings.Cut(kmsKeyName, "/cryptoKeyVersions/")
+	return key
+}
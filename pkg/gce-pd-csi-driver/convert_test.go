@@ -0,0 +1,275 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+func TestControllerModifyVolumeConvertRegional(t *testing.T) {
+	volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name)
+	zonalKey := meta.ZonalKey(name, zone)
+	regionalKey := meta.RegionalKey(name, "country-region")
+	convertParams := map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD}
+	testCases := []struct {
+		name       string
+		users      []string
+		labels     map[string]string
+		params     map[string]string
+		expErrCode codes.Code
+	}{
+		{
+			name:   "convert zonal disk",
+			labels: map[string]string{common.KeyScopeLabel: "tenant-a"},
+			params: convertParams,
+		},
+		{
+			name:       "attached disk",
+			users:      []string{fmt.Sprintf("projects/%s/zones/%s/instances/node-1", project, zone)},
+			params:     convertParams,
+			expErrCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "zonal disk stays zonal",
+			params:     map[string]string{common.ParameterKeyReplicationType: replicationTypeNone},
+			expErrCode: codes.OK,
+		},
+		{
+			name:       "unknown replication type",
+			params:     map[string]string{common.ParameterKeyReplicationType: "multi-region"},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+				Name:   name,
+				SizeGb: 10,
+				Type:   fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-balanced", project, zone),
+				Labels: tc.labels,
+				Users:  tc.users,
+			})})
+			req := &csi.ControllerModifyVolumeRequest{VolumeId: volumeID, MutableParameters: tc.params}
+
+			_, err := gceDriver.cs.ControllerModifyVolume(context.Background(), req)
+			if tc.params[common.ParameterKeyReplicationType] == replicationTypeRegionalPD && tc.expErrCode == codes.OK {
+				// The snapshot of the zonal disk is not ready when it is created
+				if status.Code(err) != codes.Unavailable {
+					t.Fatalf("expected conversion to wait for the snapshot, got %v", err)
+				}
+				_, err = gceDriver.cs.ControllerModifyVolume(context.Background(), req)
+			}
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if err != nil || tc.params[common.ParameterKeyReplicationType] != replicationTypeRegionalPD {
+				return
+			}
+
+			if _, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, zonalKey, gce.GCEAPIVersionV1); !gce.IsGCENotFoundError(err) {
+				t.Errorf("expected zonal disk to be deleted, got %v", err)
+			}
+			if _, err := gceDriver.cs.CloudProvider.GetSnapshot(context.Background(), project, conversionSnapshotPrefix+name); !gce.IsGCENotFoundError(err) {
+				t.Errorf("expected conversion snapshot to be deleted, got %v", err)
+			}
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, regionalKey, gce.GCEAPIVersionV1)
+			if err != nil {
+				t.Fatalf("expected regional disk: %v", err)
+			}
+			if got := disk.GetLabels()[common.ConvertedFromLabel]; got != zone {
+				t.Errorf("expected regional disk to be converted from zone %q, got %q", zone, got)
+			}
+			if got := disk.GetLabels()[common.KeyScopeLabel]; got != "tenant-a" {
+				t.Errorf("expected key scope label to be kept, got %q", got)
+			}
+			if disk.GetLabels()[common.ConvertingLabel] != "" {
+				t.Error("expected regional disk not to be marked as converting")
+			}
+			if disk.GetPDType() != "pd-balanced" || disk.GetSizeGb() != 10 {
+				t.Errorf("expected a 10 GB pd-balanced disk, got a %d GB %s disk", disk.GetSizeGb(), disk.GetPDType())
+			}
+
+			// The volume ID of the zonal disk refers to the regional disk
+			resp, err := gceDriver.cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+			if err != nil {
+				t.Fatalf("ControllerGetVolume failed: %v", err)
+			}
+			if resp.GetStatus().GetVolumeCondition().GetAbnormal() {
+				t.Errorf("expected converted volume to be normal, got %q", resp.GetStatus().GetVolumeCondition().GetMessage())
+			}
+			if _, err := gceDriver.cs.ControllerModifyVolume(context.Background(), req); err != nil {
+				t.Errorf("modifying converted volume again failed: %v", err)
+			}
+			if _, err := gceDriver.cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(20)},
+			}); err != nil {
+				t.Fatalf("ControllerExpandVolume failed: %v", err)
+			}
+			if disk, _ := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, regionalKey, gce.GCEAPIVersionV1); disk.GetSizeGb() != 20 {
+				t.Errorf("expected regional disk to be expanded to 20 GB, got %d GB", disk.GetSizeGb())
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeConverting(t *testing.T) {
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		SizeGb: 10,
+		Labels: map[string]string{common.ConvertingLabel: "true"},
+	})})
+	gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider).InsertInstance(&compute.Instance{Name: node, Disks: []*compute.AttachedDisk{}}, zone, node)
+
+	_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+		NodeId:           testNodeID,
+		VolumeCapability: stdVolCap,
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected publishing a converting disk to be unavailable, got %v", err)
+	}
+}
+
+func TestControllerModifyVolumeAbortConversion(t *testing.T) {
+	testCases := []struct {
+		name     string
+		params   map[string]string
+		expAbort bool
+	}{
+		{
+			name:     "replication type none aborts conversion",
+			params:   map[string]string{common.ParameterKeyReplicationType: replicationTypeNone},
+			expAbort: true,
+		},
+		{
+			name:   "no replication type keeps conversion",
+			params: map[string]string{common.ParameterKeyProvisionedIOPSOnCreate: "3000"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+				Name:   name,
+				SizeGb: 10,
+				Labels: map[string]string{common.ConvertingLabel: "true"},
+			})})
+			zonalKey := meta.ZonalKey(name, zone)
+			if _, err := gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), project, zonalKey, conversionSnapshotPrefix+name, common.SnapshotParameters{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := gceDriver.cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+				VolumeId:          fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+				MutableParameters: tc.params,
+			}); err != nil {
+				t.Fatalf("ControllerModifyVolume failed: %v", err)
+			}
+
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, zonalKey, gce.GCEAPIVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if converting := disk.GetLabels()[common.ConvertingLabel] != ""; converting == tc.expAbort {
+				t.Errorf("expected disk to be marked as converting: %t, got label %q", !tc.expAbort, disk.GetLabels()[common.ConvertingLabel])
+			}
+			_, err = gceDriver.cs.CloudProvider.GetSnapshot(context.Background(), project, conversionSnapshotPrefix+name)
+			if deleted := gce.IsGCENotFoundError(err); deleted != tc.expAbort {
+				t.Errorf("expected conversion snapshot to be deleted: %t, got %v", tc.expAbort, err)
+			}
+		})
+	}
+}
+
+func TestPublishAndStageConvertedVolume(t *testing.T) {
+	volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name)
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		SizeGb: 10,
+		Type:   fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-balanced", project, zone),
+	})})
+	instance := &compute.Instance{Name: node, Disks: []*compute.AttachedDisk{}}
+	gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider).InsertInstance(instance, zone, node)
+
+	modifyReq := &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{common.ParameterKeyReplicationType: replicationTypeRegionalPD},
+	}
+	// The snapshot of the zonal disk is not ready when it is created
+	if _, err := gceDriver.cs.ControllerModifyVolume(context.Background(), modifyReq); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected conversion to wait for the snapshot, got %v", err)
+	}
+	if _, err := gceDriver.cs.ControllerModifyVolume(context.Background(), modifyReq); err != nil {
+		t.Fatalf("ControllerModifyVolume failed: %v", err)
+	}
+
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           testNodeID,
+		VolumeCapability: stdVolCap,
+	}
+	if _, err := gceDriver.cs.ControllerPublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if len(instance.Disks) != 1 {
+		t.Fatalf("expected the regional disk to be attached once, got %d disks", len(instance.Disks))
+	}
+	if got := instance.Disks[0].DeviceName; got != name {
+		t.Errorf("expected the regional disk to be attached as the device of the zonal disk %q, got %q", name, got)
+	}
+	if _, err := gceDriver.cs.ControllerPublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatalf("publishing the volume again failed: %v", err)
+	}
+	if len(instance.Disks) != 1 {
+		t.Errorf("expected publishing again to find the attached disk, got %d disks", len(instance.Disks))
+	}
+
+	// The node stages the volume from the device path of the attached disk
+	nodeDriver, _, _ := getTestRekeyGCEDriver(t)
+	mapper := &fakeCryptMapper{}
+	nodeDriver.ns.CryptMapper = mapper
+	stageReq := rekeyStageRequest(t, "")
+	stageReq.VolumeId = volumeID
+	if _, err := nodeDriver.ns.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	devicePath := "/dev/disk/by-id/google-" + instance.Disks[0].DeviceName
+	if len(mapper.opened) != 1 || mapper.opened[0] != devicePath {
+		t.Errorf("expected device %s to be opened, got %v", devicePath, mapper.opened)
+	}
+
+	if _, err := gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   testNodeID,
+	}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume failed: %v", err)
+	}
+	if len(instance.Disks) != 0 {
+		t.Errorf("expected the regional disk to be detached, got %d disks", len(instance.Disks))
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+// cryptFormatOptions returns the LUKS2 format options requested in the
+// volume context. The values were validated by the controller.
+func cryptFormatOptions(volumeContext map[string]string) (cryptsetup.FormatOptions, error) {
+	opts := cryptsetup.FormatOptions{
+		Cipher:    volumeContext[common.VolumeAttributeCipher],
+		Integrity: volumeContext[common.VolumeAttributeIntegrityAlgorithm],
+		PBKDF:     volumeContext[common.VolumeAttributePBKDF],
+	}
+	if v, ok := volumeContext[common.VolumeAttributeCryptKeySize]; ok {
+		keySize, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %w", common.VolumeAttributeCryptKeySize, v, err)
+		}
+		opts.KeySize = keySize
+	}
+	if v, ok := volumeContext[common.VolumeAttributeSectorSize]; ok {
+		sectorSize, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %w", common.VolumeAttributeSectorSize, v, err)
+		}
+		opts.SectorSize = sectorSize
+	}
+	return opts, nil
+}
+
+// formatCryptDevice creates the LUKS2 header of a new volume with the given
+// options, so the cryptmapper only has to open it. The header gets a fresh
+// UUID and its keyslot is protected by the key derived from it, the same way
+// the cryptmapper formats devices. Devices which already hold a LUKS2 header
+// keep their format. Returns whether the device was formatted.
+func (ns *GCENodeServer) formatCryptDevice(ctx context.Context, volumeID, devicePath string, opts cryptsetup.FormatOptions) (bool, error) {
+	isLUKS, err := ns.CryptSetup.IsLUKS(devicePath)
+	if err != nil {
+		return false, err
+	}
+	if isLUKS {
+		return false, nil
+	}
+	format, err := getDiskFormat(devicePath, ns.Mounter)
+	if err != nil {
+		return false, fmt.Errorf("determining if disk is formatted: %w", err)
+	}
+	if format != "" {
+		return false, fmt.Errorf("disk %q is already formatted as: %s", devicePath, format)
+	}
+
+	luksUUID := uuid.New().String()
+	passphrase, err := ns.KMS.GetDEK(ctx, luksUUID, cryptsetup.KeySize)
+	if err != nil {
+		return false, fmt.Errorf("getting key for %s: %w", devicePath, err)
+	}
+	klog.V(4).Infof("Formatting volume %s as LUKS2 device with options %+v", volumeID, opts)
+	if err := ns.CryptSetup.Format(devicePath, luksUUID, passphrase, opts); err != nil {
+		return false, err
+	}
+	return true, nil
+}
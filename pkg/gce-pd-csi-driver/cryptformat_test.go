@@ -0,0 +1,265 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+// blkidExec returns an exec running blkid, which reports the given format,
+// or no format if it is empty. Other commands fail.
+func blkidExec(format string) *testingexec.FakeExec {
+	action := func(cmd string, args ...string) exec.Cmd {
+		return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) {
+					if format == "" {
+						return nil, nil, testingexec.FakeExitError{Status: 2}
+					}
+					return []byte("DEVNAME=/dev/sdb\nTYPE=" + format + "\n"), nil, nil
+				},
+			},
+		}, cmd, args...)
+	}
+	e := &testingexec.FakeExec{}
+	for range 10 {
+		e.CommandScript = append(e.CommandScript, action)
+	}
+	return e
+}
+
+func TestNodeStageVolumeCryptFormat(t *testing.T) {
+	testCases := []struct {
+		name          string
+		volumeContext map[string]string
+		fstype        string
+		diskFormat    string
+		isLUKS        bool
+		expFormat     *cryptsetup.FormatOptions
+		expIntegrity  bool
+		expErrCode    codes.Code
+	}{
+		{
+			name: "default format is left to the cryptmapper",
+		},
+		{
+			name: "custom format",
+			volumeContext: map[string]string{
+				common.VolumeAttributeCipher:       "aes-xts-plain64",
+				common.VolumeAttributeCryptKeySize: "256",
+				common.VolumeAttributeSectorSize:   "512",
+				common.VolumeAttributePBKDF:        "pbkdf2",
+			},
+			expFormat: &cryptsetup.FormatOptions{Cipher: "aes-xts-plain64", KeySize: 256, SectorSize: 512, PBKDF: "pbkdf2"},
+		},
+		{
+			name: "integrity algorithm enables integrity protection",
+			volumeContext: map[string]string{
+				common.VolumeAttributeCipher:             "aes-gcm-random",
+				common.VolumeAttributeIntegrityAlgorithm: "aead",
+			},
+			expFormat:    &cryptsetup.FormatOptions{Cipher: "aes-gcm-random", Integrity: "aead"},
+			expIntegrity: true,
+		},
+		{
+			name:          "integrity fstype uses default algorithm",
+			volumeContext: map[string]string{common.VolumeAttributeSectorSize: "512"},
+			fstype:        "ext4-integrity",
+			expFormat:     &cryptsetup.FormatOptions{SectorSize: 512, Integrity: cryptsetup.DefaultIntegrity},
+			expIntegrity:  true,
+		},
+		{
+			name:          "existing LUKS2 device keeps its format",
+			volumeContext: map[string]string{common.VolumeAttributeSectorSize: "512"},
+			isLUKS:        true,
+		},
+		{
+			name:          "disk with other data is not formatted",
+			volumeContext: map[string]string{common.VolumeAttributeSectorSize: "512"},
+			diskFormat:    "ext4",
+			expErrCode:    codes.Internal,
+		},
+		{
+			name:          "invalid sector size",
+			volumeContext: map[string]string{common.VolumeAttributeSectorSize: "4k"},
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper := &fakeCryptMapper{}
+			cryptSetup := cryptsetup.NewFakeCryptSetup()
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = !tc.isLUKS
+			gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec(tc.diskFormat)))
+			ns := gceDriver.ns
+			ns.CryptMapper = mapper
+			ns.CryptSetup = cryptSetup
+
+			capability := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}
+			if tc.fstype != "" {
+				// Mounting fails on the fake exec, only the crypt setup is of interest
+				capability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fstype}}
+			}
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          defaultVolumeID,
+				StagingTargetPath: filepath.Join(t.TempDir(), defaultStagingPath),
+				VolumeCapability:  capability,
+				VolumeContext:     tc.volumeContext,
+			})
+			if tc.expErrCode != codes.OK {
+				if status.Code(err) != tc.expErrCode {
+					t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+				}
+				return
+			}
+			if tc.fstype == "" && err != nil {
+				t.Fatalf("NodeStageVolume failed: %v", err)
+			}
+
+			got, formatted := cryptSetup.Formats[defaultLUKSDevicePath]
+			if tc.expFormat == nil {
+				if formatted {
+					t.Errorf("expected device not to be formatted, got format %+v", got)
+				}
+			} else if !formatted || got != *tc.expFormat {
+				t.Errorf("expected format %+v, got %+v", *tc.expFormat, got)
+			}
+			if formatted {
+				// The cryptmapper opens the device with the key derived from the new UUID
+				uuid := cryptSetup.UUIDs[defaultLUKSDevicePath]
+				key, err := kms.NewStaticKMS(make([]byte, 32)).GetDEK(context.Background(), uuid, cryptsetup.KeySize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keys := cryptSetup.Keys[defaultLUKSDevicePath]; len(keys) != 1 || keys[0] != string(key) {
+					t.Errorf("expected keyslot for the key of UUID %s", uuid)
+				}
+			}
+			if mapper.integrity != tc.expIntegrity {
+				t.Errorf("expected integrity %v, got %v", tc.expIntegrity, mapper.integrity)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeAttestation(t *testing.T) {
+	trusted := []byte("trusted-report")
+	keyServer := kms.NewFakeKeyServer([]byte("0123456789abcdef"))
+	keyServer.SetAttestationVerifier(func(_, report []byte) error {
+		if !bytes.Equal(report, trusted) {
+			return errors.New("untrusted node")
+		}
+		return nil
+	})
+	server := httptest.NewServer(keyServer)
+	defer server.Close()
+
+	testCases := []struct {
+		name       string
+		report     []byte
+		expErrCode codes.Code
+	}{
+		{
+			name:   "trusted node gets the key",
+			report: trusted,
+		},
+		{
+			name:       "untrusted node is rejected",
+			report:     []byte("tampered-report"),
+			expErrCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keyManager, err := kms.NewWithAttester(kms.BackendHTTP, server.URL, kms.NewFakeAttester(tc.report))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cryptSetup := cryptsetup.NewFakeCryptSetup()
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = true
+			gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec("")))
+			ns := gceDriver.ns
+			ns.CryptSetup = cryptSetup
+			ns.KMS = keyManager
+
+			req := rekeyStageRequest(t, "")
+			req.VolumeContext = map[string]string{common.VolumeAttributeSectorSize: "512"}
+			_, err = ns.NodeStageVolume(context.Background(), req)
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if _, formatted := cryptSetup.Formats[defaultLUKSDevicePath]; formatted != (tc.expErrCode == codes.OK) {
+				t.Errorf("expected device to be formatted only with a released key, got formatted %v", formatted)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeKMSUnavailable(t *testing.T) {
+	keyServer := kms.NewFakeKeyServer([]byte("0123456789abcdef"))
+	server := httptest.NewServer(keyServer)
+	defer server.Close()
+	backend, err := kms.New(kms.BackendHTTP, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(backoff wait.Backoff) { kms.KeyRequestBackoff = backoff }(kms.KeyRequestBackoff)
+	kms.KeyRequestBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 2}
+
+	cryptSetup := cryptsetup.NewFakeCryptSetup()
+	cryptSetup.NotLUKS[defaultLUKSDevicePath] = true
+	gceDriver := getTestGCEDriverWithCustomMounter(t, mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec("")))
+	ns := gceDriver.ns
+	ns.CryptSetup = cryptSetup
+	ns.KMS = kms.NewCachingKMS(backend, time.Minute, 10)
+
+	req := rekeyStageRequest(t, "")
+	req.VolumeContext = map[string]string{common.VolumeAttributeSectorSize: "512"}
+	keyServer.SetError(errors.New("key service restarting"))
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected error code %v, got %v", codes.Unavailable, err)
+	}
+	if requests := keyServer.Requests(); len(requests) != 2 {
+		t.Errorf("expected the key request to be retried once, got requests %v", requests)
+	}
+
+	keyServer.SetError(nil)
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
+)
+
+// CollectOrphanedCryptMappings closes crypt mappings which were opened by the
+// driver but are no longer in use. Such mappings are left behind if the driver
+// is interrupted between opening the mapping and mounting it in
+// NodeStageVolume, or between unmounting and closing it in NodeUnstageVolume,
+// and keep the PD from being detached. If dryRun is set, orphaned mappings are
+// only logged. The names of the orphaned mappings are returned.
+//
+// Only mappings with recorded crypt state are considered, since the state is
+// recorded before NodeStageVolume opens a mapping and removed once
+// NodeUnstageVolume closed it. Mappings of volumes which are staged, as
+// recorded in their crypt state, are never collected.
+func (ns *GCENodeServer) CollectOrphanedCryptMappings(dryRun bool) ([]string, error) {
+	if ns.cryptState == nil {
+		return nil, errors.New("collecting orphaned crypt mappings requires a crypt state directory")
+	}
+	names, err := ns.CryptSetup.Mappings()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []string
+	var errs []error
+	for _, name := range names {
+		ok, err := ns.collectCryptMapping(name, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("crypt mapping %s: %w", name, err))
+		}
+		if ok {
+			orphaned = append(orphaned, name)
+		}
+	}
+	return orphaned, errors.Join(errs...)
+}
+
+// RunCryptMappingCollector collects orphaned crypt mappings once, and then
+// every interval until ctx is cancelled. A zero interval only runs the
+// collector once.
+func (ns *GCENodeServer) RunCryptMappingCollector(ctx context.Context, interval time.Duration, dryRun bool) {
+	for {
+		if orphaned, err := ns.CollectOrphanedCryptMappings(dryRun); err != nil {
+			klog.Errorf("Failed to collect orphaned crypt mappings: %v", err)
+		} else if len(orphaned) > 0 {
+			klog.Infof("Collected %d orphaned crypt mappings: %v", len(orphaned), orphaned)
+		}
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// collectCryptMapping closes the crypt mapping name if it was opened by the
+// driver and is not in use, and returns whether it was orphaned.
+func (ns *GCENodeServer) collectCryptMapping(name string, dryRun bool) (bool, error) {
+	state, err := ns.cryptState.Get(name)
+	if err != nil {
+		return false, err
+	}
+	if state == nil || state.VolumeID == "" {
+		klog.V(6).Infof("Skipping crypt mapping %s, it was not opened by the driver", name)
+		return false, nil
+	}
+	if state.StagingTargetPath != "" {
+		klog.V(6).Infof("Skipping crypt mapping %s, volume %s is staged at %s", name, state.VolumeID, state.StagingTargetPath)
+		return false, nil
+	}
+
+	// Never race a NodeStageVolume or NodeUnstageVolume of the volume
+	if acquired := ns.volumeLocks.TryAcquire(state.VolumeID); !acquired {
+		klog.V(4).Infof("Skipping crypt mapping %s, an operation on volume %s is in progress", name, state.VolumeID)
+		return false, nil
+	}
+	defer ns.volumeLocks.Release(state.VolumeID)
+	if ns.reencryptions.running(name) || ns.wipes.running(name) {
+		klog.V(4).Infof("Skipping crypt mapping %s, a crypt operation on volume %s is running", name, state.VolumeID)
+		return false, nil
+	}
+
+	mapping, err := ns.CryptSetup.Mapping(name)
+	if err != nil {
+		return false, err
+	}
+	if mapping.InUse {
+		return false, nil
+	}
+	mappedPath := mappedDevicePrefix + name
+	mountPoints, err := ns.Mounter.List()
+	if err != nil {
+		return false, fmt.Errorf("listing mount points: %w", err)
+	}
+	for _, mp := range mountPoints {
+		if mp.Device == mappedPath {
+			return false, nil
+		}
+	}
+	if err := ns.confirmPathUnused(mappedPath); err != nil {
+		// Keep the mapping if its use can not be ruled out
+		klog.V(4).Infof("Skipping crypt mapping %s: %v", name, err)
+		return false, nil
+	}
+
+	if dryRun {
+		klog.Infof("Crypt mapping %s of volume %s is orphaned, not closing it in dry-run mode", name, state.VolumeID)
+		return true, nil
+	}
+	klog.Infof("Closing orphaned crypt mapping %s of volume %s", name, state.VolumeID)
+	err = ns.CryptMapper.CloseCryptDevice(name)
+	ns.emitAudit(ns.auditContext(context.Background(), state.VolumeID, nil), audit.OperationClose, err)
+	if err != nil {
+		return false, fmt.Errorf("closing orphaned mapping: %w", err)
+	}
+	if err := ns.forgetCryptState(name); err != nil {
+		klog.Warningf("Failed to remove crypt state of volume %s: %v", state.VolumeID, err)
+	}
+	return true, nil
+}
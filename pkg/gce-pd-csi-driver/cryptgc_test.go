@@ -0,0 +1,186 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+func TestCollectOrphanedCryptMappings(t *testing.T) {
+	testCases := []struct {
+		name     string
+		dryRun   bool
+		noState  bool
+		inUse    bool
+		mounted  bool
+		locked   bool
+		staged   bool
+		expFound bool
+		expClose bool
+	}{
+		{
+			name:     "close orphaned mapping",
+			expFound: true,
+			expClose: true,
+		},
+		{
+			name:     "dry run",
+			dryRun:   true,
+			expFound: true,
+		},
+		{
+			name:    "mapping not opened by the driver",
+			noState: true,
+		},
+		{
+			name:  "mapping held open",
+			inUse: true,
+		},
+		{
+			name:    "mapping mounted",
+			mounted: true,
+		},
+		{
+			name:   "volume operation in progress",
+			locked: true,
+		},
+		{
+			name:   "volume staged",
+			staged: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			mapper := ns.CryptMapper.(*fakeCryptMapper)
+
+			oldPrefix := mappedDevicePrefix
+			mappedDevicePrefix = t.TempDir() + "/"
+			t.Cleanup(func() { mappedDevicePrefix = oldPrefix })
+			mappedPath := mappedDevicePrefix + "testDisk"
+			if err := os.WriteFile(mappedPath, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			mounter := mountmanager.NewFakeSafeMounterWithCustomExec(&testingexec.FakeExec{})
+			if tc.mounted {
+				mounter.Interface.(*mount.FakeMounter).MountPoints = []mount.MountPoint{
+					{Device: mappedPath, Path: filepath.Join(t.TempDir(), "staging"), Type: "ext4"},
+				}
+			}
+			ns.Mounter = mounter
+
+			cryptSetup.Mapped["testDisk"] = &cryptsetup.Mapping{Name: "testDisk", Type: "LUKS2", Device: "/dev/sdb", InUse: tc.inUse}
+			if !tc.noState {
+				if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+					state.VolumeID = defaultVolumeID
+					state.DevicePath = defaultLUKSDevicePath
+					if tc.staged {
+						state.StagingTargetPath = filepath.Join(t.TempDir(), defaultStagingPath)
+					}
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.locked {
+				ns.volumeLocks.TryAcquire(defaultVolumeID)
+				defer ns.volumeLocks.Release(defaultVolumeID)
+			}
+
+			orphaned, err := ns.CollectOrphanedCryptMappings(tc.dryRun)
+			if err != nil {
+				t.Fatalf("CollectOrphanedCryptMappings failed: %v", err)
+			}
+
+			var expOrphaned, expClosed []string
+			if tc.expFound {
+				expOrphaned = []string{"testDisk"}
+			}
+			if tc.expClose {
+				expClosed = []string{"testDisk"}
+			}
+			if diff := cmp.Diff(expOrphaned, orphaned); diff != "" {
+				t.Errorf("unexpected orphaned mappings: %s", diff)
+			}
+			if diff := cmp.Diff(expClosed, mapper.closed); diff != "" {
+				t.Errorf("unexpected closed mappings: %s", diff)
+			}
+			state, err := store.Get("testDisk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expClose && state != nil {
+				t.Errorf("expected crypt state of closed mapping to be removed")
+			}
+			if !tc.expClose && !tc.noState && state == nil {
+				t.Errorf("expected crypt state of kept mapping to remain")
+			}
+		})
+	}
+}
+
+func TestCollectOrphanedCryptMappingsStagedBlockVolume(t *testing.T) {
+	gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	mapper := ns.CryptMapper.(*fakeCryptMapper)
+
+	oldPrefix := mappedDevicePrefix
+	mappedDevicePrefix = t.TempDir() + "/"
+	t.Cleanup(func() { mappedDevicePrefix = oldPrefix })
+	if err := os.WriteFile(mappedDevicePrefix+"testDisk", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A raw block volume is neither mounted nor held open between its stage and publish
+	req := rekeyStageRequest(t, "")
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	cryptSetup.Mapped["testDisk"] = &cryptsetup.Mapping{Name: "testDisk", Type: "LUKS2", Device: "/dev/sdb"}
+
+	orphaned, err := ns.CollectOrphanedCryptMappings(false)
+	if err != nil {
+		t.Fatalf("CollectOrphanedCryptMappings failed: %v", err)
+	}
+	if len(orphaned) != 0 || len(mapper.closed) != 0 {
+		t.Errorf("expected mapping of staged block volume to be kept, got orphaned %v, closed %v", orphaned, mapper.closed)
+	}
+	state, err := store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.StagingTargetPath != req.GetStagingTargetPath() {
+		t.Errorf("expected staging target path %q in crypt state, got %+v", req.GetStagingTargetPath(), state)
+	}
+}
+
+func TestCollectOrphanedCryptMappingsWithoutStateStore(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	if _, err := gceDriver.ns.CollectOrphanedCryptMappings(false); err == nil {
+		t.Fatal("expected an error without crypt state store")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"sync"
+)
+
+// cryptJobs tracks long running crypt operations of one kind, such as online
+// reencryptions, running on this node by crypt mapping name.
+type cryptJobs struct {
+	mux  sync.Mutex
+	jobs map[string]*cryptJob
+}
+
+type cryptJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newCryptJobs() *cryptJobs {
+	return &cryptJobs{jobs: map[string]*cryptJob{}}
+}
+
+// start runs fn in the background unless a job for name is already running.
+func (r *cryptJobs) start(name string, fn func(ctx context.Context)) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.jobs[name]; ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &cryptJob{cancel: cancel, done: make(chan struct{})}
+	r.jobs[name] = job
+	go func() {
+		defer func() {
+			r.mux.Lock()
+			delete(r.jobs, name)
+			r.mux.Unlock()
+			close(job.done)
+		}()
+		fn(ctx)
+	}()
+	return true
+}
+
+// stop cancels the job for name, if any, and waits for it to return.
+func (r *cryptJobs) stop(name string) {
+	r.mux.Lock()
+	job, ok := r.jobs[name]
+	r.mux.Unlock()
+	if !ok {
+		return
+	}
+	job.cancel()
+	<-job.done
+}
+
+func (r *cryptJobs) running(name string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	_, ok := r.jobs[name]
+	return ok
+}
@@ -41,7 +41,9 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
 	common "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
@@ -91,12 +93,17 @@ func (gceDriver *GCEDriver) SetupGCEDriver(name, vendorVersion string, extraVolu
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,       // [Edgeless]
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION, // [Edgeless]
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,     // [Edgeless]
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,    // [Edgeless]
 	}
 	gceDriver.AddControllerServiceCapabilities(csc)
 	ns := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION, // [Edgeless]
 	}
 	gceDriver.AddNodeServiceCapabilities(ns)
 
@@ -161,7 +168,11 @@ func NewIdentityServer(gceDriver *GCEDriver) *GCEIdentityServer {
 	}
 }
 
-func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, deviceUtils deviceutils.DeviceUtils, meta metadataservice.MetadataService, statter mountmanager.Statter, mapper cryptMapper) *GCENodeServer {
+func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, deviceUtils deviceutils.DeviceUtils, meta metadataservice.MetadataService, statter mountmanager.Statter, mapper cryptMapper, kms keyCreator, cryptSetup cryptsetup.CryptSetup, auditor audit.Emitter) *GCENodeServer {
+	// [Edgeless] If set, key requests and crypt operations are recorded in the audit log
+	if auditor != nil {
+		kms = audit.NewKMS(kms, auditor)
+	}
 	return &GCENodeServer{
 		Driver:          gceDriver,
 		Mounter:         mounter,
@@ -170,6 +181,12 @@ func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, devi
 		volumeLocks:     common.NewVolumeLocks(),
 		VolumeStatter:   statter,
 		CryptMapper:     mapper,
+		KMS:             kms,
+		CryptSetup:      cryptSetup,
+		reencryptions:   newCryptJobs(),
+		wipes:           newCryptJobs(),
+		imports:         newCryptJobs(),
+		auditor:         auditor,
 	}
 }
 
@@ -0,0 +1,56 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/klog/v2"
+)
+
+// backupHeader stores a backup of the LUKS2 header of devicePath in the header
+// backup sink, unless the sink already holds a backup of the header's UUID.
+// If replace is set, an existing backup is replaced, e.g. after the volume key
+// was changed by a reencryption.
+func (ns *GCENodeServer) backupHeader(ctx context.Context, volumeID, devicePath string, replace bool) error {
+	if ns.headerBackup == nil {
+		return nil
+	}
+	uuid, err := ns.CryptSetup.UUID(devicePath)
+	if err != nil {
+		return err
+	}
+	if !replace {
+		has, err := ns.headerBackup.Has(ctx, volumeID, uuid)
+		if err != nil {
+			return err
+		}
+		if has {
+			return nil
+		}
+	}
+
+	header, err := ns.CryptSetup.BackupHeader(devicePath)
+	if err != nil {
+		return err
+	}
+	if err := ns.headerBackup.Store(ctx, volumeID, uuid, header); err != nil {
+		return fmt.Errorf("storing header backup: %w", err)
+	}
+	klog.V(4).Infof("Stored backup of LUKS2 header %s of volume %s", uuid, volumeID)
+	return nil
+}
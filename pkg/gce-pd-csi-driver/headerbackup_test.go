@@ -0,0 +1,78 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/headerbackup"
+)
+
+func TestNodeStageVolumeHeaderBackup(t *testing.T) {
+	ctx := context.Background()
+	gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	sink, err := headerbackup.NewDirSink(filepath.Join(t.TempDir(), "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.WithHeaderBackup(sink)
+
+	stage := func() {
+		t.Helper()
+		if _, err := ns.NodeStageVolume(ctx, rekeyStageRequest(t, "")); err != nil {
+			t.Fatalf("NodeStageVolume failed: %v", err)
+		}
+	}
+	wantBackup := func(uuid string, backups int) {
+		t.Helper()
+		header, err := sink.Load(ctx, defaultVolumeID, uuid)
+		if err != nil {
+			t.Fatalf("loading header backup %s: %v", uuid, err)
+		}
+		if want := "header of " + defaultLUKSDevicePath + " with UUID " + uuid; string(header) != want {
+			t.Errorf("expected header backup %q, got %q", want, header)
+		}
+		if got := cryptSetup.HeaderBackups[defaultLUKSDevicePath]; got != backups {
+			t.Errorf("expected %d header backups, got %d", backups, got)
+		}
+	}
+
+	// The header is backed up once
+	cryptSetup.UUIDs[defaultLUKSDevicePath] = "uuid-1"
+	stage()
+	wantBackup("uuid-1", 1)
+	stage()
+	wantBackup("uuid-1", 1)
+
+	// A new header, e.g. after rewrapping the keyslot, is backed up again
+	cryptSetup.UUIDs[defaultLUKSDevicePath] = "uuid-2"
+	stage()
+	wantBackup("uuid-2", 2)
+
+	// A reencryption replaces the backup, the outdated ones are deleted
+	if err := ns.reencrypt(ctx, defaultVolumeID, "testDisk", defaultLUKSDevicePath, "1", false); err != nil {
+		t.Fatalf("reencrypt failed: %v", err)
+	}
+	wantBackup(cryptSetup.UUIDs[defaultLUKSDevicePath], 3)
+	for _, uuid := range []string{"uuid-1", "uuid-2"} {
+		if has, err := sink.Has(ctx, defaultVolumeID, uuid); err != nil || has {
+			t.Errorf("Has(%s) = %v, %v, want false", uuid, has, err)
+		}
+	}
+}
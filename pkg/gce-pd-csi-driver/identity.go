@@ -23,6 +23,8 @@ import (
 )
 
 type GCEIdentityServer struct {
+	csi.UnimplementedIdentityServer // [Edgeless]
+
 	Driver *GCEDriver
 }
 
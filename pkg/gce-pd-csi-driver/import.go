@@ -0,0 +1,214 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+// reconcileImport starts or resumes the in-place encryption of the imported
+// unencrypted disk at devicePath. It returns whether the data of the volume is
+// encrypted.
+//
+// The filesystem is shrunk to make room for the LUKS2 header, then the header
+// is created and the data is encrypted offline in the background. Staging
+// grows the filesystem to the size of the mapped device afterwards. Once the
+// header exists, an interrupted encryption is resumed from it, on any node.
+// Disks without a header are only encrypted if the controller allowed it, or
+// if the crypt state of the node records an import of the volume which was
+// interrupted before the header was created. Other disks which were already
+// handed out are refused: encrypting them twice or formatting them would
+// destroy their data.
+func (ns *GCENodeServer) reconcileImport(volumeID, name, devicePath, keyScope string, allowed bool, opts cryptsetup.FormatOptions) (bool, error) {
+	if ns.imports.running(name) {
+		return false, nil
+	}
+	isLUKS, err := ns.CryptSetup.IsLUKS(devicePath)
+	if err != nil {
+		return false, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to check for a LUKS2 header on volume %v: %v", volumeID, err))
+	}
+	if isLUKS {
+		inProgress, err := ns.CryptSetup.ReencryptionInProgress(devicePath)
+		if err != nil {
+			return false, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to check for an interrupted import of volume %v: %v", volumeID, err))
+		}
+		if !inProgress {
+			return true, nil
+		}
+		klog.V(4).Infof("Resuming in-place encryption of volume %s", volumeID)
+		ns.imports.start(name, func(ctx context.Context) {
+			ns.runImport(ctx, volumeID, name, devicePath, keyScope, nil)
+		})
+		return false, nil
+	}
+
+	format, err := getDiskFormat(devicePath, ns.Mounter)
+	if err != nil {
+		return false, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to determine filesystem of volume %v: %v", volumeID, err))
+	}
+	if !allowed {
+		interrupted, err := ns.importInterrupted(volumeID, name)
+		if err != nil {
+			return false, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to read crypt state of volume %v: %v", volumeID, err))
+		}
+		if !interrupted {
+			return false, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v was already handed out for import, but %s holds no LUKS2 header (found %q) and no interrupted import is recorded on this node: refusing to encrypt or format it", volumeID, devicePath, format))
+		}
+		// The node was interrupted before it created the header, the data is still unencrypted
+		klog.V(4).Infof("Volume %s was already handed out for import, resuming the import interrupted before its LUKS2 header was created", volumeID)
+	}
+	switch format {
+	case "ext2", fsTypeExt3, defaultLinuxFsType:
+	default:
+		return false, status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v can not be imported: only ext filesystems can be shrunk to make room for the LUKS2 header, found %q", volumeID, format))
+	}
+
+	klog.V(4).Infof("Starting in-place encryption of volume %s", volumeID)
+	ns.imports.start(name, func(ctx context.Context) {
+		ns.runImport(ctx, volumeID, name, devicePath, keyScope, func(ctx context.Context) error {
+			return ns.initImport(ctx, volumeID, devicePath, format, keyScope, opts)
+		})
+	})
+	return false, nil
+}
+
+// importInterrupted returns whether the crypt state of name records an import
+// of volumeID which did not complete.
+func (ns *GCENodeServer) importInterrupted(volumeID, name string) (bool, error) {
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil {
+		return false, err
+	}
+	return state.VolumeID == volumeID && state.Import != nil && state.Import.Phase != cryptsetup.PhaseComplete, nil
+}
+
+// initImport shrinks the filesystem on devicePath and creates the LUKS2 header
+// for its in-place encryption.
+func (ns *GCENodeServer) initImport(ctx context.Context, volumeID, devicePath, format, keyScope string, opts cryptsetup.FormatOptions) error {
+	size, err := getBlockSizeBytes(devicePath, ns.Mounter)
+	if err != nil {
+		return err
+	}
+	if size <= cryptsetup.EncryptReduceSize {
+		return fmt.Errorf("disk %s is too small to be encrypted", devicePath)
+	}
+	klog.V(4).Infof("Shrinking %s filesystem of volume %s by %d bytes", format, volumeID, cryptsetup.EncryptReduceSize)
+	if err := shrinkFilesystem(devicePath, format, size-cryptsetup.EncryptReduceSize, ns.Mounter); err != nil {
+		return err
+	}
+
+	luksUUID := uuid.New().String()
+	passphrase, err := ns.KMS.GetDEK(kms.WithKeyScope(ctx, keyScope), luksUUID, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting key for %s: %w", devicePath, err)
+	}
+	klog.V(4).Infof("Creating LUKS2 header for in-place encryption of volume %s with options %+v", volumeID, opts)
+	return ns.CryptSetup.InitEncryption(devicePath, luksUUID, passphrase, opts)
+}
+
+// runImport calls init, if set, and then encrypts the data of devicePath,
+// recording the progress in the crypt state of name. An interrupted import is
+// resumed on the next stage.
+func (ns *GCENodeServer) runImport(ctx context.Context, volumeID, name, devicePath, keyScope string, init func(ctx context.Context) error) {
+	ctx = ns.auditContext(ctx, volumeID, nil)
+	now := time.Now()
+	if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		if state.Import == nil || state.Import.Phase == cryptsetup.PhaseComplete {
+			state.Import = &cryptsetup.OperationState{StartedAt: now}
+		}
+		state.Import.Phase = cryptsetup.PhaseRunning
+		state.Import.Error = ""
+		state.Import.UpdatedAt = now
+	}); err != nil {
+		klog.Errorf("Import of volume %s failed: %v", volumeID, err)
+		return
+	}
+
+	err := ns.encryptImport(ctx, name, devicePath, keyScope, init)
+	if ctx.Err() != nil {
+		// Interrupted by unstaging or shutdown, the import is resumed the next time the volume is staged
+		klog.V(4).Infof("Import of volume %s interrupted, it will be resumed on the next stage", volumeID)
+		return
+	}
+	if updateErr := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.Import.UpdatedAt = time.Now()
+		if err != nil {
+			state.Import.Phase = cryptsetup.PhaseFailed
+			state.Import.Error = err.Error()
+			return
+		}
+		state.Import.Phase = cryptsetup.PhaseComplete
+	}); updateErr != nil {
+		klog.Warningf("Failed to record import state of %s: %v", name, updateErr)
+	}
+	if err != nil {
+		klog.Errorf("Import of volume %s failed: %v", volumeID, err)
+		return
+	}
+	klog.V(4).Infof("Import of volume %s succeeded", volumeID)
+}
+
+func (ns *GCENodeServer) encryptImport(ctx context.Context, name, devicePath, keyScope string, init func(ctx context.Context) error) error {
+	if init != nil {
+		if err := init(ctx); err != nil {
+			return err
+		}
+	}
+	uuid, err := ns.CryptSetup.UUID(devicePath)
+	if err != nil {
+		return err
+	}
+	passphrase, err := ns.KMS.GetDEK(kms.WithKeyScope(ctx, keyScope), uuid, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting key for %s: %w", devicePath, err)
+	}
+	progress := func(done, total uint64) {
+		if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+			state.Import.BytesDone = done
+			state.Import.BytesTotal = total
+			state.Import.UpdatedAt = time.Now()
+		}); err != nil {
+			klog.Warningf("Failed to record import progress of %s: %v", name, err)
+		}
+	}
+	return ns.CryptSetup.Reencrypt(ctx, devicePath, passphrase, true, progress)
+}
+
+// importProgress describes the progress of the import of name for error messages.
+func (ns *GCENodeServer) importProgress(name string) string {
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil || state.Import == nil {
+		return "0%"
+	}
+	if state.Import.Phase == cryptsetup.PhaseFailed {
+		return "failed: " + state.Import.Error
+	}
+	if state.Import.BytesTotal == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", state.Import.BytesDone*100/state.Import.BytesTotal)
+}
@@ -0,0 +1,317 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+// importExec fakes the commands run on a disk of the given size holding a filesystem
+// of the given format, recording the commands run.
+type importExec struct {
+	mux      sync.Mutex
+	format   string
+	size     int64
+	commands [][]string
+}
+
+func (e *importExec) exec() *testingexec.FakeExec {
+	action := func(cmd string, args ...string) exec.Cmd {
+		e.mux.Lock()
+		e.commands = append(e.commands, append([]string{cmd}, args...))
+		e.mux.Unlock()
+		return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) {
+					switch cmd {
+					case "blkid":
+						if e.format == "" {
+							return nil, nil, testingexec.FakeExitError{Status: 2}
+						}
+						return []byte("DEVNAME=/dev/sdb\nTYPE=" + e.format + "\n"), nil, nil
+					case "blockdev":
+						return []byte(strconv.FormatInt(e.size, 10) + "\n"), nil, nil
+					}
+					return nil, nil, nil
+				},
+			},
+		}, cmd, args...)
+	}
+	fakeExec := &testingexec.FakeExec{}
+	for range 10 {
+		fakeExec.CommandScript = append(fakeExec.CommandScript, action)
+	}
+	return fakeExec
+}
+
+func (e *importExec) ran(cmd ...string) bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return slices.ContainsFunc(e.commands, func(c []string) bool { return slices.Equal(c, cmd) })
+}
+
+func TestNodeStageVolumeImport(t *testing.T) {
+	const size = 10 << 30
+
+	testCases := []struct {
+		name         string
+		isLUKS       bool
+		reencrypting bool
+		allowed      bool
+		// importState is the import recorded in the crypt state of the node
+		importState *cryptsetup.OperationState
+		format      string
+		fsType      string
+		expEncrypt  bool
+		expResume   bool
+		expCode     codes.Code
+	}{
+		{
+			name:       "import unencrypted disk",
+			allowed:    true,
+			format:     "ext4",
+			expEncrypt: true,
+			expResume:  true,
+			expCode:    codes.Aborted,
+		},
+		{
+			name:        "resume import interrupted before the header was created",
+			importState: &cryptsetup.OperationState{Phase: cryptsetup.PhaseRunning},
+			format:      "ext4",
+			expEncrypt:  true,
+			expResume:   true,
+			expCode:     codes.Aborted,
+		},
+		{
+			name:    "unencrypted disk was already handed out for import",
+			format:  "ext4",
+			expCode: codes.FailedPrecondition,
+		},
+		{
+			name:        "completed import recorded for a disk without header",
+			importState: &cryptsetup.OperationState{Phase: cryptsetup.PhaseComplete},
+			format:      "ext4",
+			expCode:     codes.FailedPrecondition,
+		},
+		{
+			name:    "disk was already handed out for import",
+			expCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "filesystem can not be shrunk",
+			allowed: true,
+			format:  "xfs",
+			expCode: codes.FailedPrecondition,
+		},
+		{
+			name:         "resume interrupted import",
+			isLUKS:       true,
+			reencrypting: true,
+			expResume:    true,
+			expCode:      codes.Aborted,
+		},
+		{
+			name:   "already imported",
+			isLUKS: true,
+		},
+		{
+			name:    "integrity requested",
+			allowed: true,
+			format:  "ext4",
+			fsType:  "ext4-integrity",
+			expCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			e := &importExec{format: tc.format, size: size}
+			ns.Mounter = mountmanager.NewFakeSafeMounterWithCustomExec(e.exec())
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = !tc.isLUKS
+			cryptSetup.Reencrypting[defaultLUKSDevicePath] = tc.reencrypting
+			if tc.importState != nil {
+				if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+					state.VolumeID = defaultVolumeID
+					state.Import = tc.importState
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req := rekeyStageRequest(t, "")
+			req.VolumeContext = map[string]string{common.VolumeAttributeImportPlaintext: "true"}
+			if tc.allowed {
+				req.PublishContext = map[string]string{common.VolumeAttributeImportPlaintext: "true"}
+			}
+			if tc.fsType != "" {
+				req.VolumeCapability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fsType}}
+			}
+			_, err := ns.NodeStageVolume(context.Background(), req)
+			if code := status.Code(err); code != tc.expCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.expCode, code, err)
+			}
+			<-waitForJob(ns.imports, "testDisk")
+
+			if _, ok := cryptSetup.Encryptions[defaultLUKSDevicePath]; ok != tc.expEncrypt {
+				t.Errorf("expected encryption to be initialized: %v, got %v", tc.expEncrypt, ok)
+			}
+			if tc.expEncrypt && !e.ran("resize2fs", defaultLUKSDevicePath, strconv.Itoa((size-cryptsetup.EncryptReduceSize)/1024)+"K") {
+				t.Errorf("expected filesystem to be shrunk by %d bytes, ran %v", cryptsetup.EncryptReduceSize, e.commands)
+			}
+			if resumed := slices.Contains(cryptSetup.Reencryptions, defaultLUKSDevicePath); resumed != tc.expResume {
+				t.Errorf("expected data to be encrypted: %v, got %v", tc.expResume, resumed)
+			}
+			if !tc.expResume {
+				return
+			}
+			state, err := store.Get("testDisk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state == nil || state.Import == nil || state.Import.Phase != cryptsetup.PhaseComplete {
+				t.Fatalf("expected a completed import in the crypt state, got %+v", state)
+			}
+
+			// The volume is mapped once its data is encrypted
+			if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodeStageVolume after import failed: %v", err)
+			}
+			if mapper := ns.CryptMapper.(*fakeCryptMapper); len(mapper.keyScopes) != 1 {
+				t.Errorf("expected the crypt device to be opened once, got %d", len(mapper.keyScopes))
+			}
+		})
+	}
+}
+
+func TestCreateVolumeDiskSource(t *testing.T) {
+	imageSource := "projects/images-project/global/images/base"
+	testCases := []struct {
+		name          string
+		params        map[string]string
+		contentSource *csi.VolumeContentSource
+		imageLabels   map[string]string
+		expContext    map[string]string
+		expSource     string
+		expErrCode    codes.Code
+	}{
+		{
+			name:       "encrypted volume from image",
+			params:     map[string]string{common.ParameterKeyDiskSource: imageSource},
+			expContext: map[string]string{common.VolumeAttributeImportPlaintext: "true"},
+		},
+		{
+			name:       "plain volume from image",
+			params:     map[string]string{common.ParameterKeyDiskSource: imageSource, common.ParameterKeyEncryption: common.EncryptionNone},
+			expContext: map[string]string{common.VolumeAttributeEncryption: common.EncryptionNone},
+		},
+		{
+			name:       "volume from image family",
+			params:     map[string]string{common.ParameterKeyDiskSource: "projects/images-project/global/images/family/base-family"},
+			expContext: map[string]string{common.VolumeAttributeImportPlaintext: "true"},
+			expSource:  imageSource,
+		},
+		{
+			name:       "missing image family",
+			params:     map[string]string{common.ParameterKeyDiskSource: "projects/images-project/global/images/family/missing"},
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:        "image family encrypted by the driver",
+			params:      map[string]string{common.ParameterKeyDiskSource: "projects/images-project/global/images/family/base-family"},
+			imageLabels: map[string]string{common.KeyScopeLabel: "tenant-a"},
+			expErrCode:  codes.InvalidArgument,
+		},
+		{
+			name:       "missing image",
+			params:     map[string]string{common.ParameterKeyDiskSource: "projects/images-project/global/images/missing"},
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:        "image encrypted by the driver",
+			params:      map[string]string{common.ParameterKeyDiskSource: imageSource},
+			imageLabels: map[string]string{common.KeyScopeLabel: "tenant-a"},
+			expErrCode:  codes.InvalidArgument,
+		},
+		{
+			name:   "volume content source",
+			params: map[string]string{common.ParameterKeyDiskSource: imageSource},
+			contentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "projects/test-project/global/snapshots/snapshot"},
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver := initGCEDriver(t, nil)
+			if _, err := gceDriver.cs.CloudProvider.CreateImage(context.Background(), project, meta.ZonalKey("source", zone), "base", common.SnapshotParameters{Labels: tc.imageLabels, ImageFamily: "base-family"}); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:                name,
+				CapacityRange:       stdCapRange,
+				VolumeCapabilities:  stdVolCaps,
+				Parameters:          tc.params,
+				VolumeContentSource: tc.contentSource,
+			})
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetVolume().GetContentSource() != nil {
+				t.Errorf("expected no volume content source, got %v", resp.GetVolume().GetContentSource())
+			}
+			if diff := cmp.Diff(tc.expContext, resp.GetVolume().GetVolumeContext()); diff != "" {
+				t.Errorf("unexpected volume context (-want +got):\n%s", diff)
+			}
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, meta.ZonalKey(name, zone), gce.GCEAPIVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expSource := tc.params[common.ParameterKeyDiskSource]
+			if tc.expSource != "" {
+				expSource = tc.expSource
+			}
+			if disk.GetImageId() != expSource {
+				t.Errorf("expected disk created from %s, got %s", expSource, disk.GetImageId())
+			}
+		})
+	}
+}
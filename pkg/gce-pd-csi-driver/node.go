@@ -52,9 +52,13 @@ import (
 	"k8s.io/mount-utils"
 
 	"github.com/edgelesssys/constellation/v2/csi/cryptmapper"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/headerbackup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/resizefs"
 )
@@ -66,13 +70,46 @@ type cryptMapper interface {
 	GetDevicePath(volumeID string) (string, error)
 }
 
+type keyCreator interface {
+	GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error)
+}
+
+// [Edgeless] keyCache keeps volume keys in memory.
+type keyCache interface {
+	// SkipKeyScope evicts the keys of scope and never caches them again.
+	SkipKeyScope(scope string)
+}
+
 type GCENodeServer struct {
+	csi.UnimplementedNodeServer // [Edgeless]
+
 	Driver          *GCEDriver
 	Mounter         *mount.SafeFormatAndMount
 	DeviceUtils     deviceutils.DeviceUtils
 	VolumeStatter   mountmanager.Statter
 	MetadataService metadataservice.MetadataService
 	CryptMapper     cryptMapper
+	CryptSetup      cryptsetup.CryptSetup
+	KMS             keyCreator
+
+	// Persistent state of long running crypt operations, required for online re-keying
+	// and background integrity initialization
+	cryptState    *cryptsetup.StateStore
+	reencryptions *cryptJobs
+	wipes         *cryptJobs
+	imports       *cryptJobs
+
+	// If set, the LUKS2 headers of staged volumes are backed up to this sink
+	headerBackup headerbackup.Sink
+
+	// If set, key requests and crypt operations are recorded in this audit log
+	auditor audit.Emitter
+
+	// If set, keys of crypto-shredded volumes are kept out of this cache
+	keyCache keyCache
+
+	// I/O error counts of the disks of staged volumes at their last health check
+	ioErrors ioErrorCounts
 
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
@@ -139,7 +176,42 @@ func (ns *GCENodeServer) WithSerializedFormatAndMount(timeout time.Duration, max
 	return ns
 }
 
-func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// WithKeyCache sets the cache of the node's KMS, so the keys of volumes
+// whose key scope is destroyed on deletion are never cached. Scopes of such
+// volumes already recorded in the crypt state store are skipped right away.
+func (ns *GCENodeServer) WithKeyCache(cache keyCache) *GCENodeServer {
+	ns.keyCache = cache
+	if ns.cryptState == nil {
+		return ns
+	}
+	states, err := ns.cryptState.List()
+	if err != nil {
+		klog.Errorf("Failed to list crypt state for crypto-shredded key scopes: %v", err)
+		return ns
+	}
+	for _, state := range states {
+		if state.CryptoShred && state.KeyScope != "" {
+			cache.SkipKeyScope(state.KeyScope)
+		}
+	}
+	return ns
+}
+
+// WithCryptStateStore sets the store used to persist the state of long
+// running crypt operations, such as online reencryptions.
+func (ns *GCENodeServer) WithCryptStateStore(store *cryptsetup.StateStore) *GCENodeServer {
+	ns.cryptState = store
+	return ns
+}
+
+// WithHeaderBackup sets the sink the LUKS2 headers of staged volumes are
+// backed up to.
+func (ns *GCENodeServer) WithHeaderBackup(sink headerbackup.Sink) *GCENodeServer {
+	ns.headerBackup = sink
+	return ns
+}
+
+func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, retErr error) { // [Edgeless] named error for the audit log
 	// Validate Arguments
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
@@ -164,6 +236,11 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
+	// [Edgeless] Record the pod the volume is published to, only NodePublishVolume requests carry the pod info
+	defer func() {
+		ns.emitAudit(ns.auditContext(ctx, volumeID, req.GetVolumeContext()), audit.OperationPublish, retErr)
+	}()
+
 	if err := validateVolumeCapability(volumeCapability); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapability is invalid: %v", err.Error()))
 	}
@@ -201,13 +278,20 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	} else if blk := volumeCapability.GetBlock(); blk != nil {
 		klog.V(4).Infof("NodePublishVolume with block volume mode")
 
-		// [Edgeless] use the mapped device created by NodeStageVolume
+		// [Edgeless] use the mapped device created by NodeStageVolume, or the disk itself for plain volumes
 		_, volumeKey, err := common.VolumeIDToKey(volumeID)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err.Error()))
 		}
 
 		sourcePath = filepath.Join("/dev/mapper", volumeKey.Name)
+		if req.GetVolumeContext()[common.VolumeAttributeEncryption] == common.EncryptionNone {
+			partition := req.GetVolumeContext()[common.VolumeAttributePartition]
+			sourcePath, err = getDevicePath(ns, volumeID, partition)
+			if err != nil {
+				return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err.Error()))
+			}
+		}
 
 		// Expose block volume as file at target path
 		err = makeFile(targetPath)
@@ -339,6 +423,9 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 
 	// Part 2: Check if mount already exists at stagingTargetPath
 	if ns.isVolumePathMounted(stagingTargetPath) {
+		if err := ns.recordStagingPath(volumeKey.Name, stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+		}
 		klog.V(4).Infof("NodeStageVolume succeeded on volume %v to %s, mount already exists.", volumeID, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -366,20 +453,24 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 
 	// [Edgeless] Part 2.5: Map the device as a crypt device, creating a new LUKS partition if needed
 	fstype, integrity := cryptmapper.IsIntegrityFS(fstype)
-	if integrity {
-		klog.V(4).Infof("Integrity protected FS requested. Preparing to wipe device...")
-	}
-
-	klog.V(4).Infof("Creating LUKS2 device on %s", devicePath)
-	devicePath, err = ns.CryptMapper.OpenCryptDevice(ctx, devicePath, volumeKey.Name, integrity)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed on volume %v to %s, open crypt device failed (%v)", devicePath, stagingTargetPath, err))
+	if req.GetVolumeContext()[common.VolumeAttributeEncryption] == common.EncryptionNone {
+		// [Edgeless] Plain volumes are formatted and mounted without a crypt mapping
+		if err := ns.preparePlainDevice(volumeID, volumeKey.Name, devicePath, integrity); err != nil {
+			return nil, err
+		}
+	} else {
+		devicePath, err = ns.stageCryptDevice(ctx, req, volumeKey.Name, devicePath, integrity)
+		if err != nil {
+			return nil, err
+		}
 	}
-	klog.V(4).Infof("Successfully created LUKS2 device on %s", devicePath)
 
 	// Part 3: Mount device to stagingTargetPath
 	if blk := volumeCapability.GetBlock(); blk != nil {
 		// Noop for Block NodeStageVolume
+		if err := ns.recordStagingPath(volumeKey.Name, stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+		}
 		klog.V(4).Infof("NodeStageVolume succeeded on %v to %s, capability is block so this is a no-op", volumeID, stagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -403,6 +494,9 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 			options = append(options, "noload")
 			err = ns.formatAndMount(devicePath, stagingTargetPath, fstype, options, ns.Mounter)
 			if err == nil {
+				if err := ns.recordStagingPath(volumeKey.Name, stagingTargetPath); err != nil {
+					return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+				}
 				klog.V(4).Infof("NodeStageVolume succeeded with \"noload\" option on %v to %s", volumeID, stagingTargetPath)
 				return &csi.NodeStageVolumeResponse{}, nil
 			}
@@ -429,10 +523,181 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		}
 	}
 
+	// [Edgeless] Part 6: Record that the volume is staged, its crypt mapping is never collected
+	if err := ns.recordStagingPath(volumeKey.Name, stagingTargetPath); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+	}
+
 	klog.V(4).Infof("NodeStageVolume succeeded on %v to %s", volumeID, stagingTargetPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// [Edgeless] stageCryptDevice maps the LUKS2 device at devicePath as the crypt
+// device name, formatting it first if needed, and starts or resumes pending
+// reencryptions and integrity initializations. Read-only volumes are mapped
+// read-only instead. It returns the path of the mapped device.
+func (ns *GCENodeServer) stageCryptDevice(ctx context.Context, req *csi.NodeStageVolumeRequest, name, devicePath string, integrity bool) (string, error) {
+	volumeID := req.GetVolumeId()
+	stagingTargetPath := req.GetStagingTargetPath()
+	ctx = ns.auditContext(ctx, volumeID, nil)
+
+	formatOpts, err := cryptFormatOptions(req.GetVolumeContext())
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume volume context is invalid: %v", err))
+	}
+	if formatOpts.Integrity != "" {
+		integrity = true
+	}
+	integrityInit := req.GetVolumeContext()[common.VolumeAttributeIntegrityInit]
+	if integrity && (integrityInit == common.IntegrityInitNoWipe || integrityInit == common.IntegrityInitBackground) {
+		formatOpts.NoWipe = true
+	}
+	if integrity && formatOpts.Integrity == "" && !formatOpts.IsZero() {
+		formatOpts.Integrity = cryptsetup.DefaultIntegrity
+	}
+	if integrity && formatOpts.NoWipe {
+		klog.V(4).Infof("Integrity protected FS requested. Skipping wipe of device, integrity initialization is %q", integrityInit)
+	} else if integrity {
+		klog.V(4).Infof("Integrity protected FS requested. Preparing to wipe device...")
+	}
+
+	// The generation requested through ControllerModifyVolume takes precedence over the volume attribute
+	rekeyGeneration := req.GetPublishContext()[common.VolumeAttributeRekeyGeneration]
+	if rekeyGeneration == "" {
+		rekeyGeneration = req.GetVolumeContext()[common.VolumeAttributeRekeyGeneration]
+	}
+	if rekeyGeneration != "" && ns.cryptState == nil {
+		return "", status.Error(codes.FailedPrecondition, "NodeStageVolume re-keying requested, but no crypt state directory is configured")
+	}
+	keyScope := req.GetVolumeContext()[common.VolumeAttributeKeyScope]
+	if keyScope != "" && ns.cryptState == nil {
+		return "", status.Error(codes.FailedPrecondition, "NodeStageVolume key scope requested, but no crypt state directory is configured")
+	}
+	if integrity && integrityInit == common.IntegrityInitBackground && ns.cryptState == nil {
+		return "", status.Error(codes.FailedPrecondition, "NodeStageVolume background integrity initialization requested, but no crypt state directory is configured")
+	}
+	importPlaintext, _ := common.ConvertStringToBool(req.GetVolumeContext()[common.VolumeAttributeImportPlaintext])
+	if importPlaintext && ns.cryptState == nil {
+		return "", status.Error(codes.FailedPrecondition, "NodeStageVolume import of an unencrypted disk requested, but no crypt state directory is configured")
+	}
+	if importPlaintext && integrity {
+		return "", status.Error(codes.InvalidArgument, "NodeStageVolume integrity protection can not be enabled when importing an unencrypted disk")
+	}
+
+	cryptoShred, _ := common.ConvertStringToBool(req.GetVolumeContext()[common.VolumeAttributeCryptoShred])
+	if cryptoShred && keyScope != "" && ns.keyCache != nil {
+		// The scope may be destroyed any time, its keys must not outlive it in memory
+		ns.keyCache.SkipKeyScope(keyScope)
+	}
+
+	luksDevicePath := devicePath
+	if ns.cryptState != nil {
+		// Remember the key scope and integrity protection, they are needed again to resize or re-key the volume
+		if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+			state.VolumeID = volumeID
+			state.DevicePath = luksDevicePath
+			state.KeyScope = keyScope
+			state.CryptoShred = cryptoShred
+			state.Integrity = integrity
+			if integrity {
+				state.IntegrityAlgorithm = formatOpts.Integrity
+				state.SectorSize = formatOpts.SectorSize
+			}
+		}); err != nil {
+			return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+		}
+	}
+
+	// [Edgeless] Read-only volumes are mapped without writing to the disk
+	if readonly, _ := getReadOnlyFromCapability(req.GetVolumeCapability()); readonly {
+		devicePath, err := ns.openReadOnlyCryptDevice(ctx, volumeID, name, luksDevicePath, req.GetVolumeContext())
+		if err != nil {
+			return "", err
+		}
+		if err := ns.backupHeader(ctx, volumeID, luksDevicePath, false); err != nil {
+			return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to back up LUKS2 header of volume %v: %v", volumeID, err))
+		}
+		return devicePath, nil
+	}
+
+	// [Edgeless] Encrypt the data of an imported unencrypted disk in place before mapping it
+	if importPlaintext {
+		allowed, _ := common.ConvertStringToBool(req.GetPublishContext()[common.VolumeAttributeImportPlaintext])
+		done, err := ns.reconcileImport(volumeID, name, luksDevicePath, keyScope, allowed, formatOpts)
+		if err != nil {
+			return "", err
+		}
+		if !done {
+			return "", status.Error(codes.Aborted, fmt.Sprintf("NodeStageVolume volume %v is being encrypted in place (%s done), try again later", volumeID, ns.importProgress(name)))
+		}
+	}
+
+	if rewrap, _ := common.ConvertStringToBool(req.GetVolumeContext()[common.VolumeAttributeRewrapKey]); rewrap {
+		sourceScope := req.GetVolumeContext()[common.VolumeAttributeSourceKeyScope]
+		if err := ns.rewrapKey(ctx, volumeID, luksDevicePath, sourceScope, keyScope); err != nil {
+			return "", status.Error(keyErrorCode(err), fmt.Sprintf("NodeStageVolume failed to rewrap keyslot of volume %v: %v", volumeID, err))
+		}
+	}
+
+	if !formatOpts.IsZero() {
+		formatted, err := ns.formatCryptDevice(kms.WithKeyScope(ctx, keyScope), volumeID, luksDevicePath, formatOpts)
+		if err != nil {
+			return "", status.Error(keyErrorCode(err), fmt.Sprintf("NodeStageVolume failed to format volume %v: %v", volumeID, err))
+		}
+		if formatted && integrityInit == common.IntegrityInitBackground {
+			if err := ns.setWipeToken(luksDevicePath, &wipeToken{Type: wipeTokenType, Keyslots: []string{}}); err != nil {
+				return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to schedule integrity initialization of volume %v: %v", volumeID, err))
+			}
+		}
+	}
+
+	klog.V(4).Infof("Creating LUKS2 device on %s", devicePath)
+	openCtx := kms.WithKeyScope(ctx, keyScope)
+	devicePath, err = ns.CryptMapper.OpenCryptDevice(openCtx, luksDevicePath, name, integrity)
+	ns.emitAudit(openCtx, audit.OperationOpen, err)
+	if err != nil {
+		return "", status.Error(keyErrorCode(err), fmt.Sprintf("NodeStageVolume failed on volume %v to %s, open crypt device failed (%v)", devicePath, stagingTargetPath, err))
+	}
+	klog.V(4).Infof("Successfully created LUKS2 device on %s", devicePath)
+	if err := ns.backupHeader(ctx, volumeID, luksDevicePath, false); err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to back up LUKS2 header of volume %v: %v", volumeID, err))
+	}
+
+	// [Edgeless] Part 2.6: Start or resume an online reencryption if a new volume key was requested
+	if ns.cryptState != nil {
+		if err := ns.reconcileRekey(volumeID, name, luksDevicePath, rekeyGeneration, integrity); err != nil {
+			return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to re-key volume %v: %v", volumeID, err))
+		}
+	}
+
+	// [Edgeless] Part 2.7: Initialize the integrity tags in the background, the volume is usable once they are
+	if integrity && ns.cryptState != nil {
+		done, err := ns.reconcileWipe(volumeID, name, luksDevicePath, devicePath)
+		if err != nil {
+			return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to initialize integrity protection of volume %v: %v", volumeID, err))
+		}
+		if !done {
+			return "", status.Error(codes.Aborted, fmt.Sprintf("NodeStageVolume volume %v is being initialized for integrity protection (%s done), try again later", volumeID, ns.wipeProgress(name)))
+		}
+	}
+
+	return devicePath, nil
+}
+
+// [Edgeless] keyErrorCode returns the code of errors of crypt operations
+// requesting keys. If the key server rejected the attestation report of the
+// node, no key is released until the node is in a trusted state again. If the
+// key management backend is unavailable, the operation is to be retried.
+func keyErrorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, kms.ErrAttestationRejected):
+		return codes.FailedPrecondition
+	case errors.Is(err, kms.ErrUnavailable):
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
 func (ns *GCENodeServer) updateReadAhead(devicePath string, readAheadKB int64) error {
 	isBlock, err := ns.VolumeStatter.IsBlockDevice(devicePath)
 	if err != nil {
@@ -485,6 +750,13 @@ func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
+	// [Edgeless] An unstage interrupted after unmounting leaves a crypt mapping to collect
+	if _, volumeKey, err := common.VolumeIDToKey(volumeID); err == nil {
+		if err := ns.recordStagingPath(volumeKey.Name, ""); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+		}
+	}
+
 	if err := cleanupStagePath(stagingTargetPath, ns.Mounter); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed: %v\nUnmounting arguments: %s\n", err.Error(), stagingTargetPath))
 	}
@@ -498,10 +770,21 @@ func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeUnstageVolume failed: getting device name: %s", err.Error()))
 	}
 
+	// [Edgeless] Interrupt a running reencryption, wipe or import, they are resumed on the next stage
+	ns.reencryptions.stop(volumeKey.Name)
+	ns.wipes.stop(volumeKey.Name)
+	ns.imports.stop(volumeKey.Name)
+	ns.ioErrors.forget(volumeKey.Name)
+
 	// [Edgeless] Unmap the crypt device so we can properly remove the device from the node
-	if err := ns.CryptMapper.CloseCryptDevice(deviceName); err != nil {
+	err = ns.CryptMapper.CloseCryptDevice(deviceName)
+	ns.emitAudit(ns.auditContext(ctx, volumeID, nil), audit.OperationClose, err)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume failed to close mapped crypt device for disk %s: %s", stagingTargetPath, err.Error())
 	}
+	if err := ns.forgetCryptState(volumeKey.Name); err != nil {
+		klog.Warningf("Failed to remove crypt state of volume %s: %v", volumeID, err)
+	}
 
 	if err := ns.confirmDeviceUnused(volumeID); err != nil {
 		var targetErr *ignoreableError
@@ -524,7 +807,12 @@ func (ns *GCENodeServer) confirmDeviceUnused(volumeID string) error {
 	if err != nil {
 		return &ignoreableError{fmt.Errorf("failed to find device path for volume %s: %v", volumeID, err.Error())}
 	}
+	return ns.confirmPathUnused(devicePath)
+}
 
+// [Edgeless] confirmPathUnused returns an error if a file system on the device
+// at devicePath is still in use.
+func (ns *GCENodeServer) confirmPathUnused(devicePath string) error {
 	devFsPath, err := filepath.EvalSymlinks(devicePath)
 	if err != nil {
 		return &ignoreableError{fmt.Errorf("filepath.EvalSymlinks(%q) failed: %v", devicePath, err)}
@@ -539,6 +827,67 @@ func (ns *GCENodeServer) confirmDeviceUnused(volumeID string) error {
 	return nil
 }
 
+// [Edgeless] keyScope returns the key derivation scope recorded for the crypt
+// mapping name when it was staged.
+func (ns *GCENodeServer) keyScope(name string) (string, error) {
+	if ns.cryptState == nil {
+		return "", nil
+	}
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil {
+		return "", err
+	}
+	return state.KeyScope, nil
+}
+
+// [Edgeless] integrity returns whether the crypt mapping name was staged with
+// integrity protection.
+func (ns *GCENodeServer) integrity(name string) (bool, error) {
+	if ns.cryptState == nil {
+		return false, nil
+	}
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil {
+		return false, err
+	}
+	return state.Integrity, nil
+}
+
+// [Edgeless] recordStagingPath records the staging target path of the crypt
+// mapping name when its volume is staged, and clears it with an empty path
+// when it is unstaged. Volumes without crypt state are left alone.
+func (ns *GCENodeServer) recordStagingPath(name, stagingTargetPath string) error {
+	if ns.cryptState == nil {
+		return nil
+	}
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil || state.StagingTargetPath == stagingTargetPath {
+		return err
+	}
+	return ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.StagingTargetPath = stagingTargetPath
+	})
+}
+
+// [Edgeless] forgetCryptState removes the crypt state of an unstaged volume,
+// unless it is still needed to resume an interrupted reencryption or wipe.
+func (ns *GCENodeServer) forgetCryptState(name string) error {
+	if ns.cryptState == nil {
+		return nil
+	}
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil {
+		return err
+	}
+	if state.Reencryption != nil && state.Reencryption.Phase == cryptsetup.PhaseRunning {
+		return nil
+	}
+	if state.Wipe != nil && state.Wipe.Phase != cryptsetup.PhaseComplete {
+		return nil
+	}
+	return ns.cryptState.Delete(name)
+}
+
 func (ns *GCENodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: ns.Driver.nscap,
@@ -578,6 +927,18 @@ func (ns *GCENodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 		return nil, status.Errorf(codes.Internal, "unknown error when stat on %s: %v", req.VolumePath, err.Error())
 	}
 
+	// [Edgeless] Report the health of the crypt mapping backing the volume.
+	// Volume IDs that do not name a disk get their stats without a condition.
+	var condition *csi.VolumeCondition
+	if _, volKey, err := common.VolumeIDToKey(req.VolumeId); err != nil {
+		klog.V(4).Infof("Not reporting a condition for volume %s: %v", req.VolumeId, err)
+	} else {
+		condition = ns.volumeCondition(volKey.Name)
+		if condition.GetAbnormal() {
+			klog.Warningf("Volume %s is abnormal: %s", req.VolumeId, condition.GetMessage())
+		}
+	}
+
 	isBlock, err := ns.VolumeStatter.IsBlockDevice(req.VolumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to determine whether %s is block device: %v", req.VolumePath, err.Error())
@@ -594,6 +955,7 @@ func (ns *GCENodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 					Total: bcap,
 				},
 			},
+			VolumeCondition: condition,
 		}, nil
 	}
 	available, capacity, used, inodesFree, inodes, inodesUsed, err := ns.VolumeStatter.StatFS(req.VolumePath)
@@ -616,6 +978,7 @@ func (ns *GCENodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGe
 				Used:      inodesUsed,
 			},
 		},
+		VolumeCondition: condition,
 	}, nil
 }
 
@@ -629,7 +992,6 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("capacity range is invalid: %v", err.Error()))
 	}
-	reqBytes = reqBytes - cryptmapper.LUKSHeaderSize // LUKS2 header is 16MiB, subtract from request size to get expected value
 
 	volumePath := req.GetVolumePath()
 	if len(volumePath) == 0 {
@@ -649,10 +1011,23 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 		}
 	}
 
+	// [Edgeless] plain volumes are resized without a crypt mapping
+	plainDevicePath, err := ns.plainDevicePath(volKey.Name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeExpandVolume failed to read crypt state of volume %v: %v", volumeID, err))
+	}
+	if plainDevicePath == "" {
+		reqBytes = reqBytes - cryptmapper.LUKSHeaderSize // LUKS2 header is 16MiB, subtract from request size to get expected value
+	}
+
+	// [Edgeless] integrity protection is requested with the fstype or recorded when staging the volume
+	integrity, err := ns.integrity(volKey.Name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeExpandVolume failed to read crypt state of volume %v: %v", volumeID, err))
+	}
 	if mnt := volumeCapability.GetMount(); mnt != nil {
 		if _, ok := cryptmapper.IsIntegrityFS(mnt.FsType); ok {
-			klog.Error("Integrity protected devices can not be resized")
-			return nil, status.Error(codes.InvalidArgument, "integrity protected devices can not be resized")
+			integrity = true
 		}
 
 		readonly, err := getReadOnlyFromCapability(volumeCapability)
@@ -665,9 +1040,35 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 		}
 	}
 
-	devicePath, err := ns.CryptMapper.ResizeCryptDevice(ctx, volKey.Name)
+	// [Edgeless] the volume key is requested in the scope recorded when staging the volume
+	ctx = ns.auditContext(ctx, volumeID, nil)
+	keyScope, err := ns.keyScope(volKey.Name)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("resizing crypt device: %s", err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeExpandVolume failed to read crypt state of volume %v: %v", volumeID, err))
+	}
+	var devicePath string
+	resized := true
+	if plainDevicePath != "" {
+		devicePath = plainDevicePath
+	} else if integrity {
+		if ns.cryptState == nil {
+			return nil, status.Error(codes.FailedPrecondition, "NodeExpandVolume resizing integrity protected devices requires a crypt state directory")
+		}
+		if ns.wipes.running(volKey.Name) {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("NodeExpandVolume volume %v is still being initialized for integrity protection, try again later", volumeID))
+		}
+		devicePath, resized, err = ns.resizeIntegrityDevice(ctx, volumeID, volKey.Name)
+	} else {
+		devicePath, err = ns.CryptMapper.ResizeCryptDevice(kms.WithKeyScope(ctx, keyScope), volKey.Name)
+	}
+	if plainDevicePath == "" {
+		ns.emitAudit(kms.WithKeyScope(ctx, keyScope), audit.OperationResize, err)
+	}
+	if err != nil {
+		return nil, status.Error(keyErrorCode(err), fmt.Sprintf("resizing crypt device: %s", err))
+	}
+	if !resized {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("NodeExpandVolume region added to volume %v is being initialized for integrity protection (%s done), try again later", volumeID, ns.wipeProgress(volKey.Name)))
 	}
 
 	if blk := volumeCapability.GetBlock(); blk != nil {
@@ -688,9 +1089,19 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 		klog.Errorf("NodeExpandVolume failed: Could not get block size: %v", err)
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("could not get block size in bytes: %v", err))
 	}
-	if diskSizeBytes < reqBytes {
+	// [Edgeless] dm-integrity tags and journal take a share of the disk depending
+	// on the LUKS2 format, on top of the LUKS2 header
+	expBytes := reqBytes
+	if integrity && plainDevicePath == "" {
+		overhead, err := ns.integrityOverhead(volKey.Name)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("NodeExpandVolume failed to read crypt state of volume %v: %v", volumeID, err))
+		}
+		expBytes = overhead.usableBytes(reqBytes)
+	}
+	if diskSizeBytes < expBytes {
 		// It's possible that the somewhere the volume size was rounded up, getting more size than requested is a success :)
-		return nil, status.Errorf(codes.Internal, "resize requested for %v but after resize volume was size %v", reqBytes, diskSizeBytes)
+		return nil, status.Errorf(codes.Internal, "resize requested for %v but after resize volume was size %v", expBytes, diskSizeBytes)
 	}
 
 	// TODO(dyzz) Some sort of formatted volume could also check the fs size.
@@ -714,9 +1125,9 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 	*/
 
 	// Respond
-	klog.V(4).Infof("NodeExpandVolume succeeded on volume %v to size %v", volKey, reqBytes)
+	klog.V(4).Infof("NodeExpandVolume succeeded on volume %v to size %v", volKey, expBytes)
 	return &csi.NodeExpandVolumeResponse{
-		CapacityBytes: reqBytes,
+		CapacityBytes: expBytes,
 	}, nil
 }
 
@@ -48,9 +48,13 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
 	"k8s.io/mount-utils"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/deviceutils"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
 
@@ -62,17 +66,30 @@ const (
 
 type fakeCryptMapper struct {
 	deviceName string
+	// keyScopes records the key derivation scope of each request for a volume key
+	keyScopes []string
+	// integrity records whether integrity protection was requested when opening a device
+	integrity bool
+	// closed records the mappings closed
+	closed []string
+	// opened records the devices opened
+	opened []string
 }
 
 func (s *fakeCryptMapper) CloseCryptDevice(volumeID string) error {
+	s.closed = append(s.closed, volumeID)
 	return nil
 }
 
 func (s *fakeCryptMapper) OpenCryptDevice(ctx context.Context, source, volumeID string, integrity bool) (string, error) {
+	s.keyScopes = append(s.keyScopes, kms.KeyScopeFromContext(ctx))
+	s.integrity = integrity
+	s.opened = append(s.opened, source)
 	return "/dev/mapper/" + volumeID, nil
 }
 
 func (s *fakeCryptMapper) ResizeCryptDevice(ctx context.Context, volumeID string) (string, error) {
+	s.keyScopes = append(s.keyScopes, kms.KeyScopeFromContext(ctx))
 	return "/dev/mapper/" + volumeID, nil
 }
 
@@ -90,7 +107,7 @@ func getTestGCEDriverWithCustomMounter(t *testing.T, mounter *mount.SafeFormatAn
 
 func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, deviceUtils deviceutils.DeviceUtils, metaService metadataservice.MetadataService) *GCEDriver {
 	gceDriver := GetGCEDriver()
-	nodeServer := NewNodeServer(gceDriver, mounter, deviceUtils, metaService, mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{})
+	nodeServer := NewNodeServer(gceDriver, mounter, deviceUtils, metaService, mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{}, kms.NewStaticKMS(make([]byte, 32)), cryptsetup.NewFakeCryptSetup(), nil)
 	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
@@ -101,7 +118,7 @@ func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, dev
 func getTestBlockingMountGCEDriver(t *testing.T, readyToExecute chan chan struct{}) *GCEDriver {
 	gceDriver := GetGCEDriver()
 	mounter := mountmanager.NewFakeSafeBlockingMounter(readyToExecute)
-	nodeServer := NewNodeServer(gceDriver, mounter, deviceutils.NewFakeDeviceUtils(false), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{})
+	nodeServer := NewNodeServer(gceDriver, mounter, deviceutils.NewFakeDeviceUtils(false), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{}, kms.NewStaticKMS(make([]byte, 32)), cryptsetup.NewFakeCryptSetup(), nil)
 	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
@@ -112,7 +129,7 @@ func getTestBlockingMountGCEDriver(t *testing.T, readyToExecute chan chan struct
 func getTestBlockingFormatAndMountGCEDriver(t *testing.T, readyToExecute chan chan struct{}) *GCEDriver {
 	gceDriver := GetGCEDriver()
 	mounter := mountmanager.NewFakeSafeBlockingMounter(readyToExecute)
-	nodeServer := NewNodeServer(gceDriver, mounter, deviceutils.NewFakeDeviceUtils(false), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{}).WithSerializedFormatAndMount(5*time.Second, 1)
+	nodeServer := NewNodeServer(gceDriver, mounter, deviceutils.NewFakeDeviceUtils(false), metadataservice.NewFakeService(), mountmanager.NewFakeStatter(mounter), &fakeCryptMapper{}, kms.NewStaticKMS(make([]byte, 32)), cryptsetup.NewFakeCryptSetup(), nil).WithSerializedFormatAndMount(5*time.Second, 1)
 
 	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nil, nodeServer)
 	if err != nil {
@@ -168,6 +185,21 @@ func TestNodeGetVolumeStats(t *testing.T) {
 			volumeID:       defaultVolumeID,
 			volumePath:     targetPath,
 			deviceCapacity: 300 * 1024 * 1024 * 1024, // 300 GB
+			expectedResp: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{
+					{
+						Unit:  csi.VolumeUsage_BYTES,
+						Total: 300 * 1024 * 1024 * 1024, // 300 GB,
+					},
+				},
+				VolumeCondition: &csi.VolumeCondition{Message: "crypt mapping is healthy"},
+			},
+		},
+		{
+			name:           "volume ID not naming a disk",
+			volumeID:       "not-a-disk-id",
+			volumePath:     targetPath,
+			deviceCapacity: 300 * 1024 * 1024 * 1024, // 300 GB
 			expectedResp: &csi.NodeGetVolumeStatsResponse{
 				Usage: []*csi.VolumeUsage{
 					{
@@ -226,7 +258,7 @@ func TestNodeGetVolumeStats(t *testing.T) {
 			if err == nil && tc.expectErr {
 				t.Fatal("Did not get error but expected one")
 			}
-			if diff := cmp.Diff(tc.expectedResp, resp); diff != "" {
+			if diff := cmp.Diff(tc.expectedResp, resp, protocmp.Transform()); diff != "" {
 				t.Errorf("NodeGetVolumeStats(%s): -want, +got \n%s", req, diff)
 			}
 		})
@@ -1146,3 +1178,90 @@ func TestBlockingFormatAndMount(t *testing.T) {
 	gceDriver := getTestBlockingFormatAndMountGCEDriver(t, readyToExecute)
 	runBlockingFormatAndMount(t, gceDriver, readyToExecute)
 }
+
+type fakeKeyCache struct {
+	skipped []string
+}
+
+func (c *fakeKeyCache) SkipKeyScope(scope string) {
+	c.skipped = append(c.skipped, scope)
+}
+
+func TestNodeStageVolumeCryptoShredSkipsKeyCache(t *testing.T) {
+	gceDriver, _, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	cache := &fakeKeyCache{}
+	ns.WithKeyCache(cache)
+
+	req := rekeyStageRequest(t, "")
+	req.VolumeContext = map[string]string{common.VolumeAttributeKeyScope: "pvc-shred", common.VolumeAttributeCryptoShred: "true"}
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"pvc-shred"}, cache.skipped); diff != "" {
+		t.Errorf("unexpected skipped key scopes: -want, +got\n%s", diff)
+	}
+	state, err := store.Get("testDisk")
+	if err != nil || state == nil || !state.CryptoShred {
+		t.Fatalf("expected crypt state to record the crypto-shredded volume, got %+v, err: %v", state, err)
+	}
+
+	// A restarted node plugin skips the scopes of staged volumes right away
+	restarted := &fakeKeyCache{}
+	ns.WithKeyCache(restarted)
+	if diff := cmp.Diff([]string{"pvc-shred"}, restarted.skipped); diff != "" {
+		t.Errorf("unexpected skipped key scopes after restart: -want, +got\n%s", diff)
+	}
+}
+
+func TestNodeStageVolumeKeyScope(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	ns := gceDriver.ns
+	mapper := ns.CryptMapper.(*fakeCryptMapper)
+
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: filepath.Join(t.TempDir(), defaultStagingPath),
+		VolumeCapability:  blockCap,
+		VolumeContext:     map[string]string{common.VolumeAttributeKeyScope: "tenant-a"},
+	}
+
+	// Without a crypt state store the scope could not be recovered on expansion
+	if _, err := ns.NodeStageVolume(context.Background(), stageReq); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected error code %v, got %v", codes.FailedPrecondition, err)
+	}
+
+	store, err := cryptsetup.NewStateStore(filepath.Join(t.TempDir(), "crypt-state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.WithCryptStateStore(store)
+	if _, err := ns.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if _, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         defaultVolumeID,
+		VolumePath:       stageReq.StagingTargetPath,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 1},
+		VolumeCapability: blockCap,
+	}); err != nil {
+		t.Fatalf("NodeExpandVolume failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"tenant-a", "tenant-a"}, mapper.keyScopes); diff != "" {
+		t.Errorf("unexpected key scopes: -want, +got\n%s", diff)
+	}
+
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: stageReq.StagingTargetPath,
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if state, err := store.Get("testDisk"); err != nil || state != nil {
+		t.Errorf("expected crypt state to be removed on unstage, got %+v, err: %v", state, err)
+	}
+}
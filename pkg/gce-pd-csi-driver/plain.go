@@ -0,0 +1,71 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+// preparePlainDevice checks that the disk at devicePath can be staged as the
+// plain volume volumeID without a crypt mapping, and records it in the crypt
+// state, so it is resized without one as well.
+//
+// A LUKS2 header on a plain volume means it was encrypted before, formatting
+// it with a file system would destroy the data, so it is refused.
+func (ns *GCENodeServer) preparePlainDevice(volumeID, name, devicePath string, integrity bool) error {
+	if integrity {
+		return status.Error(codes.InvalidArgument, "NodeStageVolume integrity protection requested for an unencrypted volume")
+	}
+	if ns.cryptState == nil {
+		return status.Error(codes.FailedPrecondition, "NodeStageVolume unencrypted volume requested, but no crypt state directory is configured")
+	}
+	isLUKS, err := ns.CryptSetup.IsLUKS(devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to check for a LUKS2 header on volume %v: %v", volumeID, err))
+	}
+	if isLUKS {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v is unencrypted, but %s holds a LUKS2 header", volumeID, devicePath))
+	}
+	if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.VolumeID = volumeID
+		state.DevicePath = devicePath
+		state.Unencrypted = true
+	}); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to record crypt state of volume %v: %v", volumeID, err))
+	}
+	klog.V(4).Infof("Staging unencrypted volume %v from %s without a crypt mapping", volumeID, devicePath)
+	return nil
+}
+
+// plainDevicePath returns the path of the disk of the plain volume name as
+// recorded when staging it, or "" if the volume is encrypted.
+func (ns *GCENodeServer) plainDevicePath(name string) (string, error) {
+	if ns.cryptState == nil {
+		return "", nil
+	}
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil || !state.Unencrypted {
+		return "", err
+	}
+	return state.DevicePath, nil
+}
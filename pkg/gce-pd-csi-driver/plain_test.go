@@ -0,0 +1,179 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+func TestNodeStageVolumePlain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		luks     bool
+		fsType   string
+		expState bool
+		expCode  codes.Code
+	}{
+		{
+			name:     "plain block volume",
+			expState: true,
+		},
+		{
+			name:    "disk holds a LUKS2 header",
+			luks:    true,
+			expCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "integrity requested",
+			fsType:  "ext4-integrity",
+			expCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = !tc.luks
+
+			req := rekeyStageRequest(t, "")
+			req.VolumeContext = map[string]string{common.VolumeAttributeEncryption: common.EncryptionNone}
+			if tc.fsType != "" {
+				req.VolumeCapability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fsType}}
+			}
+			_, err := ns.NodeStageVolume(context.Background(), req)
+			if code := status.Code(err); code != tc.expCode {
+				t.Fatalf("expected code %v, got %v (%v)", tc.expCode, code, err)
+			}
+
+			if mapper := ns.CryptMapper.(*fakeCryptMapper); len(mapper.keyScopes) != 0 {
+				t.Errorf("expected no crypt device to be opened, got %d", len(mapper.keyScopes))
+			}
+			state, err := store.Get("testDisk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.expState {
+				if state != nil {
+					t.Errorf("expected no crypt state, got %+v", state)
+				}
+				return
+			}
+			if state == nil || !state.Unencrypted || state.DevicePath != defaultLUKSDevicePath {
+				t.Errorf("expected crypt state of an unencrypted volume at %s, got %+v", defaultLUKSDevicePath, state)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumePlainWithoutStateStore(t *testing.T) {
+	ns := getTestGCEDriver(t).ns
+	req := rekeyStageRequest(t, "")
+	req.VolumeContext = map[string]string{common.VolumeAttributeEncryption: common.EncryptionNone}
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected code %v, got %v", codes.FailedPrecondition, err)
+	}
+}
+
+func TestNodePublishVolumePlainBlock(t *testing.T) {
+	testCases := []struct {
+		name          string
+		volumeContext map[string]string
+		expSource     string
+	}{
+		{
+			name:      "encrypted volume",
+			expSource: "/dev/mapper/testDisk",
+		},
+		{
+			name:          "plain volume",
+			volumeContext: map[string]string{common.VolumeAttributeEncryption: common.EncryptionNone},
+			expSource:     defaultLUKSDevicePath,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns := getTestGCEDriver(t).ns
+			targetPath := filepath.Join(t.TempDir(), "block")
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          defaultVolumeID,
+				StagingTargetPath: defaultStagingPath,
+				TargetPath:        targetPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+				VolumeContext: tc.volumeContext,
+			})
+			if err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			mounts, err := ns.Mounter.Interface.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var source string
+			for _, mnt := range mounts {
+				if mnt.Path == targetPath {
+					source = mnt.Device
+				}
+			}
+			if source != tc.expSource {
+				t.Errorf("expected bind mount of %s to %s, got %q", tc.expSource, targetPath, source)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumePlain(t *testing.T) {
+	gceDriver, _, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+		state.VolumeID = defaultVolumeID
+		state.DevicePath = defaultLUKSDevicePath
+		state.Unencrypted = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      defaultVolumeID,
+		VolumePath:    "some-path",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume failed: %v", err)
+	}
+	if mapper := ns.CryptMapper.(*fakeCryptMapper); len(mapper.keyScopes) != 0 {
+		t.Errorf("expected no crypt device to be resized, got %d", len(mapper.keyScopes))
+	}
+	if cond := ns.volumeCondition("testDisk"); cond != nil {
+		t.Errorf("expected no volume condition for an unencrypted volume, got %v", cond)
+	}
+}
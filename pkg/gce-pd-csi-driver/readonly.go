@@ -0,0 +1,115 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/audit"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+// openReadOnlyCryptDevice maps the LUKS2 device at devicePath read-only as the
+// crypt device name and returns the path of the mapped device. Nothing is
+// written to the disk, so it can be staged read-only on many nodes at once:
+// the device is never formatted, and pending rewraps, re-keys and integrity
+// initializations are left to the next read-write stage.
+func (ns *GCENodeServer) openReadOnlyCryptDevice(ctx context.Context, volumeID, name, devicePath string, volumeContext map[string]string) (string, error) {
+	mappedPath := mappedDevicePrefix + name
+	mappings, err := ns.CryptSetup.Mappings()
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to list crypt mappings: %v", err))
+	}
+	if slices.Contains(mappings, name) {
+		return mappedPath, nil
+	}
+
+	if importPlaintext, _ := common.ConvertStringToBool(volumeContext[common.VolumeAttributeImportPlaintext]); importPlaintext {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v is imported and must be encrypted in place, which requires a read-write stage", volumeID))
+	}
+	isLUKS, err := ns.CryptSetup.IsLUKS(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to check for a LUKS2 header on volume %v: %v", volumeID, err))
+	}
+	if !isLUKS {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v is read-only, but %s holds no LUKS2 header: refusing to format it", volumeID, devicePath))
+	}
+	inProgress, err := ns.CryptSetup.ReencryptionInProgress(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to check for an interrupted reencryption of volume %v: %v", volumeID, err))
+	}
+	if inProgress {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v has an unfinished reencryption, which requires a read-write stage", volumeID))
+	}
+	wipe, err := ns.wipeToken(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to read integrity initialization state of volume %v: %v", volumeID, err))
+	}
+	if wipe != nil && !wipe.Done {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v is not yet initialized for integrity protection, which requires a read-write stage", volumeID))
+	}
+
+	keyScope, err := ns.readOnlyKeyScope(volumeID, devicePath, volumeContext)
+	if err != nil {
+		return "", err
+	}
+	uuid, err := ns.CryptSetup.UUID(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to read LUKS2 UUID of volume %v: %v", volumeID, err))
+	}
+	openCtx := kms.WithKeyScope(ctx, keyScope)
+	passphrase, err := ns.KMS.GetDEK(openCtx, uuid, cryptsetup.KeySize)
+	if err != nil {
+		return "", status.Error(keyErrorCode(err), fmt.Sprintf("NodeStageVolume failed to get key of volume %v: %v", volumeID, err))
+	}
+	klog.V(4).Infof("Opening read-only LUKS2 device on %s", devicePath)
+	err = ns.CryptSetup.OpenReadOnly(devicePath, name, passphrase)
+	ns.emitAudit(openCtx, audit.OperationOpen, err)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to open read-only crypt device of volume %v: %v", volumeID, err))
+	}
+	return mappedPath, nil
+}
+
+// readOnlyKeyScope returns the key scope of the keyslot of a read-only volume.
+// The keyslot of a volume that should be rewrapped, but never was staged
+// read-write, is still that of its source.
+func (ns *GCENodeServer) readOnlyKeyScope(volumeID, devicePath string, volumeContext map[string]string) (string, error) {
+	keyScope := volumeContext[common.VolumeAttributeKeyScope]
+	if rewrap, _ := common.ConvertStringToBool(volumeContext[common.VolumeAttributeRewrapKey]); !rewrap {
+		return keyScope, nil
+	}
+	token, err := ns.rewrapToken(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("NodeStageVolume failed to read rewrap state of volume %v: %v", volumeID, err))
+	}
+	if token == nil || token.VolumeID != volumeID {
+		klog.V(4).Infof("Read-only volume %v was not rewrapped yet, using the key of its volume content source", volumeID)
+		return volumeContext[common.VolumeAttributeSourceKeyScope], nil
+	}
+	if !token.Done {
+		return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("NodeStageVolume volume %v has an interrupted rewrap, which requires a read-write stage", volumeID))
+	}
+	return keyScope, nil
+}
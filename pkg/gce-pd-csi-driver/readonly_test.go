@@ -0,0 +1,140 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+func TestNodeStageVolumeReadOnly(t *testing.T) {
+	const headerUUID = "source-uuid"
+
+	testCases := []struct {
+		name          string
+		volumeContext map[string]string
+		notLUKS       bool
+		// keyScope is the scope of the key of the keyslot in the header
+		keyScope    string
+		rewrapToken *rewrapToken
+		wipeToken   *wipeToken
+		expErrCode  codes.Code
+	}{
+		{
+			name:          "open read-only",
+			volumeContext: map[string]string{common.VolumeAttributeKeyScope: "tenant-a"},
+			keyScope:      "tenant-a",
+		},
+		{
+			name:          "never format",
+			volumeContext: map[string]string{common.VolumeAttributeKeyScope: "tenant-a"},
+			notLUKS:       true,
+			expErrCode:    codes.FailedPrecondition,
+		},
+		{
+			name: "volume not rewrapped yet uses key of source",
+			volumeContext: map[string]string{
+				common.VolumeAttributeKeyScope:       "tenant-b",
+				common.VolumeAttributeRewrapKey:      "true",
+				common.VolumeAttributeSourceKeyScope: "tenant-a",
+			},
+			keyScope: "tenant-a",
+		},
+		{
+			name: "rewrapped volume uses own key",
+			volumeContext: map[string]string{
+				common.VolumeAttributeKeyScope:       "tenant-b",
+				common.VolumeAttributeRewrapKey:      "true",
+				common.VolumeAttributeSourceKeyScope: "tenant-a",
+			},
+			keyScope:    "tenant-b",
+			rewrapToken: &rewrapToken{VolumeID: defaultVolumeID, OldUUID: "older-uuid", NewUUID: headerUUID, Done: true},
+		},
+		{
+			name: "interrupted rewrap",
+			volumeContext: map[string]string{
+				common.VolumeAttributeKeyScope:       "tenant-b",
+				common.VolumeAttributeRewrapKey:      "true",
+				common.VolumeAttributeSourceKeyScope: "tenant-a",
+			},
+			rewrapToken: &rewrapToken{VolumeID: defaultVolumeID, OldUUID: "older-uuid", NewUUID: headerUUID},
+			expErrCode:  codes.FailedPrecondition,
+		},
+		{
+			name:       "pending integrity initialization",
+			wipeToken:  &wipeToken{},
+			expErrCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = tc.notLUKS
+			cryptSetup.UUIDs[defaultLUKSDevicePath] = headerUUID
+			key, err := ns.KMS.GetDEK(kms.WithKeyScope(context.Background(), tc.keyScope), headerUUID, cryptsetup.KeySize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cryptSetup.Keys[defaultLUKSDevicePath] = []string{string(key)}
+			if tc.rewrapToken != nil {
+				tc.rewrapToken.Type = rewrapTokenType
+				tc.rewrapToken.Keyslots = []string{}
+				if err := ns.setRewrapToken(defaultLUKSDevicePath, tc.rewrapToken); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.wipeToken != nil {
+				tc.wipeToken.Type = wipeTokenType
+				tc.wipeToken.Keyslots = []string{}
+				if err := ns.setWipeToken(defaultLUKSDevicePath, tc.wipeToken); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tokensBefore := len(cryptSetup.Tokens[defaultLUKSDevicePath])
+
+			req := rekeyStageRequest(t, "")
+			req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+			req.VolumeContext = tc.volumeContext
+			_, err = ns.NodeStageVolume(context.Background(), req)
+			if status.Code(err) != tc.expErrCode {
+				t.Fatalf("expected error code %v, got %v", tc.expErrCode, err)
+			}
+
+			if len(cryptSetup.Formats) != 0 {
+				t.Errorf("expected read-only volume not to be formatted")
+			}
+			if got := len(cryptSetup.Tokens[defaultLUKSDevicePath]); got != tokensBefore || cryptSetup.UUIDs[defaultLUKSDevicePath] != headerUUID || len(cryptSetup.Keys[defaultLUKSDevicePath]) != 1 {
+				t.Errorf("expected LUKS2 header of read-only volume to be unchanged")
+			}
+			mapping, mapped := cryptSetup.Mapped["testDisk"]
+			if mapped != (tc.expErrCode == codes.OK) {
+				t.Fatalf("expected volume mapped to be %v, got %v", tc.expErrCode == codes.OK, mapped)
+			}
+			if mapped && !mapping.ReadOnly {
+				t.Errorf("expected a read-only mapping")
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+const (
+	// LUKS2 token slot used to record the generation a volume was last re-keyed with.
+	rekeyTokenID   = 0
+	rekeyTokenType = "constellation-rekey"
+)
+
+// rekeyToken is stored in the LUKS2 header, so the completed re-key generation
+// travels with the disk when it is staged on another node.
+type rekeyToken struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Generation string   `json:"generation"`
+	// Rotating is the generation whose volume key was replaced, but whose
+	// keyslot is still being moved from the key of OldUUID to that of NewUUID.
+	Rotating string `json:"rotating,omitempty"`
+	OldUUID  string `json:"oldUUID,omitempty"`
+	NewUUID  string `json:"newUUID,omitempty"`
+}
+
+// reconcileRekey starts an online reencryption of the staged crypt device
+// name if the requested generation has not been applied yet, or if the LUKS2
+// header records an interrupted reencryption.
+func (ns *GCENodeServer) reconcileRekey(volumeID, name, devicePath, generation string, integrity bool) error {
+	if ns.reencryptions.running(name) {
+		return nil
+	}
+
+	inProgress, err := ns.CryptSetup.ReencryptionInProgress(devicePath)
+	if err != nil {
+		return err
+	}
+	if inProgress {
+		if state, err := ns.cryptState.Get(name); err == nil && state != nil && state.Reencryption != nil {
+			generation = state.Reencryption.Generation
+		}
+		klog.V(4).Infof("Resuming interrupted reencryption of volume %s", volumeID)
+		ns.startReencryption(volumeID, name, devicePath, generation, true)
+		return nil
+	}
+
+	if generation == "" {
+		return nil
+	}
+	applied, err := ns.appliedRekeyGeneration(devicePath)
+	if err != nil {
+		return err
+	}
+	if applied == generation {
+		return nil
+	}
+	if integrity {
+		// Disks labeled before ControllerModifyVolume refused them still pass the generation on every publish
+		klog.Warningf("Ignoring re-key generation %q of volume %s, integrity protected volumes can not be re-keyed online", generation, volumeID)
+		return nil
+	}
+
+	klog.V(4).Infof("Starting reencryption of volume %s for re-key generation %q", volumeID, generation)
+	ns.startReencryption(volumeID, name, devicePath, generation, false)
+	return nil
+}
+
+func (ns *GCENodeServer) appliedRekeyGeneration(devicePath string) (string, error) {
+	token, err := ns.rekeyToken(devicePath)
+	if err != nil || token == nil {
+		return "", err
+	}
+	return token.Generation, nil
+}
+
+func (ns *GCENodeServer) rekeyToken(devicePath string) (*rekeyToken, error) {
+	data, err := ns.CryptSetup.Token(devicePath, rekeyTokenID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var token rekeyToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("parsing LUKS2 token %d: %w", rekeyTokenID, err)
+	}
+	if token.Type != rekeyTokenType {
+		return nil, fmt.Errorf("LUKS2 token %d has unexpected type %q", rekeyTokenID, token.Type)
+	}
+	return &token, nil
+}
+
+func (ns *GCENodeServer) setRekeyToken(devicePath string, token *rekeyToken) error {
+	token.Type = rekeyTokenType
+	token.Keyslots = []string{}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshalling re-key token: %w", err)
+	}
+	return ns.CryptSetup.SetToken(devicePath, rekeyTokenID, data)
+}
+
+func (ns *GCENodeServer) startReencryption(volumeID, name, devicePath, generation string, resume bool) {
+	ns.reencryptions.start(name, func(ctx context.Context) {
+		if err := ns.reencrypt(ctx, volumeID, name, devicePath, generation, resume); err != nil {
+			klog.Errorf("Reencryption of volume %s failed: %v", volumeID, err)
+		}
+	})
+}
+
+func (ns *GCENodeServer) reencrypt(ctx context.Context, volumeID, name, devicePath, generation string, resume bool) error {
+	ctx = ns.auditContext(ctx, volumeID, nil)
+	now := time.Now()
+	var keyScope string
+	if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		keyScope = state.KeyScope
+		state.VolumeID = volumeID
+		state.DevicePath = devicePath
+		if state.Reencryption == nil || state.Reencryption.Phase != cryptsetup.PhaseRunning {
+			state.Reencryption = &cryptsetup.OperationState{StartedAt: now}
+		}
+		state.Reencryption.Phase = cryptsetup.PhaseRunning
+		state.Reencryption.Generation = generation
+		state.Reencryption.Error = ""
+		state.Reencryption.UpdatedAt = now
+	}); err != nil {
+		return err
+	}
+
+	err := ns.runReencryption(kms.WithKeyScope(ctx, keyScope), name, devicePath, generation, resume)
+	if ctx.Err() != nil {
+		// Interrupted by unstaging or shutdown, the reencryption is resumed the next time the volume is staged
+		klog.V(4).Infof("Reencryption of volume %s interrupted, it will be resumed on the next stage", volumeID)
+		return nil
+	}
+
+	updateErr := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.Reencryption.UpdatedAt = time.Now()
+		if err != nil {
+			state.Reencryption.Phase = cryptsetup.PhaseFailed
+			state.Reencryption.Error = err.Error()
+			return
+		}
+		state.Reencryption.Phase = cryptsetup.PhaseComplete
+	})
+	if err != nil {
+		return err
+	}
+	if updateErr != nil {
+		return updateErr
+	}
+	klog.V(4).Infof("Reencryption of volume %s for re-key generation %q succeeded", volumeID, generation)
+	// The previous header backup holds the old volume key
+	if err := ns.backupHeader(ctx, volumeID, devicePath, true); err != nil {
+		klog.Warningf("Failed to back up LUKS2 header of re-keyed volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// runReencryption replaces the volume key of the device, then moves its
+// keyslot to a key requested for a new LUKS2 UUID, so neither the old volume
+// key nor the old key of the keyslot unlock the device afterwards.
+func (ns *GCENodeServer) runReencryption(ctx context.Context, name, devicePath, generation string, resume bool) error {
+	token, err := ns.rekeyToken(devicePath)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		token = &rekeyToken{}
+	}
+	// The volume key was replaced already if the keyslot of this generation is being rotated
+	if token.Rotating != generation || token.NewUUID == "" {
+		oldUUID, err := ns.CryptSetup.UUID(devicePath)
+		if err != nil {
+			return err
+		}
+		passphrase, err := ns.KMS.GetDEK(ctx, oldUUID, cryptsetup.KeySize)
+		if err != nil {
+			return fmt.Errorf("getting key for %s: %w", devicePath, err)
+		}
+
+		progress := func(done, total uint64) {
+			if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+				state.Reencryption.BytesDone = done
+				state.Reencryption.BytesTotal = total
+				state.Reencryption.UpdatedAt = time.Now()
+			}); err != nil {
+				klog.Warningf("Failed to record reencryption progress of %s: %v", name, err)
+			}
+		}
+		if err := ns.CryptSetup.Reencrypt(ctx, devicePath, passphrase, resume, progress); err != nil {
+			return err
+		}
+
+		token.Rotating = generation
+		token.OldUUID = oldUUID
+		token.NewUUID = uuid.New().String()
+		if err := ns.setRekeyToken(devicePath, token); err != nil {
+			return err
+		}
+	}
+
+	if err := ns.rotateKeyslot(ctx, devicePath, token.OldUUID, token.NewUUID); err != nil {
+		return fmt.Errorf("rotating keyslot key: %w", err)
+	}
+	return ns.setRekeyToken(devicePath, &rekeyToken{Generation: generation})
+}
+
+// rotateKeyslot moves the keyslot of the device from the key of oldUUID to
+// the key of newUUID and sets the LUKS2 UUID to newUUID.
+func (ns *GCENodeServer) rotateKeyslot(ctx context.Context, devicePath, oldUUID, newUUID string) error {
+	oldKey, err := ns.KMS.GetDEK(ctx, oldUUID, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting old key: %w", err)
+	}
+	newKey, err := ns.KMS.GetDEK(ctx, newUUID, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting new key: %w", err)
+	}
+	return ns.moveKeyslot(devicePath, oldKey, newKey, newUUID)
+}
+
+// ResumeReencryptions restarts the reencryptions which were running when the
+// driver stopped, as long as their crypt devices are still mapped. Devices
+// which are no longer mapped are resumed the next time they are staged.
+func (ns *GCENodeServer) ResumeReencryptions() error {
+	if ns.cryptState == nil {
+		return nil
+	}
+	states, err := ns.cryptState.List()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.Reencryption == nil || state.Reencryption.Phase != cryptsetup.PhaseRunning {
+			continue
+		}
+		if _, err := ns.CryptMapper.GetDevicePath(state.Name); err != nil {
+			klog.V(4).Infof("Not resuming reencryption of volume %s, crypt device is not mapped: %v", state.VolumeID, err)
+			continue
+		}
+		klog.V(4).Infof("Resuming reencryption of volume %s after driver restart", state.VolumeID)
+		ns.startReencryption(state.VolumeID, state.Name, state.DevicePath, state.Reencryption.Generation, true)
+	}
+	return nil
+}
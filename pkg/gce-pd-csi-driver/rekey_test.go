@@ -0,0 +1,435 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+const defaultLUKSDevicePath = "/dev/disk/by-id/google-testDisk"
+
+func getTestRekeyGCEDriver(t *testing.T) (*GCEDriver, *cryptsetup.FakeCryptSetup, *cryptsetup.StateStore) {
+	gceDriver := getTestGCEDriver(t)
+	cryptSetup := cryptsetup.NewFakeCryptSetup()
+	store, err := cryptsetup.NewStateStore(filepath.Join(t.TempDir(), "crypt-state"))
+	if err != nil {
+		t.Fatalf("Failed to create crypt state store: %v", err)
+	}
+	gceDriver.ns.CryptSetup = cryptSetup
+	gceDriver.ns.WithCryptStateStore(store)
+	return gceDriver, cryptSetup, store
+}
+
+func rekeyStageRequest(t *testing.T, generation string) *csi.NodeStageVolumeRequest {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: filepath.Join(t.TempDir(), defaultStagingPath),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	if generation != "" {
+		req.VolumeContext = map[string]string{common.VolumeAttributeRekeyGeneration: generation}
+	}
+	return req
+}
+
+func rekeyTokenFor(t *testing.T, generation string) []byte {
+	token, err := json.Marshal(rekeyToken{Type: rekeyTokenType, Keyslots: []string{}, Generation: generation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestNodeStageVolumeRekey(t *testing.T) {
+	testCases := []struct {
+		name              string
+		generation        string
+		appliedGeneration string
+		inProgress        bool
+		storedGeneration  string
+		expReencryption   bool
+		expGeneration     string
+	}{
+		{
+			name: "no re-key requested",
+		},
+		{
+			name:            "re-key requested",
+			generation:      "1",
+			expReencryption: true,
+			expGeneration:   "1",
+		},
+		{
+			name:              "re-key generation already applied",
+			generation:        "1",
+			appliedGeneration: "1",
+		},
+		{
+			name:              "new re-key generation requested",
+			generation:        "2",
+			appliedGeneration: "1",
+			expReencryption:   true,
+			expGeneration:     "2",
+		},
+		{
+			name:             "interrupted reencryption is resumed",
+			generation:       "3",
+			inProgress:       true,
+			storedGeneration: "2",
+			expReencryption:  true,
+			expGeneration:    "2",
+		},
+		{
+			name:            "interrupted reencryption is resumed without request",
+			inProgress:      true,
+			expReencryption: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			if tc.appliedGeneration != "" {
+				if err := cryptSetup.SetToken(defaultLUKSDevicePath, rekeyTokenID, rekeyTokenFor(t, tc.appliedGeneration)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cryptSetup.Reencrypting[defaultLUKSDevicePath] = tc.inProgress
+			if tc.storedGeneration != "" {
+				if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+					state.Reencryption = &cryptsetup.OperationState{Phase: cryptsetup.PhaseRunning, Generation: tc.storedGeneration}
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := ns.NodeStageVolume(context.Background(), rekeyStageRequest(t, tc.generation)); err != nil {
+				t.Fatalf("NodeStageVolume failed: %v", err)
+			}
+			<-waitForReencryption(ns, "testDisk")
+
+			if got := len(cryptSetup.Reencryptions) > 0; got != tc.expReencryption {
+				t.Fatalf("expected reencryption %v, got %v", tc.expReencryption, got)
+			}
+			if !tc.expReencryption {
+				return
+			}
+			state, err := store.Get("testDisk")
+			if err != nil || state == nil {
+				t.Fatalf("expected crypt state to be recorded, got %v, err: %v", state, err)
+			}
+			if state.Reencryption.Phase != cryptsetup.PhaseComplete {
+				t.Errorf("expected reencryption phase %s, got %s", cryptsetup.PhaseComplete, state.Reencryption.Phase)
+			}
+			applied, err := ns.appliedRekeyGeneration(defaultLUKSDevicePath)
+			if err != nil {
+				t.Fatalf("reading applied generation: %v", err)
+			}
+			if applied != tc.expGeneration {
+				t.Errorf("expected applied generation %q, got %q", tc.expGeneration, applied)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeRekeyKeyServer(t *testing.T) {
+	keyServer := kms.NewFakeKeyServer([]byte("0123456789abcdef"))
+	server := httptest.NewServer(keyServer)
+	defer server.Close()
+	keyManager, err := kms.New(kms.BackendHTTP, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	ns.KMS = keyManager
+	oldUUID := "fake-uuid-" + defaultLUKSDevicePath
+	oldKey, err := keyManager.GetDEK(context.Background(), oldUUID, cryptsetup.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptSetup.Keys[defaultLUKSDevicePath] = []string{string(oldKey)}
+	if _, err := ns.NodeStageVolume(context.Background(), rekeyStageRequest(t, "1")); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	<-waitForReencryption(ns, "testDisk")
+
+	// The keyslot is moved from the key of the old LUKS2 UUID to that of a new one
+	uuid, _ := cryptSetup.UUID(defaultLUKSDevicePath)
+	if uuid == oldUUID {
+		t.Errorf("expected LUKS2 UUID to be rotated, got %q", uuid)
+	}
+	if requests := keyServer.Requests(); len(requests) == 0 || requests[0] != oldUUID || requests[len(requests)-1] != uuid {
+		t.Errorf("expected keys %q and %q to be requested, got %v", oldUUID, uuid, requests)
+	}
+	if ok, _ := cryptSetup.TestKey(defaultLUKSDevicePath, oldKey); ok {
+		t.Error("expected the key of the old LUKS2 UUID to be removed")
+	}
+	newKey, err := keyManager.GetDEK(context.Background(), uuid, cryptsetup.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cryptSetup.TestKey(defaultLUKSDevicePath, newKey); !ok {
+		t.Error("expected the key of the new LUKS2 UUID to unlock the device")
+	}
+	state, err := store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Reencryption.Phase != cryptsetup.PhaseComplete {
+		t.Errorf("expected reencryption phase %s, got %s", cryptsetup.PhaseComplete, state.Reencryption.Phase)
+	}
+
+	// A key server failure fails the reencryption
+	keyServer.SetError(errors.New("key server unavailable"))
+	if _, err := ns.NodeStageVolume(context.Background(), rekeyStageRequest(t, "2")); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	<-waitForReencryption(ns, "testDisk")
+	state, err = store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Reencryption.Phase != cryptsetup.PhaseFailed {
+		t.Errorf("expected reencryption phase %s, got %s", cryptsetup.PhaseFailed, state.Reencryption.Phase)
+	}
+}
+
+func TestNodeStageVolumeRekeyPublishContext(t *testing.T) {
+	gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	if err := cryptSetup.SetToken(defaultLUKSDevicePath, rekeyTokenID, rekeyTokenFor(t, "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generation requested through ControllerModifyVolume takes precedence
+	req := rekeyStageRequest(t, "1")
+	req.PublishContext = map[string]string{common.VolumeAttributeRekeyGeneration: "2"}
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	<-waitForReencryption(ns, "testDisk")
+	if applied, _ := ns.appliedRekeyGeneration(defaultLUKSDevicePath); applied != "2" {
+		t.Errorf("expected applied generation %q, got %q", "2", applied)
+	}
+}
+
+func TestNodeStageVolumeRekeyResumesKeyslotRotation(t *testing.T) {
+	gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	token, err := json.Marshal(rekeyToken{Type: rekeyTokenType, Keyslots: []string{}, Generation: "1", Rotating: "2", OldUUID: "fake-uuid-" + defaultLUKSDevicePath, NewUUID: "new-uuid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cryptSetup.SetToken(defaultLUKSDevicePath, rekeyTokenID, token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ns.NodeStageVolume(context.Background(), rekeyStageRequest(t, "2")); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	<-waitForReencryption(ns, "testDisk")
+
+	// The volume key was replaced before the interruption, only the keyslot is rotated
+	if len(cryptSetup.Reencryptions) != 0 {
+		t.Errorf("expected no reencryption, got %v", cryptSetup.Reencryptions)
+	}
+	if uuid, _ := cryptSetup.UUID(defaultLUKSDevicePath); uuid != "new-uuid" {
+		t.Errorf("expected LUKS2 UUID %q, got %q", "new-uuid", uuid)
+	}
+	if applied, _ := ns.appliedRekeyGeneration(defaultLUKSDevicePath); applied != "2" {
+		t.Errorf("expected applied generation %q, got %q", "2", applied)
+	}
+}
+
+func TestNodeStageVolumeRekeyIntegrity(t *testing.T) {
+	// Disks labeled with a re-key generation before integrity protected disks
+	// were refused pass it in every publish context
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		SizeGb: 10,
+		Labels: map[string]string{common.RekeyGenerationLabel: "2"},
+	})})
+	gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider).InsertInstance(&compute.Instance{Name: node, Disks: []*compute.AttachedDisk{}}, zone, node)
+	resp, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+		NodeId:           testNodeID,
+		VolumeCapability: stdVolCap,
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+
+	nodeDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	req := rekeyStageRequest(t, "")
+	req.PublishContext = resp.GetPublishContext()
+	req.VolumeContext = map[string]string{common.VolumeAttributeIntegrityAlgorithm: cryptsetup.DefaultIntegrity}
+	if _, err := nodeDriver.ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	<-waitForReencryption(nodeDriver.ns, "testDisk")
+	if len(cryptSetup.Reencryptions) != 0 {
+		t.Errorf("expected no reencryption, got %v", cryptSetup.Reencryptions)
+	}
+}
+
+func TestControllerModifyVolumeRekeyIntegrity(t *testing.T) {
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		SizeGb: 10,
+		Labels: map[string]string{common.IntegrityLabel: "true"},
+	})})
+	_, err := gceDriver.cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name),
+		MutableParameters: map[string]string{common.VolumeAttributeRekeyGeneration: "2"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected error code %v, got %v", codes.InvalidArgument, err)
+	}
+	disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), project, meta.ZonalKey(name, zone), gce.GCEAPIVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generation, ok := disk.GetLabels()[common.RekeyGenerationLabel]; ok {
+		t.Errorf("expected no re-key generation label, got %q", generation)
+	}
+}
+
+func TestControllerModifyVolumeRekey(t *testing.T) {
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{gce.CloudDiskFromV1(&compute.Disk{
+		Name:   name,
+		SizeGb: 10,
+	})})
+	gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider).InsertInstance(&compute.Instance{Name: node, Disks: []*compute.AttachedDisk{}}, zone, node)
+	volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, name)
+
+	if _, err := gceDriver.cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{common.VolumeAttributeRekeyGeneration: "2"},
+	}); err != nil {
+		t.Fatalf("ControllerModifyVolume failed: %v", err)
+	}
+
+	resp, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           testNodeID,
+		VolumeCapability: stdVolCap,
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if got := resp.GetPublishContext()[common.VolumeAttributeRekeyGeneration]; got != "2" {
+		t.Errorf("expected re-key generation %q in publish context, got %q", "2", got)
+	}
+}
+
+func TestNodeStageVolumeRekeyWithoutStateStore(t *testing.T) {
+	ns := getTestGCEDriver(t).ns
+	_, err := ns.NodeStageVolume(context.Background(), rekeyStageRequest(t, "1"))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected error code %v, got %v", codes.FailedPrecondition, err)
+	}
+}
+
+func TestNodeUnstageVolumeInterruptsReencryption(t *testing.T) {
+	gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	cryptSetup.ReencryptBlock = make(chan struct{})
+
+	req := rekeyStageRequest(t, "1")
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if !ns.reencryptions.running("testDisk") {
+		t.Fatal("expected reencryption to be running")
+	}
+
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: req.StagingTargetPath,
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if ns.reencryptions.running("testDisk") {
+		t.Fatal("expected reencryption to be stopped")
+	}
+	state, err := store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Reencryption.Phase != cryptsetup.PhaseRunning {
+		t.Errorf("expected interrupted reencryption to stay in phase %s, got %s", cryptsetup.PhaseRunning, state.Reencryption.Phase)
+	}
+
+	// The reencryption is picked up again after a driver restart
+	close(cryptSetup.ReencryptBlock)
+	if err := ns.ResumeReencryptions(); err != nil {
+		t.Fatalf("ResumeReencryptions failed: %v", err)
+	}
+	<-waitForReencryption(ns, "testDisk")
+	state, err = store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Reencryption.Phase != cryptsetup.PhaseComplete {
+		t.Errorf("expected resumed reencryption to complete, got phase %s", state.Reencryption.Phase)
+	}
+	if len(cryptSetup.Reencryptions) != 2 {
+		t.Errorf("expected 2 reencryption runs, got %d", len(cryptSetup.Reencryptions))
+	}
+}
+
+// waitForReencryption returns a channel which is closed once the background
+// reencryption of name, if any, has returned.
+func waitForReencryption(ns *GCENodeServer, name string) <-chan struct{} {
+	return waitForJob(ns.reencryptions, name)
+}
+
+// waitForJob returns a channel which is closed once the job of name, if any,
+// has returned.
+func waitForJob(jobs *cryptJobs, name string) <-chan struct{} {
+	jobs.mux.Lock()
+	defer jobs.mux.Unlock()
+	job, ok := jobs.jobs[name]
+	if !ok {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return job.done
+}
@@ -0,0 +1,136 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+// mappedDevicePrefix is the directory crypt mappings are created in.
+var mappedDevicePrefix = "/dev/mapper/"
+
+// resizeIntegrityDevice extends the dm-integrity and crypt mappings of name to
+// the size of the expanded disk and starts initializing the integrity tags of
+// the added region by wiping it in the background, so it can be read before it
+// was first written. It returns the path of the mapped crypt device and
+// whether the added region is initialized.
+//
+// The size of the mapping before the resize is recorded as the offset of a
+// wipe in the crypt state, so a resize which was interrupted after the
+// mappings were extended still initializes the whole added region.
+func (ns *GCENodeServer) resizeIntegrityDevice(ctx context.Context, volumeID, name string) (string, bool, error) {
+	state, err := ns.cryptState.Get(name)
+	if err != nil {
+		return "", false, err
+	}
+	if state == nil {
+		return "", false, fmt.Errorf("no crypt state recorded for %s", name)
+	}
+	mappedPath := mappedDevicePrefix + name
+
+	if state.Wipe == nil || state.Wipe.Phase == cryptsetup.PhaseComplete {
+		size, err := getBlockSizeBytes(mappedPath, ns.Mounter)
+		if err != nil {
+			return "", false, err
+		}
+		now := time.Now()
+		if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+			state.Wipe = &cryptsetup.OperationState{
+				Phase:     cryptsetup.PhaseRunning,
+				BytesDone: uint64(size),
+				StartedAt: now,
+				UpdatedAt: now,
+			}
+		}); err != nil {
+			return "", false, err
+		}
+	}
+
+	uuid, err := ns.CryptSetup.UUID(state.DevicePath)
+	if err != nil {
+		return "", false, err
+	}
+	passphrase, err := ns.KMS.GetDEK(kms.WithKeyScope(ctx, state.KeyScope), uuid, cryptsetup.KeySize)
+	if err != nil {
+		return "", false, fmt.Errorf("getting key for %s: %w", state.DevicePath, err)
+	}
+	klog.V(4).Infof("Resizing integrity protected crypt device %s", name)
+	if err := ns.CryptSetup.Resize(ctx, name, passphrase); err != nil {
+		return "", false, err
+	}
+
+	// A repeated resize of a volume whose added region is initialized adds nothing
+	size, err := getBlockSizeBytes(mappedPath, ns.Mounter)
+	if err != nil {
+		return "", false, err
+	}
+	var offset uint64
+	if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		offset = state.Wipe.BytesDone
+		if offset >= uint64(size) {
+			state.Wipe.Phase = cryptsetup.PhaseComplete
+			state.Wipe.UpdatedAt = time.Now()
+		}
+	}); err != nil {
+		return "", false, err
+	}
+	if offset >= uint64(size) {
+		return mappedPath, true, nil
+	}
+
+	klog.V(4).Infof("Initializing integrity tags of the region added to volume %s", volumeID)
+	ns.wipes.start(name, func(ctx context.Context) {
+		err := ns.runWipe(ctx, volumeID, name, state.DevicePath, mappedPath, nil)
+		if ctx.Err() != nil {
+			// Interrupted by unstaging or shutdown, the wipe is resumed by the next resize
+			klog.V(4).Infof("Wipe of the region added to volume %s interrupted, it will be resumed on the next resize", volumeID)
+			return
+		}
+		if err != nil {
+			klog.Errorf("Wipe of the region added to volume %s failed: %v", volumeID, err)
+		}
+	})
+	return mappedPath, false, nil
+}
+
+// integrityOverhead returns the overhead of the integrity protected crypt
+// mapping of name in addition to its LUKS2 header. Options not recorded when
+// staging the volume are those the mapping was formatted with by default.
+func (ns *GCENodeServer) integrityOverhead(name string) (*cryptOverhead, error) {
+	state, err := ns.cryptState.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, sectorSize := cryptsetup.DefaultIntegrity, cryptsetup.DefaultSectorSize
+	if state != nil && state.IntegrityAlgorithm != "" {
+		algorithm = state.IntegrityAlgorithm
+	}
+	if state != nil && state.SectorSize != 0 {
+		sectorSize = state.SectorSize
+	}
+	return &cryptOverhead{
+		fixed:      integrityMetadataReserve,
+		sectorSize: int64(sectorSize),
+		tagSize:    integrityTagSizes[algorithm],
+	}, nil
+}
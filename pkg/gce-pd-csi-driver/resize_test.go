@@ -0,0 +1,227 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+// outputCmds returns fake commands printing outs in order.
+func outputCmds(outs ...string) []testingexec.FakeCommandAction {
+	var cmds []testingexec.FakeCommandAction
+	for _, out := range outs {
+		cmds = append(cmds, makeFakeCmd(&testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(out), nil, nil },
+			},
+		}, ""))
+	}
+	return cmds
+}
+
+func TestNodeExpandVolumeIntegrity(t *testing.T) {
+	const (
+		oldSize = 1 << 30
+		newSize = 2 << 30
+	)
+
+	testCases := []struct {
+		name string
+		// wipe is the wipe recorded before the resize, if any
+		wipe *cryptsetup.OperationState
+		// sizes are the sizes of the mapping read by both calls of NodeExpandVolume
+		sizes     []int64
+		expOffset uint64
+	}{
+		{
+			name:      "resize staged volume",
+			sizes:     []int64{oldSize, newSize, newSize, newSize},
+			expOffset: oldSize,
+		},
+		{
+			name:      "resize after integrity initialization",
+			wipe:      &cryptsetup.OperationState{Phase: cryptsetup.PhaseComplete, BytesDone: oldSize / 2, BytesTotal: oldSize / 2},
+			sizes:     []int64{oldSize, newSize, newSize, newSize},
+			expOffset: oldSize,
+		},
+		{
+			name:      "resume interrupted resize",
+			wipe:      &cryptsetup.OperationState{Phase: cryptsetup.PhaseRunning, BytesDone: oldSize + 4096},
+			sizes:     []int64{newSize, newSize, newSize},
+			expOffset: oldSize + 4096,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			var outs []string
+			for _, size := range tc.sizes {
+				outs = append(outs, strconv.FormatInt(size, 10)+"\n")
+			}
+			ns.Mounter = mountmanager.NewFakeSafeMounterWithCustomExec(&testingexec.FakeExec{CommandScript: outputCmds(outs...)})
+			if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+				state.VolumeID = defaultVolumeID
+				state.DevicePath = defaultLUKSDevicePath
+				state.Integrity = true
+				state.Wipe = tc.wipe
+			}); err != nil {
+				t.Fatal(err)
+			}
+			req := &csi.NodeExpandVolumeRequest{
+				VolumeId:      defaultVolumeID,
+				VolumePath:    "some-path",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: newSize},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			}
+
+			// The added region is wiped in the background
+			_, err := ns.NodeExpandVolume(context.Background(), req)
+			if status.Code(err) != codes.Aborted {
+				t.Fatalf("expected error code %v, got %v", codes.Aborted, err)
+			}
+			<-waitForJob(ns.wipes, "testDisk")
+			wantWipes := []cryptsetup.FakeWipe{{DevicePath: "/dev/mapper/testDisk", Offset: tc.expOffset}}
+			if diff := cmp.Diff(wantWipes, cryptSetup.Wipes); diff != "" {
+				t.Errorf("unexpected wipes: %s", diff)
+			}
+			state, err := store.Get("testDisk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.Wipe.Phase != cryptsetup.PhaseComplete {
+				t.Errorf("expected wipe of the added region to complete, got phase %s", state.Wipe.Phase)
+			}
+
+			// The resize succeeds once the added region is initialized
+			if _, err := ns.NodeExpandVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodeExpandVolume failed: %v", err)
+			}
+			if len(cryptSetup.Wipes) != 1 {
+				t.Errorf("expected no further wipe, got %v", cryptSetup.Wipes)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumeIntegrityFilesystem(t *testing.T) {
+	const (
+		oldSize = 1 << 30
+		// usableSize is the size of a hmac-sha256 mapping of a 2 GiB disk
+		usableSize = (2<<30 - 16<<20 - 65<<20) / (4096 + 32) * 4096
+	)
+	resizeFS := []string{
+		"0\n", // the mapping is writable
+		"DEVNAME=/dev/mapper/testDisk\nTYPE=ext4\n",
+		"DEVNAME=/dev/mapper/testDisk\nTYPE=ext4\n",
+		"", // resize2fs
+	}
+	testCases := []struct {
+		name string
+		// outs are the outputs of the commands run by the last call of
+		// NodeExpandVolume, after the added region was initialized
+		outs        []string
+		expCapacity int64
+		expCode     codes.Code
+	}{
+		{
+			name:        "mapping extended",
+			outs:        append(append([]string{strconv.Itoa(usableSize) + "\n", strconv.Itoa(usableSize) + "\n"}, resizeFS...), strconv.Itoa(usableSize)+"\n"),
+			expCapacity: usableSize,
+		},
+		{
+			name:    "mapping not extended",
+			outs:    append(append([]string{strconv.Itoa(oldSize) + "\n", strconv.Itoa(oldSize) + "\n"}, resizeFS...), strconv.Itoa(oldSize)+"\n"),
+			expCode: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			outs := tc.outs
+			if tc.expCode == codes.OK {
+				// The first call resizes the mapping and starts the wipe of the added region
+				outs = append([]string{strconv.Itoa(oldSize) + "\n", strconv.Itoa(usableSize) + "\n"}, outs...)
+			}
+			ns.Mounter = mountmanager.NewFakeSafeMounterWithCustomExec(&testingexec.FakeExec{CommandScript: outputCmds(outs...)})
+			if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+				state.VolumeID = defaultVolumeID
+				state.DevicePath = defaultLUKSDevicePath
+				state.Integrity = true
+			}); err != nil {
+				t.Fatal(err)
+			}
+			req := &csi.NodeExpandVolumeRequest{
+				VolumeId:      defaultVolumeID,
+				VolumePath:    "some-path",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * oldSize},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4-integrity"}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			}
+
+			resp, err := ns.NodeExpandVolume(context.Background(), req)
+			if status.Code(err) == codes.Aborted {
+				<-waitForJob(ns.wipes, "testDisk")
+				resp, err = ns.NodeExpandVolume(context.Background(), req)
+			}
+			if status.Code(err) != tc.expCode {
+				t.Fatalf("expected error code %v, got %v", tc.expCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetCapacityBytes() != tc.expCapacity {
+				t.Errorf("expected capacity %d, got %d", tc.expCapacity, resp.GetCapacityBytes())
+			}
+			if diff := cmp.Diff([]string{"testDisk", "testDisk"}, cryptSetup.Resizes); diff != "" {
+				t.Errorf("unexpected resizes: %s", diff)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumeIntegrityWithoutStateStore(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	_, err := gceDriver.ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      defaultVolumeID,
+		VolumePath:    "some-path",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 31},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4-integrity"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+}
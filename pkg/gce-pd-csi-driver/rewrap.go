@@ -0,0 +1,170 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+const (
+	// LUKS2 token slot used to record the progress of rewrapping the keyslot
+	// of a restored or cloned volume.
+	rewrapTokenID   = 1
+	rewrapTokenType = "constellation-rewrap"
+)
+
+// rewrapToken is stored in the LUKS2 header, so an interrupted rewrap is
+// picked up again on the next stage, even on another node.
+type rewrapToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	// VolumeID is the volume the rewrap was started for. Clones of a rewrapped
+	// volume carry its token, but need a rewrap of their own.
+	VolumeID string `json:"volumeID"`
+	OldUUID  string `json:"oldUUID"`
+	NewUUID  string `json:"newUUID"`
+	Done     bool   `json:"done"`
+}
+
+// rewrapKey moves the LUKS2 header of a volume restored or cloned from a
+// content source from the key of its source to a key of its own. The header
+// gets a new UUID, which the volume key is derived from, and a keyslot for
+// the new key before the keyslot of the old key is removed.
+//
+// Only the keyslot is rewrapped, the volume key protecting the data stays the
+// same as that of the source until the volume is re-keyed.
+func (ns *GCENodeServer) rewrapKey(ctx context.Context, volumeID, devicePath, sourceScope, keyScope string) error {
+	isLUKS, err := ns.CryptSetup.IsLUKS(devicePath)
+	if err != nil {
+		return err
+	}
+	if !isLUKS {
+		// Empty volume, it is formatted with a key of its own when opened
+		return nil
+	}
+
+	token, err := ns.rewrapToken(devicePath)
+	if err != nil {
+		return err
+	}
+	if token == nil || token.VolumeID != volumeID {
+		oldUUID, err := ns.CryptSetup.UUID(devicePath)
+		if err != nil {
+			return err
+		}
+		token = &rewrapToken{
+			Type:     rewrapTokenType,
+			Keyslots: []string{},
+			VolumeID: volumeID,
+			OldUUID:  oldUUID,
+			NewUUID:  uuid.New().String(),
+		}
+		if err := ns.setRewrapToken(devicePath, token); err != nil {
+			return err
+		}
+	}
+	if token.Done {
+		return nil
+	}
+
+	klog.V(4).Infof("Rewrapping keyslot of volume %s from LUKS2 UUID %s to %s", volumeID, token.OldUUID, token.NewUUID)
+	oldKey, err := ns.KMS.GetDEK(kms.WithKeyScope(ctx, sourceScope), token.OldUUID, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting key of volume content source: %w", err)
+	}
+	newKey, err := ns.KMS.GetDEK(kms.WithKeyScope(ctx, keyScope), token.NewUUID, cryptsetup.KeySize)
+	if err != nil {
+		return fmt.Errorf("getting new key: %w", err)
+	}
+
+	if err := ns.moveKeyslot(devicePath, oldKey, newKey, token.NewUUID); err != nil {
+		return err
+	}
+
+	token.Done = true
+	if err := ns.setRewrapToken(devicePath, token); err != nil {
+		return err
+	}
+	klog.V(4).Infof("Rewrapped keyslot of volume %s", volumeID)
+	return nil
+}
+
+// moveKeyslot moves the keyslot of the device from oldKey to newKey and sets
+// the LUKS2 UUID to newUUID. Every step checks the header first, so an
+// interrupted move can be repeated.
+func (ns *GCENodeServer) moveKeyslot(devicePath string, oldKey, newKey []byte, newUUID string) error {
+	currentUUID, err := ns.CryptSetup.UUID(devicePath)
+	if err != nil {
+		return err
+	}
+	if currentUUID != newUUID {
+		hasNewKey, err := ns.CryptSetup.TestKey(devicePath, newKey)
+		if err != nil {
+			return err
+		}
+		if !hasNewKey {
+			if err := ns.CryptSetup.AddKey(devicePath, oldKey, newKey); err != nil {
+				return err
+			}
+		}
+		if err := ns.CryptSetup.SetUUID(devicePath, newUUID); err != nil {
+			return err
+		}
+	}
+	hasOldKey, err := ns.CryptSetup.TestKey(devicePath, oldKey)
+	if err != nil {
+		return err
+	}
+	if hasOldKey {
+		return ns.CryptSetup.RemoveKey(devicePath, oldKey)
+	}
+	return nil
+}
+
+func (ns *GCENodeServer) rewrapToken(devicePath string) (*rewrapToken, error) {
+	data, err := ns.CryptSetup.Token(devicePath, rewrapTokenID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var token rewrapToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("parsing LUKS2 token %d: %w", rewrapTokenID, err)
+	}
+	if token.Type != rewrapTokenType {
+		return nil, fmt.Errorf("LUKS2 token %d has unexpected type %q", rewrapTokenID, token.Type)
+	}
+	return &token, nil
+}
+
+func (ns *GCENodeServer) setRewrapToken(devicePath string, token *rewrapToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshalling rewrap token: %w", err)
+	}
+	return ns.CryptSetup.SetToken(devicePath, rewrapTokenID, data)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"testing"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/kms"
+)
+
+func TestNodeStageVolumeRewrap(t *testing.T) {
+	const sourceUUID = "source-uuid"
+
+	testKey := func(t *testing.T, ns *GCENodeServer, scope, uuid string) string {
+		key, err := ns.KMS.GetDEK(kms.WithKeyScope(context.Background(), scope), uuid, cryptsetup.KeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(key)
+	}
+
+	testCases := []struct {
+		name        string
+		sourceScope string
+		keyScope    string
+		// token is the rewrap token already in the header, if any
+		token      *rewrapToken
+		headerUUID string
+		notLUKS    bool
+		expRewrap  bool
+	}{
+		{
+			name:       "rewrap clone of unscoped volume",
+			keyScope:   "tenant-b",
+			headerUUID: sourceUUID,
+			expRewrap:  true,
+		},
+		{
+			name:        "rewrap restore into another scope",
+			sourceScope: "tenant-a",
+			keyScope:    "tenant-b",
+			headerUUID:  sourceUUID,
+			expRewrap:   true,
+		},
+		{
+			name:        "resume interrupted rewrap",
+			sourceScope: "tenant-a",
+			keyScope:    "tenant-b",
+			token:       &rewrapToken{VolumeID: defaultVolumeID, OldUUID: sourceUUID, NewUUID: "new-uuid"},
+			headerUUID:  "new-uuid",
+			expRewrap:   true,
+		},
+		{
+			name:        "clone of rewrapped volume is rewrapped again",
+			sourceScope: "tenant-a",
+			keyScope:    "tenant-b",
+			token:       &rewrapToken{VolumeID: "projects/test-project/zones/country-region-zone/disks/source", OldUUID: "older-uuid", NewUUID: sourceUUID, Done: true},
+			headerUUID:  sourceUUID,
+			expRewrap:   true,
+		},
+		{
+			name:        "already rewrapped",
+			sourceScope: "tenant-a",
+			keyScope:    "tenant-b",
+			token:       &rewrapToken{VolumeID: defaultVolumeID, OldUUID: sourceUUID, NewUUID: "new-uuid", Done: true},
+			headerUUID:  "new-uuid",
+		},
+		{
+			name:     "empty volume",
+			keyScope: "tenant-b",
+			notLUKS:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+			ns := gceDriver.ns
+			cryptSetup.NotLUKS[defaultLUKSDevicePath] = tc.notLUKS
+			if tc.headerUUID != "" {
+				cryptSetup.UUIDs[defaultLUKSDevicePath] = tc.headerUUID
+			}
+			oldKey := testKey(t, ns, tc.sourceScope, sourceUUID)
+			cryptSetup.Keys[defaultLUKSDevicePath] = []string{oldKey}
+			if tc.token != nil {
+				tc.token.Type = rewrapTokenType
+				tc.token.Keyslots = []string{}
+				if err := ns.setRewrapToken(defaultLUKSDevicePath, tc.token); err != nil {
+					t.Fatal(err)
+				}
+				if tc.token.VolumeID == defaultVolumeID {
+					// The new keyslot was already added before the rewrap was interrupted
+					cryptSetup.Keys[defaultLUKSDevicePath] = []string{oldKey, testKey(t, ns, tc.keyScope, tc.token.NewUUID)}
+					if tc.token.Done {
+						cryptSetup.Keys[defaultLUKSDevicePath] = cryptSetup.Keys[defaultLUKSDevicePath][1:]
+					}
+				}
+			}
+			keysBefore := append([]string{}, cryptSetup.Keys[defaultLUKSDevicePath]...)
+
+			req := rekeyStageRequest(t, "")
+			req.VolumeContext = map[string]string{
+				common.VolumeAttributeKeyScope:  tc.keyScope,
+				common.VolumeAttributeRewrapKey: "true",
+			}
+			if tc.sourceScope != "" {
+				req.VolumeContext[common.VolumeAttributeSourceKeyScope] = tc.sourceScope
+			}
+			if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodeStageVolume failed: %v", err)
+			}
+
+			if !tc.expRewrap {
+				if got := cryptSetup.Keys[defaultLUKSDevicePath]; len(got) != len(keysBefore) {
+					t.Errorf("expected keyslots to be unchanged, got %d keyslots, want %d", len(got), len(keysBefore))
+				}
+				return
+			}
+			token, err := ns.rewrapToken(defaultLUKSDevicePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == nil || !token.Done || token.VolumeID != defaultVolumeID {
+				t.Fatalf("expected a completed rewrap token for %s, got %+v", defaultVolumeID, token)
+			}
+			if token.OldUUID != sourceUUID {
+				t.Errorf("expected old UUID %q, got %q", sourceUUID, token.OldUUID)
+			}
+			newUUID, err := cryptSetup.UUID(defaultLUKSDevicePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if newUUID == sourceUUID || newUUID != token.NewUUID {
+				t.Errorf("expected header UUID %q, got %q", token.NewUUID, newUUID)
+			}
+			newKey := testKey(t, ns, tc.keyScope, newUUID)
+			if got := cryptSetup.Keys[defaultLUKSDevicePath]; len(got) != 1 || got[0] != newKey {
+				t.Errorf("expected only the keyslot of the new key to remain, got %d keyslots", len(got))
+			}
+		})
+	}
+}
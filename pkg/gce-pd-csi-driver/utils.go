@@ -142,6 +142,25 @@ func validateAccessMode(am *csi.VolumeCapability_AccessMode) error {
 	return nil
 }
 
+// [Edgeless] Disk types whose IOPS or throughput can't be provisioned. GCE
+// rejects updates of them, other types are left to GCE to validate.
+var (
+	fixedIOPSDiskTypes       = sets.NewString("pd-standard", "pd-balanced", "pd-ssd", "hyperdisk-throughput")
+	fixedThroughputDiskTypes = sets.NewString("pd-standard", "pd-balanced", "pd-ssd", "pd-extreme", "hyperdisk-extreme")
+)
+
+// [Edgeless] validateModifyVolumeParameters checks that the IOPS and throughput
+// of params can be provisioned for disks of diskType.
+func validateModifyVolumeParameters(diskType string, params common.ModifyVolumeParameters) error {
+	if params.IOPS != nil && fixedIOPSDiskTypes.Has(diskType) {
+		return fmt.Errorf("disk type %s does not support provisioned IOPS", diskType)
+	}
+	if params.Throughput != nil && fixedThroughputDiskTypes.Has(diskType) {
+		return fmt.Errorf("disk type %s does not support provisioned throughput", diskType)
+	}
+	return nil
+}
+
 func validateStoragePools(req *csi.CreateVolumeRequest, params common.DiskParameters, project string) error {
 	storagePoolsEnabled := params.StoragePools != nil
 	if !storagePoolsEnabled || req == nil {
@@ -16,6 +16,7 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
@@ -133,3 +135,33 @@ func setReadAheadKB(devicePath string, readAheadKB int64, m *mount.SafeFormatAnd
 	}
 	return nil
 }
+
+// [Edgeless] getDiskFormat returns the format of the disk at devicePath, or an
+// empty string if it is unformatted.
+func getDiskFormat(devicePath string, m *mount.SafeFormatAndMount) (string, error) {
+	return m.GetDiskFormat(devicePath)
+}
+
+// [Edgeless] shrinkFilesystem shrinks the unmounted filesystem of the given
+// format on devicePath to size bytes. Only ext filesystems can be shrunk.
+func shrinkFilesystem(devicePath, format string, size int64, m *mount.SafeFormatAndMount) error {
+	switch format {
+	case "ext2", fsTypeExt3, defaultLinuxFsType:
+	default:
+		return fmt.Errorf("shrinking %q filesystems is not supported", format)
+	}
+	// resize2fs refuses to shrink a filesystem which was not checked since it was last mounted
+	output, err := m.Exec.Command("e2fsck", "-f", "-p", devicePath).CombinedOutput()
+	if err != nil {
+		// e2fsck exits with 1 if it corrected errors
+		var exitErr utilexec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			return fmt.Errorf("checking filesystem on %s: output: %s, err: %w", devicePath, string(output), err)
+		}
+	}
+	output, err = m.Exec.Command("resize2fs", devicePath, strconv.FormatInt(size/1024, 10)+"K").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("shrinking filesystem on %s: output: %s, err: %w", devicePath, string(output), err)
+	}
+	return nil
+}
@@ -110,3 +110,13 @@ func setReadAheadKB(devicePath string, readAheadKB int64, m *mount.SafeFormatAnd
 	// This is a no-op on windows.
 	return nil
 }
+
+// [Edgeless] getDiskFormat is not supported on windows, disks are never formatted as LUKS2.
+func getDiskFormat(devicePath string, m *mount.SafeFormatAndMount) (string, error) {
+	return "", fmt.Errorf("determining the disk format is not supported on windows")
+}
+
+// [Edgeless] shrinkFilesystem is not supported on windows, disks are never imported.
+func shrinkFilesystem(devicePath, format string, size int64, m *mount.SafeFormatAndMount) error {
+	return fmt.Errorf("shrinking filesystems is not supported on windows")
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+)
+
+const (
+	// LUKS2 token slot marking a volume whose integrity tags are initialized in the background.
+	wipeTokenID   = 2
+	wipeTokenType = "constellation-wipe"
+)
+
+// wipeToken is stored in the LUKS2 header of volumes formatted without
+// initializing their integrity tags, so a pending wipe is known on every node.
+type wipeToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	Done     bool     `json:"done"`
+}
+
+// reconcileWipe starts or resumes the background wipe of the mapped crypt
+// device at mappedPath if its LUKS2 header records a pending wipe. It returns
+// whether the integrity tags of the volume are initialized.
+func (ns *GCENodeServer) reconcileWipe(volumeID, name, devicePath, mappedPath string) (bool, error) {
+	if ns.wipes.running(name) {
+		return false, nil
+	}
+	token, err := ns.wipeToken(devicePath)
+	if err != nil {
+		return false, err
+	}
+	if token == nil || token.Done {
+		return true, nil
+	}
+
+	klog.V(4).Infof("Starting background wipe of volume %s", volumeID)
+	ns.wipes.start(name, func(ctx context.Context) {
+		if err := ns.wipe(ctx, volumeID, name, devicePath, mappedPath); err != nil {
+			klog.Errorf("Wipe of volume %s failed: %v", volumeID, err)
+		}
+	})
+	return false, nil
+}
+
+func (ns *GCENodeServer) wipe(ctx context.Context, volumeID, name, devicePath, mappedPath string) error {
+	err := ns.runWipe(ctx, volumeID, name, devicePath, mappedPath, func() error {
+		return ns.setWipeToken(devicePath, &wipeToken{Type: wipeTokenType, Keyslots: []string{}, Done: true})
+	})
+	if ctx.Err() != nil {
+		// Interrupted by unstaging or shutdown, the wipe is resumed the next time the volume is staged
+		klog.V(4).Infof("Wipe of volume %s interrupted, it will be resumed on the next stage", volumeID)
+		return nil
+	}
+	return err
+}
+
+// runWipe wipes the mapped crypt device at mappedPath, continuing where a
+// previous wipe recorded in the crypt state of name stopped, and calls finish
+// once the device is wiped. An interrupted wipe stays in phase Running.
+func (ns *GCENodeServer) runWipe(ctx context.Context, volumeID, name, devicePath, mappedPath string, finish func() error) error {
+	now := time.Now()
+	var offset uint64
+	if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.VolumeID = volumeID
+		state.DevicePath = devicePath
+		if state.Wipe == nil || state.Wipe.Phase == cryptsetup.PhaseComplete {
+			state.Wipe = &cryptsetup.OperationState{StartedAt: now}
+		}
+		// Continue where an interrupted or failed wipe on this node stopped
+		offset = state.Wipe.BytesDone
+		state.Wipe.Phase = cryptsetup.PhaseRunning
+		state.Wipe.Error = ""
+		state.Wipe.UpdatedAt = now
+	}); err != nil {
+		return err
+	}
+
+	progress := func(done, total uint64) {
+		if err := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+			state.Wipe.BytesDone = done
+			state.Wipe.BytesTotal = total
+			state.Wipe.UpdatedAt = time.Now()
+		}); err != nil {
+			klog.Warningf("Failed to record wipe progress of %s: %v", name, err)
+		}
+	}
+	err := ns.CryptSetup.Wipe(ctx, mappedPath, offset, progress)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil && finish != nil {
+		err = finish()
+	}
+
+	updateErr := ns.cryptState.Update(name, func(state *cryptsetup.VolumeState) {
+		state.Wipe.UpdatedAt = time.Now()
+		if err != nil {
+			state.Wipe.Phase = cryptsetup.PhaseFailed
+			state.Wipe.Error = err.Error()
+			return
+		}
+		state.Wipe.Phase = cryptsetup.PhaseComplete
+	})
+	if err != nil {
+		return err
+	}
+	if updateErr != nil {
+		return updateErr
+	}
+	klog.V(4).Infof("Wipe of volume %s succeeded", volumeID)
+	return nil
+}
+
+// wipeProgress describes the progress of the wipe of name for error messages.
+func (ns *GCENodeServer) wipeProgress(name string) string {
+	state, err := ns.cryptState.Get(name)
+	if err != nil || state == nil || state.Wipe == nil || state.Wipe.BytesTotal == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", state.Wipe.BytesDone*100/state.Wipe.BytesTotal)
+}
+
+func (ns *GCENodeServer) wipeToken(devicePath string) (*wipeToken, error) {
+	data, err := ns.CryptSetup.Token(devicePath, wipeTokenID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var token wipeToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("parsing LUKS2 token %d: %w", wipeTokenID, err)
+	}
+	if token.Type != wipeTokenType {
+		return nil, fmt.Errorf("LUKS2 token %d has unexpected type %q", wipeTokenID, token.Type)
+	}
+	return &token, nil
+}
+
+func (ns *GCENodeServer) setWipeToken(devicePath string, token *wipeToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshalling wipe token: %w", err)
+	}
+	return ns.CryptSetup.SetToken(devicePath, wipeTokenID, data)
+}
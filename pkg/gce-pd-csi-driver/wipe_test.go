@@ -0,0 +1,138 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package gceGCEDriver
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/cryptsetup"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+func integrityInitStageRequest(t *testing.T, integrityInit string) *csi.NodeStageVolumeRequest {
+	req := rekeyStageRequest(t, "")
+	req.VolumeContext = map[string]string{
+		common.VolumeAttributeIntegrityAlgorithm: "hmac-sha256",
+		common.VolumeAttributeIntegrityInit:      integrityInit,
+	}
+	return req
+}
+
+func TestNodeStageVolumeIntegrityNoWipe(t *testing.T) {
+	gceDriver, cryptSetup, _ := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	ns.Mounter = mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec(""))
+	cryptSetup.NotLUKS[defaultLUKSDevicePath] = true
+
+	if _, err := ns.NodeStageVolume(context.Background(), integrityInitStageRequest(t, common.IntegrityInitNoWipe)); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if format := cryptSetup.Formats[defaultLUKSDevicePath]; !format.NoWipe {
+		t.Errorf("expected device to be formatted without wipe, got %+v", format)
+	}
+	if len(cryptSetup.Wipes) != 0 {
+		t.Errorf("expected no wipe, got %v", cryptSetup.Wipes)
+	}
+}
+
+func TestNodeStageVolumeIntegrityBackgroundWipe(t *testing.T) {
+	gceDriver, cryptSetup, store := getTestRekeyGCEDriver(t)
+	ns := gceDriver.ns
+	ns.Mounter = mountmanager.NewFakeSafeMounterWithCustomExec(blkidExec(""))
+	cryptSetup.NotLUKS[defaultLUKSDevicePath] = true
+	cryptSetup.WipeBlock = make(chan struct{})
+
+	// The volume is not usable until its integrity tags are initialized
+	req := integrityInitStageRequest(t, common.IntegrityInitBackground)
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected NodeStageVolume to return Aborted while wiping, got %v", err)
+	}
+	if format := cryptSetup.Formats[defaultLUKSDevicePath]; !format.NoWipe {
+		t.Errorf("expected device to be formatted without wipe, got %+v", format)
+	}
+	if !ns.wipes.running("testDisk") {
+		t.Fatal("expected wipe to be running")
+	}
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected NodeStageVolume to return Aborted while wiping, got %v", err)
+	}
+
+	// Unstaging interrupts the wipe, the next stage resumes it at the recorded progress
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: req.StagingTargetPath,
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if ns.wipes.running("testDisk") {
+		t.Fatal("expected wipe to be stopped")
+	}
+	if err := store.Update("testDisk", func(state *cryptsetup.VolumeState) {
+		if state.Wipe == nil || state.Wipe.Phase != cryptsetup.PhaseRunning {
+			t.Errorf("expected interrupted wipe to stay in phase %s, got %+v", cryptsetup.PhaseRunning, state.Wipe)
+			return
+		}
+		state.Wipe.BytesDone = 4096
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(cryptSetup.WipeBlock)
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected NodeStageVolume to return Aborted while wiping, got %v", err)
+	}
+	<-waitForJob(ns.wipes, "testDisk")
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed after the wipe completed: %v", err)
+	}
+
+	wantWipes := []cryptsetup.FakeWipe{
+		{DevicePath: "/dev/mapper/testDisk", Offset: 0},
+		{DevicePath: "/dev/mapper/testDisk", Offset: 4096},
+	}
+	if diff := cmp.Diff(wantWipes, cryptSetup.Wipes); diff != "" {
+		t.Errorf("unexpected wipes: %s", diff)
+	}
+	state, err := store.Get("testDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Wipe.Phase != cryptsetup.PhaseComplete {
+		t.Errorf("expected wipe to complete, got phase %s", state.Wipe.Phase)
+	}
+	token, err := ns.wipeToken(defaultLUKSDevicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || !token.Done {
+		t.Errorf("expected LUKS2 header to record the completed wipe, got %+v", token)
+	}
+}
+
+func TestNodeStageVolumeIntegrityBackgroundWipeWithoutStateStore(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	_, err := gceDriver.ns.NodeStageVolume(context.Background(), integrityInitStageRequest(t, common.IntegrityInitBackground))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+}
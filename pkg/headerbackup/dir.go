@@ -0,0 +1,151 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package headerbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// headerFileExt is the extension of header backup files, named after the LUKS2 UUID.
+const headerFileExt = ".luks2"
+
+// DirSink stores header backups in a local directory, with one subdirectory
+// per volume.
+type DirSink struct {
+	dir string
+}
+
+var _ Sink = &DirSink{}
+
+// NewDirSink creates a sink storing header backups below dir.
+func NewDirSink(dir string) (*DirSink, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating header backup directory %s: %w", dir, err)
+	}
+	return &DirSink{dir: dir}, nil
+}
+
+func (s *DirSink) Store(ctx context.Context, volumeID, uuid string, header []byte) error {
+	volumeDir := s.volumeDir(volumeID)
+	if err := os.MkdirAll(volumeDir, 0o700); err != nil {
+		return fmt.Errorf("creating header backup directory of volume %s: %w", volumeID, err)
+	}
+
+	// Write to a temporary file first, so an interrupted backup never replaces a complete one
+	tmp, err := os.CreateTemp(volumeDir, ".header-*")
+	if err != nil {
+		return fmt.Errorf("creating header backup of volume %s: %w", volumeID, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing header backup of volume %s: %w", volumeID, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing header backup of volume %s: %w", volumeID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing header backup of volume %s: %w", volumeID, err)
+	}
+	path := s.headerPath(volumeID, uuid)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("storing header backup of volume %s: %w", volumeID, err)
+	}
+
+	// The keyslots of older headers are protected by keys which were replaced,
+	// only the backup of the current header is kept
+	paths, err := filepath.Glob(filepath.Join(volumeDir, "*"+headerFileExt))
+	if err != nil {
+		return fmt.Errorf("listing header backups of volume %s: %w", volumeID, err)
+	}
+	for _, other := range paths {
+		if other == path {
+			continue
+		}
+		if err := os.Remove(other); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("deleting outdated header backup of volume %s: %w", volumeID, err)
+		}
+	}
+	return nil
+}
+
+func (s *DirSink) Has(ctx context.Context, volumeID, uuid string) (bool, error) {
+	_, err := os.Stat(s.headerPath(volumeID, uuid))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking header backup of volume %s: %w", volumeID, err)
+	}
+	return true, nil
+}
+
+func (s *DirSink) Load(ctx context.Context, volumeID, uuid string) ([]byte, error) {
+	path := s.headerPath(volumeID, uuid)
+	if uuid == "" {
+		var err error
+		if path, err = s.latest(volumeID); err != nil {
+			return nil, err
+		}
+	}
+	header, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading header backup of volume %s: %w", volumeID, err)
+	}
+	return header, nil
+}
+
+// latest returns the path of the most recently stored header backup of volumeID.
+func (s *DirSink) latest(volumeID string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.volumeDir(volumeID), "*"+headerFileExt))
+	if err != nil {
+		return "", fmt.Errorf("listing header backups of volume %s: %w", volumeID, err)
+	}
+	var latest string
+	var latestInfo os.FileInfo
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("listing header backups of volume %s: %w", volumeID, err)
+		}
+		if latestInfo == nil || info.ModTime().After(latestInfo.ModTime()) {
+			latest, latestInfo = path, info
+		}
+	}
+	if latest == "" {
+		return "", ErrNotFound
+	}
+	return latest, nil
+}
+
+// volumeDir returns the directory of the backups of volumeID. Volume IDs
+// contain slashes, so they are escaped.
+func (s *DirSink) volumeDir(volumeID string) string {
+	return filepath.Join(s.dir, url.PathEscape(volumeID))
+}
+
+func (s *DirSink) headerPath(volumeID, uuid string) string {
+	return filepath.Join(s.volumeDir(volumeID), url.PathEscape(uuid)+headerFileExt)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package headerbackup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testVolumeID = "projects/test-project/zones/country-region-zone/disks/testDisk"
+
+func TestDirSink(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "backups")
+	sink, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sink.Load(ctx, testVolumeID, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound without backups, got %v", err)
+	}
+	if err := sink.Store(ctx, testVolumeID, "uuid-1", []byte("header 1")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	has, err := sink.Has(ctx, testVolumeID, "uuid-1")
+	if err != nil || !has {
+		t.Errorf("Has(uuid-1) = %v, %v, want true", has, err)
+	}
+	header, err := sink.Load(ctx, testVolumeID, "uuid-1")
+	if err != nil || string(header) != "header 1" {
+		t.Errorf("Load(uuid-1) = %q, %v, want %q", header, err, "header 1")
+	}
+
+	// Storing the backup of a new header deletes the outdated ones of the volume only
+	if err := sink.Store(ctx, "other-volume", "uuid-other", []byte("header other")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if err := sink.Store(ctx, testVolumeID, "uuid-2", []byte("header 2")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	has, err = sink.Has(ctx, testVolumeID, "uuid-1")
+	if err != nil || has {
+		t.Errorf("Has(uuid-1) = %v, %v, want false", has, err)
+	}
+	if _, err := sink.Load(ctx, testVolumeID, "uuid-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for outdated UUID, got %v", err)
+	}
+	has, err = sink.Has(ctx, "other-volume", "uuid-other")
+	if err != nil || !has {
+		t.Errorf("Has(uuid-other) = %v, %v, want true", has, err)
+	}
+	header, err = sink.Load(ctx, testVolumeID, "")
+	if err != nil || string(header) != "header 2" {
+		t.Errorf("Load(latest) = %q, %v, want %q", header, err, "header 2")
+	}
+	if _, err := sink.Load(ctx, testVolumeID, "uuid-3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown UUID, got %v", err)
+	}
+
+	// Replacing a backup leaves no temporary files behind
+	if err := sink.Store(ctx, testVolumeID, "uuid-2", []byte("header 2 rekeyed")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	entries, err := os.ReadDir(sink.volumeDir(testVolumeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected 1 backup, got %d entries", len(entries))
+	}
+	header, err = sink.Load(ctx, testVolumeID, "uuid-2")
+	if err != nil || string(header) != "header 2 rekeyed" {
+		t.Errorf("Load(uuid-2) = %q, %v, want %q", header, err, "header 2 rekeyed")
+	}
+}
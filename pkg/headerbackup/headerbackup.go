@@ -0,0 +1,42 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package headerbackup stores backups of the LUKS2 headers of encrypted
+// volumes, so a volume with a corrupted header can be recovered.
+package headerbackup
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned if a sink holds no matching header backup.
+var ErrNotFound = errors.New("header backup not found")
+
+// Sink stores LUKS2 header backups. Backups are identified by the ID of the
+// volume and the LUKS2 UUID of the header, which changes if the keyslots of a
+// cloned volume are rewrapped.
+type Sink interface {
+	// Store saves the header backup of volumeID with the given UUID, replacing
+	// an existing backup with the same UUID.
+	Store(ctx context.Context, volumeID, uuid string, header []byte) error
+
+	// Has returns whether the sink holds a header backup of volumeID with the given UUID.
+	Has(ctx context.Context, volumeID, uuid string) (bool, error)
+
+	// Load returns the header backup of volumeID with the given UUID, or the
+	// most recently stored backup of volumeID if uuid is empty.
+	Load(ctx context.Context, volumeID, uuid string) ([]byte, error)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// maxReportSize bounds the size of attestation reports.
+const maxReportSize = 1 << 20
+
+// ErrAttestationRejected is returned for key requests the key server denied,
+// because it did not accept the attestation report of the node.
+var ErrAttestationRejected = errors.New("key server rejected the attestation report")
+
+// Attester collects attestation reports of the node. Key requests carry a
+// report, so the key server only releases keys to nodes in a trusted state.
+type Attester interface {
+	// Attest returns a report of the node's state binding userData.
+	Attest(ctx context.Context, userData []byte) ([]byte, error)
+}
+
+// CommandAttester collects attestation reports by running a command, which
+// reads the user data to bind from stdin and writes the report to stdout.
+type CommandAttester struct {
+	path string
+	args []string
+}
+
+// NewCommandAttester returns a CommandAttester running the command at path
+// with args.
+func NewCommandAttester(path string, args ...string) *CommandAttester {
+	return &CommandAttester{path: path, args: args}
+}
+
+// Attest runs the attestation command.
+func (a *CommandAttester) Attest(ctx context.Context, userData []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.path, a.args...)
+	cmd.Stdin = bytes.NewReader(userData)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running attestation command %s: %w: %s", a.path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	report, err := io.ReadAll(io.LimitReader(&stdout, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(report) == 0 || len(report) > maxReportSize {
+		return nil, fmt.Errorf("attestation command %s returned a %d byte report", a.path, len(report))
+	}
+	return report, nil
+}
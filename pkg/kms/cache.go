@@ -0,0 +1,250 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package kms
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// ErrUnavailable is returned for key requests which still failed after
+// retrying, because the key management backend is unavailable.
+var ErrUnavailable = errors.New("key management backend unavailable")
+
+// transientError marks failed key requests which are worth retrying, because
+// the key management backend could not be reached or failed with a server
+// error.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// isTransient returns whether err of a key request is transient: a transport
+// error or server error of the HTTP backend, or a gRPC status of the
+// Constellation key service that indicates an unavailable or failing server.
+// All other errors, such as requests for keys of destroyed scopes, are
+// returned as they are.
+func isTransient(err error) bool {
+	var transient *transientError
+	if errors.As(err, &transient) {
+		return true
+	}
+	if _, ok := status.FromError(err); !ok {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// KeyRequestBackoff is the backoff between retries of failed key requests.
+// Default values make 5 attempts over about 8 seconds.
+var KeyRequestBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Steps:    5,
+	Cap:      8 * time.Second,
+}
+
+// CacheMetrics records the key requests of a CachingKMS.
+type CacheMetrics interface {
+	RecordKeyCacheHit()
+	RecordKeyCacheMiss()
+	RecordKMSRequest(duration time.Duration, err error)
+}
+
+type cacheKey struct {
+	scope   string
+	dekID   string
+	dekSize int
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	dek     []byte
+	expires time.Time
+}
+
+// CachingKMS caches the keys fetched from a KMS in memory, so volumes can be
+// staged while the key management backend is briefly unavailable, and
+// retries failed key requests with backoff.
+//
+// Keys are never written to disk. The cache holds at most maxEntries keys,
+// each for at most ttl, and evicts the least recently used key first. Keys of
+// scopes passed to SkipKeyScope are never cached.
+type CachingKMS struct {
+	kms        KMS
+	ttl        time.Duration
+	maxEntries int
+	backoff    wait.Backoff
+	clock      clock.Clock
+	metrics    CacheMetrics
+
+	mux        sync.Mutex
+	lru        *list.List
+	entries    map[cacheKey]*list.Element
+	skipScopes map[string]bool
+}
+
+// NewCachingKMS returns a CachingKMS requesting keys from kms. A ttl or
+// maxEntries of 0 disables caching, failed requests are still retried.
+func NewCachingKMS(kms KMS, ttl time.Duration, maxEntries int) *CachingKMS {
+	return &CachingKMS{
+		kms:        kms,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		backoff:    KeyRequestBackoff,
+		clock:      clock.RealClock{},
+		lru:        list.New(),
+		entries:    map[cacheKey]*list.Element{},
+		skipScopes: map[string]bool{},
+	}
+}
+
+// WithMetrics records cache hits, misses and the latency of key requests to
+// metrics.
+func (k *CachingKMS) WithMetrics(metrics CacheMetrics) *CachingKMS {
+	k.metrics = metrics
+	return k
+}
+
+// GetDEK returns the key dekID from the cache, or requests it from the
+// wrapped KMS. The key derivation scope of ctx is part of the cache key.
+func (k *CachingKMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	key := cacheKey{scope: KeyScopeFromContext(ctx), dekID: dekID, dekSize: dekSize}
+	if dek, ok := k.get(key); ok {
+		if k.metrics != nil {
+			k.metrics.RecordKeyCacheHit()
+		}
+		return dek, nil
+	}
+	if k.metrics != nil {
+		k.metrics.RecordKeyCacheMiss()
+	}
+
+	dek, err := k.request(ctx, dekID, dekSize)
+	if err != nil {
+		return nil, err
+	}
+	k.put(key, dek)
+	return dek, nil
+}
+
+// Purge removes all keys from the cache.
+func (k *CachingKMS) Purge() {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	for k.lru.Len() > 0 {
+		k.remove(k.lru.Back())
+	}
+}
+
+// SkipKeyScope evicts all keys of scope from the cache and never caches them
+// again, so keys of a scope which may be destroyed are not handed out from
+// memory afterwards.
+func (k *CachingKMS) SkipKeyScope(scope string) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.skipScopes[scope] = true
+	for key, elem := range k.entries {
+		if key.scope == scope {
+			k.remove(elem)
+		}
+	}
+}
+
+// request requests the key dekID from the wrapped KMS, retrying transient
+// errors with backoff. Other errors are returned as they are.
+func (k *CachingKMS) request(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	backoff := k.backoff
+	for {
+		start := k.clock.Now()
+		dek, err := k.kms.GetDEK(ctx, dekID, dekSize)
+		if k.metrics != nil {
+			k.metrics.RecordKMSRequest(k.clock.Since(start), err)
+		}
+		if err == nil || !isTransient(err) {
+			return dek, err
+		}
+		if backoff.Steps <= 1 {
+			return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		delay := backoff.Step()
+		klog.V(4).Infof("Requesting key %s failed, retrying in %v: %v", dekID, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+		case <-k.clock.After(delay):
+		}
+	}
+}
+
+func (k *CachingKMS) get(key cacheKey) ([]byte, bool) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	elem, ok := k.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !k.clock.Now().Before(entry.expires) {
+		k.remove(elem)
+		return nil, false
+	}
+	k.lru.MoveToFront(elem)
+	return append([]byte{}, entry.dek...), true
+}
+
+func (k *CachingKMS) put(key cacheKey, dek []byte) {
+	if k.ttl <= 0 || k.maxEntries <= 0 {
+		return
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.skipScopes[key.scope] {
+		return
+	}
+	if elem, ok := k.entries[key]; ok {
+		k.remove(elem)
+	}
+	for k.lru.Len() >= k.maxEntries {
+		k.remove(k.lru.Back())
+	}
+	entry := &cacheEntry{key: key, dek: append([]byte{}, dek...), expires: k.clock.Now().Add(k.ttl)}
+	k.entries[key] = k.lru.PushFront(entry)
+}
+
+// remove removes elem from the cache and overwrites its key. Callers hold mux.
+func (k *CachingKMS) remove(elem *list.Element) {
+	entry := k.lru.Remove(elem).(*cacheEntry)
+	delete(k.entries, entry.key)
+	clear(entry.dek)
+}
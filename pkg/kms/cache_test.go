@@ -0,0 +1,220 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+// flakyKMS fails the first failures requests, and all requests if err is set.
+type flakyKMS struct {
+	mux      sync.Mutex
+	kms      KMS
+	failures int
+	err      error
+	requests int
+}
+
+func (k *flakyKMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.requests++
+	if k.err != nil {
+		return nil, k.err
+	}
+	if k.failures > 0 {
+		k.failures--
+		return nil, &transientError{errors.New("connection refused")}
+	}
+	return k.kms.GetDEK(ctx, dekID, dekSize)
+}
+
+type fakeCacheMetrics struct {
+	hits, misses, requests, failedRequests int
+}
+
+func (m *fakeCacheMetrics) RecordKeyCacheHit()  { m.hits++ }
+func (m *fakeCacheMetrics) RecordKeyCacheMiss() { m.misses++ }
+func (m *fakeCacheMetrics) RecordKMSRequest(_ time.Duration, err error) {
+	m.requests++
+	if err != nil {
+		m.failedRequests++
+	}
+}
+
+func TestCachingKMS(t *testing.T) {
+	backend := &flakyKMS{kms: NewStaticKMS(testMasterSecret)}
+	metrics := &fakeCacheMetrics{}
+	cache := NewCachingKMS(NewScopedKMS(backend), time.Minute, 2).WithMetrics(metrics)
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	cache.clock = fakeClock
+
+	getDEK := func(scope, dekID string) []byte {
+		t.Helper()
+		key, err := cache.GetDEK(WithKeyScope(context.Background(), scope), dekID, 32)
+		if err != nil {
+			t.Fatalf("GetDEK() error = %v", err)
+		}
+		return key
+	}
+	expectRequests := func(want int) {
+		t.Helper()
+		if backend.requests != want {
+			t.Errorf("expected %d key requests, got %d", want, backend.requests)
+		}
+	}
+
+	key := getDEK("", "volume-1")
+	if again := getDEK("", "volume-1"); !bytes.Equal(key, again) {
+		t.Errorf("expected cached key to equal the requested key")
+	}
+	expectRequests(1)
+	// Callers can not modify the cached key
+	clear(key)
+	if again := getDEK("", "volume-1"); bytes.Equal(key, again) {
+		t.Errorf("expected cached key to be a copy")
+	}
+	expectRequests(1)
+
+	// Keys of other scopes are cached separately
+	if scoped := getDEK("tenant-a", "volume-1"); bytes.Equal(scoped, getDEK("", "volume-1")) {
+		t.Errorf("expected keys of different scopes to differ")
+	}
+	expectRequests(2)
+
+	// The least recently used key is evicted
+	getDEK("", "volume-2")
+	expectRequests(3)
+	getDEK("", "volume-1")
+	expectRequests(3)
+	getDEK("tenant-a", "volume-1")
+	expectRequests(4)
+
+	// Expired keys are requested again
+	fakeClock.Step(time.Minute)
+	getDEK("", "volume-1")
+	expectRequests(5)
+
+	cache.Purge()
+	getDEK("", "volume-1")
+	expectRequests(6)
+
+	if metrics.misses != 6 || metrics.requests != 6 || metrics.hits != 4 {
+		t.Errorf("expected 6 misses, 6 requests and 4 hits, got %+v", metrics)
+	}
+
+	// Keys of skipped scopes are evicted and never cached again
+	getDEK("shredded", "volume-1")
+	cache.SkipKeyScope("shredded")
+	getDEK("shredded", "volume-1")
+	getDEK("shredded", "volume-1")
+	expectRequests(9)
+	getDEK("", "volume-1")
+	expectRequests(9)
+}
+
+func TestCachingKMSRetries(t *testing.T) {
+	testCases := []struct {
+		name            string
+		failures        int
+		err             error
+		wantErr         bool
+		wantUnavailable bool
+		wantRequests    int
+	}{
+		{
+			name:         "transient failures are retried",
+			failures:     2,
+			wantRequests: 3,
+		},
+		{
+			name:            "outage fails with unavailable",
+			failures:        10,
+			wantErr:         true,
+			wantUnavailable: true,
+			wantRequests:    3,
+		},
+		{
+			name:         "rejected attestation is not retried",
+			err:          fmt.Errorf("%w: untrusted node", ErrAttestationRejected),
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "client errors are not retried",
+			err:          errors.New("key server returned 410 Gone: key scope was destroyed"),
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:            "unavailable key service is retried",
+			err:             status.Error(codes.Unavailable, "connection refused"),
+			wantErr:         true,
+			wantUnavailable: true,
+			wantRequests:    3,
+		},
+		{
+			name:         "key service errors other than server errors are not retried",
+			err:          fmt.Errorf("fetching data encryption key: %w", status.Error(codes.FailedPrecondition, "key scope was destroyed")),
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &flakyKMS{kms: NewStaticKMS(testMasterSecret), failures: tc.failures, err: tc.err}
+			metrics := &fakeCacheMetrics{}
+			cache := NewCachingKMS(backend, time.Minute, 10).WithMetrics(metrics)
+			cache.backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+			_, err := cache.GetDEK(context.Background(), "volume-1", 32)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("GetDEK() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if errors.Is(err, ErrUnavailable) != tc.wantUnavailable {
+				t.Errorf("GetDEK() error = %v, want unavailable %v", err, tc.wantUnavailable)
+			}
+			if backend.requests != tc.wantRequests || metrics.requests != tc.wantRequests {
+				t.Errorf("expected %d key requests, got %d, recorded %d", tc.wantRequests, backend.requests, metrics.requests)
+			}
+		})
+	}
+
+	t.Run("failed requests are not cached", func(t *testing.T) {
+		backend := &flakyKMS{kms: NewStaticKMS(testMasterSecret), err: errors.New("key server unavailable")}
+		cache := NewCachingKMS(backend, time.Minute, 10)
+		cache.backoff = wait.Backoff{Duration: time.Millisecond, Steps: 1}
+		if _, err := cache.GetDEK(context.Background(), "volume-1", 32); err == nil {
+			t.Fatal("expected GetDEK() to fail")
+		}
+		backend.err = nil
+		if _, err := cache.GetDEK(context.Background(), "volume-1", 32); err != nil {
+			t.Fatalf("GetDEK() error = %v", err)
+		}
+	})
+}
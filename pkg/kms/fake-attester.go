@@ -0,0 +1,61 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package kms
+
+import (
+	"context"
+	"sync"
+)
+
+// FakeAttester is a stand-in for an Attester, returning fixed reports.
+type FakeAttester struct {
+	mux      sync.Mutex
+	report   []byte
+	err      error
+	userData []string
+}
+
+// NewFakeAttester returns a FakeAttester returning report.
+func NewFakeAttester(report []byte) *FakeAttester {
+	return &FakeAttester{report: report}
+}
+
+// SetReport makes all following attestations return report, or fail with err
+// if it is not nil.
+func (a *FakeAttester) SetReport(report []byte, err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.report = report
+	a.err = err
+}
+
+// UserData returns the user data of all attestations so far.
+func (a *FakeAttester) UserData() []string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return append([]string{}, a.userData...)
+}
+
+// Attest returns the configured report.
+func (a *FakeAttester) Attest(_ context.Context, userData []byte) ([]byte, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.userData = append(a.userData, string(userData))
+	if a.err != nil {
+		return nil, a.err
+	}
+	return append([]byte{}, a.report...), nil
+}
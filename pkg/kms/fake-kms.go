@@ -0,0 +1,205 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/edgelesssys/constellation/v2/keyservice/keyserviceproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errKeyScopeDestroyed is returned for requests of keys in destroyed scopes.
+var errKeyScopeDestroyed = errors.New("key scope was destroyed")
+
+// FakeKeyServer is a local stand-in for the remote key management backends.
+// It serves the Constellation key service API over gRPC and the HTTP key
+// server API, deriving keys the same way StaticKMS does. Requests for keys of
+// destroyed scopes fail with FailedPrecondition or 410 Gone, all other errors
+// are server errors.
+type FakeKeyServer struct {
+	keyserviceproto.UnimplementedAPIServer
+
+	mux          sync.Mutex
+	masterSecret []byte
+	requests     []string
+	err          error
+	verify       func(reportData, report []byte) error
+	nonces       map[string]bool
+	destroyed    map[string]bool
+}
+
+// NewFakeKeyServer returns a FakeKeyServer deriving keys from masterSecret.
+func NewFakeKeyServer(masterSecret []byte) *FakeKeyServer {
+	return &FakeKeyServer{masterSecret: masterSecret, nonces: map[string]bool{}, destroyed: map[string]bool{}}
+}
+
+// SetError makes all following requests fail with err, or succeed again if
+// err is nil.
+func (s *FakeKeyServer) SetError(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.err = err
+}
+
+// SetAttestationVerifier makes the HTTP key server reject key requests with
+// 403 Forbidden if they carry no nonce handed out by the server, reuse one, or
+// if verify returns an error for their attestation report and the ReportData
+// it must bind. All requests are accepted again if verify is nil.
+func (s *FakeKeyServer) SetAttestationVerifier(verify func(reportData, report []byte) error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.verify = verify
+}
+
+// Destroyed returns whether the key scope was destroyed.
+func (s *FakeKeyServer) Destroyed(scope string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.destroyed[scope]
+}
+
+// Requests returns the IDs of all keys requested so far.
+func (s *FakeKeyServer) Requests() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// ServeConstellation serves the Constellation key service API on lis until
+// the listener is closed.
+func (s *FakeKeyServer) ServeConstellation(lis net.Listener) error {
+	server := grpc.NewServer()
+	keyserviceproto.RegisterAPIServer(server, s)
+	return server.Serve(lis)
+}
+
+// GetDataKey implements the Constellation key service API.
+func (s *FakeKeyServer) GetDataKey(_ context.Context, req *keyserviceproto.GetDataKeyRequest) (*keyserviceproto.GetDataKeyResponse, error) {
+	key, err := s.getDataKey(req.DataKeyId, int(req.Length))
+	if errors.Is(err, errKeyScopeDestroyed) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &keyserviceproto.GetDataKeyResponse{DataKey: key}, nil
+}
+
+// ServeHTTP implements the HTTP key server API.
+func (s *FakeKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dataKeyPath && r.URL.Path != destroyKeyScopePath && r.URL.Path != noncePath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == destroyKeyScopePath {
+		s.serveDestroyKeyScope(w, r)
+		return
+	}
+	if r.URL.Path == noncePath {
+		s.serveNonce(w)
+		return
+	}
+	var req dataKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.verifyAttestation(req.DataKeyID, req.Nonce, req.Attestation); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key, err := s.getDataKey(req.DataKeyID, req.Length)
+	if errors.Is(err, errKeyScopeDestroyed) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dataKeyResponse{DataKey: key})
+}
+
+func (s *FakeKeyServer) serveDestroyKeyScope(w http.ResponseWriter, r *http.Request) {
+	var req destroyKeyScopeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeyScope == "" {
+		http.Error(w, "invalid key scope", http.StatusBadRequest)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.err != nil {
+		http.Error(w, s.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.destroyed[req.KeyScope] = true
+}
+
+func (s *FakeKeyServer) serveNonce(w http.ResponseWriter) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mux.Lock()
+	s.nonces[string(nonce)] = true
+	s.mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(nonceResponse{Nonce: nonce})
+}
+
+func (s *FakeKeyServer) verifyAttestation(dekID string, nonce, report []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.verify == nil {
+		return nil
+	}
+	if !s.nonces[string(nonce)] {
+		return fmt.Errorf("unknown or reused nonce")
+	}
+	delete(s.nonces, string(nonce))
+	return s.verify(ReportData(nonce, dekID), report)
+}
+
+func (s *FakeKeyServer) getDataKey(dekID string, dekSize int) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests = append(s.requests, dekID)
+	if s.err != nil {
+		return nil, s.err
+	}
+	if scope, _, ok := strings.Cut(dekID, "/"); ok && s.destroyed[scope] {
+		return nil, fmt.Errorf("%w: %q", errKeyScopeDestroyed, scope)
+	}
+	return deriveKey(s.masterSecret, dekID, dekSize)
+}
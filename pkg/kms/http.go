@@ -0,0 +1,248 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// dataKeyPath is the path of the key server endpoint handing out data keys.
+	dataKeyPath = "/v1/data-key"
+	// destroyKeyScopePath is the path of the key server endpoint destroying
+	// the key material of a key scope.
+	destroyKeyScopePath = "/v1/destroy-key-scope"
+	// noncePath is the path of the key server endpoint handing out nonces
+	// for attestation reports.
+	noncePath = "/v1/nonce"
+	// minNonceSize is the minimum size of nonces accepted from the key server.
+	minNonceSize = 16
+	// httpTimeout bounds a single request to the key server.
+	httpTimeout = 30 * time.Second
+	// maxResponseSize bounds the size of key server responses.
+	maxResponseSize = 1 << 20
+)
+
+// dataKeyRequest is the body of a POST request to the key server.
+type dataKeyRequest struct {
+	DataKeyID string `json:"dataKeyId"`
+	Length    int    `json:"length"`
+	// Nonce is the nonce handed out by the key server for this request.
+	Nonce []byte `json:"nonce,omitempty"`
+	// Attestation is the attestation report of the node, binding
+	// ReportData(Nonce, DataKeyID).
+	Attestation []byte `json:"attestation,omitempty"`
+}
+
+// nonceResponse is the key server's response to a nonce request.
+type nonceResponse struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// destroyKeyScopeRequest is the body of a POST request to destroy a key scope.
+type destroyKeyScopeRequest struct {
+	KeyScope string `json:"keyScope"`
+}
+
+// dataKeyResponse is the key server's response to a dataKeyRequest.
+type dataKeyResponse struct {
+	DataKey []byte `json:"dataKey"`
+}
+
+// HTTPKMS fetches keys from an HTTP key server.
+//
+// The key server is expected to answer a POST request to /v1/data-key with a
+// JSON body of the form {"dataKeyId": "<id>", "length": <bytes>} with a JSON
+// object {"dataKey": "<base64 encoded key>"}.
+//
+// If an Attester is set, the driver first requests a nonce with a POST request
+// to /v1/nonce, answered with a JSON object {"nonce": "<base64 encoded nonce>"}.
+// The key request then additionally carries the nonce in "nonce" and the
+// base64 encoded attestation report of the node in "attestation", with
+// ReportData of the nonce and the key ID as user data. The key server answers
+// with 403 Forbidden if it rejects the report, or if it did not hand out the
+// nonce or already saw it in another request, so reports can not be replayed.
+//
+// Key scopes are destroyed with a POST request to /v1/destroy-key-scope with
+// a JSON body of the form {"keyScope": "<scope>"}. Afterwards, the key server
+// never hands out keys of the scope again.
+type HTTPKMS struct {
+	endpoint        string
+	destroyEndpoint string
+	nonceEndpoint   string
+	client          *http.Client
+	attester        Attester
+}
+
+// NewHTTPKMS returns an HTTPKMS using the key server at endpoint.
+func NewHTTPKMS(endpoint string) (*HTTPKMS, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key server URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("key server URL %q must use http or https", endpoint)
+	}
+	return &HTTPKMS{
+		endpoint:        u.JoinPath(dataKeyPath).String(),
+		destroyEndpoint: u.JoinPath(destroyKeyScopePath).String(),
+		nonceEndpoint:   u.JoinPath(noncePath).String(),
+		client:          &http.Client{Timeout: httpTimeout},
+	}, nil
+}
+
+// WithAttester makes key requests carry an attestation report collected by
+// attester.
+func (k *HTTPKMS) WithAttester(attester Attester) *HTTPKMS {
+	k.attester = attester
+	return k
+}
+
+// GetDEK requests the data encryption key dekID from the key server.
+func (k *HTTPKMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	dataKeyReq := dataKeyRequest{DataKeyID: dekID, Length: dekSize}
+	if k.attester != nil {
+		nonce, err := k.getNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+		report, err := k.attester.Attest(ctx, ReportData(nonce, dekID))
+		if err != nil {
+			return nil, fmt.Errorf("collecting attestation report: %w", err)
+		}
+		dataKeyReq.Nonce = nonce
+		dataKeyReq.Attestation = report
+	}
+	body, err := json.Marshal(dataKeyReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, &transientError{fmt.Errorf("fetching data encryption key from key server: %w", err)}
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading key server response: %w", err)
+	}
+	if res.StatusCode == http.StatusForbidden && k.attester != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAttestationRejected, bytes.TrimSpace(data))
+	}
+	if err := statusError(res, data); err != nil {
+		return nil, err
+	}
+
+	var dataKey dataKeyResponse
+	if err := json.Unmarshal(data, &dataKey); err != nil {
+		return nil, fmt.Errorf("parsing key server response: %w", err)
+	}
+	if len(dataKey.DataKey) != dekSize {
+		return nil, fmt.Errorf("key server returned a %d byte key, requested %d bytes", len(dataKey.DataKey), dekSize)
+	}
+	return dataKey.DataKey, nil
+}
+
+// getNonce requests a fresh nonce for an attestation report from the key
+// server.
+func (k *HTTPKMS) getNonce(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.nonceEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, &transientError{fmt.Errorf("fetching nonce from key server: %w", err)}
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading key server response: %w", err)
+	}
+	if err := statusError(res, data); err != nil {
+		return nil, fmt.Errorf("requesting a nonce: %w", err)
+	}
+	var nonce nonceResponse
+	if err := json.Unmarshal(data, &nonce); err != nil {
+		return nil, fmt.Errorf("parsing key server response: %w", err)
+	}
+	if len(nonce.Nonce) < minNonceSize {
+		return nil, fmt.Errorf("key server returned a %d byte nonce, at least %d bytes are required", len(nonce.Nonce), minNonceSize)
+	}
+	return nonce.Nonce, nil
+}
+
+// statusError returns the error of a key server response other than 200 OK
+// with body data. Server errors are transient.
+func statusError(res *http.Response, data []byte) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	err := fmt.Errorf("key server returned %s: %s", res.Status, bytes.TrimSpace(data))
+	if res.StatusCode >= http.StatusInternalServerError {
+		return &transientError{err}
+	}
+	return err
+}
+
+// ReportData returns the user data bound by the attestation report of a
+// request for the key dekID: the SHA-256 digest of nonce followed by dekID.
+func ReportData(nonce []byte, dekID string) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write([]byte(dekID))
+	return h.Sum(nil)
+}
+
+// DestroyKeyScope requests the key server to destroy the key material of
+// scope. Destroying a scope again succeeds.
+func (k *HTTPKMS) DestroyKeyScope(ctx context.Context, scope string) error {
+	body, err := json.Marshal(destroyKeyScopeRequest{KeyScope: scope})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.destroyEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("destroying key scope %q: %w", scope, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+		return fmt.Errorf("key server returned %s when destroying key scope %q: %s", res.Status, scope, bytes.TrimSpace(data))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package kms provides the key management backends the node plugin fetches
+// data encryption keys (DEKs) for crypt devices from.
+package kms
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+
+	cryptKms "github.com/edgelesssys/constellation/v2/csi/kms"
+)
+
+// Supported key management backends.
+const (
+	// BackendConstellation fetches keys from the Constellation key service.
+	BackendConstellation = "constellation"
+	// BackendFile derives keys from a static master secret read from a file.
+	// Only meant for local testing.
+	BackendFile = "file"
+	// BackendHTTP fetches keys from an HTTP key server.
+	BackendHTTP = "http"
+)
+
+// KMS fetches data encryption keys.
+type KMS interface {
+	// GetDEK returns the data encryption key with the given ID and size.
+	// Repeated calls with the same ID return the same key.
+	GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error)
+}
+
+// KeyDestroyer destroys the key material of key scopes, so volumes encrypted
+// in a scope can never be decrypted again.
+type KeyDestroyer interface {
+	// DestroyKeyScope destroys all keys of scope.
+	DestroyKeyScope(ctx context.Context, scope string) error
+}
+
+// NewKeyDestroyer returns the KeyDestroyer for the given backend, with addr as
+// for New. Only BackendHTTP supports destroying keys, the other backends
+// derive all keys from a single secret.
+func NewKeyDestroyer(backend, addr string) (KeyDestroyer, error) {
+	if backend != BackendHTTP {
+		return nil, fmt.Errorf("KMS backend %q does not support destroying keys, use %q", backend, BackendHTTP)
+	}
+	return NewHTTPKMS(addr)
+}
+
+// New returns the KMS for the given backend. The meaning of addr depends on
+// the backend: the key service address for BackendConstellation, the path of
+// the master secret for BackendFile and the key server URL for BackendHTTP.
+// The returned KMS honors the key derivation scope set with WithKeyScope.
+func New(backend, addr string) (KMS, error) {
+	return NewWithAttester(backend, addr, nil)
+}
+
+// NewWithAttester returns the KMS for the given backend like New. If attester
+// is not nil, key requests carry an attestation report collected by it. Only
+// BackendHTTP supports attestation.
+func NewWithAttester(backend, addr string, attester Attester) (KMS, error) {
+	if attester != nil && backend != BackendHTTP {
+		return nil, fmt.Errorf("KMS backend %q does not support attestation, use %q", backend, BackendHTTP)
+	}
+	var kms KMS
+	switch backend {
+	case BackendConstellation:
+		kms = cryptKms.NewConstellationKMS(addr)
+	case BackendFile:
+		static, err := NewStaticKMSFromFile(addr)
+		if err != nil {
+			return nil, err
+		}
+		kms = static
+	case BackendHTTP:
+		httpKMS, err := NewHTTPKMS(addr)
+		if err != nil {
+			return nil, err
+		}
+		if attester != nil {
+			httpKMS = httpKMS.WithAttester(attester)
+		}
+		kms = httpKMS
+	default:
+		return nil, fmt.Errorf("unknown KMS backend %q, supported backends are %q, %q and %q", backend, BackendConstellation, BackendFile, BackendHTTP)
+	}
+	return NewScopedKMS(kms), nil
+}
+
+// deriveKey derives the key dekID from masterSecret. Backends which hold the
+// master secret locally, and the local stand-ins, share this derivation.
+func deriveKey(masterSecret []byte, dekID string, dekSize int) ([]byte, error) {
+	return hkdf.Key(sha256.New, masterSecret, nil, "key-"+dekID, dekSize)
+}
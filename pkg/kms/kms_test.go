@@ -0,0 +1,370 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var testMasterSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// startBackends starts local stand-ins for all backends and returns the
+// address to pass to New for each of them.
+func startBackends(t *testing.T, server *FakeKeyServer) map[string]string {
+	t.Helper()
+
+	secretPath := filepath.Join(t.TempDir(), "master-secret")
+	if err := os.WriteFile(secretPath, testMasterSecret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() { _ = server.ServeConstellation(lis) }()
+
+	return map[string]string{
+		BackendFile:          secretPath,
+		BackendHTTP:          httpServer.URL,
+		BackendConstellation: lis.Addr().String(),
+	}
+}
+
+func TestBackends(t *testing.T) {
+	server := NewFakeKeyServer(testMasterSecret)
+	addrs := startBackends(t, server)
+	want, err := NewStaticKMS(testMasterSecret).GetDEK(context.Background(), "volume-1", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for backend, addr := range addrs {
+		t.Run(backend, func(t *testing.T) {
+			kms, err := New(backend, addr)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			key, err := kms.GetDEK(context.Background(), "volume-1", 32)
+			if err != nil {
+				t.Fatalf("GetDEK() error = %v", err)
+			}
+			if !bytes.Equal(key, want) {
+				t.Errorf("GetDEK() returned a different key than the static backend")
+			}
+			other, err := kms.GetDEK(context.Background(), "volume-2", 32)
+			if err != nil {
+				t.Fatalf("GetDEK() error = %v", err)
+			}
+			if bytes.Equal(key, other) {
+				t.Errorf("GetDEK() returned the same key for different IDs")
+			}
+		})
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	server := NewFakeKeyServer(testMasterSecret)
+	server.SetError(errors.New("key service unavailable"))
+	addrs := startBackends(t, server)
+
+	for _, backend := range []string{BackendHTTP, BackendConstellation} {
+		t.Run(backend, func(t *testing.T) {
+			kms, err := New(backend, addrs[backend])
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			_, err = kms.GetDEK(context.Background(), "volume-1", 32)
+			if err == nil {
+				t.Fatalf("expected GetDEK() to fail")
+			}
+			// Server errors are retried
+			if !isTransient(err) {
+				t.Errorf("expected GetDEK() error %v to be transient", err)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	shortSecret := filepath.Join(t.TempDir(), "short-secret")
+	if err := os.WriteFile(shortSecret, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		backend string
+		addr    string
+		wantErr bool
+	}{
+		{
+			name:    "constellation",
+			backend: BackendConstellation,
+			addr:    "kms.kube-system:9000",
+		},
+		{
+			name:    "unknown backend",
+			backend: "vault",
+			wantErr: true,
+		},
+		{
+			name:    "missing master secret",
+			backend: BackendFile,
+			addr:    filepath.Join(t.TempDir(), "missing"),
+			wantErr: true,
+		},
+		{
+			name:    "master secret too short",
+			backend: BackendFile,
+			addr:    shortSecret,
+			wantErr: true,
+		},
+		{
+			name:    "key server URL without scheme",
+			backend: BackendHTTP,
+			addr:    "keyserver:8080",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.backend, tc.addr)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestScopedKMS(t *testing.T) {
+	server := NewFakeKeyServer(testMasterSecret)
+	addrs := startBackends(t, server)
+	kms, err := New(BackendHTTP, addrs[BackendHTTP])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unscoped, err := kms.GetDEK(context.Background(), "volume-1", 32)
+	if err != nil {
+		t.Fatalf("GetDEK() error = %v", err)
+	}
+	tenantA, err := kms.GetDEK(WithKeyScope(context.Background(), "tenant-a"), "volume-1", 32)
+	if err != nil {
+		t.Fatalf("GetDEK() error = %v", err)
+	}
+	tenantB, err := kms.GetDEK(WithKeyScope(context.Background(), "tenant-b"), "volume-1", 32)
+	if err != nil {
+		t.Fatalf("GetDEK() error = %v", err)
+	}
+	if bytes.Equal(unscoped, tenantA) || bytes.Equal(tenantA, tenantB) {
+		t.Errorf("expected keys of different scopes to differ")
+	}
+
+	want := []string{"volume-1", "tenant-a/volume-1", "tenant-b/volume-1"}
+	got := server.Requests()
+	if len(got) != len(want) {
+		t.Fatalf("expected requests %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected requests %v, got %v", want, got)
+		}
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	server := NewFakeKeyServer(testMasterSecret)
+	addrs := startBackends(t, server)
+	trusted := []byte("trusted-report")
+	var mux sync.Mutex
+	var reportData [][]byte
+	server.SetAttestationVerifier(func(data, report []byte) error {
+		mux.Lock()
+		defer mux.Unlock()
+		reportData = append(reportData, data)
+		if !bytes.Equal(report, trusted) {
+			return errors.New("untrusted node")
+		}
+		return nil
+	})
+
+	testCases := []struct {
+		name         string
+		report       []byte
+		attestErr    error
+		wantErr      bool
+		wantRejected bool
+	}{
+		{
+			name:   "trusted node",
+			report: trusted,
+		},
+		{
+			name:         "untrusted node",
+			report:       []byte("tampered-report"),
+			wantErr:      true,
+			wantRejected: true,
+		},
+		{
+			name:      "report not available",
+			attestErr: errors.New("no TPM"),
+			wantErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux.Lock()
+			reportData = nil
+			mux.Unlock()
+			attester := NewFakeAttester(tc.report)
+			attester.SetReport(tc.report, tc.attestErr)
+			kms, err := NewWithAttester(BackendHTTP, addrs[BackendHTTP], attester)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = kms.GetDEK(WithKeyScope(context.Background(), "tenant-a"), "volume-1", 32)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("GetDEK() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if errors.Is(err, ErrAttestationRejected) != tc.wantRejected {
+				t.Errorf("GetDEK() error = %v, want rejected %v", err, tc.wantRejected)
+			}
+			// The report binds the nonce of the request and the ID of the requested key
+			got := attester.UserData()
+			if len(got) != 1 {
+				t.Fatalf("expected one report, got user data %v", got)
+			}
+			mux.Lock()
+			defer mux.Unlock()
+			if tc.attestErr == nil && (len(reportData) != 1 || string(reportData[0]) != got[0]) {
+				t.Errorf("expected the report to bind the data checked by the key server %x, got %x", reportData, got[0])
+			}
+		})
+	}
+
+	t.Run("replayed report", func(t *testing.T) {
+		nonceRes, err := http.Post(addrs[BackendHTTP]+noncePath, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonce nonceResponse
+		err = json.NewDecoder(nonceRes.Body).Decode(&nonce)
+		nonceRes.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(dataKeyRequest{DataKeyID: "volume-1", Length: 32, Nonce: nonce.Nonce, Attestation: trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []int{http.StatusOK, http.StatusForbidden} {
+			res, err := http.Post(addrs[BackendHTTP]+dataKeyPath, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != want {
+				t.Errorf("request %d: expected status %d, got %d", i, want, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("unsupported backend", func(t *testing.T) {
+		if _, err := NewWithAttester(BackendFile, addrs[BackendFile], NewFakeAttester(trusted)); err == nil {
+			t.Errorf("expected NewWithAttester() to fail for backend %q", BackendFile)
+		}
+	})
+}
+
+func TestCommandAttester(t *testing.T) {
+	attester := NewCommandAttester("/bin/sh", "-c", "printf report-; cat")
+	report, err := attester.Attest(context.Background(), []byte("volume-1"))
+	if err != nil {
+		t.Fatalf("Attest() error = %v", err)
+	}
+	if string(report) != "report-volume-1" {
+		t.Errorf("expected report %q, got %q", "report-volume-1", report)
+	}
+
+	if _, err := NewCommandAttester("/bin/sh", "-c", "exit 1").Attest(context.Background(), nil); err == nil {
+		t.Errorf("expected Attest() to fail if the command fails")
+	}
+	if _, err := NewCommandAttester("/bin/sh", "-c", "true").Attest(context.Background(), nil); err == nil {
+		t.Errorf("expected Attest() to fail for an empty report")
+	}
+}
+
+func TestDestroyKeyScope(t *testing.T) {
+	server := NewFakeKeyServer(testMasterSecret)
+	addrs := startBackends(t, server)
+	kms, err := New(BackendHTTP, addrs[BackendHTTP])
+	if err != nil {
+		t.Fatal(err)
+	}
+	destroyer, err := NewKeyDestroyer(BackendHTTP, addrs[BackendHTTP])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := destroyer.DestroyKeyScope(context.Background(), "pvc-1"); err != nil {
+		t.Fatalf("DestroyKeyScope() error = %v", err)
+	}
+	if !server.Destroyed("pvc-1") {
+		t.Errorf("expected key scope pvc-1 to be destroyed")
+	}
+	// Destroying a scope is idempotent
+	if err := destroyer.DestroyKeyScope(context.Background(), "pvc-1"); err != nil {
+		t.Fatalf("DestroyKeyScope() error = %v", err)
+	}
+	_, err = kms.GetDEK(WithKeyScope(context.Background(), "pvc-1"), "volume-1", 32)
+	if err == nil {
+		t.Errorf("expected GetDEK() to fail for a destroyed key scope")
+	}
+	// Requests for destroyed keys are not retried
+	if isTransient(err) {
+		t.Errorf("expected GetDEK() error %v for a destroyed key scope not to be transient", err)
+	}
+	if _, err := kms.GetDEK(WithKeyScope(context.Background(), "pvc-2"), "volume-1", 32); err != nil {
+		t.Errorf("GetDEK() error = %v", err)
+	}
+
+	server.SetError(errors.New("key server unavailable"))
+	if err := destroyer.DestroyKeyScope(context.Background(), "pvc-2"); err == nil {
+		t.Errorf("expected DestroyKeyScope() to fail")
+	}
+
+	for _, backend := range []string{BackendConstellation, BackendFile} {
+		if _, err := NewKeyDestroyer(backend, addrs[backend]); err == nil {
+			t.Errorf("expected NewKeyDestroyer() to fail for backend %q", backend)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import "context"
+
+type keyScopeKey struct{}
+
+// WithKeyScope returns a copy of ctx carrying the key derivation scope of
+// the volume keys requested with it. An empty scope selects the default,
+// unscoped key hierarchy.
+func WithKeyScope(ctx context.Context, scope string) context.Context {
+	if scope == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, keyScopeKey{}, scope)
+}
+
+// KeyScopeFromContext returns the key derivation scope carried by ctx.
+func KeyScopeFromContext(ctx context.Context) string {
+	scope, _ := ctx.Value(keyScopeKey{}).(string)
+	return scope
+}
+
+// ScopedKMS derives keys within the key derivation scope of the request
+// context, so volumes with different scopes never share key material.
+type ScopedKMS struct {
+	kms KMS
+}
+
+// NewScopedKMS returns a ScopedKMS requesting keys from kms.
+func NewScopedKMS(kms KMS) *ScopedKMS {
+	return &ScopedKMS{kms: kms}
+}
+
+// GetDEK requests the key dekID within the scope of ctx. Keys requested
+// without a scope are the same as those of the wrapped KMS.
+func (k *ScopedKMS) GetDEK(ctx context.Context, dekID string, dekSize int) ([]byte, error) {
+	return k.kms.GetDEK(ctx, ScopedDEKID(KeyScopeFromContext(ctx), dekID), dekSize)
+}
+
+// ScopedDEKID returns the ID the key dekID is requested with in scope.
+func ScopedDEKID(scope, dekID string) string {
+	if scope == "" {
+		return dekID
+	}
+	return scope + "/" + dekID
+}
@@ -0,0 +1,54 @@
+/*
+Copyright (c) Edgeless Systems GmbH
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package kms
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// minMasterSecretSize is the minimum size of a static master secret in bytes.
+const minMasterSecretSize = 16
+
+// StaticKMS derives keys from a master secret held in memory.
+type StaticKMS struct {
+	masterSecret []byte
+}
+
+// NewStaticKMS returns a StaticKMS deriving keys from masterSecret.
+func NewStaticKMS(masterSecret []byte) *StaticKMS {
+	return &StaticKMS{masterSecret: masterSecret}
+}
+
+// NewStaticKMSFromFile returns a StaticKMS using the content of the file at
+// path as master secret.
+func NewStaticKMSFromFile(path string) (*StaticKMS, error) {
+	masterSecret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading master secret: %w", err)
+	}
+	if len(masterSecret) < minMasterSecretSize {
+		return nil, fmt.Errorf("master secret %s is %d bytes, at least %d bytes are required", path, len(masterSecret), minMasterSecretSize)
+	}
+	return NewStaticKMS(masterSecret), nil
+}
+
+// GetDEK derives the data encryption key dekID from the master secret.
+func (k *StaticKMS) GetDEK(_ context.Context, dekID string, dekSize int) ([]byte, error) {
+	return deriveKey(k.masterSecret, dekID, dekSize)
+}
@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"k8s.io/component-base/metrics"
@@ -55,6 +56,26 @@ var (
 			StabilityLevel: metrics.ALPHA,
 		},
 		[]string{"driver_name", "method_name", "grpc_status_code", "disk_type", "enable_confidential_storage", "enable_storage_pools"})
+
+	// [Edgeless] Key requests of the node plugin
+	kmsKeyCacheRequestsMetric = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      "csidriver",
+			Name:           "kms_key_cache_requests",
+			Help:           "Volume key requests of the node plugin by whether the key was cached",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"})
+
+	kmsRequestDurationMetric = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      "csidriver",
+			Name:           "kms_request_duration_seconds",
+			Help:           "Latency of volume key requests of the node plugin to the key management backend",
+			Buckets:        metrics.ExponentialBuckets(0.005, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"grpc_status_code"})
 )
 
 type MetricsManager struct {
@@ -80,6 +101,13 @@ func (mm *MetricsManager) RegisterPDCSIMetric() {
 	mm.registry.MustRegister(pdcsiOperationErrorsMetric)
 }
 
+// [Edgeless] RegisterKMSMetrics registers the metrics of the key requests of
+// the node plugin.
+func (mm *MetricsManager) RegisterKMSMetrics() {
+	mm.registry.MustRegister(kmsKeyCacheRequestsMetric)
+	mm.registry.MustRegister(kmsRequestDurationMetric)
+}
+
 func (mm *MetricsManager) recordComponentVersionMetric() error {
 	v := getEnvVar(envGKEPDCSIVersion)
 	if v == "" {
@@ -103,6 +131,23 @@ func (mm *MetricsManager) RecordOperationErrorMetrics(
 	klog.Infof("Recorded PDCSI operation error code: %q", errCode)
 }
 
+// [Edgeless] RecordKeyCacheHit records a volume key served from the key cache.
+func (mm *MetricsManager) RecordKeyCacheHit() {
+	kmsKeyCacheRequestsMetric.WithLabelValues("hit").Inc()
+}
+
+// [Edgeless] RecordKeyCacheMiss records a volume key requested from the key
+// management backend.
+func (mm *MetricsManager) RecordKeyCacheMiss() {
+	kmsKeyCacheRequestsMetric.WithLabelValues("miss").Inc()
+}
+
+// [Edgeless] RecordKMSRequest records the latency of a single request to the
+// key management backend.
+func (mm *MetricsManager) RecordKMSRequest(duration time.Duration, err error) {
+	kmsRequestDurationMetric.WithLabelValues(errorCodeLabelValue(err)).Observe(duration.Seconds())
+}
+
 func (mm *MetricsManager) EmitGKEComponentVersion() error {
 	mm.registerComponentVersionMetric()
 	if err := mm.recordComponentVersionMetric(); err != nil {